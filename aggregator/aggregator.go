@@ -0,0 +1,165 @@
+package aggregator
+
+import (
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/heistp/cgmon/analyzer"
+	"github.com/heistp/cgmon/tracker"
+	"gonum.org/v1/gonum/stat"
+)
+
+// rttPcts are the percentiles of flow median RTTs in a Record.
+var rttPcts = [3]float64{0.1, 0.5, 0.9}
+
+// A Config contains the aggregator configuration.
+type Config struct {
+	Interval time.Duration // interval on which records are emitted
+	Log      bool          // if true, logging is enabled
+}
+
+// RecordType is the Type of aggregate records.
+const RecordType = "aggregate"
+
+// A Record contains the aggregate stats for one destination over an interval.
+type Record struct {
+	Type               string     // record type, always RecordType
+	DstIP              net.IP     // dest (remote) IP address
+	StartTime          time.Time  // start of the interval
+	EndTime            time.Time  // end of the interval
+	FlowsStarted       int        // flows started during the interval
+	FlowsEnded         int        // flows ended during the interval (excluding short flows)
+	ShortFlows         int        // flows ended during the interval, but too short for detailed stats
+	ShortBytesAcked    uint64     // total bytes acked by short flows
+	BytesAcked         uint64     // total bytes acked by ended flows
+	RTTPercentiles     [3]float64 // 10th, 50th and 90th percentiles of ended flow median RTTs, in milliseconds
+	Retransmits        uint64     // total retransmits of ended flows
+	RetransmitsPerSec  float64    // retransmits per second over the interval
+	SendThroughputMbps float64    // bytes acked by ended flows over the interval, in Mbps
+}
+
+// dest accumulates data for one destination.
+type dest struct {
+	started     int
+	ended       int
+	short       int
+	shortBytes  uint64
+	bytesAcked  uint64
+	retransmits uint64
+	rtts        []float64
+}
+
+// An Aggregator accumulates per-destination stats for ended flows, and
+// returns Records for them on the configured interval.
+type Aggregator struct {
+	Config
+	start time.Time
+	dests map[[16]byte]*dest
+}
+
+func NewAggregator(cfg Config) *Aggregator {
+	return &Aggregator{
+		cfg,
+		time.Time{},
+		make(map[[16]byte]*dest),
+	}
+}
+
+// Add adds stats for ended flows, along with started and short flow counts
+// per destination, and returns Records if the interval has elapsed.
+func (a *Aggregator) Add(fs []*analyzer.FlowStats,
+	dc map[[16]byte]*tracker.DestCounts, now time.Time) (r []*Record) {
+	if a.start.IsZero() {
+		a.start = now
+	}
+
+	for k, c := range dc {
+		d := a.dest(k)
+		d.started += c.Started
+		d.short += c.Short
+		d.shortBytes += c.ShortBytesAcked
+	}
+
+	for _, s := range fs {
+		var k [16]byte
+		copy(k[:], s.ID.DstIP.To16())
+		d := a.dest(k)
+		d.ended++
+		d.bytesAcked += s.BytesAcked
+		d.retransmits += uint64(s.TotalRetransmits)
+		d.rtts = append(d.rtts, s.RTTSummary[3])
+	}
+
+	if now.Sub(a.start) >= a.Interval {
+		r = a.Flush(now)
+	}
+
+	return
+}
+
+// Flush returns Records for all destinations with data since the start of
+// the current interval, and starts a new interval.
+func (a *Aggregator) Flush(now time.Time) (r []*Record) {
+	el := now.Sub(a.start).Seconds()
+	for k, d := range a.dests {
+		ip := make(net.IP, 16)
+		copy(ip, k[:])
+		rec := &Record{
+			Type:            RecordType,
+			DstIP:           ip,
+			StartTime:       a.start,
+			EndTime:         now,
+			FlowsStarted:    d.started,
+			FlowsEnded:      d.ended,
+			ShortFlows:      d.short,
+			ShortBytesAcked: d.shortBytes,
+			BytesAcked:      d.bytesAcked,
+			Retransmits:     d.retransmits,
+		}
+		if len(d.rtts) > 0 {
+			sort.Float64s(d.rtts)
+			for i, p := range rttPcts {
+				rec.RTTPercentiles[i] = stat.Quantile(p, stat.LinInterp,
+					d.rtts, nil)
+			}
+		}
+		if el > 0 {
+			rec.RetransmitsPerSec = float64(d.retransmits) / el
+			rec.SendThroughputMbps = float64(d.bytesAcked) * 8 / 1000000 / el
+		}
+		r = append(r, rec)
+	}
+
+	sort.Slice(r, func(i, j int) bool {
+		return bytesLess(r[i].DstIP, r[j].DstIP)
+	})
+
+	if a.Log {
+		log.Printf("aggregator interval=%s dests=%d", now.Sub(a.start), len(r))
+	}
+
+	a.dests = make(map[[16]byte]*dest)
+	a.start = now
+
+	return
+}
+
+func (a *Aggregator) dest(k [16]byte) (d *dest) {
+	var ok bool
+	if d, ok = a.dests[k]; !ok {
+		d = &dest{}
+		a.dests[k] = d
+	}
+	return
+}
+
+func bytesLess(a, b []byte) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
@@ -1,6 +1,7 @@
 package analyzer
 
 import (
+	"fmt"
 	"log"
 	"math"
 	"net"
@@ -8,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/heistp/cgmon/clock"
 	"github.com/heistp/cgmon/linux"
 	"github.com/heistp/cgmon/metrics"
 	"github.com/heistp/cgmon/sampler"
@@ -18,12 +20,36 @@ import (
 // snsPcts  are the seven-number summary percentiles
 var snsPcts = [7]float64{0.02, 0.09, 0.25, 0.5, 0.75, 0.91, 0.98}
 
+// RTT heatmap dimensions: four hours of one minute columns, and rows from
+// 0.1ms to 10s with five per decade
+const (
+	rttHeatmapInterval  = 1 * time.Minute
+	rttHeatmapColumns   = 240
+	rttHeatmapMinms     = 0.1
+	rttHeatmapMaxms     = 10000
+	rttHeatmapPerDecade = 5
+)
+
 const CORR_UNDEFINED = -2
 
 const CORR_INSUFFICIENT_SAMPLES = -3
 
+const CORR_TRUNCATED = -4
+
 const debug = false
 
+// Values of FlowStats.BufferLimited, for what kept a flow's window below its
+// bandwidth-delay product.
+const (
+	BufferLimitedSndbuf = "sndbuf" // the local send buffer
+	BufferLimitedRwnd   = "rwnd"   // the peer's advertised receive window
+	BufferLimitedCwnd   = "cwnd"   // the congestion window
+)
+
+// bufferLimitedMinFraction is the minimum fraction of the sampled duration
+// that a flow must be sndbuf or rwnd limited for BufferLimited to blame them.
+const bufferLimitedMinFraction = 0.05
+
 // An ID uniquely identifies flows within program execution. A monotonic
 // timestamp from the first sample is added to distinguish between flows with
 // the same 5-tuple.
@@ -41,15 +67,31 @@ type FlowStats struct {
 	StartTime                 time.Time     // start time
 	EndTime                   time.Time     // end time
 	Duration                  time.Duration // duration from first to last sample
+	IdleAtEnd                 time.Duration // time from the last data sent or received to the last sample, from the kernel's activity times
+	LastActivityTime          time.Time     // estimated time of the last data sent or received or ACK received, which bounds the end of the transfer more closely than EndTime if the flow was idle before it closed
 	Samples                   int           // number of unique samples
 	SamplesDeduped            int           // number of samples de-duped
+	SamplesDropped            int           `json:",omitempty"` // number of samples dropped by the tracker's max samples per flow, so Samples and RawSamples are a subset
 	Partial                   bool          // true if flow was pre-existing or had no last sample on shutdown
+	Direction                 string        `json:",omitempty"` // outbound if the local host initiated the connection (client), inbound if the remote did (server), inferred from a SYN_SENT sample or the ports, or empty if unknown
 	Timestamps                bool          // true if flow had timestamps enabled (TCPI_OPT_TIMESTAMPS)
 	SACK                      bool          // true if flow had SACK enabled (TCPI_OPT_SACK)
 	ECN                       bool          // true if flow had ECN enabled (TCPI_OPT_ECN)
 	ECNSeen                   bool          // true if at least one packet _received_ with ECT (TCPI_OPT_ECN_SEEN)
+	WindowScaling             bool          // true if flow had window scaling enabled (TCPI_OPT_WSCALE)
+	CongestionControl         string        // congestion control algorithm (e.g. cubic, bbr, dctcp)
+	SndMSS                    uint32        // sender MSS on the last sample, in bytes
+	SndCwnd                   uint32        // send cwnd on the last sample, in segments
+	AdvMSS                    uint32        // advertised MSS on the last sample, in bytes
+	PMTU                      uint32        // path MTU on the last sample, in bytes
+	PMTUChanges               int           `json:",omitempty"` // times the path MTU changed after the handshake (e.g. by PMTU discovery or ICMP fragmentation needed), which can masquerade as congestion
+	PMTUMin                   uint32        `json:",omitempty"` // minimum path MTU, in bytes, if it changed
+	SndMSSChanges             int           `json:",omitempty"` // times the sender MSS changed after the handshake (e.g. by PMTU changes or MSS clamping)
+	SndWscale                 uint8         // send window scale shift (valid if WindowScaling)
+	RcvWscale                 uint8         // receive window scale shift (valid if WindowScaling)
 	MinRTTKernelms            float64       // minimum RTT as tracked by the kernel, in milliseconds
 	MinRTTObservedms          float64       // minimum RTT in the observed samples
+	MinRTTKernelWindow        time.Duration `json:",omitempty"` // window over which MinRTTKernelms is a windowed minimum (tcp_min_rtt_wlen), if known
 	MaxPacingRateKernelMbps   float64       // maximum pacing rate as tracked by the kernel, in Mbps
 	MaxPacingRateObservedMbps float64       // maximum pacing rate in the observed samples
 	RTTSummary                [7]float64    // RTT seven number summary
@@ -57,12 +99,118 @@ type FlowStats struct {
 	CorrRTTCwnd               float64       // correlation between RTT and cwnd
 	CorrRetransCwnd           float64       // correlation between retransmit rate and cwnd
 	CorrPacingCwnd            float64       // correlation between pacing rate and cwnd
-	TotalRetransmits          uint32        // the value of tcpi_total_retrans from the kernel on the last sample
-	BytesAcked                uint64        // bytes acked
-	// delivery stats only available in 4.18 and later
-	//Delivered                 uint32        // packets delivered
-	//DeliveredCE               uint32        // packets delivered and acked with ECE
-	SendThroughputMbps float64 // mean send throughput in Mbps
+	CorrRetransRTT            float64       // correlation between retransmit rate and RTT
+	CorrRetransBurstRTT       float64       // correlation between retransmit rate and RTT, with retransmits windowed into bursts
+	TotalRetransmits          uint32        // the value of tcpi_total_retrans from the kernel on the last sample, or within the segment for segments after the first
+	RTORetransmits            uint32        // estimated retransmits due to retransmission timeouts (including tail loss probes that timed out)
+	FastRetransmits           uint32        // estimated retransmits during fast recovery
+	RTOEvents                 int           // estimated number of retransmission timeouts
+	RTOMinms                  float64       // minimum retransmission timeout (tcpi_rto), in milliseconds
+	RTOMedianms               float64       // median retransmission timeout, in milliseconds
+	RTOMaxms                  float64       // maximum retransmission timeout, in milliseconds, which inflates well beyond the RTT with high RTT variance or backoff
+	RetransPerSecMean         float64       // mean retransmits per second over the sampled duration
+	RetransPerSecMax          float64       // maximum retransmits per second over a sample interval
+	RetransPerSecSummary      [7]float64    // retransmits per second seven number summary, over sample intervals weighted by their duration
+	RetransPerMBMean          float64       // mean retransmits per MB (10^6 bytes) acked over the sampled duration
+	RetransPerMBMax           float64       // maximum retransmits per MB acked over a sample interval with bytes acked
+	RetransPerMBSummary       [7]float64    // retransmits per MB acked seven number summary, over sample intervals with bytes acked weighted by their bytes acked
+	ReorderingMax             uint32        // maximum reordering distance estimate, in segments (3 by default, higher after reordering is detected)
+	SackedMax                 uint32        // maximum segments SACKed at once
+	LostMax                   uint32        // maximum segments considered lost at once
+	DSACKDups                 uint32        // total duplicate segments reported by DSACK, i.e. spurious retransmits, or within the segment for segments after the first (5.0 and later)
+	ReordSeen                 uint32        // total reordering events seen, or within the segment for segments after the first (5.0 and later)
+	BytesAcked                uint64        // bytes acked, or within the segment for segments after the first
+	BytesSent                 uint64        // data bytes sent, including retransmits, or within the segment for segments after the first (4.19 and later)
+	BytesRetrans              uint64        // data bytes retransmitted, or within the segment for segments after the first (4.19 and later)
+	RetransByteRatio          float64       // BytesRetrans / BytesSent, the fraction of sent bytes that were retransmits
+	Delivered                 uint32        // packets delivered, or within the segment for segments after the first (4.18 and later)
+	DeliveredCE               uint32        // packets delivered and acked with ECE, or within the segment for segments after the first (4.18 and later)
+	ECNMarkRate               float64       // DeliveredCE / Delivered, the fraction of delivered packets marked CE
+	SendThroughputMbps        float64       // mean send throughput in Mbps
+	BusyFraction              float64       // fraction of the sampled duration with data to send (4.10 and later)
+	CwndLimitedFraction       float64       // fraction of the sampled duration busy and not rwnd or sndbuf limited, i.e. limited by cwnd or pacing
+	RwndLimitedFraction       float64       // fraction of the sampled duration limited by the receive window
+	SndbufLimitedFraction     float64       // fraction of the sampled duration limited by the send buffer
+	SndQueueSummary           [7]float64    // send queue memory (sk_wmem_queued, unsent and unacked data) seven number summary, in bytes
+	SndQueueFullFraction      float64       // fraction of the sampled duration with the send queue at or above the send buffer size
+	SndBufMax                 uint32        // maximum send buffer size (sk_sndbuf), in bytes
+	RcvQueueMax               uint32        // maximum receive queue memory (sk_rmem_alloc), in bytes
+	RcvBufMax                 uint32        // maximum receive buffer size (sk_rcvbuf), in bytes
+	SlowStartDuration         time.Duration // sampled time in slow start (cwnd < ssthresh)
+	CongAvoidDuration         time.Duration // sampled time in congestion avoidance (cwnd >= ssthresh)
+	SlowStartExit             time.Duration // time from the first sample to the first with cwnd >= ssthresh, or -1 if never
+	BytesReceived             uint64        // bytes received (4.1 and later)
+	RecvThroughputMbps        float64       // mean receive throughput in Mbps
+	RcvRTTSummary             [7]float64    // receiver side RTT estimate seven number summary, over samples with an estimate, in milliseconds
+	RcvSpaceMax               uint32        // maximum receive buffer space autotuning estimate (rcv_space), in bytes
+	SndWndMedian              float64       // median of the peer's advertised receive window, in bytes (5.4 and later)
+	RcvWndMedian              float64       // median of the local advertised receive window, in bytes (6.2 and later)
+	ZeroWindowEpisodes        int           `json:",omitempty"` // episodes of consecutive samples with the peer's advertised window at zero (5.4 and later), when the remote receiver stalled the transfer
+	ZeroWindowDuration        time.Duration `json:",omitempty"` // sampled time with the peer's advertised window at zero
+	RcvZeroWindowEpisodes     int           `json:",omitempty"` // episodes of consecutive samples with the local advertised window at zero (6.2 and later), when the local receiver stalled the transfer
+	RcvZeroWindowDuration     time.Duration `json:",omitempty"` // sampled time with the local advertised window at zero
+	ProbesMax                 uint8         `json:",omitempty"` // maximum unanswered zero window or keepalive probes
+	ATOMinms                  float64       // minimum delayed ACK timeout (tcpi_ato), in milliseconds
+	ATOMedianms               float64       // median delayed ACK timeout, in milliseconds
+	ATOMaxms                  float64       // maximum delayed ACK timeout, in milliseconds
+	RcvOOOPack                uint32        // out-of-order packets received, which are ACKed immediately instead of delayed (5.4 and later)
+	MaxDeliveryRateMbps       float64       // maximum delivery rate sample, in Mbps (4.9 and later)
+	BDPBytes                  uint64        // bandwidth-delay product, from the min RTT (kernel, or else observed) and MaxDeliveryRateMbps, in bytes
+	CwndMaxBytes              uint32        // maximum send cwnd, in bytes
+	BufferLimited             string        `json:",omitempty"` // hint for what kept the window below BDPBytes: sndbuf if SndBufMax was below it while sndbuf limited, rwnd if SndWndMedian was below it while rwnd limited, cwnd if CwndMaxBytes was below it, or empty if none
+	ConcurrentFlowsAtStart    int           // other flows tracked when the flow started
+	ConcurrentFlowsMean       float64       // mean number of other flows tracked during the flow
+	ConcurrentFlowsMax        int           // maximum number of other flows tracked during the flow
+	AggThroughputMbpsAtStart  float64       // aggregate throughput of tracked flows when the flow started, in Mbps
+	AggThroughputMbpsMean     float64       // mean aggregate throughput of tracked flows during the flow, in Mbps
+	BaselineRTTms             float64       // minimum RTT across flows to the destination (or prefix), in milliseconds
+	ExcessRTTms               float64       // median RTT in excess of BaselineRTTms, in milliseconds
+	TeardownSamples           int           `json:",omitempty"` // samples in teardown states (e.g. FIN_WAIT1, CLOSE_WAIT), when dumped
+	EndState                  string        `json:",omitempty"` // TCP state of the last sample, if not established
+	Mark                      uint32        `json:",omitempty"` // socket mark (SO_MARK) of the last sample, if permitted
+	DSCP                      uint8         `json:",omitempty"` // DSCP of the last sample, from the IP TOS or IPv6 traffic class
+	UID                       uint32        // socket owner UID
+	PID                       int           `json:",omitempty"` // ID of the process owning the socket, if attributed
+	Process                   string        `json:",omitempty"` // name of the process owning the socket, if attributed
+	CgroupID                  uint64        `json:",omitempty"` // ID of the socket's cgroup v2 (5.7 and later)
+	Cgroup                    string        `json:",omitempty"` // path of the socket's cgroup, if resolved
+	ContainerID               string        `json:",omitempty"` // container ID from the cgroup path, if found
+	PodUID                    string        `json:",omitempty"` // Kubernetes pod UID from the cgroup path, if found
+	Tag                       string        `json:",omitempty"` // label from the first tracker rule that tagged the flow, if any
+	Targeted                  bool          `json:",omitempty"` // true if the flow matched a tracker target, so it was never filtered, and all its samples were kept
+	Interface                 string        `json:",omitempty"` // egress interface, set when qdisc collection is enabled
+	Experiment                string        `json:",omitempty"` // experiment ID, if the flow started during an experiment phase
+	Phase                     string        `json:",omitempty"` // experiment phase label, if the flow started during a phase
+	Group                     string        `json:",omitempty"` // name of the sample group that sampled the flow, if named (group/namespace with -netlink-netns)
+	Analysis                  string        `json:",omitempty"` // name of the analyzer configuration that produced the stats, if named (for comparing configurations)
+	Compared                  bool          `json:",omitempty"` // true if the stats are from the comparison analyzer configuration, and the same flow's stats from the primary configuration are also in the output
+	AnalysisTruncated         bool          `json:",omitempty"` // true if FlowDeadline passed, and RTTVarSummary and correlations (CORR_TRUNCATED) may not be set
+	FlowUID                   string        // identifies the flow across its records, so the segments of a flow can be joined (16 hex digits)
+	Segment                   int           `json:",omitempty"` // index of the segment from 1, if the flow was cut into segments by the tracker's segment interval, in which case cumulative counters are for the segment only
+	Continued                 bool          `json:",omitempty"` // true if the flow continues in a later segment
+	IsFinal                   bool          `json:",omitempty"` // true for the last segment of a segmented flow, which ends it
+	Idle                      bool          `json:",omitempty"` // true if the flow was ended after its data didn't change for the tracker's idle timeout, while its socket remained open
+	Capture                   string        `json:",omitempty"` // path of a packet capture started when the flow crossed the capture thresholds, if any
+	ClockJump                 bool          `json:",omitempty"` // true if a jump between the wall and sample timestamp clocks (e.g. suspend) was seen during the flow, so its durations and wall times may be inconsistent
+	// MissingFields lists tcp_info fields not provided by the kernel, for
+	// which the dependent stats are zero
+	MissingFields []string `json:",omitempty"`
+	// Extra contains metrics returned by analysis plugins
+	Extra map[string]float64 `json:",omitempty"`
+	// RawSamples contains the flow's sampled values, if enabled
+	RawSamples *Series `json:",omitempty"`
+	// MinRTTSeries compares the kernel's min RTT with observed minimums, if
+	// enabled
+	MinRTTSeries *MinRTTSeries `json:",omitempty"`
+	// ThroughputSeries contains the flow's throughput per sample interval, if
+	// enabled
+	ThroughputSeries *ThroughputSeries `json:",omitempty"`
+}
+
+// Plugin is the interface that wraps the Analyze method, for custom analysis
+// of each flow. The returned metrics are merged into FlowStats.Extra.
+type Plugin interface {
+	Analyze(*tracker.Flow) (map[string]float64, error)
 }
 
 type Config struct {
@@ -72,11 +220,25 @@ type Config struct {
 	UnweightedQuantiles    bool              // if true, quantiles are unweighted
 	AdjustedCC1            bool              // if true, use adjusted correlation r_adj = r * (1 + (1-r^2)/2n)
 	AdjustedCC2            bool              // if true, use adjusted correlation r_adj = sqrt(1 - ((1-r^2)*(n-1)) / (n-2))
+	BaselinePrefixLen      int               // IPv4 destination prefix length for RTT baselines (0 disables)
+	BaselinePrefixLen6     int               // IPv6 destination prefix length for RTT baselines
+	BaselineTTL            time.Duration     // time after which an RTT baseline that hasn't been refreshed expires
+	FlowDeadline           time.Duration     // time after which analysis of one flow is truncated (0 disables)
+	Plugins                []Plugin          // analysis plugins called for each flow
+	MissingFields          []string          // tcp_info fields not provided by the kernel, marked in FlowStats
+	RawSamples             bool              // if true, include each flow's sampled values in FlowStats
+	MinRTTKernelWindow     time.Duration     // window of the kernel's min RTT filter, recorded in FlowStats (0 if unknown)
+	MinRTTSeries           bool              // if true, include each flow's MinRTTSeries in FlowStats
+	ThroughputSeries       bool              // if true, include each flow's ThroughputSeries in FlowStats
+	Name                   string            // if set, name of the configuration, recorded in FlowStats.Analysis
+	Clock                  clock.Clock       // clock for RTT baseline expiry (nil for the wall clock)
 	Log                    bool              // if true, logging is enabled
 }
 
 type Metrics struct {
 	AnalyzeTimes metrics.DurationStats
+	Truncated    uint64 // flows with truncated analysis
+	PMTUChanged  uint64 // flows whose path MTU changed after the handshake
 	sync.RWMutex
 }
 
@@ -86,10 +248,24 @@ func (m *Metrics) recordAnalyzeTime(d time.Duration) {
 	m.AnalyzeTimes.Push(d)
 }
 
+func (m *Metrics) recordTruncated() {
+	m.Lock()
+	defer m.Unlock()
+	m.Truncated++
+}
+
+func (m *Metrics) recordPMTUChanged() {
+	m.Lock()
+	defer m.Unlock()
+	m.PMTUChanged++
+}
+
 type Analyzer struct {
 	Config
 	FlowDurations metrics.DurationHistogram
+	RTTHeatmap    metrics.Heatmap // median RTTs of ended flows by end time, in milliseconds
 	metrics       Metrics
+	baselines     *baselines
 }
 
 func mindur(d1, d2 time.Duration) time.Duration {
@@ -120,10 +296,19 @@ func NewAnalyzer(cfg Config) *Analyzer {
 		1 * time.Hour,
 	}
 
+	var bl *baselines
+	if cfg.BaselinePrefixLen > 0 {
+		bl = newBaselines(cfg.BaselinePrefixLen, cfg.BaselinePrefixLen6,
+			cfg.BaselineTTL)
+	}
+
 	return &Analyzer{
 		cfg,
 		metrics.NewDurationHistogram(steps, ends),
+		metrics.NewHeatmap(rttHeatmapInterval, rttHeatmapColumns,
+			rttHeatmapMinms, rttHeatmapMaxms, rttHeatmapPerDecade),
 		Metrics{},
+		bl,
 	}
 }
 
@@ -133,15 +318,37 @@ func (a *Analyzer) Analyze(fs []*tracker.Flow) (s []*FlowStats) {
 	}
 
 	t0 := time.Now()
+	now := clock.Or(a.Clock).Now()
 
 	s = make([]*FlowStats, len(fs))
 	fa := &flow{Config: &a.Config}
 
 	for i := 0; i < len(fs); i++ {
 		fa.Flow = fs[i]
+		if a.FlowDeadline > 0 {
+			fa.deadline = time.Now().Add(a.FlowDeadline)
+		}
 		s[i] = fa.analyze()
+		if s[i].AnalysisTruncated {
+			a.metrics.recordTruncated()
+			if a.Log {
+				log.Printf("analysis truncated for flow with %d samples",
+					s[i].Samples)
+			}
+		}
+		if s[i].PMTUChanges > 0 {
+			a.metrics.recordPMTUChanged()
+		}
+		s[i].MissingFields = a.MissingFields
+		s[i].MinRTTKernelWindow = a.MinRTTKernelWindow
+		s[i].Analysis = a.Name
+		if a.baselines != nil {
+			fa.applyBaseline(a.baselines, s[i], now)
+		}
+		a.runPlugins(fs[i], s[i])
 		a.FlowDurations.Push(a.SamplerInterval *
-			time.Duration(s[i].Samples+s[i].SamplesDeduped))
+			time.Duration(s[i].Samples+s[i].SamplesDeduped+s[i].SamplesDropped))
+		a.RTTHeatmap.Push(s[i].EndTime, s[i].RTTSummary[3])
 	}
 
 	el := time.Since(t0)
@@ -154,6 +361,24 @@ func (a *Analyzer) Analyze(fs []*tracker.Flow) (s []*FlowStats) {
 	return
 }
 
+// runPlugins runs the configured plugins for the flow and merges their
+// metrics into the stats. Plugin errors are logged, and don't stop analysis.
+func (a *Analyzer) runPlugins(f *tracker.Flow, s *FlowStats) {
+	for _, p := range a.Plugins {
+		m, err := p.Analyze(f)
+		if err != nil {
+			log.Printf("analyzer plugin error (%s)", err)
+			continue
+		}
+		for k, v := range m {
+			if s.Extra == nil {
+				s.Extra = make(map[string]float64, len(m))
+			}
+			s.Extra[k] = v
+		}
+	}
+}
+
 func (a *Analyzer) Metrics() (m Metrics) {
 	a.metrics.RLock()
 	defer a.metrics.RUnlock()
@@ -164,6 +389,17 @@ func (a *Analyzer) Metrics() (m Metrics) {
 type flow struct {
 	*Config
 	*tracker.Flow
+	deadline time.Time // zero for no deadline
+}
+
+// truncate returns true and marks the stats as truncated if the flow's
+// analysis deadline has passed.
+func (f *flow) truncate(s *FlowStats) bool {
+	if f.deadline.IsZero() || time.Now().Before(f.deadline) {
+		return false
+	}
+	s.AnalysisTruncated = true
+	return true
 }
 
 func (f *flow) analyze() (s *FlowStats) {
@@ -172,19 +408,135 @@ func (f *flow) analyze() (s *FlowStats) {
 	s.StartTime = f.StartTime
 	s.EndTime = f.EndTime
 	s.Duration = f.duration()
+	s.IdleAtEnd, s.LastActivityTime = f.activity()
 	s.Samples = len(f.Data)
 	s.SamplesDeduped = f.SamplesDeduped
+	s.SamplesDropped = f.SamplesDropped
 	s.Partial = f.Partial
 	s.Timestamps = f.optSeen(linux.TCPI_OPT_TIMESTAMPS)
 	s.SACK = f.optSeen(linux.TCPI_OPT_SACK)
 	s.ECN = f.optSeen(linux.TCPI_OPT_ECN)
 	s.ECNSeen = f.optSeen(linux.TCPI_OPT_ECN_SEEN)
+	s.WindowScaling = f.optSeen(linux.TCPI_OPT_WSCALE)
+	s.CongestionControl = f.lastData().CongestionControl
+	s.SndMSS = f.lastData().SndMSS
+	s.SndCwnd = f.lastData().SndCwnd
+	s.AdvMSS = f.lastData().AdvMSS
+	s.PMTU = f.lastData().PMTU
+	s.PMTUChanges, s.PMTUMin, s.SndMSSChanges = f.mtuChanges()
+	s.SndWscale = f.lastData().SndWscale
+	s.RcvWscale = f.lastData().RcvWscale
+	s.TeardownSamples = f.teardownSamples()
+	s.Mark = f.lastData().Mark
+	s.DSCP = f.lastData().DSCP
+	s.UID = f.lastData().UID
+	s.PID = f.PID
+	s.Process = f.Process
+	s.CgroupID = f.CgroupID
+	s.Cgroup = f.Cgroup
+	s.ContainerID = f.ContainerID
+	s.PodUID = f.PodUID
+	s.Tag = f.Tag
+	s.Targeted = f.Targeted
+	s.Direction = f.Direction
+	s.ClockJump = f.ClockJump
+	s.Idle = f.Idle
+	s.FlowUID = fmt.Sprintf("%016x", f.UID)
+	s.Segment = f.Segment
+	s.Continued = f.Continued
+	s.IsFinal = f.Segment > 0 && !f.Continued
+	s.Capture = f.Capture
+	if st := f.lastData().State; st != linux.TCP_ESTABLISHED {
+		s.EndState = linux.TCPStateNames[st]
+	}
 	s.MinRTTKernelms = usToMs(f.minRTTKernel())
 	s.MinRTTObservedms = usToMs(f.minRTTObserved())
+	b := f.baseData()
+	s.TotalRetransmits = f.lastData().TotalRetransmits - b.TotalRetransmits
+	s.RTORetransmits, s.FastRetransmits, s.RTOEvents = f.retransKinds()
+	min, max := f.rtoRange()
+	s.RTOMinms, s.RTOMaxms = usToMs(min), usToMs(max)
+	s.RTOMedianms = f.summary(f.rtos())[3]
+	rps, wps, rpm, wpm := f.retransRates()
+	s.RetransPerSecMean, s.RetransPerSecMax, s.RetransPerSecSummary =
+		f.rateStats(rps, wps)
+	s.RetransPerMBMean, s.RetransPerMBMax, s.RetransPerMBSummary =
+		f.rateStats(rpm, wpm)
+	s.ReorderingMax, s.SackedMax, s.LostMax = f.maxSACKState()
+	s.DSACKDups = f.lastData().DSACKDups - b.DSACKDups
+	s.ReordSeen = f.lastData().ReordSeen - b.ReordSeen
+	s.BytesAcked = f.lastData().BytesAcked - b.BytesAcked
+	s.BytesSent = f.lastData().BytesSent - b.BytesSent
+	s.BytesRetrans = f.lastData().BytesRetrans - b.BytesRetrans
+	if s.BytesSent > 0 {
+		s.RetransByteRatio = float64(s.BytesRetrans) / float64(s.BytesSent)
+	}
+	s.Delivered = f.lastData().Delivered - b.Delivered
+	s.DeliveredCE = f.lastData().DeliveredCE - b.DeliveredCE
+	if s.Delivered > 0 {
+		s.ECNMarkRate = float64(s.DeliveredCE) / float64(s.Delivered)
+	}
+	s.SendThroughputMbps = bytesPSToMbps(1000000000 * s.BytesAcked /
+		uint64(s.EndTime.Sub(s.StartTime)))
 	s.MaxPacingRateObservedMbps = bytesPSToMbps(f.maxPacingRateObserved())
+	s.BusyFraction, s.CwndLimitedFraction, s.RwndLimitedFraction,
+		s.SndbufLimitedFraction = f.limited()
+	s.SlowStartDuration, s.CongAvoidDuration, s.SlowStartExit = f.slowStart()
+	s.SndQueueSummary = f.summary(f.sndQueues())
+	s.SndQueueFullFraction = f.sndQueueFull()
+	s.SndBufMax, s.RcvQueueMax, s.RcvBufMax = f.maxSocketMemory()
+	s.BytesReceived = f.lastData().BytesReceived - b.BytesReceived
+	s.RecvThroughputMbps = bytesPSToMbps(1000000000 * s.BytesReceived /
+		uint64(s.EndTime.Sub(s.StartTime)))
+	s.RcvRTTSummary = f.nonzeroSummary(f.rcvRTTs())
+	s.RcvSpaceMax = f.maxRcvSpace()
+	s.SndWndMedian = f.summary(f.sndWnds())[3]
+	s.RcvWndMedian = f.summary(f.rcvWnds())[3]
+	s.ZeroWindowEpisodes, s.ZeroWindowDuration = f.zeroWindows(
+		func(d *sampler.Data) uint32 { return d.SndWnd })
+	s.RcvZeroWindowEpisodes, s.RcvZeroWindowDuration = f.zeroWindows(
+		func(d *sampler.Data) uint32 { return d.RcvWnd })
+	s.ProbesMax = f.maxProbes()
+	min, max = f.atoRange()
+	s.ATOMinms, s.ATOMaxms = usToMs(min), usToMs(max)
+	s.ATOMedianms = f.summary(f.atos())[3]
+	s.RcvOOOPack = f.lastData().RcvOOOPack - b.RcvOOOPack
+	s.MaxDeliveryRateMbps = bytesPSToMbps(f.maxDeliveryRate())
+	s.BDPBytes = f.bdp()
+	s.CwndMaxBytes = f.maxCwndBytes()
+	s.BufferLimited = bufferLimited(s)
+	c := &f.Concurrency
+	s.ConcurrentFlowsAtStart = c.StartFlows
+	s.ConcurrentFlowsMean = c.MeanFlows()
+	s.ConcurrentFlowsMax = c.MaxFlows
+	s.AggThroughputMbpsAtStart = c.StartMbps
+	s.AggThroughputMbpsMean = c.MeanMbps()
 	rtts := f.rtts()
-	s.RTTSummary = f.summary(rtts)
+	// summary sorts its input, and rtts must stay in time order for correlations
+	s.RTTSummary = f.summary(append([]float64(nil), rtts...))
+	if f.RawSamples {
+		s.RawSamples = f.series()
+	}
+	if f.MinRTTSeries {
+		s.MinRTTSeries = f.minRTTSeries()
+	}
+	if f.ThroughputSeries {
+		s.ThroughputSeries = f.throughputSeries()
+	}
+
+	// the stats above are always set, the rest only until the deadline
+	s.CorrRTTCwnd = CORR_TRUNCATED
+	s.CorrRetransCwnd = CORR_TRUNCATED
+	s.CorrPacingCwnd = CORR_TRUNCATED
+	s.CorrRetransRTT = CORR_TRUNCATED
+	s.CorrRetransBurstRTT = CORR_TRUNCATED
+	if f.truncate(s) {
+		return
+	}
 	s.RTTVarSummary = f.summary(f.rttvars())
+	if f.truncate(s) {
+		return
+	}
 	cwnds := f.cwnds()
 	if s.Samples > 1 {
 		var w []float64
@@ -197,48 +549,72 @@ func (f *flow) analyze() (s *FlowStats) {
 		if debug {
 			log.Printf("correlate rtts %v to cwnds %v", rtts, cwnds)
 		}
-		s.CorrRTTCwnd = stat.Correlation(rtts, cwnds, w)
-		if isUndefined(s.CorrRTTCwnd) {
-			s.CorrRTTCwnd = CORR_UNDEFINED
-		} else {
-			s.CorrRTTCwnd = f.adjustCorrelation(s.CorrRTTCwnd)
+		if f.truncate(s) {
+			return
 		}
+		s.CorrRTTCwnd = f.correlation(rtts, cwnds, w)
 
+		if f.truncate(s) {
+			return
+		}
+		// retransmit rates are per interval, so they're correlated with the
+		// samples ending each interval
 		rtps := f.retransPerSec()
-		if debug {
-			log.Printf("correlate retransmits %v to cwnds %v", rtps, cwnds)
+		var wi []float64
+		if w != nil {
+			wi = w[1:]
 		}
-		s.CorrRetransCwnd = stat.Correlation(rtps, cwnds, w)
-		if isUndefined(s.CorrRetransCwnd) {
-			s.CorrRetransCwnd = CORR_UNDEFINED
-		} else {
-			s.CorrRetransCwnd = f.adjustCorrelation(s.CorrRetransCwnd)
+		if debug {
+			log.Printf("correlate retransmits %v to cwnds %v", rtps, cwnds[1:])
 		}
+		s.CorrRetransCwnd = f.correlation(rtps, cwnds[1:], wi)
 
+		if f.truncate(s) {
+			return
+		}
 		pcng := f.pacing()
 		if debug {
 			log.Printf("correlate pacing %v to cwnds %v", pcng, cwnds)
 		}
-		s.CorrPacingCwnd = stat.Correlation(pcng, cwnds, w)
-		if isUndefined(s.CorrPacingCwnd) {
-			s.CorrPacingCwnd = CORR_UNDEFINED
-		} else {
-			s.CorrPacingCwnd = f.adjustCorrelation(s.CorrPacingCwnd)
+		s.CorrPacingCwnd = f.correlation(pcng, cwnds, w)
+
+		if f.truncate(s) {
+			return
+		}
+		if debug {
+			log.Printf("correlate retransmits %v to rtts %v", rtps, rtts[1:])
+		}
+		s.CorrRetransRTT = f.correlation(rtps, rtts[1:], wi)
+
+		if f.truncate(s) {
+			return
+		}
+		rtbs := f.retransBursts()
+		if debug {
+			log.Printf("correlate retransmit bursts %v to rtts %v", rtbs, rtts)
 		}
+		s.CorrRetransBurstRTT = f.correlation(rtbs, rtts, w)
 	} else {
 		s.CorrRTTCwnd = CORR_INSUFFICIENT_SAMPLES
 		s.CorrRetransCwnd = CORR_INSUFFICIENT_SAMPLES
 		s.CorrPacingCwnd = CORR_INSUFFICIENT_SAMPLES
+		s.CorrRetransRTT = CORR_INSUFFICIENT_SAMPLES
+		s.CorrRetransBurstRTT = CORR_INSUFFICIENT_SAMPLES
 	}
-	s.TotalRetransmits = f.lastData().TotalRetransmits
-	s.BytesAcked = f.lastData().BytesAcked
-	//s.Delivered = f.lastData().Delivered
-	//s.DeliveredCE = f.lastData().DeliveredCE
-	s.SendThroughputMbps = bytesPSToMbps(1000000000 * s.BytesAcked /
-		uint64(s.EndTime.Sub(s.StartTime)))
 	return
 }
 
+// applyBaseline updates the RTT baseline for the flow's destination, then sets
+// the baseline and the flow's excess over it in the stats.
+func (f *flow) applyBaseline(b *baselines, s *FlowStats, now time.Time) {
+	min := f.minRTTKernel()
+	if o := f.minRTTObserved(); min == 0 || o < min {
+		min = o
+	}
+	s.BaselineRTTms = usToMs(b.update(f.ID, min, now))
+	s.ExcessRTTms = s.RTTSummary[3] - s.BaselineRTTms
+}
+
 func (f *flow) convertID() (id ID) {
 	id.SrcIP = net.IP(f.ID.SrcIP[:])
 	id.SrcPort = f.ID.SrcPort
@@ -248,6 +624,19 @@ func (f *flow) convertID() (id ID) {
 	return
 }
 
+// activity returns the time from the last data activity to the last sample,
+// including any de-duped samples after the last kept one, during which the
+// data didn't change, and the estimated wall time of the last data or ACK
+// activity, from the start time and sample timestamps.
+func (f *flow) activity() (idle time.Duration, last time.Time) {
+	d := f.lastData()
+	dd := time.Duration(f.EndTstampNs - d.TstampNs)
+	idle = d.SinceData() + dd
+	last = f.StartTime.Add(time.Duration(d.TstampNs-f.firstData().TstampNs) -
+		d.SinceActivity())
+	return
+}
+
 func (f *flow) duration() time.Duration {
 	return time.Duration(f.EndTstampNs - f.firstData().TstampNs)
 }
@@ -260,6 +649,16 @@ func (f *flow) lastData() *sampler.Data {
 	return &f.Data[len(f.Data)-1]
 }
 
+// baseData returns the data that the flow's cumulative counters are relative
+// to, which is the first sample for segments after the first, so their stats
+// cover only the segment, otherwise zero data.
+func (f *flow) baseData() (b sampler.Data) {
+	if f.Segment > 1 {
+		b = f.Data[0]
+	}
+	return
+}
+
 func (f *flow) optSeen(opt uint8) (b bool) {
 	for _, d := range f.Data {
 		if d.Options&opt != 0 {
@@ -270,6 +669,198 @@ func (f *flow) optSeen(opt uint8) (b bool) {
 	return
 }
 
+// teardownSamples returns the number of samples taken after the connection
+// started closing.
+func (f *flow) teardownSamples() (n int) {
+	for _, d := range f.Data {
+		switch d.State {
+		case linux.TCP_FIN_WAIT1, linux.TCP_FIN_WAIT2, linux.TCP_TIME_WAIT,
+			linux.TCP_CLOSE, linux.TCP_CLOSE_WAIT, linux.TCP_LAST_ACK,
+			linux.TCP_CLOSING:
+			n++
+		}
+	}
+	return
+}
+
+// limited returns the fractions of the time from the first to the last sample
+// that the flow was busy, and limited by cwnd, the receive window and the send
+// buffer, from the kernel's chrono stats.
+func (f *flow) limited() (busy, cwnd, rwnd, sndbuf float64) {
+	d0, d1 := f.firstData(), f.lastData()
+	if d1.TstampNs <= d0.TstampNs {
+		return
+	}
+	t := float64(d1.TstampNs-d0.TstampNs) / 1000
+	frac := func(v0, v1 uint64) float64 {
+		if v1 <= v0 {
+			return 0
+		}
+		return math.Min(float64(v1-v0)/t, 1)
+	}
+	busy = frac(d0.BusyTimeus, d1.BusyTimeus)
+	rwnd = frac(d0.RwndLimitedus, d1.RwndLimitedus)
+	sndbuf = frac(d0.SndbufLimitedus, d1.SndbufLimitedus)
+	cwnd = math.Max(busy-rwnd-sndbuf, 0)
+	return
+}
+
+// slowStart returns the sampled time spent in slow start and congestion
+// avoidance, by comparing cwnd and ssthresh, with the time between samples
+// attributed to the phase of the earlier sample, and the time from the first
+// sample to the first out of slow start, or -1 if none was. Congestion control
+// algorithms that don't use ssthresh (e.g. BBR) appear to stay in slow start.
+func (f *flow) slowStart() (ss, ca, exit time.Duration) {
+	exit = -1
+	t0 := f.Data[0].TstampNs
+	for i := range f.Data {
+		d := &f.Data[i]
+		inSS := inSlowStart(d)
+		if !inSS && exit < 0 {
+			exit = time.Duration(d.TstampNs - t0)
+		}
+		if i == len(f.Data)-1 {
+			break
+		}
+		dt := time.Duration(f.Data[i+1].TstampNs - d.TstampNs)
+		if inSS {
+			ss += dt
+		} else {
+			ca += dt
+		}
+	}
+	return
+}
+
+func (f *flow) sndQueues() (q []float64) {
+	q = make([]float64, len(f.Data))
+	for i := 0; i < len(f.Data); i++ {
+		q[i] = float64(f.Data[i].WmemQueued)
+	}
+	return
+}
+
+// sndQueueFull returns the fraction of the sampled duration with the send
+// queue at or above the send buffer size, when the socket isn't writable, with
+// the time between samples attributed to the earlier sample.
+func (f *flow) sndQueueFull() float64 {
+	var full, total uint64
+	for i := 0; i < len(f.Data)-1; i++ {
+		d := &f.Data[i]
+		dt := f.Data[i+1].TstampNs - d.TstampNs
+		total += dt
+		if d.SndBuf > 0 && d.WmemQueued >= d.SndBuf {
+			full += dt
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(full) / float64(total)
+}
+
+// maxSocketMemory returns the maximum send buffer size, receive queue memory
+// and receive buffer size in the samples.
+func (f *flow) maxSocketMemory() (sndbuf, rmem, rcvbuf uint32) {
+	for i := 0; i < len(f.Data); i++ {
+		d := &f.Data[i]
+		if d.SndBuf > sndbuf {
+			sndbuf = d.SndBuf
+		}
+		if d.RmemAlloc > rmem {
+			rmem = d.RmemAlloc
+		}
+		if d.RcvBuf > rcvbuf {
+			rcvbuf = d.RcvBuf
+		}
+	}
+	return
+}
+
+// maxDeliveryRate returns the maximum delivery rate sample, in bytes / second.
+func (f *flow) maxDeliveryRate() (max uint64) {
+	for i := 0; i < len(f.Data); i++ {
+		if f.Data[i].DeliveryRateBps > max {
+			max = f.Data[i].DeliveryRateBps
+		}
+	}
+	return
+}
+
+// bdp returns the bandwidth-delay product in bytes, from the maximum delivery
+// rate and the kernel's min RTT, or the observed min RTT if the kernel's isn't
+// available.
+func (f *flow) bdp() uint64 {
+	rtt := f.minRTTKernel()
+	if rtt == 0 {
+		rtt = f.minRTTObserved()
+	}
+	return f.maxDeliveryRate() * uint64(rtt) / 1000000
+}
+
+// maxCwndBytes returns the maximum send cwnd in the samples, in bytes.
+func (f *flow) maxCwndBytes() (max uint32) {
+	for i := 0; i < len(f.Data); i++ {
+		if f.Data[i].SndCwndBytes > max {
+			max = f.Data[i].SndCwndBytes
+		}
+	}
+	return
+}
+
+// bufferLimited returns a hint for what kept the flow's window below its
+// bandwidth-delay product (see the BufferLimited constants), or empty if
+// nothing did, or the BDP is unknown. The send buffer and receive window are
+// only blamed if the kernel also reported the flow limited by them.
+func bufferLimited(s *FlowStats) string {
+	if s.BDPBytes == 0 {
+		return ""
+	}
+	bdp := float64(s.BDPBytes)
+	switch {
+	case s.SndBufMax > 0 && float64(s.SndBufMax) < bdp &&
+		s.SndbufLimitedFraction >= bufferLimitedMinFraction:
+		return BufferLimitedSndbuf
+	case s.SndWndMedian > 0 && s.SndWndMedian < bdp &&
+		s.RwndLimitedFraction >= bufferLimitedMinFraction:
+		return BufferLimitedRwnd
+	case float64(s.CwndMaxBytes) < bdp:
+		return BufferLimitedCwnd
+	}
+	return ""
+}
+
+// mtuChanges returns the number of times the path MTU and sender MSS changed
+// between samples, excluding those from handshake states, in which they're not
+// settled, and the minimum path MTU if it changed.
+func (f *flow) mtuChanges() (pmtu int, min uint32, mss int) {
+	min = f.Data[0].PMTU
+	for i := 1; i < len(f.Data); i++ {
+		p, d := &f.Data[i-1], &f.Data[i]
+		if d.PMTU > 0 && (d.PMTU < min || min == 0) {
+			min = d.PMTU
+		}
+		if p.State == linux.TCP_SYN_SENT || p.State == linux.TCP_SYN_RECV {
+			continue
+		}
+		if d.PMTU != p.PMTU {
+			pmtu++
+		}
+		if d.SndMSS != p.SndMSS {
+			mss++
+		}
+	}
+	if pmtu == 0 {
+		min = 0
+	}
+	return
+}
+
+// inSlowStart returns true if cwnd is below ssthresh for the sample.
+func inSlowStart(d *sampler.Data) bool {
+	return uint64(d.SndCwndBytes) < uint64(d.SndSsthresh)*uint64(d.SndMSS)
+}
+
 func (f *flow) minRTTKernel() (min uint32) {
 	min = f.lastData().MinRTTus
 	return
@@ -310,6 +901,95 @@ func (f *flow) rtts() (r []float64) {
 	return
 }
 
+// maxSACKState returns the maximum reordering, sacked and lost values in the
+// samples.
+func (f *flow) maxSACKState() (reordering, sacked, lost uint32) {
+	for i := 0; i < len(f.Data); i++ {
+		d := &f.Data[i]
+		if d.Reordering > reordering {
+			reordering = d.Reordering
+		}
+		if d.Sacked > sacked {
+			sacked = d.Sacked
+		}
+		if d.Lost > lost {
+			lost = d.Lost
+		}
+	}
+	return
+}
+
+func (f *flow) rcvRTTs() (r []float64) {
+	r = make([]float64, len(f.Data))
+	for i := 0; i < len(f.Data); i++ {
+		r[i] = usToMs(f.Data[i].RcvRTTus)
+	}
+	return
+}
+
+func (f *flow) maxRcvSpace() (max uint32) {
+	for i := 0; i < len(f.Data); i++ {
+		if f.Data[i].RcvSpace > max {
+			max = f.Data[i].RcvSpace
+		}
+	}
+	return
+}
+
+func (f *flow) sndWnds() (w []float64) {
+	w = make([]float64, len(f.Data))
+	for i := 0; i < len(f.Data); i++ {
+		w[i] = float64(f.Data[i].SndWnd)
+	}
+	return
+}
+
+// zeroWindows returns the number of episodes of consecutive established
+// samples with a zero window, as returned by wnd, and their sampled duration,
+// with the time between samples attributed to the earlier sample. Flows whose
+// window is never non-zero are skipped, as the window is always zero on
+// kernels that don't provide it.
+func (f *flow) zeroWindows(wnd func(*sampler.Data) uint32) (n int,
+	dur time.Duration) {
+	var seen, zero bool
+	for i := range f.Data {
+		d := &f.Data[i]
+		if wnd(d) > 0 {
+			seen = true
+		}
+		z := d.State == linux.TCP_ESTABLISHED && wnd(d) == 0
+		if z && !zero {
+			n++
+		}
+		if z && i < len(f.Data)-1 {
+			dur += time.Duration(f.Data[i+1].TstampNs - d.TstampNs)
+		}
+		zero = z
+	}
+	if !seen {
+		return 0, 0
+	}
+	return
+}
+
+// maxProbes returns the maximum unanswered probes in the samples.
+func (f *flow) maxProbes() (max uint8) {
+	for i := 0; i < len(f.Data); i++ {
+		if f.Data[i].Probes > max {
+			max = f.Data[i].Probes
+		}
+	}
+	return
+}
+
+func (f *flow) rcvWnds() (w []float64) {
+	w = make([]float64, len(f.Data))
+	for i := 0; i < len(f.Data); i++ {
+		w[i] = float64(f.Data[i].RcvWnd)
+	}
+	return
+}
+
 func (f *flow) rttvars() (v []float64) {
 	v = make([]float64, len(f.Data))
 	for i := 0; i < len(f.Data); i++ {
@@ -318,6 +998,50 @@ func (f *flow) rttvars() (v []float64) {
 	return
 }
 
+func (f *flow) rtos() (r []float64) {
+	r = make([]float64, len(f.Data))
+	for i := 0; i < len(f.Data); i++ {
+		r[i] = usToMs(f.Data[i].RTOus)
+	}
+	return
+}
+
+// rtoRange returns the minimum and maximum RTO in the samples.
+func (f *flow) rtoRange() (min, max uint32) {
+	min = f.Data[0].RTOus
+	max = min
+	for i := 1; i < len(f.Data); i++ {
+		if r := f.Data[i].RTOus; r < min {
+			min = r
+		} else if r > max {
+			max = r
+		}
+	}
+	return
+}
+
+func (f *flow) atos() (a []float64) {
+	a = make([]float64, len(f.Data))
+	for i := 0; i < len(f.Data); i++ {
+		a[i] = usToMs(f.Data[i].ATOus)
+	}
+	return
+}
+
+// atoRange returns the minimum and maximum ATO in the samples.
+func (f *flow) atoRange() (min, max uint32) {
+	min = f.Data[0].ATOus
+	max = min
+	for i := 1; i < len(f.Data); i++ {
+		if a := f.Data[i].ATOus; a < min {
+			min = a
+		} else if a > max {
+			max = a
+		}
+	}
+	return
+}
+
 func (f *flow) cwnds() (w []float64) {
 	w = make([]float64, len(f.Data))
 	for i := 0; i < len(f.Data); i++ {
@@ -326,12 +1050,120 @@ func (f *flow) cwnds() (w []float64) {
 	return
 }
 
+// retransPerSec returns the retransmit rate over each interval between
+// samples, so it has one less element than the samples.
 func (f *flow) retransPerSec() (r []float64) {
-	r = make([]float64, len(f.Data))
+	r = make([]float64, len(f.Data)-1)
 	for i := 1; i < len(f.Data); i++ {
 		deltaSec := float64(f.Data[i].TstampNs-f.Data[i-1].TstampNs) / 1000000000
 		retrans := f.Data[i].TotalRetransmits - f.Data[i-1].TotalRetransmits
-		r[i] = float64(retrans) / deltaSec
+		r[i-1] = float64(retrans) / deltaSec
+	}
+	return
+}
+
+// retransRates returns the retransmits per second over each interval between
+// samples, weighted by the interval's duration in sampler intervals, and the
+// retransmits per MB acked over each interval with bytes acked, weighted by
+// its MB acked.
+func (f *flow) retransRates() (ps, wps, pmb, wpmb []float64) {
+	ps = f.retransPerSec()
+	wps = make([]float64, len(ps))
+	for i := 1; i < len(f.Data); i++ {
+		p, d := &f.Data[i-1], &f.Data[i]
+		wps[i-1] = float64(d.TstampNs-p.TstampNs) / float64(f.SamplerInterval)
+		if d.BytesAcked <= p.BytesAcked {
+			continue
+		}
+		mb := float64(d.BytesAcked-p.BytesAcked) / 1000000
+		pmb = append(pmb, float64(d.TotalRetransmits-p.TotalRetransmits)/mb)
+		wpmb = append(wpmb, mb)
+	}
+	return
+}
+
+// rateStats returns the weighted mean, the maximum and the seven number
+// summary of rates with weights w, or zeros if there are none. The summary is
+// unweighted with UnweightedQuantiles.
+func (f *flow) rateStats(r, w []float64) (mean, max float64, s [7]float64) {
+	if len(r) == 0 {
+		return
+	}
+	var sum, sumw float64
+	for i, v := range r {
+		sum += v * w[i]
+		sumw += w[i]
+		if v > max {
+			max = v
+		}
+	}
+	if sumw > 0 {
+		mean = sum / sumw
+	}
+	if f.UnweightedQuantiles {
+		w = nil
+	}
+	s = f.weightedSummary(r, w)
+	return
+}
+
+// retransBursts returns the retransmit rate for each sample, with retransmits
+// windowed into bursts. A retransmit within one RTT of the previous one is in
+// the same burst, and each sample in a burst gets the burst's mean retransmit
+// rate, from the sample before its first retransmit to its last.
+func (f *flow) retransBursts() (r []float64) {
+	r = make([]float64, len(f.Data))
+	start, last := -1, -1
+	flush := func() {
+		if start < 0 {
+			return
+		}
+		p, l := &f.Data[start-1], &f.Data[last]
+		deltaSec := float64(l.TstampNs-p.TstampNs) / 1000000000
+		rate := float64(l.TotalRetransmits-p.TotalRetransmits) / deltaSec
+		for i := start; i <= last; i++ {
+			r[i] = rate
+		}
+		start = -1
+	}
+	for i := 1; i < len(f.Data); i++ {
+		d := &f.Data[i]
+		if d.TotalRetransmits == f.Data[i-1].TotalRetransmits {
+			continue
+		}
+		if start >= 0 &&
+			d.TstampNs-f.Data[last].TstampNs > uint64(d.RTTus)*1000 {
+			flush()
+		}
+		if start < 0 {
+			start = i
+		}
+		last = i
+	}
+	flush()
+	return
+}
+
+// retransKinds estimates the retransmits due to RTOs and during fast recovery,
+// and the number of RTOs, from the congestion avoidance state and RTO backoff
+// of the samples. Retransmits between two samples are attributed to RTOs if
+// either sample was in the Loss state or backed off, so an RTO that started
+// and recovered between samples is counted as fast recovery.
+func (f *flow) retransKinds() (rto, fast uint32, events int) {
+	rtoState := func(d *sampler.Data) bool {
+		return d.CAState == linux.TCP_CA_Loss || d.Backoff > 0
+	}
+	for i := 1; i < len(f.Data); i++ {
+		p, d := &f.Data[i-1], &f.Data[i]
+		if rtoState(d) && (!rtoState(p) || d.Backoff > p.Backoff) {
+			events++
+		}
+		n := d.TotalRetransmits - p.TotalRetransmits
+		if rtoState(p) || rtoState(d) {
+			rto += n
+		} else {
+			fast += n
+		}
 	}
 	return
 }
@@ -346,10 +1178,44 @@ func (f *flow) pacing() (p []float64) {
 
 func (f *flow) summary(d []float64) (s [7]float64) {
 	var w []float64
-	if f.UnweightedQuantiles {
+	if !f.UnweightedQuantiles {
+		w = f.sampleWeights()
+	}
+	return f.weightedSummary(d, w)
+}
+
+// nonzeroSummary returns the summary of the non-zero values in d, which has
+// one value per sample, or all zeros if there are none.
+func (f *flow) nonzeroSummary(d []float64) (s [7]float64) {
+	var w []float64
+	if !f.UnweightedQuantiles {
+		w = f.sampleWeights()
+	}
+	n := 0
+	for i := range d {
+		if d[i] != 0 {
+			d[n] = d[i]
+			if w != nil {
+				w[n] = w[i]
+			}
+			n++
+		}
+	}
+	if n == 0 {
+		return
+	}
+	if w != nil {
+		w = w[:n]
+	}
+	return f.weightedSummary(d[:n], w)
+}
+
+// weightedSummary returns the seven number summary of d with weights w, or
+// unweighted if w is nil. d and w are sorted in place.
+func (f *flow) weightedSummary(d, w []float64) (s [7]float64) {
+	if w == nil {
 		sort.Float64s(d)
 	} else {
-		w = f.sampleWeights()
 		t := transformFromSlices(d, w)
 		sort.Sort(t)
 		t.transformToSlices(d, w)
@@ -378,6 +1244,16 @@ func (f *flow) sampleWeights() (w []float64) {
 	return
 }
 
+// correlation returns the adjusted correlation between x and y with weights w,
+// or CORR_UNDEFINED if it's undefined.
+func (f *flow) correlation(x, y, w []float64) float64 {
+	r := stat.Correlation(x, y, w)
+	if isUndefined(r) {
+		return CORR_UNDEFINED
+	}
+	return f.adjustCorrelation(r)
+}
+
 func (f *flow) adjustCorrelation(r float64) (radj float64) {
 	if f.AdjustedCC1 {
 		n := float64(len(f.Data))
@@ -0,0 +1,108 @@
+package analyzer
+
+import (
+	"time"
+
+	"github.com/heistp/cgmon/sampler"
+)
+
+// baselineKey identifies a destination, or destination prefix, for which an
+// RTT baseline is kept.
+type baselineKey [16]byte
+
+// baseline is the long-lived minimum RTT seen across flows to a destination.
+type baseline struct {
+	minRTTus uint32    // minimum RTT in microseconds
+	updated  time.Time // time the minimum was last lowered or refreshed
+}
+
+// baselines tracks per-destination minimum RTT baselines across flows, so
+// queueing delay may be estimated even for short flows that never observe the
+// path minimum themselves.
+type baselines struct {
+	prefixLen  int
+	prefixLen6 int
+	ttl        time.Duration
+	m          map[baselineKey]*baseline
+	lastPrune  time.Time
+}
+
+func newBaselines(prefixLen, prefixLen6 int, ttl time.Duration) *baselines {
+	return &baselines{
+		prefixLen,
+		prefixLen6,
+		ttl,
+		make(map[baselineKey]*baseline),
+		time.Time{},
+	}
+}
+
+// key returns the baseline key for the destination IP of the given ID. IPv4
+// addresses use prefixLen and IPv6 addresses prefixLen6.
+func (b *baselines) key(id sampler.ID) (k baselineKey) {
+	k = baselineKey(id.DstIP)
+	pl := b.prefixLen6
+	if id.IsIPv4() {
+		pl = 96 + b.prefixLen
+	}
+	for i := 0; i < len(k); i++ {
+		bits := pl - i*8
+		if bits >= 8 {
+			continue
+		}
+		if bits <= 0 {
+			k[i] = 0
+		} else {
+			k[i] &= byte(0xff << uint(8-bits))
+		}
+	}
+	return
+}
+
+// update lowers the baseline for the flow's destination to the given minimum
+// RTT if it's lower, or if the existing baseline has expired, and returns the
+// resulting baseline RTT in microseconds.
+func (b *baselines) update(id sampler.ID, minRTTus uint32,
+	now time.Time) uint32 {
+	b.maybePrune(now)
+
+	k := b.key(id)
+	bl, ok := b.m[k]
+	if !ok {
+		bl = &baseline{minRTTus, now}
+		b.m[k] = bl
+	} else if minRTTus <= bl.minRTTus || b.expired(bl, now) {
+		bl.minRTTus = minRTTus
+		bl.updated = now
+	}
+	return bl.minRTTus
+}
+
+// len returns the number of baselines tracked.
+func (b *baselines) len() int {
+	return len(b.m)
+}
+
+func (b *baselines) expired(bl *baseline, now time.Time) bool {
+	return b.ttl > 0 && now.Sub(bl.updated) > b.ttl
+}
+
+// maybePrune deletes expired baselines at most once per TTL.
+func (b *baselines) maybePrune(now time.Time) {
+	if b.ttl <= 0 {
+		return
+	}
+	if b.lastPrune.IsZero() {
+		b.lastPrune = now
+		return
+	}
+	if now.Sub(b.lastPrune) < b.ttl {
+		return
+	}
+	for k, bl := range b.m {
+		if b.expired(bl, now) {
+			delete(b.m, k)
+		}
+	}
+	b.lastPrune = now
+}
@@ -0,0 +1,65 @@
+package analyzer
+
+import (
+	"embed"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"strings"
+)
+
+// sources is the package source that declares the output types, embedded so
+// their field comments are available to the running binary.
+//
+//go:embed analyzer.go series.go
+var sources embed.FS
+
+// FieldDocs returns the comments of the fields of the package's struct types,
+// keyed by type and field name (e.g. "FlowStats.RTTSummary"), parsed from the
+// embedded package source, so descriptions of the output (see the schema
+// package) always match the code the binary was built from.
+func FieldDocs() (docs map[string]string, err error) {
+	var ds []fs.DirEntry
+	if ds, err = sources.ReadDir("."); err != nil {
+		return
+	}
+	docs = make(map[string]string)
+	fset := token.NewFileSet()
+	for _, d := range ds {
+		var b []byte
+		if b, err = sources.ReadFile(d.Name()); err != nil {
+			return
+		}
+		var f *ast.File
+		if f, err = parser.ParseFile(fset, d.Name(), b,
+			parser.ParseComments); err != nil {
+			return
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			ts, ok := n.(*ast.TypeSpec)
+			if !ok {
+				return true
+			}
+			st, ok := ts.Type.(*ast.StructType)
+			if !ok {
+				return false
+			}
+			for _, fl := range st.Fields.List {
+				c := fl.Doc
+				if c == nil {
+					c = fl.Comment
+				}
+				if c == nil {
+					continue
+				}
+				doc := strings.Join(strings.Fields(c.Text()), " ")
+				for _, nm := range fl.Names {
+					docs[ts.Name.Name+"."+nm.Name] = doc
+				}
+			}
+			return false
+		})
+	}
+	return
+}
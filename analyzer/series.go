@@ -0,0 +1,197 @@
+package analyzer
+
+import "time"
+
+// Series contains a flow's raw sampled values as parallel arrays in time
+// order, for plotting. It's included in FlowStats when Config.RawSamples is
+// set.
+type Series struct {
+	Time           []float64 // time since the first sample, in seconds
+	RTTms          []float64 // RTT in milliseconds
+	RTTVarms       []float64 // RTT variance in milliseconds
+	RTOms          []float64 // retransmission timeout in milliseconds
+	CwndBytes      []float64 // send cwnd in bytes
+	CwndPackets    []float64 // send cwnd in segments
+	SsthreshBytes  []float64 // slow start threshold in bytes
+	PacingRateMbps []float64 // pacing rate in Mbps
+	Retransmits    []float64 // total retransmits
+	BytesAcked     []float64 // bytes acked
+	DeliveredCE    []float64 // delivered packets acked with ECE (4.18 and later)
+	CAState        []float64 // congestion avoidance state (TCP_CA_* in the linux package)
+	SndQueueBytes  []float64 // send queue memory in bytes (sk_wmem_queued)
+	RcvQueueBytes  []float64 // receive queue memory in bytes (sk_rmem_alloc)
+}
+
+// A Column is one metric of a Series.
+type Column struct {
+	Name   string    // metric name, including its unit
+	Values []float64 // values, one per sample
+}
+
+// Columns returns the metrics of the Series, excluding Time.
+func (s *Series) Columns() []Column {
+	return []Column{
+		{"rtt_ms", s.RTTms},
+		{"rttvar_ms", s.RTTVarms},
+		{"rto_ms", s.RTOms},
+		{"cwnd_bytes", s.CwndBytes},
+		{"cwnd_packets", s.CwndPackets},
+		{"ssthresh_bytes", s.SsthreshBytes},
+		{"pacing_rate_mbps", s.PacingRateMbps},
+		{"retransmits", s.Retransmits},
+		{"bytes_acked", s.BytesAcked},
+		{"delivered_ce", s.DeliveredCE},
+		{"ca_state", s.CAState},
+		{"snd_queue_bytes", s.SndQueueBytes},
+		{"rcv_queue_bytes", s.RcvQueueBytes},
+	}
+}
+
+// series returns the flow's Series.
+func (f *flow) series() (s *Series) {
+	n := len(f.Data)
+	s = &Series{
+		make([]float64, n),
+		make([]float64, n),
+		make([]float64, n),
+		make([]float64, n),
+		make([]float64, n),
+		make([]float64, n),
+		make([]float64, n),
+		make([]float64, n),
+		make([]float64, n),
+		make([]float64, n),
+		make([]float64, n),
+		make([]float64, n),
+		make([]float64, n),
+		make([]float64, n),
+	}
+	t0 := f.Data[0].TstampNs
+	for i := 0; i < n; i++ {
+		d := &f.Data[i]
+		s.Time[i] = float64(d.TstampNs-t0) / 1e9
+		s.RTTms[i] = usToMs(d.RTTus)
+		s.RTTVarms[i] = usToMs(d.RTTVarus)
+		s.RTOms[i] = usToMs(d.RTOus)
+		s.CwndBytes[i] = float64(d.SndCwndBytes)
+		s.CwndPackets[i] = float64(d.SndCwnd)
+		s.SsthreshBytes[i] = float64(d.SndSsthresh) * float64(d.SndMSS)
+		s.PacingRateMbps[i] = bytesPSToMbps(d.PacingRateBps)
+		s.Retransmits[i] = float64(d.TotalRetransmits)
+		s.BytesAcked[i] = float64(d.BytesAcked)
+		s.DeliveredCE[i] = float64(d.DeliveredCE)
+		s.CAState[i] = float64(d.CAState)
+		s.SndQueueBytes[i] = float64(d.WmemQueued)
+		s.RcvQueueBytes[i] = float64(d.RmemAlloc)
+	}
+	return
+}
+
+// DefaultMinRTTWindow is the window for MinRTTSeries.Windowedms when the
+// kernel's isn't known, which is the default for tcp_min_rtt_wlen.
+const DefaultMinRTTWindow = 300 * time.Second
+
+// MinRTTSeries compares the kernel's min RTT, which is a windowed minimum on
+// kernels with tcp_min_rtt_wlen, with the all-time and windowed minimums of
+// the observed RTTs, in time order. It's included in FlowStats when
+// Config.MinRTTSeries is set.
+type MinRTTSeries struct {
+	Window     time.Duration // window for Windowedms (the kernel's, if known)
+	Time       []float64     // time since the first sample, in seconds
+	Kernelms   []float64     // min RTT from the kernel in milliseconds
+	Observedms []float64     // all-time minimum observed RTT in milliseconds
+	Windowedms []float64     // minimum observed RTT in the window up to the sample, in milliseconds
+}
+
+// Columns returns the metrics of the MinRTTSeries, excluding Time.
+func (s *MinRTTSeries) Columns() []Column {
+	return []Column{
+		{"min_rtt_kernel_ms", s.Kernelms},
+		{"min_rtt_observed_ms", s.Observedms},
+		{"min_rtt_windowed_ms", s.Windowedms},
+	}
+}
+
+// minRTTSeries returns the flow's MinRTTSeries.
+func (f *flow) minRTTSeries() (s *MinRTTSeries) {
+	w := f.MinRTTKernelWindow
+	if w == 0 {
+		w = DefaultMinRTTWindow
+	}
+	n := len(f.Data)
+	s = &MinRTTSeries{
+		w,
+		make([]float64, n),
+		make([]float64, n),
+		make([]float64, n),
+		make([]float64, n),
+	}
+	t0 := f.Data[0].TstampNs
+	min := f.Data[0].RTTus
+	var q []int // indexes of samples in the window with increasing RTTs
+	for i := 0; i < n; i++ {
+		d := &f.Data[i]
+		if d.RTTus < min {
+			min = d.RTTus
+		}
+		for len(q) > 0 && f.Data[q[len(q)-1]].RTTus >= d.RTTus {
+			q = q[:len(q)-1]
+		}
+		q = append(q, i)
+		for d.TstampNs-f.Data[q[0]].TstampNs > uint64(w) {
+			q = q[1:]
+		}
+		s.Time[i] = float64(d.TstampNs-t0) / 1e9
+		s.Kernelms[i] = usToMs(d.MinRTTus)
+		s.Observedms[i] = usToMs(min)
+		s.Windowedms[i] = usToMs(f.Data[q[0]].RTTus)
+	}
+	return
+}
+
+// ThroughputSeries contains a flow's send and receive throughput over each
+// interval between samples, from the deltas of bytes acked and bytes received,
+// in time order, so ramp-up and stalls are visible where the mean throughput
+// hides them. It has one less element than the flow has samples, and
+// intervals span any samples de-duplicated by the tracker. It's included in
+// FlowStats when Config.ThroughputSeries is set.
+type ThroughputSeries struct {
+	Time     []float64 // time since the first sample at the end of the interval, in seconds
+	SendMbps []float64 // send throughput (bytes acked) over the interval in Mbps
+	RecvMbps []float64 // receive throughput (bytes received) over the interval in Mbps
+}
+
+// Columns returns the metrics of the ThroughputSeries, excluding Time.
+func (s *ThroughputSeries) Columns() []Column {
+	return []Column{
+		{"send_throughput_mbps", s.SendMbps},
+		{"recv_throughput_mbps", s.RecvMbps},
+	}
+}
+
+// throughputSeries returns the flow's ThroughputSeries.
+func (f *flow) throughputSeries() (s *ThroughputSeries) {
+	n := len(f.Data) - 1
+	s = &ThroughputSeries{
+		make([]float64, n),
+		make([]float64, n),
+		make([]float64, n),
+	}
+	t0 := f.Data[0].TstampNs
+	for i := 0; i < n; i++ {
+		p, d := &f.Data[i], &f.Data[i+1]
+		s.Time[i] = float64(d.TstampNs-t0) / 1e9
+		dt := float64(d.TstampNs - p.TstampNs)
+		if dt <= 0 {
+			continue
+		}
+		if d.BytesAcked > p.BytesAcked {
+			s.SendMbps[i] = float64(d.BytesAcked-p.BytesAcked) * 8 * 1000 / dt
+		}
+		if d.BytesReceived > p.BytesReceived {
+			s.RecvMbps[i] = float64(d.BytesReceived-p.BytesReceived) * 8 * 1000 /
+				dt
+		}
+	}
+	return
+}
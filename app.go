@@ -1,17 +1,38 @@
-package main
+// Package cgmon samples congestion related statistics for TCP flows from the
+// Linux kernel, and analyzes and writes them. It may be embedded in other
+// programs using New and Run, with a Handler to receive the results:
+//
+//	a, err := cgmon.New(cfg)
+//	...
+//	err = a.Run(ctx)
+package cgmon
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"runtime"
+	"sort"
 	"strings"
 	"text/tabwriter"
 	"time"
 
+	"github.com/heistp/cgmon/aggregator"
 	"github.com/heistp/cgmon/analyzer"
+	"github.com/heistp/cgmon/capture"
+	"github.com/heistp/cgmon/clock"
+	"github.com/heistp/cgmon/filter"
 	"github.com/heistp/cgmon/netlink"
+	"github.com/heistp/cgmon/otlp"
+	"github.com/heistp/cgmon/qdisc"
+	"github.com/heistp/cgmon/remotewrite"
+	"github.com/heistp/cgmon/replay"
 	"github.com/heistp/cgmon/sampler"
+	"github.com/heistp/cgmon/sandbox"
+	"github.com/heistp/cgmon/summary"
+	"github.com/heistp/cgmon/synthetic"
 	"github.com/heistp/cgmon/tracker"
 	"github.com/heistp/cgmon/writer"
 )
@@ -25,89 +46,422 @@ import (
 // - Should I rename Src/Dst to Local/Remote? Src/Dst used in tcphdr. Can
 //   I tell if it's a client or server socket from tcphdr or tcp_info?
 
+// A Handler receives the stats for each group of ended flows. It is called
+// from the write stage of the pipeline, so it should not block for long.
+// Returning an error stops the App.
+type Handler func([]*analyzer.FlowStats) error
+
+// An EventHandler receives the tracker's capacity events and connect attempts
+// (see tracker.CapacityEvent and tracker.ConnectAttempts), after each group of
+// ended flows that has any. It's called like Handler.
+type EventHandler func([]interface{}) error
+
+// A Config contains the App configuration.
 type Config struct {
-	Netlink     netlink.Config  // netlink config
-	Tracker     tracker.Config  // tracker config
-	Analyzer    analyzer.Config // analyzer config
-	Writer      writer.Config   // writer config
-	Serial      bool            // if true, execute pipe in one goroutine
-	HTTPAddr    string          // listen address of metrics server
-	Interval    time.Duration   // time between sample calls
-	Duration    time.Duration   // limit on run time
-	MaxErrors   int             // maximum consecutive errors
-	ErrorDelay  time.Duration   // initial exponential backoff time between errors
-	StopTimeout time.Duration   // time to wait on stop request
+	Netlink     netlink.Config     // netlink config
+	Replay      replay.Config      // replay config, used instead of netlink if Path is set
+	Synthetic   synthetic.Config   // synthetic sampler config, used instead of netlink if Flows > 0
+	Tracker     tracker.Config     // tracker config
+	Analyzer    analyzer.Config    // analyzer config
+	Compare     *analyzer.Config   // if not nil, a second analyzer config run on the same flows, with its stats also written, for comparing configurations
+	Writer      writer.Config      // writer config
+	Sandbox     sandbox.Config     // sandbox config
+	Aggregator  aggregator.Config  // aggregator config
+	AggWriter   writer.Config      // writer config for aggregate records
+	Summary     summary.Config     // host summary config
+	Budget      BudgetConfig       // pipeline stage latency budgets
+	Qdisc       qdisc.Config       // qdisc stats collector config
+	QdiscWriter writer.Config      // writer config for qdisc records
+	Filter      filter.Config      // destination allow-list filter config
+	RemoteWrite remotewrite.Config // Prometheus remote_write config
+	OTLP        otlp.Config        // OpenTelemetry flow span exporter config
+	Capture     capture.Config     // packet capture config, enabled if Dir is set
+	Serial      bool               // if true, execute pipe in one goroutine
+	HTTPAddr    string             // listen address of metrics server
+	RecentFlows int                // if > 0 with HTTPAddr, number of most recently ended flows' stats kept for /api/flows/recent
+	Interval    time.Duration      // time between sample calls
+	Groups      []SampleGroup      // if not empty, sample groups used instead of Netlink and Interval
+	Destroyed   bool               // if true, end flows on sock_diag destroy broadcasts (requires CAP_NET_ADMIN)
+	ClockJump   time.Duration      // change in the wall - sample timestamp clock offset between dumps above which tracked flows are marked with ClockJump (0 disables)
+	Clock       *clock.Manual      // if not nil, sample without waiting, advancing this clock to each sample time instead, for reproducible runs of the replay and synthetic samplers (requires Serial)
+	Duration    time.Duration      // limit on run time
+	MaxErrors   int                // maximum consecutive errors
+	ErrorDelay  time.Duration      // initial exponential backoff time between errors
+	StopTimeout time.Duration      // time to wait on stop request
+	Recover     bool               // if true, recover from panics in pipeline stages by logging them and dropping the batch, instead of exiting
+	Handler     Handler            // if not nil, called with the stats for ended flows
+	Events      EventHandler       // if not nil, called with capacity events and connect attempts
+	NoWriter    bool               // if true, the writer is not used (e.g. when a Handler is set)
+	Experiment  string             // if set, experiment ID for markers and flow tags (enables Mark)
+	Phase       string             // if set with Experiment, phase to start on Run
 }
 
+// An App runs the cgmon pipeline.
 type App struct {
 	*Config
-	sampler  sampler.Sampler
+	groups   []*sampleGroup
+	destroy  *netlink.DestroyListener
 	tracker  *tracker.Tracker
 	analyzer *analyzer.Analyzer
+	compare  *analyzer.Analyzer
 	writer   *writer.Writer
+	agg      *aggregator.Aggregator
+	aggw     *writer.Writer
+	summ     *summary.Summarizer
+	qdisc    *qdisc.Collector
+	qdiscw   *writer.Writer
+	features netlink.Features
+	exp      *experiment
+	filter   *filter.DstFilter
+	ifilter  *filter.IfaceFilter
+	dfilter  *filter.DSCPFilter
+	rw       *remotewrite.Exporter
+	spans    *otlp.Exporter
+	capture  *capture.Capturer
+	budgets  *budgets
+	recent   *recentFlows
+	panics   PanicMetrics
 	errs     int
 	dur      <-chan time.Time
 	stop     chan bool
 	done     chan bool
-	rc       chan sampler.Result
-	sc       chan []sampler.Sample
+	dc       chan []sampler.Sample
+	dstop    chan bool
+	ddone    chan bool
+	rc       chan groupResult
+	sc       chan groupSamples
 	fc       chan []*tracker.Flow
-	fsc      chan []*analyzer.FlowStats
+	fsc      chan analyzedFlows
 	errc     chan error
 }
 
-func NewApp(cfg *Config) (a *App, err error) {
-	var w *writer.Writer
-	if w, err = writer.Open(cfg.Writer); err != nil {
+// New returns a new App, opening any configured output.
+func New(cfg *Config) (a *App, err error) {
+	if cfg.Clock != nil && !cfg.Serial {
+		err = fmt.Errorf("a manual clock requires serial execution")
+		return
+	}
+
+	var gs []*sampleGroup
+	if gs, err = openSampleGroups(cfg); err != nil {
 		return
 	}
+	defer func() {
+		if err != nil {
+			closeSampleGroups(gs)
+		}
+	}()
+
+	var dl *netlink.DestroyListener
+	if cfg.Destroyed {
+		if dl, err = netlink.NewDestroyListener(cfg.Netlink); err != nil {
+			err = fmt.Errorf("unable to listen for destroyed sockets (%s)", err)
+			return
+		}
+		defer func() {
+			if err != nil {
+				dl.Close()
+			}
+		}()
+	}
+
+	// probe kernel features, so stats depending on missing tcp_info fields
+	// are marked, and the kernel's min RTT window is recorded (features don't
+	// apply to replayed or synthetic samples)
+	var feat netlink.Features
+	var e error
+	if cfg.Replay.Path == "" && cfg.Synthetic.Flows == 0 {
+		if feat, e = netlink.ProbeFeatures(); e != nil {
+			log.Printf("unable to probe kernel features (%s)", e)
+		} else if cfg.Netlink.Log || len(feat.Missing()) > 0 {
+			log.Printf("%s", feat)
+		}
+	}
+	acfg := cfg.Analyzer
+	if acfg.MissingFields == nil {
+		acfg.MissingFields = feat.Missing()
+	}
+	if acfg.MinRTTKernelWindow == 0 {
+		acfg.MinRTTKernelWindow = feat.MinRTTWindow
+	}
+	tcfg := cfg.Tracker
+	if cfg.Clock != nil {
+		tcfg.Clock = cfg.Clock
+		acfg.Clock = cfg.Clock
+	}
+	var capt *capture.Capturer
+	if cfg.Capture.Dir != "" {
+		if capt, err = capture.New(cfg.Capture); err != nil {
+			err = fmt.Errorf("unable to start packet capture (%s)", err)
+			return
+		}
+		defer func() {
+			if err != nil {
+				capt.Close()
+			}
+		}()
+		tcfg.Observers = append(tcfg.Observers, capt)
+	}
+	var cmp *analyzer.Analyzer
+	if cfg.Compare != nil {
+		ccfg := *cfg.Compare
+		ccfg.MissingFields = acfg.MissingFields
+		ccfg.MinRTTKernelWindow = acfg.MinRTTKernelWindow
+		ccfg.Clock = acfg.Clock
+		cmp = analyzer.NewAnalyzer(ccfg)
+	}
+
+	var w *writer.Writer
+	if !cfg.NoWriter {
+		if w, err = writer.Open(cfg.Writer); err != nil {
+			return
+		}
+		defer func() {
+			if err != nil {
+				w.Close()
+			}
+		}()
+	}
+
+	var agg *aggregator.Aggregator
+	var aggw *writer.Writer
+	if cfg.Aggregator.Interval > 0 {
+		agg = aggregator.NewAggregator(cfg.Aggregator)
+		if aggw, err = writer.Open(cfg.AggWriter); err != nil {
+			return
+		}
+		defer func() {
+			if err != nil {
+				aggw.Close()
+			}
+		}()
+	}
+
+	var qc *qdisc.Collector
+	var qw *writer.Writer
+	if len(cfg.Qdisc.Interfaces) > 0 {
+		if qc, err = qdisc.NewCollector(cfg.Qdisc); err != nil {
+			return
+		}
+		defer func() {
+			if err != nil {
+				qc.Close()
+			}
+		}()
+		if qw, err = writer.Open(cfg.QdiscWriter); err != nil {
+			return
+		}
+		defer func() {
+			if err != nil {
+				qw.Close()
+			}
+		}()
+	}
+
+	var summ *summary.Summarizer
+	if cfg.Summary.Enabled {
+		var iface func([16]byte) string
+		if qc != nil {
+			iface = qc.Interface
+		} else if cfg.Summary.Fairness == summary.FairnessInterface {
+			log.Printf("fairness by interface requires qdisc collection, disabled")
+		}
+		summ = summary.NewSummarizer(cfg.Summary, iface)
+	}
+
+	var exp *experiment
+	if cfg.Experiment != "" {
+		exp = &experiment{id: cfg.Experiment}
+	}
+
+	var flt *filter.DstFilter
+	if cfg.Filter.DstFile != "" {
+		if flt, err = filter.NewDstFilter(cfg.Filter); err != nil {
+			err = fmt.Errorf("unable to load destination filter (%s)", err)
+			return
+		}
+		defer func() {
+			if err != nil {
+				flt.Close()
+			}
+		}()
+	}
+
+	var iflt *filter.IfaceFilter
+	if len(cfg.Filter.Interfaces) > 0 {
+		if iflt, err = filter.NewIfaceFilter(cfg.Filter); err != nil {
+			err = fmt.Errorf("unable to start interface filter (%s)", err)
+			return
+		}
+		defer func() {
+			if err != nil {
+				iflt.Close()
+			}
+		}()
+	}
+
+	var dflt *filter.DSCPFilter
+	if len(cfg.Filter.DSCPs) > 0 {
+		dflt = filter.NewDSCPFilter(cfg.Filter)
+	}
+
+	var rw *remotewrite.Exporter
+	if cfg.RemoteWrite.URL != "" {
+		if rw, err = remotewrite.NewExporter(cfg.RemoteWrite); err != nil {
+			err = fmt.Errorf("unable to start remote_write (%s)", err)
+			return
+		}
+		defer func() {
+			if err != nil {
+				rw.Close()
+			}
+		}()
+	}
+
+	var spans *otlp.Exporter
+	if cfg.OTLP.URL != "" {
+		if spans, err = otlp.NewExporter(cfg.OTLP); err != nil {
+			err = fmt.Errorf("unable to start OTLP exporter (%s)", err)
+			return
+		}
+	}
+
+	var recent *recentFlows
+	if cfg.HTTPAddr != "" && cfg.RecentFlows > 0 {
+		recent = newRecentFlows(cfg.RecentFlows)
+	}
 
 	a = &App{cfg,
-		netlink.NewSampler(cfg.Netlink),
-		tracker.NewTracker(cfg.Tracker),
-		analyzer.NewAnalyzer(cfg.Analyzer),
+		gs,
+		dl,
+		tracker.NewTracker(tcfg),
+		analyzer.NewAnalyzer(acfg),
+		cmp,
 		w,
+		agg,
+		aggw,
+		summ,
+		qc,
+		qw,
+		feat,
+		exp,
+		flt,
+		iflt,
+		dflt,
+		rw,
+		spans,
+		capt,
+		newBudgets(&cfg.Budget, minInterval(gs)),
+		recent,
+		PanicMetrics{},
 		0,
 		make(<-chan time.Time),
 		make(chan bool),
 		make(chan bool),
-		make(chan sampler.Result, 128),
-		make(chan []sampler.Sample, 256),
+		make(chan []sampler.Sample, 128),
+		make(chan bool),
+		make(chan bool),
+		make(chan groupResult, 128),
+		make(chan groupSamples, 256),
 		make(chan []*tracker.Flow, 256),
-		make(chan []*analyzer.FlowStats, 1024),
+		make(chan analyzedFlows, 1024),
 		make(chan error, 1),
 	}
 
 	return
 }
 
-func (a *App) Run() (err error) {
+// Run runs the pipeline until the context is done, Stop is called, the
+// configured Duration elapses, or an error occurs.
+func (a *App) Run(ctx context.Context) (err error) {
 	defer close(a.done)
 	defer func() {
+		if a.writer == nil {
+			return
+		}
 		if e := a.writer.Close(); e != nil {
 			log.Printf("error closing writer (%s)", e)
 		}
 	}()
 	defer func() {
-		if c, ok := a.sampler.(sampler.Closer); ok {
-			if e := c.Close(); e != nil {
-				log.Printf("error closing sampler (%s)", e)
-			}
+		if a.exp == nil {
+			return
+		}
+		if e := a.Mark(""); e != nil {
+			log.Printf("error writing experiment stop marker (%s)", e)
+		}
+	}()
+	defer func() {
+		if a.aggw == nil {
+			return
+		}
+		if e := a.aggw.WriteValues(recordValues(a.agg.Flush(a.now()))...); e != nil {
+			log.Printf("error writing final aggregate records (%s)", e)
+		}
+		if e := a.aggw.Close(); e != nil {
+			log.Printf("error closing aggregate writer (%s)", e)
 		}
 	}()
+	defer func() {
+		if a.qdisc == nil {
+			return
+		}
+		a.qdisc.Close()
+		if e := a.qdiscw.Close(); e != nil {
+			log.Printf("error closing qdisc writer (%s)", e)
+		}
+	}()
+	defer func() {
+		if a.filter != nil {
+			a.filter.Close()
+		}
+		if a.ifilter != nil {
+			a.ifilter.Close()
+		}
+	}()
+	defer func() {
+		if a.rw != nil {
+			a.rw.Close()
+		}
+	}()
+	defer func() {
+		if a.spans != nil {
+			a.spans.Close()
+		}
+	}()
+	defer func() {
+		if a.capture != nil {
+			a.capture.Close()
+		}
+	}()
+	defer closeSampleGroups(a.groups)
+	if a.destroy != nil {
+		go a.listenDestroyed()
+		defer func() {
+			close(a.dstop)
+			<-a.ddone
+		}()
+	}
 
 	if a.HTTPAddr != "" {
 		go a.httpServer()
 	}
 
+	if a.exp != nil && a.Phase != "" {
+		if err = a.Mark(a.Phase); err != nil {
+			return
+		}
+	}
+
 	if !a.Serial {
 		go a.convert()
-		go a.track()
+		go a.trackAll()
 		go a.analyze()
 		go a.write()
 	}
 
-	if a.Duration > 0 {
+	start := a.now()
+	if a.Duration > 0 && a.Clock == nil {
 		a.dur = time.After(a.Duration)
 	}
 
@@ -118,38 +472,67 @@ Outer:
 			err = fmt.Errorf("aborted after %d consecutive errors", a.errs)
 			break
 		} else if a.errs > 0 {
-			if stopped, err = a.waitOnError(); stopped || err != nil {
+			if stopped, err = a.waitOnError(ctx); stopped || err != nil {
 				break
 			}
 		}
 
-		tck := time.NewTicker(a.Interval)
+		now := a.now()
+		for _, g := range a.groups {
+			g.next = now.Add(g.interval)
+		}
+		tmr := time.NewTimer(a.until(nextGroup(a.groups).next))
 		for !stopped {
-			if stopped, err = a.wait(tck.C); stopped || err != nil {
+			var ds []sampler.Sample
+			if stopped, ds, err = a.waitSample(ctx, tmr.C); stopped ||
+				err != nil {
 				break
 			}
+			if ds != nil {
+				if err = a.process(groupResult{destroyedResult(ds), nil}); err != nil {
+					break Outer
+				}
+				continue
+			}
 
+			g := nextGroup(a.groups)
+			if a.Clock != nil {
+				if a.Duration > 0 && g.next.Sub(start) > a.Duration {
+					log.Printf("stopping after duration %s", a.Duration)
+					break Outer
+				}
+				a.Clock.Set(g.next)
+			}
 			var r sampler.Result
-			if r, err = a.sampler.Sample(); err != nil {
+			t0 := time.Now()
+			if !a.guard(stageSample, func() {
+				r, err = g.sampler.Sample()
+			}) {
+				r, err = nil, errPanic
+			}
+			if err != nil {
 				a.errs++
-				log.Printf("error[%d] getting sample (%s)", a.errs, err)
+				log.Printf("error[%d] getting sample%s (%s)", a.errs, g.label(),
+					err)
 				break
 			}
+			a.budgets.since(stageSample, t0)
 			a.errs = 0
+			g.schedule(a.now())
+
+			a.maybeAdapt()
 
 			if r == nil {
 				log.Printf("stopping due to nil sampler result")
 				break Outer
 			}
 
-			if a.Serial {
-				if err = a.processSerial(r); err != nil {
-					break Outer
-				}
-			} else {
-				a.rc <- r
+			if err = a.process(groupResult{r, g}); err != nil {
+				break Outer
 			}
+			tmr.Reset(a.until(nextGroup(a.groups).next))
 		}
+		tmr.Stop()
 	}
 
 	if !a.Serial {
@@ -166,27 +549,115 @@ Outer:
 	return
 }
 
-func (a *App) netlinkSampler() (s *netlink.Sampler) {
-	var ok bool
-	if s, ok = a.sampler.(*netlink.Sampler); !ok {
-		panic("sampler isn't netlink")
+// now returns the current time from the Clock, if set, or the wall clock.
+func (a *App) now() time.Time {
+	if a.Clock != nil {
+		return a.Clock.Now()
 	}
-	return
+	return time.Now()
+}
+
+// until returns the time to wait until t, which is 0 with a Clock, as the
+// Clock is advanced to t instead.
+func (a *App) until(t time.Time) time.Duration {
+	if a.Clock != nil {
+		return 0
+	}
+	return time.Until(t)
 }
 
+// maybeAdapt raises the sample interval of each group if a latency budget was
+// exceeded and adaptation is enabled. New intervals take effect after each
+// group's next sample.
+func (a *App) maybeAdapt() {
+	select {
+	case <-a.budgets.adapt:
+	default:
+		return
+	}
+	var raised bool
+	for _, g := range a.groups {
+		iv, ok := a.budgets.nextInterval(g.interval)
+		if !ok {
+			continue
+		}
+		log.Printf("raising sample interval%s from %s to %s", g.label(),
+			g.interval, iv)
+		g.interval = iv
+		raised = true
+	}
+	if raised {
+		a.budgets.metrics.recordAdaptation(minInterval(a.groups))
+	}
+}
+
+// netlinkMetricser is the interface that wraps the Metrics method of the
+// netlink samplers.
+type netlinkMetricser interface {
+	Metrics() netlink.Metrics
+}
+
+// DumpMetrics returns the App's internal metrics as text.
 func (a *App) DumpMetrics() (s string) {
 	sb := &strings.Builder{}
 	var ms runtime.MemStats
 	runtime.ReadMemStats(&ms)
 
-	nm := a.netlinkSampler().Metrics()
+	nms := make([]netlink.Metrics, len(a.groups))
+	for i, g := range a.groups {
+		nms[i] = g.netlinkMetrics()
+	}
 	tm := a.tracker.Metrics()
 	am := a.analyzer.Metrics()
-	wm := a.writer.Metrics()
+	var wm writer.Metrics
+	if a.writer != nil {
+		wm = a.writer.Metrics()
+	}
 
 	w := tabwriter.NewWriter(sb, 0, 0, 2, ' ', 0)
 
-	fmt.Fprintf(w, "Tracking %d flows\n\n", tm.TrackedFlows)
+	fmt.Fprintf(w, "Tracking %d flows (approx. %d KiB)\n\n", tm.TrackedFlows,
+		tm.Memory/1024)
+
+	if tm.ShedFlows > 0 {
+		fmt.Fprintf(w, "Shed flows (over memory budget): %d\n\n", tm.ShedFlows)
+	}
+	if a.Tracker.Rules != nil {
+		fmt.Fprintf(w, "Tracker rules: %d rules, %d flows tagged, %d flows dropped\n\n",
+			a.Tracker.Rules.Len(), tm.TaggedFlows, tm.DroppedFlows)
+	}
+	if len(a.Tracker.Targets) > 0 {
+		fmt.Fprintf(w, "Tracker targets: %d targets, %d flows targeted\n\n",
+			len(a.Tracker.Targets), tm.TargetedFlows)
+	}
+	if a.Tracker.Cgroups {
+		cm := &tm.CgroupCache
+		fmt.Fprintf(w, "Cgroup cache: %d paths, %d negative, %d hits, %d negative hits, %d misses, %d scans\n\n",
+			cm.Entries, cm.Negative, cm.Hits, cm.NegativeHits, cm.Misses, cm.Scans)
+	}
+
+	fmt.Fprintf(w, "Established connections: %d%s\n\n", tm.Established,
+		portCounts(tm.EstablishedPorts, 10))
+
+	if tm.ShortFlows > 0 {
+		fmt.Fprintf(w, "Short flows (below min samples or duration): %d (%d bytes acked)\n\n",
+			tm.ShortFlows, tm.ShortBytesAcked)
+	}
+
+	if tm.CounterResets > 0 {
+		fmt.Fprintf(w, "Counter resets (flows split due to socket reuse): %d\n\n",
+			tm.CounterResets)
+	}
+
+	if tm.IdleFlows > 0 {
+		fmt.Fprintf(w, "Idle flows (ended by idle timeout): %d\n\n",
+			tm.IdleFlows)
+	}
+
+	if tm.Segments > 0 {
+		fmt.Fprintf(w, "Flow segments (cut by segment interval): %d\n\n",
+			tm.Segments)
+	}
 
 	fmt.Fprintf(w, "Churn rate (flows/sec):\n")
 	fmt.Fprintf(w, "-----------------------\n\n")
@@ -194,26 +665,192 @@ func (a *App) DumpMetrics() (s string) {
 	fmt.Fprintf(w, "Mean\t%.2f\n", tm.ChurnRate())
 	fmt.Fprintf(w, "\n")
 
-	nt := nm.SampleTimes
-	ct := nm.ConvertTimes
 	tt := tm.TrackTimes
 	at := am.AnalyzeTimes
 	wt := wm.WriteTimes
 	fmt.Fprintf(w, "Pipeline Stage Times (in μs):\n")
 	fmt.Fprintf(w, "-----------------------------\n\n")
 	fmt.Fprintf(w, "Stage\tCalls\tMin\tMean\tMax\tStddev\n")
-	fmt.Fprintf(w, "Netlink\t%d\t%d\t%d\t%d\t%d\n",
-		nt.N, us(nt.Min), us(nt.Mean()), us(nt.Max), us(nt.Stddev()))
-	fmt.Fprintf(w, "Conversion\t%d\t%d\t%d\t%d\t%d\n",
-		ct.N, us(ct.Min), us(ct.Mean()), us(ct.Max), us(ct.Stddev()))
+	for i, nm := range nms {
+		var gn string
+		if len(a.groups) > 1 {
+			gn = " (" + a.groups[i].Name + ")"
+		}
+		nt := nm.SampleTimes
+		ct := nm.ConvertTimes
+		fmt.Fprintf(w, "Netlink%s\t%d\t%d\t%d\t%d\t%d\n", gn,
+			nt.N, us(nt.Min), us(nt.Mean()), us(nt.Max), us(nt.Stddev()))
+		for j, st := range nm.ShardSampleTimes {
+			fmt.Fprintf(w, "Netlink shard %d%s\t%d\t%d\t%d\t%d\t%d\n", j, gn,
+				st.N, us(st.Min), us(st.Mean()), us(st.Max), us(st.Stddev()))
+		}
+		fmt.Fprintf(w, "Conversion%s\t%d\t%d\t%d\t%d\t%d\n", gn,
+			ct.N, us(ct.Min), us(ct.Mean()), us(ct.Max), us(ct.Stddev()))
+	}
 	fmt.Fprintf(w, "Tracker\t%d\t%d\t%d\t%d\t%d\n",
 		tt.N, us(tt.Min), us(tt.Mean()), us(tt.Max), us(tt.Stddev()))
+	for i, st := range tm.ShardTimes {
+		fmt.Fprintf(w, "Tracker shard %d\t%d\t%d\t%d\t%d\t%d\n", i,
+			st.N, us(st.Min), us(st.Mean()), us(st.Max), us(st.Stddev()))
+	}
 	fmt.Fprintf(w, "Analyzer\t%d\t%d\t%d\t%d\t%d\n",
 		at.N, us(at.Min), us(at.Mean()), us(at.Max), us(at.Stddev()))
+	if a.compare != nil {
+		ct := a.compare.Metrics().AnalyzeTimes
+		fmt.Fprintf(w, "Analyzer (%s)\t%d\t%d\t%d\t%d\t%d\n", a.compare.Name,
+			ct.N, us(ct.Min), us(ct.Mean()), us(ct.Max), us(ct.Stddev()))
+	}
 	fmt.Fprintf(w, "Writer\t%d\t%d\t%d\t%d\t%d\n",
 		wt.N, us(wt.Min), us(wt.Mean()), us(wt.Max), us(wt.Stddev()))
 	fmt.Fprintf(w, "\n")
 
+	for i, nm := range nms {
+		if nm.Overruns == 0 {
+			continue
+		}
+		var gn string
+		if len(a.groups) > 1 {
+			gn = " (" + a.groups[i].Name + ")"
+		}
+		fmt.Fprintf(w, "Netlink receive buffer overruns%s: %d (consider raising -netlink-receive-bufsize)\n\n",
+			gn, nm.Overruns)
+	}
+
+	if len(a.groups) > 1 {
+		fmt.Fprintf(w, "Sample Groups:\n")
+		fmt.Fprintf(w, "--------------\n\n")
+		fmt.Fprintf(w, "Group\tInterval\tSamples\tTracked flows\n")
+		for i, g := range a.groups {
+			var n int
+			if i < len(tm.GroupFlows) {
+				n = tm.GroupFlows[i]
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", g.Name, g.interval,
+				nms[i].SampleTimes.N, n)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+
+	if a.destroy != nil {
+		dm := a.destroy.Metrics()
+		fmt.Fprintf(w, "Destroyed sockets: %d received, %d flows ended, %d buffer overflows\n\n",
+			dm.Received, tm.DestroyedFlows, dm.Overflows)
+	}
+
+	if am.PMTUChanged > 0 {
+		fmt.Fprintf(w, "Flows with path MTU changes: %d\n\n", am.PMTUChanged)
+	}
+	if am.Truncated > 0 {
+		fmt.Fprintf(w, "Truncated flow analyses: %d\n\n", am.Truncated)
+	}
+
+	if a.filter != nil {
+		fm := a.filter.Metrics()
+		fmt.Fprintf(w, "Destination filter: %d entries, %d reloads, %d reload errors, %d samples filtered\n\n",
+			fm.Entries, fm.Reloads, fm.Errors, fm.Filtered)
+	}
+
+	if a.ifilter != nil {
+		fm := a.ifilter.Metrics()
+		fmt.Fprintf(w, "Interface filter: %d interfaces, %d samples filtered\n\n",
+			fm.Entries, fm.Filtered)
+	}
+
+	if a.dfilter != nil {
+		fm := a.dfilter.Metrics()
+		fmt.Fprintf(w, "DSCP filter: %d classes, %d samples filtered\n\n",
+			fm.Entries, fm.Filtered)
+	}
+
+	if a.rw != nil {
+		rm := a.rw.Metrics()
+		fmt.Fprintf(w, "Remote write: %d pushes (%d series last), %d errors\n\n",
+			rm.Pushes, rm.Series, rm.Errors)
+	}
+
+	if a.spans != nil {
+		om := a.spans.Metrics()
+		fmt.Fprintf(w, "OTLP spans: %d exported, %d dropped, %d export errors\n\n",
+			om.Exported, om.Dropped, om.Errors)
+	}
+
+	if a.capture != nil {
+		cm := a.capture.Metrics()
+		fmt.Fprintf(w, "Packet captures: %d started (%d packets, %d bytes), %d skipped, %d errors\n\n",
+			cm.Captures, cm.Packets, cm.Bytes, cm.Skipped, cm.Errors)
+	}
+
+	if a.summ != nil {
+		if sum := a.summ.Last(); sum != nil {
+			fmt.Fprintf(w, "Host Summary (at %s):\n", sum.Time.Format(time.RFC3339))
+			fmt.Fprintf(w, "-------------------------------------------\n\n")
+			fmt.Fprintf(w, "Window\tEnded\tMbps\tQueue delay (ms)\tRetrans/sec\n")
+			for _, sw := range []struct {
+				name string
+				w    summary.Window
+			}{{"1m", sum.Window1m}, {"5m", sum.Window5m}} {
+				fmt.Fprintf(w, "%s\t%d\t%.2f\t%.2f\t%.2f\n", sw.name,
+					sw.w.FlowsEnded, sw.w.ThroughputMbps,
+					sw.w.MeanQueueDelayms, sw.w.RetransmitsPerSec)
+			}
+			fmt.Fprintf(w, "\n")
+		}
+	}
+
+	if wm.Batches > 0 {
+		fmt.Fprintf(w, "Writer batches: %d (mean %.1f records)\n\n",
+			wm.Batches, wm.MeanBatchSize())
+	}
+
+	if wm.VerifiedFiles > 0 || wm.VerifyFailures > 0 {
+		fmt.Fprintf(w, "Writer verification: %d files verified, %d failed\n\n",
+			wm.VerifiedFiles, wm.VerifyFailures)
+	}
+
+	if wm.WriteErrors > 0 || wm.Degraded {
+		fmt.Fprintf(w, "Writer errors: %d, retries: %d, dropped records: %d, degraded: %t\n\n",
+			wm.WriteErrors, wm.WriteRetries, wm.DroppedRecords, wm.Degraded)
+	}
+
+	if pm := a.panicMetrics(); pm.total() > 0 {
+		fmt.Fprintf(w, "Recovered Panics:\n")
+		fmt.Fprintf(w, "-----------------\n\n")
+		fmt.Fprintf(w, "Stage\tPanics\n")
+		for i := stage(0); i < numStages; i++ {
+			fmt.Fprintf(w, "%s\t%d\n", i, pm.Recovered[i])
+		}
+		fmt.Fprintf(w, "\n")
+	}
+
+	if bm := a.budgets.Metrics(); a.budgets.enabled() {
+		fmt.Fprintf(w, "Latency Budgets:\n")
+		fmt.Fprintf(w, "----------------\n\n")
+		fmt.Fprintf(w, "Stage\tBudget\tOverruns\tExceeded\n")
+		for i := stage(0); i < numStages; i++ {
+			if l := a.budgets.limit(i); l > 0 {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", i, l, bm.Overruns[i],
+					bm.Exceeded[i])
+			}
+		}
+		if a.Budget.Adapt {
+			fmt.Fprintf(w, "\nSample interval\t%s (raised %d times)\n",
+				bm.Interval, bm.Adaptations)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+
+	if c := nms[0].Clock; c.Anchors > 0 {
+		fmt.Fprintf(w, "Clock (wall - monotonic offset):\n")
+		fmt.Fprintf(w, "--------------------------------\n\n")
+		fmt.Fprintf(w, "Anchors\t%d\n", c.Anchors)
+		fmt.Fprintf(w, "Drift since start\t%s\n", c.Drift())
+		fmt.Fprintf(w, "Max step\t%s\n", c.MaxStep)
+		fmt.Fprintf(w, "Jumps\t%d\n", tm.ClockJumps)
+		fmt.Fprintf(w, "\n")
+	}
+
+	fmt.Fprintf(w, "Kernel features: %s\n\n", a.features)
+
 	fmt.Fprintf(w, "Memory Stats:\n")
 	fmt.Fprintf(w, "-------------\n\n")
 	fmt.Fprintf(w, "Heap alloc objects\t%d\n", ms.HeapAlloc)
@@ -228,6 +865,7 @@ func (a *App) DumpMetrics() (s string) {
 	return
 }
 
+// Stop stops the App and waits up to StopTimeout for it to complete.
 func (a *App) Stop() (err error) {
 	log.Printf("stopping (waiting up to %s for stop)", a.StopTimeout)
 	close(a.stop)
@@ -239,75 +877,470 @@ func (a *App) Stop() (err error) {
 	return
 }
 
-func (a *App) processSerial(r sampler.Result) (err error) {
-	s := r.Samples()
+// process processes a Result serially, or sends it to the pipeline.
+func (a *App) process(r groupResult) (err error) {
+	if a.Serial {
+		err = a.processSerial(r)
+		return
+	}
+	a.rc <- r
+	return
+}
 
-	if rr, ok := a.sampler.(sampler.ResultRecycler); ok {
-		rr.RecycleResult(r)
+func (a *App) processSerial(r groupResult) (err error) {
+	var gs groupSamples
+	if !a.guard(stageConvert, func() {
+		gs = a.convertResult(r)
+	}) {
+		return
 	}
 
-	ef := a.tracker.Track(s)
+	var ef []*tracker.Flow
+	if !a.guard(stageTrack, func() {
+		ef = a.trackSamples(gs)
+	}) {
+		return
+	}
 
-	if sr, ok := a.sampler.(sampler.SamplesRecycler); ok {
-		sr.RecycleSamples(s)
+	var af analyzedFlows
+	if !a.guard(stageAnalyze, func() {
+		af = a.analyzeStage(ef)
+	}) {
+		return
 	}
 
-	fs := a.analyzer.Analyze(ef)
+	a.guard(stageWrite, func() {
+		err = a.writeStage(af)
+	})
 
-	err = a.writer.Write(fs)
+	return
+}
 
+// samples returns the samples from a sampler Result, filtered by the
+// destination, interface and DSCP filters, if enabled.
+func (a *App) samples(r sampler.Result) (s []sampler.Sample) {
+	s = r.Samples()
+	if a.filter != nil {
+		s = a.filter.Filter(s)
+	}
+	if a.ifilter != nil {
+		s = a.ifilter.Filter(s)
+	}
+	if a.dfilter != nil {
+		s = a.dfilter.Filter(s)
+	}
 	return
 }
 
 func (a *App) convert() {
 	defer close(a.sc)
 	for r := range a.rc {
-		a.sc <- r.Samples()
-
-		if rr, ok := a.sampler.(sampler.ResultRecycler); ok {
-			rr.RecycleResult(r)
+		var gs groupSamples
+		if a.guard(stageConvert, func() {
+			gs = a.convertResult(r)
+		}) {
+			a.sc <- gs
 		}
 	}
 }
 
-func (a *App) track() {
+// convertResult returns the samples from a sampler Result, then recycles it.
+func (a *App) convertResult(r groupResult) (gs groupSamples) {
+	t0 := time.Now()
+	gs = groupSamples{a.samples(r), r.group, a.clockJumped(r)}
+	a.budgets.since(stageConvert, t0)
+	r.recycleResult()
+	return
+}
+
+func (a *App) trackAll() {
 	defer close(a.fc)
 	for s := range a.sc {
-		a.fc <- a.tracker.Track(s)
+		var f []*tracker.Flow
+		if a.guard(stageTrack, func() {
+			f = a.trackSamples(s)
+		}) {
+			a.fc <- f
+		}
+	}
+}
 
-		if sr, ok := a.sampler.(sampler.SamplesRecycler); ok {
-			sr.RecycleSamples(s)
+// trackSamples tracks samples, and returns the ended flows.
+func (a *App) trackSamples(s groupSamples) (ended []*tracker.Flow) {
+	t0 := time.Now()
+	ended = a.track(s)
+	a.budgets.since(stageTrack, t0)
+	return
+}
+
+// clockJumped returns true if the offset between the wall clock and the
+// sample timestamp clock changed by more than ClockJump since the group's last
+// result, as after a suspend with monotonic timestamps, or a wall clock step.
+func (a *App) clockJumped(r groupResult) (jumped bool) {
+	an, ok := r.Result.(sampler.Anchorer)
+	if !ok || r.group == nil || a.ClockJump == 0 {
+		return
+	}
+	g := r.group
+	m, w := an.Anchor()
+	o := time.Duration(w.UnixNano() - int64(m))
+	if g.anchored {
+		st := o - g.offset
+		if st < 0 {
+			st = -st
+		}
+		if jumped = st > a.ClockJump; jumped {
+			log.Printf("clock jump of %s detected%s, marking tracked flows",
+				o-g.offset, g.label())
 		}
 	}
+	g.offset, g.anchored = o, true
+	return
+}
+
+// track tracks samples from a group, or ends the flows for samples of
+// destroyed sockets, then recycles the samples. Tracked flows are marked
+// first if the clock jumped.
+func (a *App) track(s groupSamples) (ended []*tracker.Flow) {
+	if s.group == nil {
+		ended = a.tracker.End(s.samples)
+		return
+	}
+	if s.clockJump {
+		a.tracker.MarkClockJump()
+	}
+	ended = a.tracker.TrackGroup(s.samples, s.group.index)
+	if a.Clock != nil {
+		sortFlows(ended)
+	}
+	if sr, ok := s.group.sampler.(sampler.SamplesRecycler); ok {
+		sr.RecycleSamples(s.samples)
+	}
+	return
+}
+
+// sortFlows sorts flows by the timestamp of their first sample, then ID, so
+// the order of ended flows is reproducible.
+func sortFlows(fs []*tracker.Flow) {
+	sort.Slice(fs, func(i, j int) bool {
+		a, b := fs[i], fs[j]
+		if a.Data[0].TstampNs != b.Data[0].TstampNs {
+			return a.Data[0].TstampNs < b.Data[0].TstampNs
+		}
+		if c := bytes.Compare(a.ID.SrcIP[:], b.ID.SrcIP[:]); c != 0 {
+			return c < 0
+		}
+		if a.ID.SrcPort != b.ID.SrcPort {
+			return a.ID.SrcPort < b.ID.SrcPort
+		}
+		if c := bytes.Compare(a.ID.DstIP[:], b.ID.DstIP[:]); c != 0 {
+			return c < 0
+		}
+		return a.ID.DstPort < b.ID.DstPort
+	})
+}
+
+// listenDestroyed receives samples for destroyed sockets and sends them to
+// the run loop, until the App is stopped.
+func (a *App) listenDestroyed() {
+	defer close(a.ddone)
+	defer a.destroy.Close()
+	for {
+		select {
+		case <-a.dstop:
+			return
+		default:
+		}
+		ss, err := a.destroy.Receive()
+		if err != nil {
+			log.Printf("stopping destroy listener due to error (%s)", err)
+			return
+		}
+		if len(ss) == 0 {
+			continue
+		}
+		select {
+		case a.dc <- ss:
+		case <-a.dstop:
+			return
+		}
+	}
+}
+
+// analyzedFlows contains the stats for a group of ended flows, and the stats
+// from the comparison analyzer, if enabled.
+type analyzedFlows struct {
+	stats   []*analyzer.FlowStats
+	compare []*analyzer.FlowStats
 }
 
 func (a *App) analyze() {
 	defer close(a.fsc)
 	for f := range a.fc {
-		a.fsc <- a.analyzer.Analyze(f)
+		var af analyzedFlows
+		if a.guard(stageAnalyze, func() {
+			af = a.analyzeStage(f)
+		}) {
+			a.fsc <- af
+		}
 	}
 }
 
+// analyzeStage analyzes ended flows, and returns their stats.
+func (a *App) analyzeStage(f []*tracker.Flow) (af analyzedFlows) {
+	t0 := time.Now()
+	af = a.analyzeFlows(f)
+	a.budgets.since(stageAnalyze, t0)
+	return
+}
+
+// analyzeFlows analyzes ended flows, and again with the comparison analyzer,
+// if enabled, labelling the stats with their sample group names, and marking
+// the comparison stats as Compared.
+func (a *App) analyzeFlows(f []*tracker.Flow) (af analyzedFlows) {
+	af.stats = a.analyzer.Analyze(f)
+	if a.compare != nil {
+		af.compare = a.compare.Analyze(f)
+		for _, s := range af.compare {
+			s.Compared = true
+		}
+	}
+	for _, fs := range [][]*analyzer.FlowStats{af.stats, af.compare} {
+		for i, s := range fs {
+			if g := f[i].Group; g < len(a.groups) {
+				s.Group = a.groups[g].Name
+			}
+		}
+	}
+	return
+}
+
 func (a *App) write() {
 	defer close(a.errc)
-	for fs := range a.fsc {
-		if err := a.writer.Write(fs); err != nil {
+	for af := range a.fsc {
+		var err error
+		a.guard(stageWrite, func() {
+			err = a.writeStage(af)
+		})
+		if err != nil {
 			a.errc <- err
 			break
 		}
 	}
 }
 
-func (a *App) waitOnError() (stopped bool, err error) {
+// writeStage outputs and reports flow stats.
+func (a *App) writeStage(af analyzedFlows) (err error) {
+	t0 := time.Now()
+	if err = a.output(af); err != nil {
+		return
+	}
+	if err = a.report(af.stats); err != nil {
+		return
+	}
+	a.budgets.since(stageWrite, t0)
+	return
+}
+
+// output writes flow stats, followed by any from the comparison analyzer, to
+// the writer and calls the Handler, if either are enabled. The Handler
+// receives only the stats from the primary analyzer. Capacity events and
+// connect attempts are drained whether or not there's a writer, so they don't
+// accumulate, and passed to the writer and Events handler, if set.
+func (a *App) output(af analyzedFlows) (err error) {
+	fs := af.stats
+	for _, s := range [][]*analyzer.FlowStats{fs, af.compare} {
+		a.tag(s)
+	}
+	ce := a.tracker.DrainCapacityEvents()
+	var ca []*tracker.ConnectAttempts
+	if a.Tracker.Handshakes {
+		ca = a.tracker.DrainConnectAttempts()
+	}
+	if a.writer != nil {
+		if err = a.writer.Write(fs); err != nil {
+			return
+		}
+		if len(af.compare) > 0 {
+			if err = a.writer.Write(af.compare); err != nil {
+				return
+			}
+		}
+		if len(ce) > 0 {
+			if err = a.writer.WriteValues(capacityValues(ce)...); err != nil {
+				return
+			}
+		}
+		if a.Tracker.Handshakes {
+			if err = a.writer.WriteValues(connectValues(ca)...); err != nil {
+				return
+			}
+		}
+	}
+	if a.recent != nil {
+		a.recent.add(fs)
+	}
+	if a.Handler != nil && len(fs) > 0 {
+		if err = a.Handler(fs); err != nil {
+			return
+		}
+	}
+	if a.Events != nil && len(ce)+len(ca) > 0 {
+		err = a.Events(append(capacityValues(ce), connectValues(ca)...))
+	}
+	return
+}
+
+// tag adds the experiment and egress interface to flow stats, if enabled.
+func (a *App) tag(fs []*analyzer.FlowStats) {
+	if a.exp != nil {
+		a.exp.tag(fs)
+	}
+	if a.qdisc != nil {
+		for _, s := range fs {
+			var d [16]byte
+			copy(d[:], s.ID.DstIP.To16())
+			s.Interface = a.qdisc.Interface(d)
+		}
+	}
+}
+
+// report adds flow stats and the tracker's per-destination counts to the
+// aggregator and host summarizer, if enabled.
+func (a *App) report(fs []*analyzer.FlowStats) (err error) {
+	var dc map[[16]byte]*tracker.DestCounts
+	if a.Tracker.CountDests {
+		dc = a.tracker.DrainDestCounts()
+	}
+	if err = a.aggregate(fs, dc); err != nil {
+		return
+	}
+	if a.rw != nil {
+		a.rw.Add(fs)
+		tm := a.tracker.Metrics()
+		a.rw.SetConnections(tm.EstablishedPorts)
+	}
+	if a.spans != nil {
+		a.spans.Add(fs)
+	}
+	if err = a.summarize(fs, dc); err != nil {
+		return
+	}
+	err = a.collectQdiscs()
+	return
+}
+
+// aggregate adds flow stats to the aggregator, if enabled, and writes any
+// aggregate records that are due.
+func (a *App) aggregate(fs []*analyzer.FlowStats,
+	dc map[[16]byte]*tracker.DestCounts) (err error) {
+	if a.agg == nil {
+		return
+	}
+	r := a.agg.Add(fs, dc, a.now())
+	err = a.aggw.WriteValues(recordValues(r)...)
+	return
+}
+
+// summarize adds flow stats to the host summarizer, if enabled, and writes a
+// host summary to the output if one is due.
+func (a *App) summarize(fs []*analyzer.FlowStats,
+	dc map[[16]byte]*tracker.DestCounts) (err error) {
+	if a.summ == nil {
+		return
+	}
+	now := a.now()
+	var tp map[sampler.ID]*tracker.FlowThroughput
+	if a.Tracker.Throughputs && a.summ.Due(now) {
+		tp = a.tracker.DrainThroughputs()
+	}
+	if sum := a.summ.Add(fs, dc, tp, a.tracker.Metrics().TrackedFlows,
+		now); sum != nil && a.writer != nil {
+		err = a.writer.WriteValues(sum)
+	}
+	return
+}
+
+// collectQdiscs writes qdisc stats to the qdisc writer, if enabled and due.
+func (a *App) collectQdiscs() (err error) {
+	if a.qdisc == nil {
+		return
+	}
+	var r []*qdisc.Record
+	if r, err = a.qdisc.Collect(a.now()); err != nil {
+		log.Printf("error collecting qdisc stats (%s)", err)
+		err = nil
+		return
+	}
+	v := make([]interface{}, len(r))
+	for i := range r {
+		v[i] = r[i]
+	}
+	err = a.qdiscw.WriteValues(v...)
+	return
+}
+
+func recordValues(r []*aggregator.Record) (v []interface{}) {
+	v = make([]interface{}, len(r))
+	for i := range r {
+		v[i] = r[i]
+	}
+	return
+}
+
+func capacityValues(ce []*tracker.CapacityEvent) (v []interface{}) {
+	v = make([]interface{}, len(ce))
+	for i := range ce {
+		v[i] = ce[i]
+	}
+	return
+}
+
+func connectValues(ca []*tracker.ConnectAttempts) (v []interface{}) {
+	v = make([]interface{}, len(ca))
+	for i := range ca {
+		v[i] = ca[i]
+	}
+	return
+}
+
+func (a *App) waitOnError(ctx context.Context) (stopped bool, err error) {
 	d := a.ErrorDelay << uint(a.errs-1)
 	log.Printf("waiting %s", d)
-	stopped, err = a.wait(time.After(d))
+	stopped, err = a.wait(ctx, time.After(d))
 	return
 }
 
-func (a *App) wait(ch <-chan time.Time) (stopped bool, err error) {
+// waitSample waits like wait, and also returns early with any samples for
+// destroyed sockets.
+func (a *App) waitSample(ctx context.Context, ch <-chan time.Time) (
+	stopped bool, ds []sampler.Sample, err error) {
+	select {
+	case ds = <-a.dc:
+		return
+	default:
+	}
 	stopped = true
 	select {
+	case <-ctx.Done():
+	case <-a.stop:
+	case <-a.dur:
+		log.Printf("stopping after duration %s", a.Duration)
+	case err = <-a.errc:
+		log.Printf("pipeline error (%s)", err)
+	case ds = <-a.dc:
+		stopped = false
+	case <-ch:
+		stopped = false
+	}
+	return
+}
+
+func (a *App) wait(ctx context.Context, ch <-chan time.Time) (stopped bool,
+	err error) {
+	stopped = true
+	select {
+	case <-ctx.Done():
 	case <-a.stop:
 	case <-a.dur:
 		log.Printf("stopping after duration %s", a.Duration)
@@ -320,14 +1353,53 @@ func (a *App) wait(ch <-chan time.Time) (stopped bool, err error) {
 }
 
 func (a *App) httpServer() {
-	http.Handle("/", newRootHandler(a))
-	http.Handle("/flow-duration-histogram", &flowDurationHistogramHandler{a.analyzer})
+	mux := http.NewServeMux()
+	mux.Handle("/", newRootHandler(a))
+	mux.Handle("/flow-duration-histogram", &flowDurationHistogramHandler{a.analyzer})
+	mux.Handle("/rtt-heatmap", &rttHeatmapHandler{a.analyzer})
+	mux.Handle("/experiment", &experimentHandler{a})
+	mux.Handle("/flows", &flowsHandler{a.tracker})
+	if a.recent != nil {
+		mux.Handle("/api/flows/recent", &recentFlowsHandler{a.recent})
+	}
 	log.Printf("starting http server on %s", a.HTTPAddr)
-	if err := http.ListenAndServe(a.HTTPAddr, nil); err != nil {
+	if err := http.ListenAndServe(a.HTTPAddr, mux); err != nil {
 		log.Printf("http server exiting due to error (%s)", err)
 	}
 }
 
+// portCounts returns the counts for up to max ports with the highest counts,
+// as " (by destination port: 443 12, 80 3)", or empty if there are none.
+func portCounts(pc map[uint16]int, max int) string {
+	if len(pc) == 0 {
+		return ""
+	}
+	ps := make([]uint16, 0, len(pc))
+	for p := range pc {
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		if pc[ps[i]] != pc[ps[j]] {
+			return pc[ps[i]] > pc[ps[j]]
+		}
+		return ps[i] < ps[j]
+	})
+	var sb strings.Builder
+	sb.WriteString(" (by destination port: ")
+	for i, p := range ps {
+		if i == max {
+			fmt.Fprintf(&sb, ", %d more", len(ps)-max)
+			break
+		}
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "%d %d", p, pc[p])
+	}
+	sb.WriteString(")")
+	return sb.String()
+}
+
 func us(d time.Duration) int64 {
 	return int64(d) / 1e3
 }
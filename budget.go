@@ -0,0 +1,161 @@
+package cgmon
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// A BudgetConfig contains soft latency budgets for the pipeline stages. A
+// budget of 0 is not enforced.
+type BudgetConfig struct {
+	Sample      time.Duration // budget for each netlink sample
+	Convert     time.Duration // budget for each conversion
+	Track       time.Duration // budget for each track call
+	Analyze     time.Duration // budget for each analyze call
+	Write       time.Duration // budget for each write, including aggregation and summaries
+	Repeat      int           // consecutive overruns before a budget is considered exceeded
+	Adapt       bool          // if true, double the sample interval when a budget is exceeded
+	MaxInterval time.Duration // maximum sample interval when adapting
+}
+
+// stage identifies a pipeline stage.
+type stage int
+
+const (
+	stageSample stage = iota
+	stageConvert
+	stageTrack
+	stageAnalyze
+	stageWrite
+	numStages
+)
+
+var stageNames = [numStages]string{
+	"Netlink",
+	"Conversion",
+	"Tracker",
+	"Analyzer",
+	"Writer",
+}
+
+func (s stage) String() string {
+	return stageNames[s]
+}
+
+// BudgetMetrics contains the latency budget counters for each pipeline stage.
+type BudgetMetrics struct {
+	Overruns    [numStages]uint64 // calls that took longer than the budget
+	Exceeded    [numStages]uint64 // times Repeat consecutive overruns occurred
+	Adaptations uint64            // times the sample interval was raised
+	Interval    time.Duration     // current sample interval
+	consecutive [numStages]int
+	sync.RWMutex
+}
+
+func (m *BudgetMetrics) recordAdaptation(iv time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.Adaptations++
+	m.Interval = iv
+}
+
+// budgets checks stage times against a BudgetConfig.
+type budgets struct {
+	*BudgetConfig
+	metrics BudgetMetrics
+	adapt   chan struct{}
+}
+
+func newBudgets(cfg *BudgetConfig, interval time.Duration) (b *budgets) {
+	b = &budgets{
+		BudgetConfig: cfg,
+		adapt:        make(chan struct{}, 1),
+	}
+	b.metrics.Interval = interval
+	return
+}
+
+// enabled returns true if any stage has a budget.
+func (b *budgets) enabled() bool {
+	for i := stage(0); i < numStages; i++ {
+		if b.limit(i) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *budgets) limit(s stage) time.Duration {
+	switch s {
+	case stageSample:
+		return b.Sample
+	case stageConvert:
+		return b.Convert
+	case stageTrack:
+		return b.Track
+	case stageAnalyze:
+		return b.Analyze
+	case stageWrite:
+		return b.Write
+	}
+	return 0
+}
+
+// since checks the time since t0 against the budget for the given stage.
+func (b *budgets) since(s stage, t0 time.Time) {
+	b.check(s, time.Since(t0))
+}
+
+// check records an overrun if d exceeds the budget for the given stage, and
+// logs and signals for adaptation after Repeat consecutive overruns.
+func (b *budgets) check(s stage, d time.Duration) {
+	lim := b.limit(s)
+	if lim == 0 {
+		return
+	}
+
+	m := &b.metrics
+	m.Lock()
+	defer m.Unlock()
+
+	if d <= lim {
+		m.consecutive[s] = 0
+		return
+	}
+
+	m.Overruns[s]++
+	m.consecutive[s]++
+	if m.consecutive[s] < b.Repeat {
+		return
+	}
+	m.consecutive[s] = 0
+	m.Exceeded[s]++
+
+	log.Printf("%s stage exceeded budget of %s %d consecutive times (last %s)",
+		s, lim, b.Repeat, d)
+
+	if b.Adapt {
+		select {
+		case b.adapt <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// nextInterval returns the sample interval to use after a budget is exceeded,
+// and false if the interval is already at its maximum.
+func (b *budgets) nextInterval(iv time.Duration) (next time.Duration, ok bool) {
+	if next = 2 * iv; b.MaxInterval > 0 && next > b.MaxInterval {
+		next = b.MaxInterval
+	}
+	ok = next > iv
+	return
+}
+
+func (b *budgets) Metrics() (m BudgetMetrics) {
+	b.metrics.RLock()
+	defer b.metrics.RUnlock()
+	m = b.metrics
+	return
+}
@@ -0,0 +1,137 @@
+package capture
+
+import (
+	"encoding/binary"
+	"syscall"
+
+	"github.com/heistp/cgmon/sampler"
+)
+
+// classic BPF opcodes (linux/bpf_common.h)
+const (
+	bpfLdWAbs  = 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfLdHAbs  = 0x28 // BPF_LD | BPF_H | BPF_ABS
+	bpfLdBAbs  = 0x30 // BPF_LD | BPF_B | BPF_ABS
+	bpfLdHInd  = 0x48 // BPF_LD | BPF_H | BPF_IND
+	bpfLdxBMsh = 0xb1 // BPF_LDX | BPF_B | BPF_MSH
+	bpfAndK    = 0x54 // BPF_ALU | BPF_AND | BPF_K
+	bpfJeqK    = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJsetK   = 0x45 // BPF_JMP | BPF_JSET | BPF_K
+	bpfRetK    = 0x06 // BPF_RET | BPF_K
+)
+
+// ipProtoTCP is the IP protocol number for TCP.
+const ipProtoTCP = 6
+
+// An insn is a BPF instruction with symbolic jump targets, which are resolved
+// to offsets by assemble. An empty target means the next instruction.
+type insn struct {
+	code   uint16
+	jt, jf string
+	k      uint32
+	label  string // label of this instruction, if it's a jump target
+}
+
+// assemble resolves the jump targets of a program.
+func assemble(p []insn) (f []syscall.SockFilter) {
+	at := make(map[string]int)
+	for i, n := range p {
+		if n.label != "" {
+			at[n.label] = i
+		}
+	}
+	off := func(i int, l string) uint8 {
+		if l == "" {
+			return 0
+		}
+		return uint8(at[l] - i - 1)
+	}
+	f = make([]syscall.SockFilter, len(p))
+	for i, n := range p {
+		f[i] = syscall.SockFilter{Code: n.code, Jt: off(i, n.jt),
+			Jf: off(i, n.jf), K: n.k}
+	}
+	return
+}
+
+// dropAll is a filter that drops all packets, attached before the flow filter
+// so that packets queued before it are discarded.
+var dropAll = []syscall.SockFilter{{Code: bpfRetK, K: 0}}
+
+// flowFilter returns a filter for the TCP packets of a flow in both
+// directions, truncated to snaplen, for packets starting at the network
+// header (SOCK_DGRAM). IPv6 packets with extension headers aren't matched.
+func flowFilter(id sampler.ID, snaplen int) []syscall.SockFilter {
+	var p []insn
+	if id.IsIPv4() {
+		p = []insn{
+			{code: bpfLdBAbs, k: 0},
+			{code: bpfAndK, k: 0xf0},
+			{code: bpfJeqK, k: 0x40, jf: "drop"},
+			{code: bpfLdBAbs, k: 9},
+			{code: bpfJeqK, k: ipProtoTCP, jf: "drop"},
+			{code: bpfLdHAbs, k: 6},
+			{code: bpfJsetK, k: 0x1fff, jt: "drop"}, // non-first fragment
+			{code: bpfLdxBMsh, k: 0},
+		}
+		p = append(p, match4(id.SrcIP, id.DstIP, id.SrcPort, id.DstPort,
+			"", "rev")...)
+		p = append(p, match4(id.DstIP, id.SrcIP, id.DstPort, id.SrcPort,
+			"rev", "drop")...)
+	} else {
+		p = []insn{
+			{code: bpfLdBAbs, k: 0},
+			{code: bpfAndK, k: 0xf0},
+			{code: bpfJeqK, k: 0x60, jf: "drop"},
+			{code: bpfLdBAbs, k: 6},
+			{code: bpfJeqK, k: ipProtoTCP, jf: "drop"},
+		}
+		p = append(p, match6(id.SrcIP, id.DstIP, id.SrcPort, id.DstPort,
+			"", "rev")...)
+		p = append(p, match6(id.DstIP, id.SrcIP, id.DstPort, id.SrcPort,
+			"rev", "drop")...)
+	}
+	p = append(p,
+		insn{code: bpfRetK, k: uint32(snaplen), label: "accept"},
+		insn{code: bpfRetK, k: 0, label: "drop"})
+	return assemble(p)
+}
+
+// match4 returns instructions that jump to accept if an IPv4 packet is from
+// src:sport to dst:dport, or else to fail. X must hold the IP header length.
+func match4(src, dst [16]byte, sport, dport uint16, label,
+	fail string) []insn {
+	return []insn{
+		{code: bpfLdWAbs, k: 12, jf: "", label: label},
+		{code: bpfJeqK, k: binary.BigEndian.Uint32(src[12:]), jf: fail},
+		{code: bpfLdWAbs, k: 16},
+		{code: bpfJeqK, k: binary.BigEndian.Uint32(dst[12:]), jf: fail},
+		{code: bpfLdHInd, k: 0},
+		{code: bpfJeqK, k: uint32(sport), jf: fail},
+		{code: bpfLdHInd, k: 2},
+		{code: bpfJeqK, k: uint32(dport), jt: "accept", jf: fail},
+	}
+}
+
+// match6 returns instructions that jump to accept if an IPv6 packet is from
+// src:sport to dst:dport, or else to fail.
+func match6(src, dst [16]byte, sport, dport uint16, label,
+	fail string) (p []insn) {
+	for i := 0; i < 16; i += 4 {
+		p = append(p,
+			insn{code: bpfLdWAbs, k: uint32(8 + i)},
+			insn{code: bpfJeqK, k: binary.BigEndian.Uint32(src[i:]), jf: fail})
+	}
+	for i := 0; i < 16; i += 4 {
+		p = append(p,
+			insn{code: bpfLdWAbs, k: uint32(24 + i)},
+			insn{code: bpfJeqK, k: binary.BigEndian.Uint32(dst[i:]), jf: fail})
+	}
+	p[0].label = label
+	p = append(p,
+		insn{code: bpfLdHAbs, k: 40},
+		insn{code: bpfJeqK, k: uint32(sport), jf: fail},
+		insn{code: bpfLdHAbs, k: 42},
+		insn{code: bpfJeqK, k: uint32(dport), jt: "accept", jf: fail})
+	return
+}
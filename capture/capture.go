@@ -0,0 +1,313 @@
+// Package capture takes short packet captures of flows whose stats cross
+// badness thresholds while they're active, using AF_PACKET sockets with BPF
+// filters for each flow's 4-tuple, and writes them as pcap files.
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/heistp/cgmon/sampler"
+	"github.com/heistp/cgmon/tracker"
+)
+
+// AF_PACKET constants (linux/if_packet.h, linux/if_arp.h, linux/if_ether.h)
+const (
+	ethPAllBE      = 0x0300 // htons(ETH_P_ALL)
+	packetOutgoing = 4
+	arphrdLoopback = 772
+)
+
+// minBytesSent is the minimum number of bytes a flow must have sent before
+// its retransmit rate is compared with RetransRate, so the first losses of a
+// flow don't trigger captures.
+const minBytesSent = 64 * 1024
+
+// pollInterval is the receive timeout, on which captures check whether their
+// duration has elapsed or the Capturer was closed.
+const pollInterval = 100 * time.Millisecond
+
+// A Config contains the packet capture configuration.
+type Config struct {
+	Dir          string        // directory for pcap files
+	RetransRate  float64       // fraction of bytes sent that were retransmitted at or above which to capture (0 disables)
+	RTTInflation float64       // ratio of RTT to min RTT at or above which to capture (0 disables)
+	Duration     time.Duration // maximum duration of each capture
+	MaxSize      int           // maximum size of each pcap file in bytes
+	Snaplen      int           // maximum bytes captured per packet
+	MaxActive    int           // maximum captures in progress at once, beyond which triggers are skipped
+	Log          bool          // if true, logging is enabled
+}
+
+// Metrics contains the packet capture metrics.
+type Metrics struct {
+	Captures uint64 // captures started
+	Skipped  uint64 // triggers skipped because MaxActive captures were in progress
+	Errors   uint64 // captures that failed to start or write
+	Packets  uint64 // packets captured
+	Bytes    uint64 // bytes written to pcap files
+	sync.RWMutex
+}
+
+func (m *Metrics) recordSkip() {
+	m.Lock()
+	defer m.Unlock()
+	m.Skipped++
+}
+
+func (m *Metrics) recordError() {
+	m.Lock()
+	defer m.Unlock()
+	m.Errors++
+}
+
+func (m *Metrics) recordStart() {
+	m.Lock()
+	defer m.Unlock()
+	m.Captures++
+}
+
+func (m *Metrics) recordCapture(packets, bytes int) {
+	m.Lock()
+	defer m.Unlock()
+	m.Packets += uint64(packets)
+	m.Bytes += uint64(bytes)
+}
+
+// A Capturer starts packet captures of flows that cross its thresholds. It
+// implements tracker.Observer, checking the thresholds as samples are added.
+type Capturer struct {
+	tracker.NopObserver
+	Config
+	active  int
+	mtx     sync.Mutex
+	metrics Metrics
+	stop    chan bool
+	wg      sync.WaitGroup
+}
+
+// New returns a new Capturer.
+func New(cfg Config) (c *Capturer, err error) {
+	var di os.FileInfo
+	if di, err = os.Stat(cfg.Dir); err != nil {
+		return
+	}
+	if !di.IsDir() {
+		err = fmt.Errorf("capture directory '%s' not a directory", cfg.Dir)
+		return
+	}
+	if cfg.Snaplen <= 0 || cfg.MaxSize <= 0 || cfg.Duration <= 0 {
+		err = fmt.Errorf("capture snaplen, max size and duration must be > 0")
+		return
+	}
+	c = &Capturer{
+		Config: cfg,
+		stop:   make(chan bool),
+	}
+	if cfg.Log {
+		log.Printf("capturing flows to %s (retrans rate %.3f, RTT inflation %.1f)",
+			cfg.Dir, cfg.RetransRate, cfg.RTTInflation)
+	}
+	return
+}
+
+// OnFlowSampled implements tracker.Observer, starting a capture of the flow if
+// it doesn't have one and crosses a threshold, and recording its path in the
+// flow's Capture field.
+func (c *Capturer) OnFlowSampled(f *tracker.Flow) {
+	if f.Capture == "" {
+		f.Capture = c.Capture(f.ID, &f.Data[0], &f.Data[len(f.Data)-1])
+	}
+}
+
+// Capture starts a capture of the flow, if its stats from the first to the
+// last sample cross a threshold, and returns the path of the pcap file, or
+// empty if no capture was started.
+func (c *Capturer) Capture(id sampler.ID, first, last *sampler.Data) (
+	path string) {
+	reason := c.reason(first, last)
+	if reason == "" {
+		return
+	}
+	c.mtx.Lock()
+	if c.MaxActive > 0 && c.active >= c.MaxActive {
+		c.mtx.Unlock()
+		c.metrics.recordSkip()
+		return
+	}
+	c.active++
+	c.mtx.Unlock()
+
+	p := filepath.Join(c.Dir, fmt.Sprintf("cgmon-%s-%s.%d-%s.%d.pcap",
+		time.Now().UTC().Format("20060102T150405"),
+		net.IP(id.SrcIP[:]), id.SrcPort, net.IP(id.DstIP[:]), id.DstPort))
+	fd, f, err := c.open(id, p)
+	if err != nil {
+		log.Printf("unable to start capture to %s (%s)", p, err)
+		c.metrics.recordError()
+		c.done()
+		return
+	}
+	c.metrics.recordStart()
+	if c.Log {
+		log.Printf("capturing %s to %s", reason, p)
+	}
+	c.wg.Add(1)
+	go c.capture(fd, f, p)
+	path = p
+	return
+}
+
+// reason returns why a flow should be captured, or empty if it shouldn't.
+func (c *Capturer) reason(first, last *sampler.Data) string {
+	if c.RetransRate > 0 && last.BytesSent >= first.BytesSent+minBytesSent {
+		r := float64(last.BytesRetrans-first.BytesRetrans) /
+			float64(last.BytesSent-first.BytesSent)
+		if r >= c.RetransRate {
+			return fmt.Sprintf("retrans rate %.3f", r)
+		}
+	}
+	if c.RTTInflation > 0 && last.MinRTTus > 0 {
+		r := float64(last.RTTus) / float64(last.MinRTTus)
+		if r >= c.RTTInflation {
+			return fmt.Sprintf("RTT inflation %.1f", r)
+		}
+	}
+	return ""
+}
+
+// open opens an AF_PACKET socket filtered for the flow, and creates the pcap
+// file. Packets queued before the flow filter is attached are drained.
+func (c *Capturer) open(id sampler.ID, path string) (fd int, f *os.File,
+	err error) {
+	if fd, err = syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM,
+		ethPAllBE); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			syscall.Close(fd)
+		}
+	}()
+	if err = syscall.AttachLsf(fd, dropAll); err != nil {
+		return
+	}
+	b := make([]byte, 1)
+	for {
+		if _, _, e := syscall.Recvfrom(fd, b, syscall.MSG_DONTWAIT); e != nil {
+			break
+		}
+	}
+	if err = syscall.AttachLsf(fd, flowFilter(id, c.Snaplen)); err != nil {
+		return
+	}
+	tv := syscall.NsecToTimeval(int64(pollInterval))
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET,
+		syscall.SO_RCVTIMEO, &tv); err != nil {
+		return
+	}
+	f, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	return
+}
+
+// capture writes the flow's packets to the pcap file until Duration elapses,
+// MaxSize is reached, or the Capturer is closed. Outgoing packets on loopback
+// interfaces are skipped, as they're also received.
+func (c *Capturer) capture(fd int, f *os.File, path string) {
+	defer c.wg.Done()
+	defer c.done()
+	defer syscall.Close(fd)
+
+	pw := &pcapWriter{w: bufio.NewWriter(f)}
+	var packets int
+	err := pw.writeHeader(c.Snaplen)
+	b := make([]byte, c.Snaplen)
+	end := time.Now().Add(c.Duration)
+Loop:
+	for err == nil && time.Now().Before(end) {
+		select {
+		case <-c.stop:
+			break Loop
+		default:
+		}
+		n, from, e := syscall.Recvfrom(fd, b, syscall.MSG_TRUNC)
+		if e != nil {
+			if errors.Is(e, syscall.EAGAIN) || errors.Is(e, syscall.EINTR) {
+				continue
+			}
+			err = e
+			break
+		}
+		if ll, ok := from.(*syscall.SockaddrLinklayer); ok &&
+			ll.Pkttype == packetOutgoing && ll.Hatype == arphrdLoopback {
+			continue
+		}
+		cn := n
+		if cn > len(b) {
+			cn = len(b)
+		}
+		if pw.n+16+cn > c.MaxSize {
+			break
+		}
+		if err = pw.writePacket(time.Now(), b[:cn], ipLength(b[:cn], n)); err == nil {
+			packets++
+		}
+	}
+	if e := pw.w.Flush(); err == nil {
+		err = e
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		log.Printf("capture to %s failed (%s)", path, err)
+		c.metrics.recordError()
+	}
+	c.metrics.recordCapture(packets, pw.n)
+	if c.Log {
+		log.Printf("captured %d packets (%d bytes) to %s", packets, pw.n, path)
+	}
+}
+
+// ipLength returns a packet's original length from its IP header, as the
+// filter truncates packets to the snaplen before they're received, or n if
+// the header wasn't captured.
+func ipLength(b []byte, n int) int {
+	switch {
+	case len(b) >= 4 && b[0]>>4 == 4:
+		return int(binary.BigEndian.Uint16(b[2:]))
+	case len(b) >= 6 && b[0]>>4 == 6:
+		return 40 + int(binary.BigEndian.Uint16(b[4:]))
+	}
+	return n
+}
+
+// done ends an active capture.
+func (c *Capturer) done() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.active--
+}
+
+// Metrics returns a copy of the capture metrics.
+func (c *Capturer) Metrics() (m Metrics) {
+	c.metrics.RLock()
+	defer c.metrics.RUnlock()
+	m = c.metrics
+	return
+}
+
+// Close stops any captures in progress, and waits for them to finish writing.
+func (c *Capturer) Close() {
+	close(c.stop)
+	c.wg.Wait()
+}
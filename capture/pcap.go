@@ -0,0 +1,50 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"time"
+)
+
+// linktypeRaw is the pcap link type for packets starting at the IP header.
+const linktypeRaw = 101
+
+// pcapWriter writes packets in the pcap format, with microsecond timestamps.
+type pcapWriter struct {
+	w *bufio.Writer
+	n int // bytes written
+}
+
+// writeHeader writes the pcap file header.
+func (p *pcapWriter) writeHeader(snaplen int) error {
+	var b [24]byte
+	binary.LittleEndian.PutUint32(b[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(b[4:], 2)
+	binary.LittleEndian.PutUint16(b[6:], 4)
+	binary.LittleEndian.PutUint32(b[16:], uint32(snaplen))
+	binary.LittleEndian.PutUint32(b[20:], linktypeRaw)
+	return p.write(b[:])
+}
+
+// writePacket writes a packet record, with the captured bytes and the
+// packet's original length.
+func (p *pcapWriter) writePacket(t time.Time, data []byte, length int) (
+	err error) {
+	var b [16]byte
+	binary.LittleEndian.PutUint32(b[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(b[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(b[8:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(b[12:], uint32(length))
+	if err = p.write(b[:]); err != nil {
+		return
+	}
+	err = p.write(data)
+	return
+}
+
+func (p *pcapWriter) write(b []byte) (err error) {
+	var n int
+	n, err = p.w.Write(b)
+	p.n += n
+	return
+}
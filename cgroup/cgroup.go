@@ -0,0 +1,74 @@
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// DefaultRoot is the default mount point of the cgroup v2 unified hierarchy.
+const DefaultRoot = "/sys/fs/cgroup"
+
+// cpuPeriod is the period used for the cpu.max bandwidth limit.
+const cpuPeriod = 100 * time.Millisecond
+
+// A Config contains the cgroup configuration.
+type Config struct {
+	Root      string  // mount point of the cgroup v2 hierarchy
+	Name      string  // name of the cgroup to create and join
+	CPUMax    float64 // CPU limit as a fraction of one CPU (0 for no limit)
+	MemoryMax uint64  // memory limit in bytes (0 for no limit)
+}
+
+// Confine creates the configured cgroup if it doesn't already exist, sets its
+// CPU and memory limits, then moves the current process into it. Since the
+// controllers must be enabled in the parent's cgroup.subtree_control, and the
+// process requires write access to the hierarchy, the caller should treat
+// errors as non-fatal where confinement is best effort.
+func Confine(cfg Config) (err error) {
+	root := cfg.Root
+	if root == "" {
+		root = DefaultRoot
+	}
+	if cfg.Name == "" {
+		err = fmt.Errorf("cgroup name required")
+		return
+	}
+	path := filepath.Join(root, cfg.Name)
+
+	if err = os.MkdirAll(path, 0755); err != nil {
+		return
+	}
+
+	if cfg.CPUMax > 0 {
+		q := int64(cfg.CPUMax * float64(cpuPeriod/time.Microsecond))
+		if q < 1000 { // kernel minimum quota is 1ms
+			q = 1000
+		}
+		v := fmt.Sprintf("%d %d", q, int64(cpuPeriod/time.Microsecond))
+		if err = writeFile(path, "cpu.max", v); err != nil {
+			return
+		}
+	}
+
+	if cfg.MemoryMax > 0 {
+		v := strconv.FormatUint(cfg.MemoryMax, 10)
+		if err = writeFile(path, "memory.max", v); err != nil {
+			return
+		}
+	}
+
+	err = writeFile(path, "cgroup.procs", strconv.Itoa(os.Getpid()))
+
+	return
+}
+
+// writeFile writes the value to the named control file in the cgroup dir.
+func writeFile(dir, name, value string) (err error) {
+	if err = os.WriteFile(filepath.Join(dir, name), []byte(value), 0644); err != nil {
+		err = fmt.Errorf("unable to write %s to %s (%s)", value, name, err)
+	}
+	return
+}
@@ -0,0 +1,235 @@
+package cgroup
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// cgroup2Magic is the filesystem type of the cgroup v2 hierarchy
+// (CGROUP2_SUPER_MAGIC).
+const cgroup2Magic = 0x63677270
+
+// hybridDir is the mount point of the cgroup v2 hierarchy under the root for
+// systems using the systemd hybrid layout.
+const hybridDir = "unified"
+
+// minScanInterval is the minimum time between scans of the hierarchy when
+// resolving unknown cgroup IDs.
+const minScanInterval = 1 * time.Second
+
+// DefaultMaxNegative is the default maximum number of IDs in the negative
+// cache.
+const DefaultMaxNegative = 4096
+
+// A CacheConfig contains the Resolver's cache configuration.
+type CacheConfig struct {
+	TTL         time.Duration // time after a scan that its paths are used, before looking them up rescans (0 for no expiry)
+	NegativeTTL time.Duration // time IDs not found by a scan are cached as unresolvable, so looking them up doesn't rescan (0 disables)
+	MaxNegative int           // maximum IDs in the negative cache (0 for DefaultMaxNegative)
+}
+
+// CacheMetrics contains the Resolver's cache metrics.
+type CacheMetrics struct {
+	Entries      int    // cgroup paths from the last scan
+	Negative     int    // IDs in the negative cache
+	Hits         uint64 // lookups resolved from the last scan
+	NegativeHits uint64 // lookups of IDs in the negative cache
+	Misses       uint64 // lookups of unknown or expired IDs
+	Scans        uint64 // scans of the hierarchy
+	sync.RWMutex
+}
+
+func (m *CacheMetrics) recordHit() {
+	m.Lock()
+	defer m.Unlock()
+	m.Hits++
+}
+
+func (m *CacheMetrics) recordNegativeHit() {
+	m.Lock()
+	defer m.Unlock()
+	m.NegativeHits++
+}
+
+func (m *CacheMetrics) recordMiss() {
+	m.Lock()
+	defer m.Unlock()
+	m.Misses++
+}
+
+func (m *CacheMetrics) recordScan(entries int) {
+	m.Lock()
+	defer m.Unlock()
+	m.Entries = entries
+	m.Scans++
+}
+
+func (m *CacheMetrics) setNegative(n int) {
+	m.Lock()
+	defer m.Unlock()
+	m.Negative = n
+}
+
+// A Resolver resolves cgroup IDs, which are the inode numbers of directories
+// in the cgroup v2 hierarchy, to cgroup paths. It caches the paths from the
+// last scan of the hierarchy, and optionally the IDs a scan didn't find, so
+// that under high churn, lookups rarely rescan. A Resolver is not safe for
+// concurrent use, except for its Metrics method.
+type Resolver struct {
+	Root string // mount point of the cgroup v2 hierarchy
+	CacheConfig
+	paths    map[uint64]string
+	negative map[uint64]time.Time // expiry times of IDs not found by a scan
+	lastScan time.Time
+	metrics  CacheMetrics
+}
+
+// NewResolver returns a new Resolver for the hierarchy mounted at root, or
+// DefaultRoot if root is empty. If root isn't a cgroup v2 mount but contains
+// one at hybridDir, that is used instead.
+func NewResolver(root string, cache CacheConfig) *Resolver {
+	if root == "" {
+		root = DefaultRoot
+	}
+	if !isCgroup2(root) && isCgroup2(filepath.Join(root, hybridDir)) {
+		root = filepath.Join(root, hybridDir)
+	}
+	if cache.MaxNegative <= 0 {
+		cache.MaxNegative = DefaultMaxNegative
+	}
+	return &Resolver{Root: root, CacheConfig: cache,
+		paths:    make(map[uint64]string),
+		negative: make(map[uint64]time.Time)}
+}
+
+// Path returns the path of the cgroup with the given ID, relative to the root
+// and starting with /. If the ID is unknown or the last scan has expired, and
+// the ID isn't in the negative cache, the hierarchy is rescanned, if
+// minScanInterval has elapsed since the last scan.
+func (r *Resolver) Path(id uint64) (path string, ok bool) {
+	now := time.Now()
+	fresh := r.TTL <= 0 || now.Sub(r.lastScan) < r.TTL
+	if path, ok = r.paths[id]; ok && fresh {
+		r.metrics.recordHit()
+		return
+	}
+	if t, neg := r.negative[id]; neg && now.Before(t) {
+		r.metrics.recordNegativeHit()
+		return
+	}
+	r.metrics.recordMiss()
+	if now.Sub(r.lastScan) < minScanInterval {
+		return
+	}
+	r.scan()
+	if path, ok = r.paths[id]; !ok && r.NegativeTTL > 0 {
+		r.addNegative(id, now)
+	}
+	return
+}
+
+// Metrics returns a copy of the cache metrics.
+func (r *Resolver) Metrics() (m CacheMetrics) {
+	r.metrics.RLock()
+	defer r.metrics.RUnlock()
+	m = r.metrics
+	return
+}
+
+// addNegative adds an ID to the negative cache, first removing expired IDs if
+// it's full. If it's still full, the ID isn't added.
+func (r *Resolver) addNegative(id uint64, now time.Time) {
+	if len(r.negative) >= r.MaxNegative {
+		for i, t := range r.negative {
+			if !now.Before(t) {
+				delete(r.negative, i)
+			}
+		}
+	}
+	if len(r.negative) < r.MaxNegative {
+		r.negative[id] = now.Add(r.NegativeTTL)
+	}
+	r.metrics.setNegative(len(r.negative))
+}
+
+// scan replaces the known paths with those in the hierarchy. Directories that
+// can't be read, or are on other filesystems, are skipped.
+func (r *Resolver) scan() {
+	r.lastScan = time.Now()
+	p := make(map[uint64]string)
+	var dev uint64
+	filepath.WalkDir(r.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		var st syscall.Stat_t
+		if syscall.Stat(path, &st) != nil {
+			return nil
+		}
+		if path == r.Root {
+			dev = uint64(st.Dev)
+		} else if uint64(st.Dev) != dev {
+			return fs.SkipDir
+		}
+		rel, _ := filepath.Rel(r.Root, path)
+		if rel == "." {
+			rel = ""
+		}
+		p[st.Ino] = "/" + rel
+		return nil
+	})
+	r.paths = p
+	for id := range r.negative {
+		if _, ok := p[id]; ok {
+			delete(r.negative, id)
+		}
+	}
+	r.metrics.recordScan(len(p))
+	r.metrics.setNegative(len(r.negative))
+}
+
+// isCgroup2 returns true if path is on a cgroup v2 filesystem.
+func isCgroup2(path string) bool {
+	var st syscall.Statfs_t
+	return syscall.Statfs(path, &st) == nil && st.Type == cgroup2Magic
+}
+
+// Container returns the container ID and Kubernetes pod UID in a cgroup path,
+// for the naming used by the systemd and cgroupfs drivers of common container
+// runtimes, or empty strings if they aren't found.
+func Container(path string) (id, pod string) {
+	for _, e := range strings.Split(path, "/") {
+		e = strings.TrimSuffix(strings.TrimSuffix(e, ".scope"), ".slice")
+		if i := strings.LastIndex(e, "pod"); i >= 0 &&
+			strings.HasPrefix(path, "/kubepods") {
+			if u := strings.ReplaceAll(e[i+3:], "_", "-"); len(u) == 36 {
+				pod = u
+			}
+		}
+		c := e
+		if i := strings.LastIndex(e, "-"); i >= 0 {
+			c = e[i+1:]
+		}
+		if isContainerID(c) {
+			id = c
+		}
+	}
+	return
+}
+
+// isContainerID returns true if s is a 64 character hex container ID.
+func isContainerID(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
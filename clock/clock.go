@@ -0,0 +1,58 @@
+// Package clock provides the wall clock used for the times recorded by the
+// pipeline, which may be replaced with a Manual clock so runs of the replay
+// and synthetic samplers are reproducible.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// A Clock returns the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// Real is the system wall clock.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// Or returns c, or Real if c is nil.
+func Or(c Clock) Clock {
+	if c == nil {
+		return Real
+	}
+	return c
+}
+
+// A Manual is a Clock that only changes when set.
+type Manual struct {
+	t time.Time
+	sync.Mutex
+}
+
+// NewManual returns a new Manual clock set to t.
+func NewManual(t time.Time) *Manual {
+	return &Manual{t: t}
+}
+
+func (m *Manual) Now() time.Time {
+	m.Lock()
+	defer m.Unlock()
+	return m.t
+}
+
+// Set sets the time, if it's after the current time, so the clock never goes
+// backwards.
+func (m *Manual) Set(t time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	if t.After(m.t) {
+		m.t = t
+	}
+}
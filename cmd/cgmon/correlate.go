@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/heistp/cgmon/analyzer"
+	"github.com/heistp/cgmon/correlate"
+	"github.com/heistp/cgmon/writer"
+)
+
+// correlateMain runs the correlate subcommand, which matches the flow records
+// written by cgmon on the two endpoints of connections, and writes combined
+// records with both the sender and receiver side views to stdout as NDJSON.
+func correlateMain(args []string) {
+	fs := flag.NewFlagSet("correlate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(),
+			"usage: %s correlate [flags] file-a file-b\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	var mks = fs.Duration("max-skew", DEFAULT_CORRELATE_MAX_SKEW,
+		"tolerance for the clock offset between the hosts when matching flow times (units required)")
+	var anl = fs.String("analysis", "",
+		"select the flows from the analyzer configuration with this name (see -analyzer-name and -analyzer-compare), instead of the primary configuration")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var flows [2][]*analyzer.FlowStats
+	for i, path := range fs.Args() {
+		var err error
+		if flows[i], err = writer.ReadFlowStatsFile(path); err != nil {
+			log.Fatalf("unable to read flows from %s (%s)", path, err)
+		}
+		flows[i] = writer.SelectAnalysis(flows[i], *anl)
+	}
+
+	na, nb := fs.Arg(0), fs.Arg(1)
+	r := correlate.Match(flows[0], filepath.Base(na), flows[1],
+		filepath.Base(nb), *mks)
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, rec := range r.Records {
+		if err := enc.Encode(rec); err != nil {
+			log.Fatalf("write error (%s)", err)
+		}
+	}
+
+	log.Printf("matched %d flows, unmatched %d in %s and %d in %s",
+		len(r.Records), r.UnmatchedA, na, r.UnmatchedB, nb)
+}
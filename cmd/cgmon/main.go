@@ -0,0 +1,1462 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/syslog"
+	"net"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/heistp/cgmon"
+	"github.com/heistp/cgmon/aggregator"
+	"github.com/heistp/cgmon/analyzer"
+	"github.com/heistp/cgmon/capture"
+	"github.com/heistp/cgmon/cgroup"
+	"github.com/heistp/cgmon/clock"
+	"github.com/heistp/cgmon/filter"
+	"github.com/heistp/cgmon/linux"
+	"github.com/heistp/cgmon/netlink"
+	"github.com/heistp/cgmon/otlp"
+	"github.com/heistp/cgmon/prof"
+	"github.com/heistp/cgmon/qdisc"
+	"github.com/heistp/cgmon/remotewrite"
+	"github.com/heistp/cgmon/replay"
+	"github.com/heistp/cgmon/sandbox"
+	"github.com/heistp/cgmon/summary"
+	"github.com/heistp/cgmon/synthetic"
+	"github.com/heistp/cgmon/tracker"
+	"github.com/heistp/cgmon/wasmplugin"
+	"github.com/heistp/cgmon/writer"
+	"gonum.org/v1/gonum/stat"
+)
+
+// Defaults.
+const (
+	DEFAULT_AGGREGATOR_INTERVAL              = time.Duration(0)
+	DEFAULT_ANALYZER_ADJUSTED_CORRELATION_1  = false
+	DEFAULT_ANALYZER_ADJUSTED_CORRELATION_2  = false
+	DEFAULT_ANALYZER_BASELINE_PREFIX         = 0
+	DEFAULT_ANALYZER_BASELINE_PREFIX6        = 64
+	DEFAULT_ANALYZER_BASELINE_TTL            = 1 * time.Hour
+	DEFAULT_ANALYZER_COMPARE                 = ""
+	DEFAULT_ANALYZER_CUMULANT_KIND           = "lininterp"
+	DEFAULT_ANALYZER_FLOW_DEADLINE           = 0
+	DEFAULT_ANALYZER_MIN_RTT_SERIES          = false
+	DEFAULT_ANALYZER_NAME                    = ""
+	DEFAULT_ANALYZER_RAW_SAMPLES             = false
+	DEFAULT_ANALYZER_THROUGHPUT_SERIES       = false
+	DEFAULT_ANALYZER_UNWEIGHTED_CORRELATIONS = false
+	DEFAULT_ANALYZER_UNWEIGHTED_QUANTILES    = false
+	DEFAULT_ANALYZER_WASM_PLUGINS            = ""
+	DEFAULT_ANALYZER_WASM_TIMEOUT            = 100 * time.Millisecond
+	DEFAULT_BUDGET_ADAPT                     = false
+	DEFAULT_BUDGET_ANALYZE                   = time.Duration(0)
+	DEFAULT_BUDGET_CONVERT                   = time.Duration(0)
+	DEFAULT_BUDGET_MAX_INTERVAL              = 1 * time.Minute
+	DEFAULT_BUDGET_REPEAT                    = 3
+	DEFAULT_BUDGET_SAMPLE                    = time.Duration(0)
+	DEFAULT_BUDGET_TRACK                     = time.Duration(0)
+	DEFAULT_BUDGET_WRITE                     = time.Duration(0)
+	DEFAULT_CAPTURE_DIR                      = ""
+	DEFAULT_CAPTURE_DURATION                 = 10 * time.Second
+	DEFAULT_CAPTURE_MAX_ACTIVE               = 4
+	DEFAULT_CAPTURE_MAX_SIZE                 = "1M"
+	DEFAULT_CAPTURE_RETRANS_RATE             = 0.05
+	DEFAULT_CAPTURE_RTT_INFLATION            = 0.0
+	DEFAULT_CAPTURE_SNAPLEN                  = 128
+	DEFAULT_CORRELATE_MAX_SKEW               = 1 * time.Second
+	DEFAULT_EXPERIMENT_ID                    = ""
+	DEFAULT_EXPERIMENT_PHASE                 = ""
+	DEFAULT_FILTER_DSCP                      = ""
+	DEFAULT_FILTER_DST_FILE                  = ""
+	DEFAULT_LOG_AGGREGATOR                   = false
+	DEFAULT_LOG_ALL                          = false
+	DEFAULT_LOG_ANALYZER                     = false
+	DEFAULT_LOG_CAPTURE                      = false
+	DEFAULT_LOG_FILTER                       = false
+	DEFAULT_LOG_NETLINK                      = false
+	DEFAULT_LOG_OTLP                         = false
+	DEFAULT_LOG_QDISC                        = false
+	DEFAULT_LOG_REMOTE_WRITE                 = false
+	DEFAULT_LOG_REPLAY                       = false
+	DEFAULT_LOG_SUMMARY                      = false
+	DEFAULT_LOG_SYNTHETIC                    = false
+	DEFAULT_LOG_SYSLOG                       = false
+	DEFAULT_LOG_TRACKER                      = false
+	DEFAULT_LOG_WRITER                       = false
+	DEFAULT_NETLINK_BACKEND                  = "cgo"
+	DEFAULT_NETLINK_CLOCK                    = "monotonic"
+	DEFAULT_NETLINK_DESTROYED                = false
+	DEFAULT_NETLINK_DPORT                    = ""
+	DEFAULT_NETLINK_DST_NET                  = ""
+	DEFAULT_NETLINK_FAMILY                   = "all"
+	DEFAULT_NETLINK_FILTER                   = ""
+	DEFAULT_NETLINK_INTERFACE                = ""
+	DEFAULT_NETLINK_MARK                     = ""
+	DEFAULT_NETLINK_NETNS                    = ""
+	DEFAULT_NETLINK_TIMESTAMP                = "recv"
+	DEFAULT_NETLINK_UID                      = ""
+	DEFAULT_NETLINK_READ_BUFSIZE             = 32 * 1024
+	DEFAULT_NETLINK_RECEIVE_BUFSIZE          = 0
+	DEFAULT_NETLINK_RECEIVE_BUFSIZE_FORCE    = 0
+	DEFAULT_NETLINK_RECEIVE_TIMEOUT          = 1 * time.Second
+	DEFAULT_NETLINK_SHARD_BY                 = netlink.ShardByDport
+	DEFAULT_NETLINK_SHARDS                   = 1
+	DEFAULT_NETLINK_SPORT                    = ""
+	DEFAULT_NETLINK_SRC_NET                  = ""
+	DEFAULT_NETLINK_STATES                   = "established"
+	DEFAULT_OTLP_INTERVAL                    = 5 * time.Second
+	DEFAULT_OTLP_URL                         = ""
+	DEFAULT_QDISC_INTERFACES                 = ""
+	DEFAULT_QDISC_INTERVAL                   = 1 * time.Second
+	DEFAULT_REMOTE_WRITE_INTERVAL            = 15 * time.Second
+	DEFAULT_REMOTE_WRITE_PORTS               = ""
+	DEFAULT_REMOTE_WRITE_URL                 = ""
+	DEFAULT_REPLAY_FILE                      = ""
+	DEFAULT_RUN_CGROUP                       = ""
+	DEFAULT_RUN_CGROUP_CPU_MAX               = 0.0
+	DEFAULT_RUN_CGROUP_MEMORY_MAX            = ""
+	DEFAULT_RUN_CLOCK_JUMP                   = 1 * time.Second
+	DEFAULT_RUN_DETERMINISTIC                = false
+	DEFAULT_RUN_DURATION                     = time.Duration(0)
+	DEFAULT_RUN_ERROR_DELAY                  = 1 * time.Second
+	DEFAULT_RUN_GROUPS                       = ""
+	DEFAULT_RUN_HTTP_RECENT_FLOWS            = 1000
+	DEFAULT_RUN_HTTP_SERVER                  = ""
+	DEFAULT_RUN_INTERVAL                     = 1 * time.Second
+	DEFAULT_RUN_LANDLOCK                     = false
+	DEFAULT_RUN_MAX_ERRORS                   = 5
+	DEFAULT_RUN_RECOVER                      = true
+	DEFAULT_RUN_SECCOMP                      = false
+	DEFAULT_RUN_SERIAL                       = false
+	DEFAULT_RUN_SHUTDOWN_TIMEOUT             = 15 * time.Second
+	DEFAULT_SUMMARY_FAIRNESS                 = ""
+	DEFAULT_SUMMARY_HOST                     = false
+	DEFAULT_SUMMARY_LINKS                    = ""
+	DEFAULT_SYNTHETIC_FLOWS                  = 0
+	DEFAULT_SYNTHETIC_IDLE                   = 0.1
+	DEFAULT_SYNTHETIC_LIFETIME               = 100
+	DEFAULT_SYNTHETIC_SEED                   = 1
+	DEFAULT_TRACKER_CGROUP_ATTRIBUTION       = false
+	DEFAULT_TRACKER_CGROUP_CACHE_TTL         = time.Duration(0)
+	DEFAULT_TRACKER_CGROUP_NEGATIVE_SIZE     = cgroup.DefaultMaxNegative
+	DEFAULT_TRACKER_CGROUP_NEGATIVE_TTL      = 10 * time.Second
+	DEFAULT_TRACKER_CONNECT_ATTEMPTS         = false
+	DEFAULT_TRACKER_HEARTBEAT                = 0
+	DEFAULT_TRACKER_IDLE_TIMEOUT             = time.Duration(0)
+	DEFAULT_TRACKER_KEY                      = tracker.KeyTuple
+	DEFAULT_TRACKER_MAX_FLOWS                = 0
+	DEFAULT_TRACKER_MAX_MEMORY               = ""
+	DEFAULT_TRACKER_MAX_SAMPLES_PER_FLOW     = 0
+	DEFAULT_TRACKER_MIN_DURATION             = time.Duration(0)
+	DEFAULT_TRACKER_MIN_SAMPLES              = 0
+	DEFAULT_TRACKER_MIN_SIZE_CLASSES         = ""
+	DEFAULT_TRACKER_PROCESS_ATTRIBUTION      = false
+	DEFAULT_TRACKER_RULES                    = ""
+	DEFAULT_TRACKER_SAMPLE_POLICY            = tracker.SampleDecimate
+	DEFAULT_TRACKER_SEGMENT_INTERVAL         = time.Duration(0)
+	DEFAULT_TRACKER_SHARDS                   = 0
+	DEFAULT_TRACKER_TARGETS                  = ""
+	DEFAULT_WRITER_BATCH_INTERVAL            = time.Duration(0)
+	DEFAULT_WRITER_BATCH_SIZE                = 0
+	DEFAULT_WRITER_CHECKSUM                  = false
+	DEFAULT_WRITER_COMPRESSION_LEVEL         = 9
+	DEFAULT_WRITER_DEGRADED                  = false
+	DEFAULT_WRITER_DIR                       = ""
+	DEFAULT_WRITER_ENCODING                  = "json"
+	DEFAULT_WRITER_EXEC                      = ""
+	DEFAULT_WRITER_FLUSH                     = false
+	DEFAULT_WRITER_PARTIAL                   = false
+	DEFAULT_WRITER_PARTITION                 = ""
+	DEFAULT_WRITER_RETRIES                   = 0
+	DEFAULT_WRITER_RETRY_DELAY               = 1 * time.Second
+	DEFAULT_WRITER_ROTATE_INTERVAL           = 15 * time.Minute
+	DEFAULT_WRITER_ROTATE_SIZE               = ""
+	DEFAULT_WRITER_VERIFY                    = false
+)
+
+func main() {
+	var err error
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "correlate":
+			correlateMain(os.Args[2:])
+			return
+		case "report":
+			reportMain(os.Args[2:])
+			return
+		case "schema":
+			schemaMain(os.Args[2:])
+			return
+		case "series":
+			seriesMain(os.Args[2:])
+			return
+		}
+	}
+
+	// start profiling, if enabled in build
+	if prof.ProfileEnabled {
+		defer prof.StartProfile("./cgmon.pprof").Stop()
+	}
+
+	var hostname string
+	var defaultWriterFile string
+	var defaultAggregatorFile string
+	var defaultQdiscFile string
+	if hostname, err = os.Hostname(); err != nil {
+		defaultWriterFile = "cgmon.json.gz"
+		defaultAggregatorFile = "cgmon-dest.json.gz"
+		defaultQdiscFile = "cgmon-qdisc.json.gz"
+	} else {
+		defaultWriterFile = "cgmon-" + hostname + ".json.gz"
+		defaultAggregatorFile = "cgmon-dest-" + hostname + ".json.gz"
+		defaultQdiscFile = "cgmon-qdisc-" + hostname + ".json.gz"
+	}
+
+	var agf = flag.String("aggregator-file", defaultAggregatorFile,
+		"output filename for per-destination aggregate records, in -writer-dir")
+	var agi = flag.Duration("aggregator-interval", DEFAULT_AGGREGATOR_INTERVAL,
+		"interval on which to emit per-destination aggregate records (units required, 0 disables)")
+
+	var ac1 = flag.Bool("analyzer-adjusted-correlation-1", DEFAULT_ANALYZER_ADJUSTED_CORRELATION_1,
+		"use adjusted correlation coefficient r_adj = r * (1 + (1-r*r)/2*n) (Wikipedia PCC)")
+	var ac2 = flag.Bool("analyzer-adjusted-correlation-2", DEFAULT_ANALYZER_ADJUSTED_CORRELATION_2,
+		"use adjusted correlation coefficient r_adj = sqrt(1 - ((1-r*r)*(n-1))/(n-2)) (only applied with more than 2 samples)")
+	var abp = flag.Int("analyzer-baseline-prefix", DEFAULT_ANALYZER_BASELINE_PREFIX,
+		"keep minimum RTT baselines across flows per destination prefix of this length (e.g. 32 or 24, 0 disables)")
+	var abp6 = flag.Int("analyzer-baseline-prefix6", DEFAULT_ANALYZER_BASELINE_PREFIX6,
+		"IPv6 destination prefix length for RTT baselines, when enabled with -analyzer-baseline-prefix")
+	var abt = flag.Duration("analyzer-baseline-ttl", DEFAULT_ANALYZER_BASELINE_TTL,
+		"time after which an RTT baseline that hasn't been lowered expires (0 for never)")
+	var acp = flag.String("analyzer-compare", DEFAULT_ANALYZER_COMPARE,
+		"run a second analyzer configuration on the same flows and also write its stats, given as a name followed by space separated options that override the -analyzer flags (cumulant-kind, unweighted-correlations, unweighted-quantiles, adjusted-correlation-1, adjusted-correlation-2, baseline-prefix, baseline-prefix6, baseline-ttl, flow-deadline, raw-samples, min-rtt-series or throughput-series=value), with records tagged by Analysis (e.g. \"unweighted unweighted-quantiles=true unweighted-correlations=true\")")
+	var ack = flag.String("analyzer-cumulant-kind", DEFAULT_ANALYZER_CUMULANT_KIND,
+		"for seven number summaries, empirical: use only measured values, lininterp: do linear interpolation")
+	var afd = flag.Duration("analyzer-flow-deadline", DEFAULT_ANALYZER_FLOW_DEADLINE,
+		"time limit for analyzing one flow, after which a reduced set of stats is output with AnalysisTruncated set (0 for none)")
+	var amr = flag.Bool("analyzer-min-rtt-series", DEFAULT_ANALYZER_MIN_RTT_SERIES,
+		"include the kernel's windowed min RTT, and the all-time and windowed minimums of observed RTTs, in each flow's record (MinRTTSeries)")
+	var anm = flag.String("analyzer-name", DEFAULT_ANALYZER_NAME,
+		"name of the analyzer configuration, recorded as Analysis in flow records (\"default\" if empty and -analyzer-compare is used)")
+	var ars = flag.Bool("analyzer-raw-samples", DEFAULT_ANALYZER_RAW_SAMPLES,
+		"include each flow's sampled values in its record (RawSamples), for plotting with the series subcommand")
+	var ats = flag.Bool("analyzer-throughput-series", DEFAULT_ANALYZER_THROUGHPUT_SERIES,
+		"include each flow's send and receive throughput over each sample interval in its record (ThroughputSeries), to show ramp-up and stalls, also extracted by the series subcommand")
+	var auc = flag.Bool("analyzer-unweighted-correlations",
+		DEFAULT_ANALYZER_UNWEIGHTED_CORRELATIONS,
+		"do not use weights for correlation stats (otherwise use time between samples)")
+	var auq = flag.Bool("analyzer-unweighted-quantiles",
+		DEFAULT_ANALYZER_UNWEIGHTED_QUANTILES,
+		"do not use weights for quantiles needed for seven number summaries (otherwise use time between samples)")
+	var awp = flag.String("analyzer-wasm-plugins", DEFAULT_ANALYZER_WASM_PLUGINS,
+		"comma separated paths of WASM analysis plugins (requires build with -tags wasmplugin)")
+	var awt = flag.Duration("analyzer-wasm-timeout", DEFAULT_ANALYZER_WASM_TIMEOUT,
+		"time limit for each call to a WASM analysis plugin (0 for none)")
+	var bad = flag.Bool("budget-adapt", DEFAULT_BUDGET_ADAPT,
+		"double the sample interval (up to -budget-max-interval) each time a stage budget is exceeded")
+	var ban = flag.Duration("budget-analyze", DEFAULT_BUDGET_ANALYZE,
+		"soft latency budget for each analyzer call (units required, 0 disables)")
+	var bcv = flag.Duration("budget-convert", DEFAULT_BUDGET_CONVERT,
+		"soft latency budget for each sample conversion (units required, 0 disables)")
+	var bmi = flag.Duration("budget-max-interval", DEFAULT_BUDGET_MAX_INTERVAL,
+		"maximum sample interval for -budget-adapt")
+	var brp = flag.Int("budget-repeat", DEFAULT_BUDGET_REPEAT,
+		"number of consecutive overruns before a stage budget is considered exceeded")
+	var bsm = flag.Duration("budget-sample", DEFAULT_BUDGET_SAMPLE,
+		"soft latency budget for each netlink sample (units required, e.g. 200ms, 0 disables)")
+	var btr = flag.Duration("budget-track", DEFAULT_BUDGET_TRACK,
+		"soft latency budget for each tracker call (units required, 0 disables)")
+	var bwr = flag.Duration("budget-write", DEFAULT_BUDGET_WRITE,
+		"soft latency budget for each write, including aggregation and summaries (units required, 0 disables)")
+	var cpd = flag.String("capture-dir", DEFAULT_CAPTURE_DIR,
+		"when an active flow crosses -capture-retrans-rate or -capture-rtt-inflation, capture its packets with AF_PACKET to a pcap file in this directory, referenced by Capture in its flow record (requires CAP_NET_RAW, empty disables)")
+	var cpu = flag.Duration("capture-duration", DEFAULT_CAPTURE_DURATION,
+		"maximum duration of each packet capture (units required)")
+	var cpa = flag.Int("capture-max-active", DEFAULT_CAPTURE_MAX_ACTIVE,
+		"maximum packet captures in progress at once, beyond which triggered captures are skipped (0 for unlimited)")
+	var cps = flag.String("capture-max-size", DEFAULT_CAPTURE_MAX_SIZE,
+		"maximum size of each pcap file (suffixes K, M and G supported)")
+	var cpr = flag.Float64("capture-retrans-rate", DEFAULT_CAPTURE_RETRANS_RATE,
+		"capture flows whose fraction of bytes sent that were retransmitted reaches this, after at least 64K sent (0 disables)")
+	var cpi = flag.Float64("capture-rtt-inflation", DEFAULT_CAPTURE_RTT_INFLATION,
+		"capture flows whose ratio of RTT to min RTT reaches this (e.g. 4, 0 disables)")
+	var cpn = flag.Int("capture-snaplen", DEFAULT_CAPTURE_SNAPLEN,
+		"maximum bytes captured per packet, from the IP header")
+	var exi = flag.String("experiment-id", DEFAULT_EXPERIMENT_ID,
+		"enable experiment mode with this ID, writing phase marker records and tagging flows started in each phase (phases set with /experiment?phase=name on the http server)")
+	var exp = flag.String("experiment-phase", DEFAULT_EXPERIMENT_PHASE,
+		"initial experiment phase label for -experiment-id")
+	var fds = flag.String("filter-dscp", DEFAULT_FILTER_DSCP,
+		"comma separated DSCP classes to sample, by name (e.g. ef, af41, cs1, le) or value (0-63), from the IP TOS or IPv6 traffic class")
+	var fdf = flag.String("filter-dst-file", DEFAULT_FILTER_DST_FILE,
+		"only sample flows to destinations in this file of CIDRs, IPs and host names (one per line), reloaded when it changes")
+	var lag = flag.Bool("log-aggregator", DEFAULT_LOG_AGGREGATOR, "enable aggregator logging")
+	var lal = flag.Bool("log-all", DEFAULT_LOG_ALL, "enable all logging")
+	var lga = flag.Bool("log-analyzer", DEFAULT_LOG_ANALYZER, "enable analyzer logging")
+	var lgc = flag.Bool("log-capture", DEFAULT_LOG_CAPTURE, "enable packet capture logging")
+	var lgf = flag.Bool("log-filter", DEFAULT_LOG_FILTER, "enable destination filter logging")
+	var lgn = flag.Bool("log-netlink", DEFAULT_LOG_NETLINK, "enable netlink logging")
+	var lgo = flag.Bool("log-otlp", DEFAULT_LOG_OTLP, "enable OTLP span exporter logging")
+	var lgq = flag.Bool("log-qdisc", DEFAULT_LOG_QDISC, "enable qdisc collector logging")
+	var lrw = flag.Bool("log-remote-write", DEFAULT_LOG_REMOTE_WRITE, "enable remote_write logging")
+	var lrp = flag.Bool("log-replay", DEFAULT_LOG_REPLAY, "enable replay sampler logging")
+	var lgs = flag.Bool("log-summary", DEFAULT_LOG_SUMMARY, "enable host summary logging")
+	var lsy = flag.Bool("log-synthetic", DEFAULT_LOG_SYNTHETIC, "enable synthetic sampler logging")
+	var lgy = flag.Bool("log-syslog", DEFAULT_LOG_SYSLOG, "send logging to syslog")
+	var lgt = flag.Bool("log-tracker", DEFAULT_LOG_TRACKER, "enable tracker logging")
+	var lgw = flag.Bool("log-writer", DEFAULT_LOG_WRITER, "enable writer logging")
+	var nbe = flag.String("netlink-backend", DEFAULT_NETLINK_BACKEND,
+		"netlink sampler implementation, cgo: C implementation, go: pure Go implementation")
+	var ncl = flag.String("netlink-clock", DEFAULT_NETLINK_CLOCK,
+		"sample timestamp clock, monotonic: CLOCK_MONOTONIC, which stops during suspend, boottime: CLOCK_BOOTTIME, which includes time suspended, for hosts that suspend")
+	var nds = flag.Bool("netlink-destroyed", DEFAULT_NETLINK_DESTROYED,
+		"end flows immediately when their sockets are destroyed, using sock_diag destroy broadcasts (requires CAP_NET_ADMIN)")
+	var ndp = flag.String("netlink-dport", DEFAULT_NETLINK_DPORT,
+		"kernel space filter on dest (peer) port ranges (format: a,b-c)")
+	var ndn = flag.String("netlink-dst-net", DEFAULT_NETLINK_DST_NET,
+		"kernel space filter on dest (peer) networks (format: 192.0.2.0/24,2001:db8::/32)")
+	var nfm = flag.String("netlink-family", DEFAULT_NETLINK_FAMILY,
+		"address families to sample, all: IPv4 and IPv6, 4: IPv4 only, 6: IPv6 only")
+	var nfe = flag.String("netlink-filter", DEFAULT_NETLINK_FILTER,
+		"kernel space filter expression, like ss's, AND'd with the other filters, with terms sport, dport, src, dst, mark and state combined with and, or, not and parentheses (e.g. \"dport 443 and src 10.0.0.0/8 and state established\"), with its states overriding -netlink-states")
+	var nif = flag.String("netlink-interface", DEFAULT_NETLINK_INTERFACE,
+		"comma separated names of interfaces whose sockets are sampled, by bound interface or else the egress interface of the route to the destination (filtered in user space, e.g. eth0,eth1)")
+	var nmk = flag.String("netlink-mark", DEFAULT_NETLINK_MARK,
+		"kernel space filter on socket marks, requires CAP_NET_ADMIN (format: mark[/mask],... e.g. 0x10/0xf0,0x1)")
+	var nns = flag.String("netlink-netns", DEFAULT_NETLINK_NETNS,
+		"comma separated paths of network namespaces to sample (e.g. /var/run/netns/NAME or /proc/PID/ns/net), or all for the namespaces found at startup, with each sampled as its own group when more than one (requires CAP_SYS_ADMIN)")
+	var nts = flag.String("netlink-timestamp", DEFAULT_NETLINK_TIMESTAMP,
+		"sample timestamp source, recv: monotonic time of each netlink receive, dump: monotonic time anchored to the wall clock before each dump request")
+	var nui = flag.String("netlink-uid", DEFAULT_NETLINK_UID,
+		"comma separated socket owner UIDs or user names to sample (filtered in user space, as inet_diag can't filter by UID)")
+	var nrb = flag.Int("netlink-read-bufsize", DEFAULT_NETLINK_READ_BUFSIZE,
+		"netlink receive buffer size (>32K no benefit at least in kernels 4.9-5.2)")
+	var nsb = flag.Int("netlink-receive-bufsize", DEFAULT_NETLINK_RECEIVE_BUFSIZE,
+		"netlink socket receive buffer size")
+	var nsbf = flag.Int("netlink-receive-bufsize-force", DEFAULT_NETLINK_RECEIVE_BUFSIZE_FORCE,
+		"netlink socket force receive buffer size, requires CAP_NET_ADMIN or root")
+	var nrt = flag.Duration("netlink-receive-timeout", DEFAULT_NETLINK_RECEIVE_TIMEOUT,
+		"netlink socket receive timeout")
+	var nsh = flag.Int("netlink-shards", DEFAULT_NETLINK_SHARDS,
+		"number of parallel dumps, each with its own netlink socket and kernel filter for an equal range of ports, for hosts where one dump takes longer than the sample interval (0 for one per CPU)")
+	var nsy = flag.String("netlink-shard-by", DEFAULT_NETLINK_SHARD_BY,
+		"port to shard dumps by, sport or dport, which should be the ephemeral port for most flows (dport for servers, sport for clients)")
+	var nsp = flag.String("netlink-sport", DEFAULT_NETLINK_SPORT,
+		"kernel space filter on source (local) port ranges (format: a,b-c)")
+	var nsn = flag.String("netlink-src-net", DEFAULT_NETLINK_SRC_NET,
+		"kernel space filter on source (local) networks (format: 192.0.2.0/24,2001:db8::/32)")
+	var nst = flag.String("netlink-states", DEFAULT_NETLINK_STATES,
+		"comma separated TCP states to dump, as named by ss (e.g. established,fin-wait-1,close-wait) or all (time-wait and syn-recv request sockets have no tcp_info, so are not sampled)")
+	var oti = flag.Duration("otlp-interval", DEFAULT_OTLP_INTERVAL,
+		"interval on which to export queued flow spans to -otlp-url (units required)")
+	var otu = flag.String("otlp-url", DEFAULT_OTLP_URL,
+		"export each ended flow as an OpenTelemetry span to this OTLP/HTTP traces URL, using JSON encoding (e.g. http://collector:4318/v1/traces)")
+	var qdf = flag.String("qdisc-file", defaultQdiscFile,
+		"output filename for qdisc stats records, in -writer-dir")
+	var qdi = flag.String("qdisc-interfaces", DEFAULT_QDISC_INTERFACES,
+		"comma separated interfaces for which to collect tc qdisc stats, and record flow egress interfaces (empty disables)")
+	var qdv = flag.Duration("qdisc-interval", DEFAULT_QDISC_INTERVAL,
+		"interval on which to collect qdisc stats (units required)")
+	var rwi = flag.Duration("remote-write-interval", DEFAULT_REMOTE_WRITE_INTERVAL,
+		"interval on which to push per-port flow series to -remote-write-url (units required)")
+	var rwp = flag.String("remote-write-ports", DEFAULT_REMOTE_WRITE_PORTS,
+		"comma separated ports with their own remote_write series, with other flows under port=\"other\" (if unset, the lower of each flow's ports is used, which may have high cardinality)")
+	var rwu = flag.String("remote-write-url", DEFAULT_REMOTE_WRITE_URL,
+		"push per-port ended flow counts, bytes, retransmits and RTT quantiles to this Prometheus remote_write URL (e.g. http://mimir:8080/api/v1/push)")
+	var rpf = flag.String("replay-file", DEFAULT_REPLAY_FILE,
+		"replay samples from this trace file, or output written with -analyzer-raw-samples, instead of sampling with netlink, and exit when done")
+	var rcg = flag.String("run-cgroup", DEFAULT_RUN_CGROUP,
+		"place cgmon in this cgroup v2 (relative to "+cgroup.DefaultRoot+") on startup, if permitted")
+	var rcc = flag.Float64("run-cgroup-cpu-max", DEFAULT_RUN_CGROUP_CPU_MAX,
+		"CPU limit for -run-cgroup as a fraction of one CPU (e.g. 0.05, 0 for no limit)")
+	var rcm = flag.String("run-cgroup-memory-max", DEFAULT_RUN_CGROUP_MEMORY_MAX,
+		"memory limit for -run-cgroup (suffixes K, M and G supported)")
+	var rcj = flag.Duration("run-clock-jump", DEFAULT_RUN_CLOCK_JUMP,
+		"change in the wall - timestamp clock offset between dumps (e.g. from suspend or a wall clock step) above which tracked flows are marked with ClockJump (0 to disable)")
+	var rdt = flag.Bool("run-deterministic", DEFAULT_RUN_DETERMINISTIC,
+		"with -replay-file or -synthetic-flows, run serially without waiting between samples, on a simulated clock starting at the Unix epoch that advances by the sample interval, so the output is reproducible (e.g. for golden-file tests)")
+	var rdr = flag.Duration("run-duration", DEFAULT_RUN_DURATION,
+		"run duration (units required, default unlimited)")
+	var red = flag.Duration("run-error-delay", DEFAULT_RUN_ERROR_DELAY,
+		"initial exponential backoff wait time after sample error occurs")
+	var rgr = flag.String("run-groups", DEFAULT_RUN_GROUPS,
+		"semicolon separated sample groups, each a name=interval followed by space separated filters that override the -netlink flags (sport, dport, src-net, dst-net, mark, uid or states=value), with earlier groups taking precedence (e.g. \"web=100ms dport=443; rest=5s\")")
+	var riv = flag.Duration("run-interval", DEFAULT_RUN_INTERVAL, "sample interval (units required)")
+	var rll = flag.Bool("run-landlock", DEFAULT_RUN_LANDLOCK,
+		"after initialization, restrict file writes to -writer-dir using landlock (best effort, kernel 5.13+)")
+	var rme = flag.Int("run-max-errors", DEFAULT_RUN_MAX_ERRORS,
+		"maximum number of consective sample errors before exit occurs")
+	var rrc = flag.Bool("run-recover", DEFAULT_RUN_RECOVER,
+		"recover from panics in pipeline stages by logging a stack trace and dropping the batch, instead of exiting (sampler panics count as sample errors)")
+	var rsc = flag.Bool("run-seccomp", DEFAULT_RUN_SECCOMP,
+		"after initialization, install a seccomp filter denying syscalls not needed by cgmon (e.g. execve, ptrace, mount), except execve with -writer-exec and setns with -netlink-netns")
+	var rsr = flag.Bool("run-serial", DEFAULT_RUN_SERIAL,
+		"execute pipeline in one, instead of multiple goroutines (threads)")
+	var rhr = flag.Int("run-http-recent-flows", DEFAULT_RUN_HTTP_RECENT_FLOWS,
+		"number of most recently ended flows whose stats are kept in memory and served by the http server at /api/flows/recent, paginated with the offset and limit query parameters, or all as a JSON attachment with export (0 to disable)")
+	var rhs = flag.String("run-http-server", DEFAULT_RUN_HTTP_SERVER,
+		"listen host/port of http server for metrics (e.g. :8080 or localhost:8080)")
+	var rst = flag.Duration("run-shutdown-timeout", DEFAULT_RUN_SHUTDOWN_TIMEOUT,
+		"time to wait after signal for completion of shutdown")
+	var sfa = flag.String("summary-fairness", DEFAULT_SUMMARY_FAIRNESS,
+		"include Jain's fairness index of concurrent flow throughputs in host summaries, grouped by subnet: destination /24 or /64, interface: egress interface (requires -qdisc-interfaces)")
+	var shs = flag.Bool("summary-host", DEFAULT_SUMMARY_HOST,
+		"write sar-style host-level summaries with rolling 1m and 5m windows to the output every minute")
+	var sln = flag.String("summary-links", DEFAULT_SUMMARY_LINKS,
+		"include link byte/packet rates and utilization in host summaries for these comma separated interfaces, or all for all non-loopback interfaces")
+	var syf = flag.Int("synthetic-flows", DEFAULT_SYNTHETIC_FLOWS,
+		"sample this many concurrent synthetic flows instead of using netlink, to benchmark the pipeline (0 to disable)")
+	var syi = flag.Float64("synthetic-idle", DEFAULT_SYNTHETIC_IDLE,
+		"fraction of synthetic flows whose samples don't change, and are de-duplicated")
+	var syl = flag.Int("synthetic-lifetime", DEFAULT_SYNTHETIC_LIFETIME,
+		"mean lifetime of synthetic flows in samples (exponentially distributed)")
+	var sys = flag.Int64("synthetic-seed", DEFAULT_SYNTHETIC_SEED,
+		"random seed for synthetic flows")
+	var tca = flag.Bool("tracker-cgroup-attribution", DEFAULT_TRACKER_CGROUP_ATTRIBUTION,
+		"resolve socket cgroup IDs (kernel 5.7+) to cgroup paths under "+cgroup.DefaultRoot+", and container and pod IDs")
+	var tct = flag.Duration("tracker-cgroup-cache-ttl", DEFAULT_TRACKER_CGROUP_CACHE_TTL,
+		"time after a scan of the cgroup hierarchy that its paths are used, before resolving cgroup IDs rescans, for hosts where cgroup IDs are reused (units required, 0 for no expiry)")
+	var tcs = flag.Int("tracker-cgroup-negative-size", DEFAULT_TRACKER_CGROUP_NEGATIVE_SIZE,
+		"maximum cgroup IDs cached as unresolvable")
+	var tcg = flag.Duration("tracker-cgroup-negative-ttl", DEFAULT_TRACKER_CGROUP_NEGATIVE_TTL,
+		"time cgroup IDs not found in the hierarchy are cached as unresolvable, so their flows don't cause rescans under high churn (units required, 0 disables)")
+	var tcn = flag.Bool("tracker-connect-attempts", DEFAULT_TRACKER_CONNECT_ATTEMPTS,
+		"write connection attempt records per destination to the flow output, with attempts that connected or failed and their SYN retransmits, from flows first sampled in SYN_SENT (requires syn-sent in -netlink-states)")
+	var thb = flag.Int("tracker-heartbeat", DEFAULT_TRACKER_HEARTBEAT,
+		"keep every Nth consecutive unchanged sample of a flow instead of de-duplicating it, so idle periods keep their time weighting in the output (0 to de-duplicate all)")
+	var tit = flag.Duration("tracker-idle-timeout", DEFAULT_TRACKER_IDLE_TIMEOUT,
+		"end and output flows that haven't sent or received data for this long, by their unchanged data and the kernel's last data activity times (e.g. idle keepalive connections), marked with Idle, resuming them as partial flows if their data changes (units required, 0 to disable)")
+	var tky = flag.String("tracker-key", DEFAULT_TRACKER_KEY,
+		"key that flows are tracked by: tuple (4-tuple only), namespace (4-tuple and network namespace of the sample group, with -netlink-netns) or cookie (4-tuple and socket cookie, so reused 4-tuples start new flows)")
+	var tmf = flag.Int("tracker-max-flows", DEFAULT_TRACKER_MAX_FLOWS,
+		"programmatic limit on max number of active flows (flows still sampled and tracked)")
+	var tmm = flag.String("tracker-max-memory", DEFAULT_TRACKER_MAX_MEMORY,
+		"approximate memory budget for tracked flows, estimated from their sample counts, beyond which new flows are filtered and flows adding samples are shed, with capacity events in the output (suffixes K, M and G supported, empty for unlimited)")
+	var tmx = flag.Int("tracker-max-samples-per-flow", DEFAULT_TRACKER_MAX_SAMPLES_PER_FLOW,
+		"maximum number of samples kept per flow, beyond which samples are dropped by -tracker-sample-policy to bound memory for long flows (0 for unlimited, else at least 3)")
+	var tmd = flag.Duration("tracker-min-duration", DEFAULT_TRACKER_MIN_DURATION,
+		"programmatic limit on minimum duration from first to last sample required to return ended flows (units required, e.g. 500ms)")
+	var tms = flag.Int("tracker-min-samples", DEFAULT_TRACKER_MIN_SAMPLES,
+		"programmatic limit on minimum number of samples required to return ended flows for further processing")
+	var tsc = flag.String("tracker-min-size-classes", DEFAULT_TRACKER_MIN_SIZE_CLASSES,
+		"comma separated size classes of bytes:samples:duration, whose minimum samples and duration override -tracker-min-samples and -tracker-min-duration for flows that acked or received at least bytes, using the largest class reached (e.g. 1M:0:0s keeps any flow of at least 1 MiB; suffixes K, M and G supported)")
+	var tpa = flag.Bool("tracker-process-attribution", DEFAULT_TRACKER_PROCESS_ATTRIBUTION,
+		"attribute new flows to their owning process (PID and name) by scanning /proc for socket inodes, at some cost")
+	var trl = flag.String("tracker-rules", DEFAULT_TRACKER_RULES,
+		"file of rules that tag new flows with a label, recorded in Tag, or drop them, by the first rule matching their src/dst CIDR, src/dst port or process name, one per line (e.g. 'tag cdn dst=203.0.113.0/24 dport=443' or 'drop process=rsync', process requires -tracker-process-attribution)")
+	var tsp = flag.String("tracker-sample-policy", DEFAULT_TRACKER_SAMPLE_POLICY,
+		"policy for dropping samples beyond -tracker-max-samples-per-flow: decimate (keep every Nth sample, doubling N as needed) or reservoir (keep a uniform random sample)")
+	var tsi = flag.Duration("tracker-segment-interval", DEFAULT_TRACKER_SEGMENT_INTERVAL,
+		"cut long-lived flows into segments of this length, outputting each while the flow continues, marked with Segment, Continued and IsFinal, and joined by FlowUID (units required, e.g. 15m, 0 to disable)")
+	var tsh = flag.Int("tracker-shards", DEFAULT_TRACKER_SHARDS,
+		"number of tracker shards, which partition flows by key hash and are updated in parallel, for hosts with many flows (0 or 1 for one)")
+	var ttg = flag.String("tracker-targets", DEFAULT_TRACKER_TARGETS,
+		"comma separated flows of interest, as local:port-remote:port with * as a wildcard (e.g. '*:*-192.0.2.1:443'), which are tracked with all samples, marked Targeted, and never filtered by -tracker-max-flows, -tracker-max-memory, -tracker-min-samples, -tracker-min-duration, drop rules or partial flow omission")
+	var wbi = flag.Duration("writer-batch-interval", DEFAULT_WRITER_BATCH_INTERVAL,
+		"batch flow records and write them this long after the first is pending, to reduce syscalls and flushes at high churn (units required, 0 to disable)")
+	var wbs = flag.Int("writer-batch-size", DEFAULT_WRITER_BATCH_SIZE,
+		"batch flow records and write them when this many are pending (0 to disable)")
+	var wck = flag.Bool("writer-checksum", DEFAULT_WRITER_CHECKSUM,
+		"after each rotation, write a SHA-256 sidecar (FILE"+writer.ChecksumExt+") for the rotated file, and append its checksum, size, record count and time range to the manifest (output file name without extensions + "+writer.ManifestExt+")")
+	var wcl = flag.Int("writer-compression-level", DEFAULT_WRITER_COMPRESSION_LEVEL,
+		"gzip compression level to use (1 to 9 where 9 is best compression)")
+	var wdg = flag.Bool("writer-degraded", DEFAULT_WRITER_DEGRADED,
+		"drop records and continue when writes fail after retries, instead of exiting")
+	var wdr = flag.String("writer-dir", DEFAULT_WRITER_DIR,
+		"write output to files in this directory (if unset, write to stdout)")
+	var wen = flag.String("writer-encoding", DEFAULT_WRITER_ENCODING,
+		"flow record encoding, json: JSON records, delta: compact binary batches of delta encoded columns, for constrained collector links (other records are JSON frames, use with -writer-batch-size or -writer-batch-interval for best results)")
+	var wex = flag.String("writer-exec", DEFAULT_WRITER_EXEC,
+		"pipe output as NDJSON to this command (run with /bin/sh -c, restarted with backoff on exit) instead of stdout or files")
+	var wfi = flag.String("writer-file", defaultWriterFile,
+		"output filename (extension .gz means use compression, suggested extension .json or json.gz)")
+	var wfl = flag.Bool("writer-flush", DEFAULT_WRITER_FLUSH,
+		"flush after every group of results is written (may degrade compression)")
+	var wrt = flag.Int("writer-retries", DEFAULT_WRITER_RETRIES,
+		"number of times to retry a failed write, reopening the output each time")
+	var wrd = flag.Duration("writer-retry-delay", DEFAULT_WRITER_RETRY_DELAY,
+		"initial exponential backoff wait time between write retries, which wait at most 10s in total per write, as they block the pipeline")
+	var wri = flag.Duration("writer-rotate-interval", DEFAULT_WRITER_ROTATE_INTERVAL,
+		"approximate interval on which to rotate output files (units required, e.g. 30s, 15m, 1h)")
+	var wrs = flag.String("writer-rotate-size", DEFAULT_WRITER_ROTATE_SIZE,
+		"approximate output file size to trigger rotation (suffixes K, M and G supported)")
+	var wpl = flag.Bool("writer-partial", DEFAULT_WRITER_PARTIAL,
+		"write flow results that are missing samples (cross startup or shutdown boundaries)")
+	var wpt = flag.String("writer-partition", DEFAULT_WRITER_PARTITION,
+		"move rotated output files into time-partitioned subdirectories of -writer-dir, by the UTC start time of their data: hour (2006/01/02/15), day (2006/01/02) or a custom Go time layout (e.g. year=2006/month=01/day=02/hour=15), or empty for a flat directory")
+	var wvf = flag.Bool("writer-verify", DEFAULT_WRITER_VERIFY,
+		"after each rotation, read back the rotated file to verify that it decompresses and decodes, and that its record count matches, logging failures")
+	var ver = flag.Bool("version", false, "show version number")
+	flag.Parse()
+
+	if *ver {
+		fmt.Printf("%s version %s\n", os.Args[0], cgmon.VERSION)
+		os.Exit(0)
+	}
+
+	if *lal {
+		*lag = true
+		*lga = true
+		*lgc = true
+		*lgf = true
+		*lgn = true
+		*lgo = true
+		*lgq = true
+		*lrw = true
+		*lrp = true
+		*lgs = true
+		*lsy = true
+		*lgt = true
+		*lgw = true
+	}
+
+	if *lgy {
+		var w *syslog.Writer
+		if w, err = syslog.New(syslog.LOG_NOTICE, "cgmon"); err != nil {
+			log.Fatalf("unable to open syslog (%s)", err)
+		}
+		log.Println("sending logging to syslog")
+		log.SetOutput(w)
+	}
+
+	var sports []uint16
+	if *nsp != "" {
+		if sports, err = parsePortRanges(*nsp); err != nil {
+			log.Fatalf("invalid source port range %s (%s)", *nsp, err)
+		}
+	}
+	var dports []uint16
+	if *ndp != "" {
+		if dports, err = parsePortRanges(*ndp); err != nil {
+			log.Fatalf("invalid dest port range %s (%s)", *ndp, err)
+		}
+	}
+	var snets []*net.IPNet
+	if *nsn != "" {
+		if snets, err = parseNets(*nsn); err != nil {
+			log.Fatalf("invalid source network %s (%s)", *nsn, err)
+		}
+	}
+	var dnets []*net.IPNet
+	if *ndn != "" {
+		if dnets, err = parseNets(*ndn); err != nil {
+			log.Fatalf("invalid dest network %s (%s)", *ndn, err)
+		}
+	}
+
+	var marks []netlink.MarkCond
+	if *nmk != "" {
+		if marks, err = parseMarks(*nmk); err != nil {
+			log.Fatalf("invalid socket mark %s (%s)", *nmk, err)
+		}
+	}
+
+	var filt *netlink.Filter
+	if *nfe != "" {
+		if filt, err = netlink.ParseFilter(*nfe); err != nil {
+			log.Fatalf("invalid netlink filter %s (%s)", *nfe, err)
+		}
+	}
+
+	var uids []uint32
+	if *nui != "" {
+		if uids, err = parseUIDs(*nui); err != nil {
+			log.Fatalf("invalid UID %s (%s)", *nui, err)
+		}
+	}
+
+	var rwPorts []uint16
+	if *rwp != "" {
+		if rwPorts, err = parsePorts(*rwp); err != nil {
+			log.Fatalf("invalid remote_write ports %s (%s)", *rwp, err)
+		}
+	}
+
+	var states uint32
+	if states, err = parseStates(*nst); err != nil {
+		log.Fatalf("invalid TCP states %s (%s)", *nst, err)
+	}
+
+	var ipv4, ipv6 bool
+	switch *nfm {
+	case "all":
+		ipv4, ipv6 = true, true
+	case "4":
+		ipv4 = true
+	case "6":
+		ipv6 = true
+	default:
+		log.Fatalf("unrecognized address family: %s", *nfm)
+	}
+
+	var dumpTimestamps bool
+	if *nts == "dump" {
+		dumpTimestamps = true
+	} else if *nts != "recv" {
+		log.Fatalf("unrecognized timestamp source: %s", *nts)
+	}
+
+	var bootTime bool
+	if *ncl == "boottime" {
+		bootTime = true
+	} else if *ncl != "monotonic" {
+		log.Fatalf("unrecognized timestamp clock: %s", *ncl)
+	}
+
+	var ackind stat.CumulantKind
+	if ackind, err = parseCumulantKind(*ack); err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	var rotateSize uint64
+	if *wrs != "" {
+		if rotateSize, err = parseSize(*wrs); err != nil {
+			log.Fatalf("unable to parse writer rotate size: %s", *wrs)
+		}
+	}
+
+	var maxMemory uint64
+	if *tmm != "" {
+		if maxMemory, err = parseSize(*tmm); err != nil {
+			log.Fatalf("unable to parse tracker max memory: %s", *tmm)
+		}
+	}
+
+	var cgroupMemoryMax uint64
+	if *rcm != "" {
+		if cgroupMemoryMax, err = parseSize(*rcm); err != nil {
+			log.Fatalf("unable to parse cgroup memory max: %s", *rcm)
+		}
+	}
+
+	if *wcl < 1 || *wcl > 9 {
+		log.Fatalf("invalid compression level %d, must be 1-9", *wcl)
+	}
+
+	if *abp < 0 || *abp > 32 {
+		log.Fatalf("invalid baseline prefix length %d, must be 0-32", *abp)
+	}
+	if *abp6 < 0 || *abp6 > 128 {
+		log.Fatalf("invalid IPv6 baseline prefix length %d, must be 0-128", *abp6)
+	}
+
+	var plugins []analyzer.Plugin
+	if *awp != "" {
+		for _, path := range strings.Split(*awp, ",") {
+			var p analyzer.Plugin
+			if p, err = wasmplugin.Load(path, *awt); err != nil {
+				log.Fatalf("unable to load WASM plugin %s (%s)", path, err)
+			}
+			plugins = append(plugins, p)
+		}
+	}
+
+	if *brp < 1 {
+		log.Fatalf("invalid budget repeat %d, must be at least 1", *brp)
+	}
+
+	if *ac1 && *ac2 {
+		log.Fatalf("multiple adjusted correlations may not be used at the same time")
+	}
+
+	var qdiscIfaces []string
+	if *qdi != "" {
+		qdiscIfaces = strings.Split(*qdi, ",")
+	}
+
+	var filterIfaces []string
+	if *nif != "" {
+		filterIfaces = strings.Split(*nif, ",")
+	}
+
+	var dscps []uint8
+	if *fds != "" {
+		for _, s := range strings.Split(*fds, ",") {
+			var d uint8
+			if d, err = filter.ParseDSCP(s); err != nil {
+				log.Fatalf("invalid DSCP filter %s (%s)", *fds, err)
+			}
+			dscps = append(dscps, d)
+		}
+	}
+
+	if *sfa != "" && *sfa != summary.FairnessSubnet &&
+		*sfa != summary.FairnessInterface {
+		log.Fatalf("unrecognized fairness grouping: %s", *sfa)
+	}
+
+	var summaryLinks bool
+	var summaryLinkIfaces []string
+	if *sln != "" {
+		summaryLinks = true
+		if *sln != "all" {
+			summaryLinkIfaces = strings.Split(*sln, ",")
+		}
+	}
+
+	var writeDirs []string
+	if *wdr != "" {
+		writeDirs = append(writeDirs, *wdr)
+	}
+	if *cpd != "" {
+		writeDirs = append(writeDirs, *cpd)
+	}
+
+	var captureSize uint64
+	if captureSize, err = parseSize(*cps); err != nil {
+		log.Fatalf("unable to parse capture max size: %s", *cps)
+	}
+
+	shards := *nsh
+	if shards == 0 {
+		shards = runtime.NumCPU()
+	}
+
+	ncfg := netlink.Config{
+		*nrb,
+		*nsb,
+		*nsbf,
+		sports,
+		dports,
+		snets,
+		dnets,
+		marks,
+		filt,
+		uids,
+		*nrt,
+		dumpTimestamps,
+		bootTime,
+		ipv4,
+		ipv6,
+		states,
+		*nbe,
+		"",
+		shards,
+		*nsy,
+		*lgn,
+	}
+
+	var nss []netlink.Netns
+	if nss, err = parseNetns(*nns); err != nil {
+		log.Fatalf("unable to list network namespaces (%s)", err)
+	}
+	if len(nss) == 1 {
+		ncfg.Netns = nss[0].Path
+	}
+
+	var groups []cgmon.SampleGroup
+	if *rgr != "" {
+		if groups, err = parseGroups(*rgr, ncfg); err != nil {
+			log.Fatalf("invalid sample groups %s (%s)", *rgr, err)
+		}
+	}
+	if len(nss) > 1 {
+		groups = netnsGroups(groups, ncfg, *riv, nss)
+	}
+	netns := make([]string, len(groups))
+	for i, g := range groups {
+		netns[i] = g.Netlink.Netns
+	}
+	if err = tracker.CheckMaxSamples(*tmx, *tsp); err != nil {
+		log.Fatalf("invalid tracker max samples (%s)", err)
+	}
+	var keyer tracker.Keyer
+	if keyer, err = tracker.NewKeyer(*tky, netns); err != nil {
+		log.Fatalf("invalid tracker key (%s)", err)
+	}
+	var rules *tracker.Rules
+	if *trl != "" {
+		if rules, err = tracker.LoadRules(*trl); err != nil {
+			log.Fatalf("unable to load tracker rules (%s)", err)
+		}
+	}
+	var sizeClasses []tracker.SizeClass
+	if *tsc != "" {
+		if sizeClasses, err = parseSizeClasses(*tsc); err != nil {
+			log.Fatalf("invalid tracker size classes (%s)", err)
+		}
+	}
+	var targets []tracker.Target
+	if *ttg != "" {
+		if targets, err = tracker.ParseTargets(*ttg); err != nil {
+			log.Fatalf("invalid tracker targets (%s)", err)
+		}
+	}
+	var partition string
+	if partition, err = writer.PartitionLayout(*wpt); err != nil {
+		log.Fatalf("invalid writer partition (%s)", err)
+	}
+
+	acfg := analyzer.Config{
+		*riv,
+		ackind,
+		*auc,
+		*auq,
+		*ac1,
+		*ac2,
+		*abp,
+		*abp6,
+		*abt,
+		*afd,
+		plugins,
+		nil,
+		*ars,
+		0,
+		*amr,
+		*ats,
+		*anm,
+		nil,
+		*lga,
+	}
+
+	var compare *analyzer.Config
+	if *acp != "" {
+		if compare, err = parseCompare(*acp, acfg); err != nil {
+			log.Fatalf("invalid analyzer comparison %s (%s)", *acp, err)
+		}
+		if acfg.Name == "" {
+			acfg.Name = "default"
+		}
+		if compare.Name == acfg.Name {
+			log.Fatalf("analyzer comparison name %s must differ from -analyzer-name",
+				compare.Name)
+		}
+	}
+
+	// each kind of record has its own writer, and their output would interleave
+	// on stdout
+	if *wdr == "" {
+		var stdout []string
+		if *wex == "" {
+			stdout = append(stdout, "flow")
+		}
+		if *agi > 0 {
+			stdout = append(stdout, "aggregate")
+		}
+		if *qdi != "" {
+			stdout = append(stdout, "qdisc")
+		}
+		if n := len(stdout); n > 1 {
+			log.Fatalf("%s and %s records can't share stdout (use -writer-dir)",
+				strings.Join(stdout[:n-1], ", "), stdout[n-1])
+		}
+	}
+
+	var clk *clock.Manual
+	if *rdt {
+		if *rpf == "" && *syf == 0 {
+			log.Fatalf("-run-deterministic requires -replay-file or -synthetic-flows")
+		}
+		clk = clock.NewManual(time.Unix(0, 0).UTC())
+	}
+
+	cfg := &cgmon.Config{
+		ncfg,
+		replay.Config{
+			*rpf,
+			*lrp,
+		},
+		synthetic.Config{
+			*syf,
+			*syl,
+			*syi,
+			*sys,
+			nil,
+			nil,
+			*lsy,
+		},
+		tracker.Config{
+			*tmf,
+			*tms,
+			*tmd,
+			sizeClasses,
+			*agi > 0 || *shs,
+			*tpa,
+			*tca,
+			cgroup.CacheConfig{
+				*tct,
+				*tcg,
+				*tcs,
+			},
+			*shs && *sfa != "",
+			*tit,
+			*thb,
+			*tsi,
+			*tmx,
+			*tsp,
+			keyer,
+			*tsh,
+			maxMemory,
+			*tcn,
+			nil,
+			rules,
+			targets,
+			nil,
+			*lgt,
+		},
+		acfg,
+		compare,
+		writer.Config{
+			*wdr,
+			*wfi,
+			*wcl,
+			*wfl,
+			*wri,
+			rotateSize,
+			*wpl,
+			*wex,
+			*wrt,
+			*wrd,
+			*wdg,
+			*wbs,
+			*wbi,
+			*wen,
+			*wvf,
+			*wck,
+			partition,
+			*lgw,
+		},
+		sandbox.Config{
+			*rsc,
+			*rll,
+			writeDirs,
+			len(nss) > 0,
+			*wex != "",
+		},
+		aggregator.Config{
+			*agi,
+			*lag,
+		},
+		writer.Config{
+			*wdr,
+			*agf,
+			*wcl,
+			*wfl,
+			*wri,
+			rotateSize,
+			*wpl,
+			"",
+			*wrt,
+			*wrd,
+			*wdg,
+			0,
+			0,
+			"",
+			*wvf,
+			*wck,
+			partition,
+			*lgw,
+		},
+		summary.Config{
+			*shs,
+			summaryLinks,
+			summaryLinkIfaces,
+			*sfa,
+			*lgs,
+		},
+		cgmon.BudgetConfig{
+			*bsm,
+			*bcv,
+			*btr,
+			*ban,
+			*bwr,
+			*brp,
+			*bad,
+			*bmi,
+		},
+		qdisc.Config{
+			qdiscIfaces,
+			*qdv,
+			*lgq,
+		},
+		writer.Config{
+			*wdr,
+			*qdf,
+			*wcl,
+			*wfl,
+			*wri,
+			rotateSize,
+			*wpl,
+			"",
+			*wrt,
+			*wrd,
+			*wdg,
+			0,
+			0,
+			"",
+			*wvf,
+			*wck,
+			partition,
+			*lgw,
+		},
+		filter.Config{
+			*fdf,
+			filterIfaces,
+			dscps,
+			*lgf,
+		},
+		remotewrite.Config{
+			*rwu,
+			*rwi,
+			rwPorts,
+			hostname,
+			*lrw,
+		},
+		otlp.Config{
+			*otu,
+			*oti,
+			"cgmon",
+			hostname,
+			cgmon.VERSION,
+			*lgo,
+		},
+		capture.Config{
+			*cpd,
+			*cpr,
+			*cpi,
+			*cpu,
+			int(captureSize),
+			*cpn,
+			*cpa,
+			*lgc,
+		},
+		*rsr || *rdt,
+		*rhs,
+		*rhr,
+		*riv,
+		groups,
+		*nds,
+		*rcj,
+		clk,
+		*rdr,
+		*rme,
+		*red,
+		*rst,
+		*rrc,
+		nil,
+		nil,
+		false,
+		*exi,
+		*exp,
+	}
+
+	log.Printf("cgmon version %s started", cgmon.VERSION)
+
+	if *rcg != "" {
+		ccfg := cgroup.Config{
+			Name:      *rcg,
+			CPUMax:    *rcc,
+			MemoryMax: cgroupMemoryMax,
+		}
+		if err = cgroup.Confine(ccfg); err != nil {
+			log.Printf("unable to confine to cgroup %s, continuing (%s)", *rcg, err)
+		} else {
+			log.Printf("confined to cgroup %s", *rcg)
+		}
+	}
+
+	run(cfg)
+}
+
+func run(cfg *cgmon.Config) {
+	var a *cgmon.App
+	var err error
+
+	if a, err = cgmon.New(cfg); err != nil {
+		log.Fatalf("initialization failed (%s)", err)
+	}
+
+	if cfg.Sandbox.Seccomp || cfg.Sandbox.Landlock {
+		if err = sandbox.Apply(cfg.Sandbox); err != nil {
+			log.Fatalf("unable to apply sandbox (%s)", err)
+		}
+		log.Printf("sandbox applied")
+	}
+
+	done := make(chan bool, 2)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		defer func() {
+			done <- true
+		}()
+		printMetrics := func() {
+			log.Printf("reading metrics\n" + a.DumpMetrics())
+		}
+		for {
+			sig := <-sigs
+			log.Println("received signal:", sig)
+			if sig == syscall.SIGUSR1 {
+				printMetrics()
+			} else if sig == syscall.SIGUSR2 {
+				log.Println("running full GC")
+				runtime.GC()
+				printMetrics()
+			} else {
+				if err := a.Stop(); err != nil {
+					log.Printf("error on stop (%s)", err)
+				}
+				break
+			}
+		}
+	}()
+
+	go func() {
+		defer func() {
+			done <- true
+		}()
+		if err := a.Run(context.Background()); err != nil {
+			log.Fatalf("run failed (%s)", err)
+		} else {
+			log.Println("successful termination")
+		}
+	}()
+
+	<-done
+}
+
+// parsePortRanges takes a comma separated list of dash separated ranges and
+// returns those ranges as tuples flattened inrt a slice.
+func parsePortRanges(s string) (ranges []uint16, err error) {
+	for _, cp := range strings.Split(s, ",") {
+		var lo, hi int
+		dp := strings.Split(cp, "-")
+		if lo, err = strconv.Atoi(dp[0]); err != nil {
+			return
+		}
+		if len(dp) > 1 {
+			if hi, err = strconv.Atoi(dp[1]); err != nil {
+				return
+			}
+		} else {
+			hi = lo
+		}
+		ranges = append(ranges, uint16(lo), uint16(hi))
+	}
+	return
+}
+
+// parsePorts takes a comma separated list of ports and returns them.
+func parsePorts(s string) (ports []uint16, err error) {
+	for _, n := range strings.Split(s, ",") {
+		var p uint64
+		if p, err = strconv.ParseUint(strings.TrimSpace(n), 10, 16); err != nil {
+			return
+		}
+		if p == 0 {
+			err = fmt.Errorf("port 0 is not valid")
+			return
+		}
+		ports = append(ports, uint16(p))
+	}
+	return
+}
+
+// parseNets takes a comma separated list of CIDRs and returns the networks.
+func parseNets(s string) (nets []*net.IPNet, err error) {
+	for _, c := range strings.Split(s, ",") {
+		var n *net.IPNet
+		if _, n, err = net.ParseCIDR(strings.TrimSpace(c)); err != nil {
+			return
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+// parseMarks takes a comma separated list of marks with optional masks
+// (mark[/mask]) and returns them as mark conditions.
+func parseMarks(s string) (marks []netlink.MarkCond, err error) {
+	for _, m := range strings.Split(s, ",") {
+		var mark, mask uint64
+		mm := strings.SplitN(strings.TrimSpace(m), "/", 2)
+		if mark, err = strconv.ParseUint(mm[0], 0, 32); err != nil {
+			return
+		}
+		mask = 0xffffffff
+		if len(mm) > 1 {
+			if mask, err = strconv.ParseUint(mm[1], 0, 32); err != nil {
+				return
+			}
+		}
+		marks = append(marks, netlink.MarkCond{uint32(mark & mask), uint32(mask)})
+	}
+	return
+}
+
+// parseUIDs takes a comma separated list of UIDs or user names and returns
+// the UIDs.
+func parseUIDs(s string) (uids []uint32, err error) {
+	for _, n := range strings.Split(s, ",") {
+		n = strings.TrimSpace(n)
+		var u uint64
+		if u, err = strconv.ParseUint(n, 10, 32); err != nil {
+			var usr *user.User
+			if usr, err = user.Lookup(n); err != nil {
+				return
+			}
+			if u, err = strconv.ParseUint(usr.Uid, 10, 32); err != nil {
+				return
+			}
+		}
+		uids = append(uids, uint32(u))
+	}
+	return
+}
+
+// parseStates takes a comma separated list of TCP state names, or all, and
+// returns them as a bitmask.
+func parseStates(s string) (states uint32, err error) {
+	for _, n := range strings.Split(s, ",") {
+		n = strings.TrimSpace(n)
+		if n == "all" {
+			for st := range linux.TCPStateNames {
+				states |= 1 << st
+			}
+			continue
+		}
+		var ok bool
+		for st, sn := range linux.TCPStateNames {
+			if sn == n {
+				states |= 1 << st
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			err = fmt.Errorf("unknown state: %s", n)
+			return
+		}
+	}
+	return
+}
+
+// parseGroups takes a semicolon separated list of sample groups and returns
+// them, with each group's filters overriding those in the base netlink config.
+func parseGroups(s string, base netlink.Config) (groups []cgmon.SampleGroup,
+	err error) {
+	for _, gs := range strings.Split(s, ";") {
+		fs := strings.Fields(gs)
+		if len(fs) == 0 {
+			err = fmt.Errorf("empty group")
+			return
+		}
+		ni := strings.SplitN(fs[0], "=", 2)
+		if len(ni) < 2 || ni[0] == "" {
+			err = fmt.Errorf("group %s must start with name=interval", fs[0])
+			return
+		}
+		g := cgmon.SampleGroup{Name: ni[0], Netlink: base}
+		if g.Interval, err = time.ParseDuration(ni[1]); err != nil {
+			return
+		}
+		if g.Interval <= 0 {
+			err = fmt.Errorf("group %s interval must be positive", g.Name)
+			return
+		}
+		for _, f := range fs[1:] {
+			kv := strings.SplitN(f, "=", 2)
+			if len(kv) < 2 {
+				err = fmt.Errorf("group %s filter %s must be key=value",
+					g.Name, f)
+				return
+			}
+			nc := &g.Netlink
+			switch kv[0] {
+			case "sport":
+				nc.SrcPorts, err = parsePortRanges(kv[1])
+			case "dport":
+				nc.DstPorts, err = parsePortRanges(kv[1])
+			case "src-net":
+				nc.SrcNets, err = parseNets(kv[1])
+			case "dst-net":
+				nc.DstNets, err = parseNets(kv[1])
+			case "mark":
+				nc.Marks, err = parseMarks(kv[1])
+			case "uid":
+				nc.UIDs, err = parseUIDs(kv[1])
+			case "states":
+				nc.States, err = parseStates(kv[1])
+			default:
+				err = fmt.Errorf("group %s has unknown filter %s", g.Name, kv[0])
+			}
+			if err != nil {
+				return
+			}
+		}
+		groups = append(groups, g)
+	}
+	return
+}
+
+// parseCumulantKind returns the cumulant kind for its name.
+func parseCumulantKind(s string) (k stat.CumulantKind, err error) {
+	switch s {
+	case "empirical":
+		k = stat.Empirical
+	case "lininterp":
+		k = stat.LinInterp
+	default:
+		err = fmt.Errorf("unrecognized cumulant kind: %s", s)
+	}
+	return
+}
+
+// parseCompare takes a name followed by space separated options and returns
+// an analyzer config for comparison, with the options overriding those in the
+// base config.
+func parseCompare(s string, base analyzer.Config) (cfg *analyzer.Config,
+	err error) {
+	fs := strings.Fields(s)
+	if len(fs) == 0 {
+		err = fmt.Errorf("empty comparison")
+		return
+	}
+	c := base
+	c.Name = fs[0]
+	if strings.Contains(c.Name, "=") {
+		err = fmt.Errorf("comparison %s must start with a name", fs[0])
+		return
+	}
+	for _, f := range fs[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) < 2 {
+			err = fmt.Errorf("option %s must be key=value", f)
+			return
+		}
+		switch kv[0] {
+		case "cumulant-kind":
+			c.CumulantKind, err = parseCumulantKind(kv[1])
+		case "unweighted-correlations":
+			c.UnweightedCorrelations, err = strconv.ParseBool(kv[1])
+		case "unweighted-quantiles":
+			c.UnweightedQuantiles, err = strconv.ParseBool(kv[1])
+		case "adjusted-correlation-1":
+			c.AdjustedCC1, err = strconv.ParseBool(kv[1])
+		case "adjusted-correlation-2":
+			c.AdjustedCC2, err = strconv.ParseBool(kv[1])
+		case "baseline-prefix":
+			c.BaselinePrefixLen, err = strconv.Atoi(kv[1])
+		case "baseline-prefix6":
+			c.BaselinePrefixLen6, err = strconv.Atoi(kv[1])
+		case "baseline-ttl":
+			c.BaselineTTL, err = time.ParseDuration(kv[1])
+		case "flow-deadline":
+			c.FlowDeadline, err = time.ParseDuration(kv[1])
+		case "raw-samples":
+			c.RawSamples, err = strconv.ParseBool(kv[1])
+		case "min-rtt-series":
+			c.MinRTTSeries, err = strconv.ParseBool(kv[1])
+		case "throughput-series":
+			c.ThroughputSeries, err = strconv.ParseBool(kv[1])
+		default:
+			err = fmt.Errorf("unknown option %s", kv[0])
+		}
+		if err != nil {
+			return
+		}
+	}
+	if c.AdjustedCC1 && c.AdjustedCC2 {
+		err = fmt.Errorf("multiple adjusted correlations may not be used at the same time")
+		return
+	}
+	cfg = &c
+	return
+}
+
+// parseNetns takes a comma separated list of network namespace paths, or all,
+// and returns the namespaces.
+func parseNetns(s string) (nss []netlink.Netns, err error) {
+	switch s {
+	case "":
+	case "all":
+		nss, err = netlink.AllNetns()
+	default:
+		for _, p := range strings.Split(s, ",") {
+			n := filepath.Base(p)
+			if strings.HasPrefix(p, "/proc/") {
+				n = "pid" + strings.Split(p, "/")[2]
+			}
+			nss = append(nss, netlink.Netns{n, p})
+		}
+	}
+	return
+}
+
+// netnsGroups returns a sample group for each of the given groups in each
+// network namespace, named group/namespace, or one group per namespace for the
+// base netlink config and interval if there are no groups.
+func netnsGroups(groups []cgmon.SampleGroup, base netlink.Config,
+	interval time.Duration, nss []netlink.Netns) (ngs []cgmon.SampleGroup) {
+	if len(groups) == 0 {
+		groups = []cgmon.SampleGroup{{"", base, interval}}
+	}
+	for _, g := range groups {
+		for _, ns := range nss {
+			h := g
+			h.Netlink.Netns = ns.Path
+			if h.Name = ns.Name; g.Name != "" {
+				h.Name = g.Name + "/" + ns.Name
+			}
+			ngs = append(ngs, h)
+		}
+	}
+	return
+}
+
+// parseSize parses a size in bytes, with optional suffixes K, M and G.
+func parseSize(s string) (size uint64, err error) {
+	m := uint64(1)
+	if strings.HasSuffix(s, "K") {
+		m = 1024
+		s = strings.TrimSuffix(s, "K")
+	} else if strings.HasSuffix(s, "M") {
+		m = 1024 * 1024
+		s = strings.TrimSuffix(s, "M")
+	} else if strings.HasSuffix(s, "G") {
+		m = 1024 * 1024 * 1024
+		s = strings.TrimSuffix(s, "G")
+	}
+	if size, err = strconv.ParseUint(s, 10, 64); err != nil {
+		return
+	}
+	size *= m
+	return
+}
+
+// parseSizeClasses parses a comma separated list of tracker size classes, each
+// of the form bytes:samples:duration.
+func parseSizeClasses(s string) (classes []tracker.SizeClass, err error) {
+	for _, v := range strings.Split(s, ",") {
+		f := strings.Split(strings.TrimSpace(v), ":")
+		if len(f) != 3 {
+			err = fmt.Errorf("invalid size class '%s' (expected bytes:samples:duration)",
+				v)
+			return
+		}
+		var c tracker.SizeClass
+		if c.MinBytes, err = parseSize(f[0]); err != nil {
+			return
+		}
+		if c.MinSamples, err = strconv.Atoi(f[1]); err != nil {
+			return
+		}
+		if c.MinDuration, err = time.ParseDuration(f[2]); err != nil {
+			return
+		}
+		classes = append(classes, c)
+	}
+	return
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/heistp/cgmon/analyzer"
+	"github.com/heistp/cgmon/report"
+	"github.com/heistp/cgmon/writer"
+)
+
+// reportMain runs the report subcommand, which summarizes the flows in one or
+// more output files, as a self-contained HTML report or plain text.
+func reportMain(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(),
+			"usage: %s report [flags] file...\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	var htm = fs.Bool("html", false, "write an HTML report, instead of plain text")
+	var out = fs.String("o", "", "output file (default stdout)")
+	var anl = fs.String("analysis", "",
+		"select the flows from the analyzer configuration with this name (see -analyzer-name and -analyzer-compare), instead of the primary configuration")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var flows []*analyzer.FlowStats
+	for _, path := range fs.Args() {
+		f, err := writer.ReadFlowStatsFile(path)
+		if err != nil {
+			log.Fatalf("unable to read flows from %s (%s)", path, err)
+		}
+		flows = append(flows, writer.SelectAnalysis(f, *anl)...)
+	}
+	r := report.New(flows, fs.Args())
+
+	w := os.Stdout
+	if *out != "" {
+		var err error
+		if w, err = os.Create(*out); err != nil {
+			log.Fatalf("unable to create %s (%s)", *out, err)
+		}
+	}
+	bw := bufio.NewWriter(w)
+	var err error
+	if *htm {
+		err = r.WriteHTML(bw)
+	} else {
+		err = r.WriteText(bw)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil && w != os.Stdout {
+		err = w.Close()
+	}
+	if err != nil {
+		log.Fatalf("write error (%s)", err)
+	}
+}
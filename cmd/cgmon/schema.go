@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+
+	"github.com/heistp/cgmon"
+	"github.com/heistp/cgmon/analyzer"
+	"github.com/heistp/cgmon/schema"
+)
+
+// schemaMain runs the schema subcommand, which writes a description of the
+// flow records in the output, generated from the FlowStats type and its field
+// comments, as JSON Schema or protobuf definitions.
+func schemaMain(args []string) {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s schema [flags]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	var pro = fs.Bool("proto", false, "write protobuf definitions, instead of JSON Schema")
+	var pkg = fs.String("proto-package", "cgmon", "protobuf package name")
+	var out = fs.String("o", "", "output file (default stdout)")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	docs, err := analyzer.FieldDocs()
+	if err != nil {
+		log.Fatalf("unable to read field docs (%s)", err)
+	}
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			log.Fatalf("unable to create %s (%s)", *out, err)
+		}
+	}
+	t := reflect.TypeOf(analyzer.FlowStats{})
+	if *pro {
+		err = schema.WriteProto(w, t, docs, *pkg, cgmon.VERSION)
+	} else {
+		err = schema.WriteJSONSchema(w, t, docs, cgmon.VERSION)
+	}
+	if err == nil && w != os.Stdout {
+		err = w.Close()
+	}
+	if err != nil {
+		log.Fatalf("write error (%s)", err)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/heistp/cgmon/analyzer"
+	"github.com/heistp/cgmon/writer"
+)
+
+// seriesMain runs the series subcommand, which extracts one flow's sampled
+// values from output written with -analyzer-raw-samples,
+// -analyzer-min-rtt-series and/or -analyzer-throughput-series, and writes a CSV
+// file per metric, with an optional gnuplot script to plot them.
+func seriesMain(args []string) {
+	fs := flag.NewFlagSet("series", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(),
+			"usage: %s series [flags] file\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	var src = fs.String("src", "",
+		"select flows by source address, as host:port, where either may be empty (e.g. :5201)")
+	var dst = fs.String("dst", "",
+		"select flows by destination address, as host:port, where either may be empty (e.g. 10.0.0.1:)")
+	var idx = fs.Int("index", 0, "index of the flow to extract, among the selected flows")
+	var lst = fs.Bool("list", false, "list the selected flows with sampled values, and exit")
+	var out = fs.String("o", ".", "output directory")
+	var gnu = fs.Bool("gnuplot", false, "also write a gnuplot script (series.gp) that plots the CSV files")
+	var anl = fs.String("analysis", "",
+		"select the flows from the analyzer configuration with this name (see -analyzer-name and -analyzer-compare), instead of the primary configuration")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	flows, err := writer.ReadFlowStatsFile(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("unable to read flows from %s (%s)", fs.Arg(0), err)
+	}
+	var sel []*analyzer.FlowStats
+	for _, s := range writer.SelectAnalysis(flows, *anl) {
+		if s.RawSamples == nil && s.MinRTTSeries == nil &&
+			s.ThroughputSeries == nil {
+			continue
+		}
+		if !matchAddr(*src, s.ID.SrcIP, s.ID.SrcPort) ||
+			!matchAddr(*dst, s.ID.DstIP, s.ID.DstPort) {
+			continue
+		}
+		sel = append(sel, s)
+	}
+
+	if *lst {
+		for i, s := range sel {
+			fmt.Printf("%d\t%s\t%s\t%s\t%d samples\n", i,
+				net.JoinHostPort(s.ID.SrcIP.String(), strconv.Itoa(int(s.ID.SrcPort))),
+				net.JoinHostPort(s.ID.DstIP.String(), strconv.Itoa(int(s.ID.DstPort))),
+				s.StartTime.Format("2006-01-02T15:04:05.000Z07:00"), s.Samples)
+		}
+		return
+	}
+	if len(sel) == 0 {
+		log.Fatalf("no selected flows with sampled values in %s (written with -analyzer-raw-samples, -analyzer-min-rtt-series or -analyzer-throughput-series?)",
+			fs.Arg(0))
+	}
+	if *idx < 0 || *idx >= len(sel) {
+		log.Fatalf("index %d out of range, %d flows selected", *idx, len(sel))
+	}
+	s := sel[*idx]
+
+	if err = os.MkdirAll(*out, 0755); err != nil {
+		log.Fatalf("unable to create %s (%s)", *out, err)
+	}
+	cs := flowColumns(s)
+	for _, c := range cs {
+		if err = writeSeriesCSV(filepath.Join(*out, c.Name+".csv"), c.Column,
+			c.time); err != nil {
+			log.Fatalf("unable to write %s series (%s)", c.Name, err)
+		}
+	}
+	if *gnu {
+		if err = writeGnuplot(filepath.Join(*out, "series.gp"), s, cs); err != nil {
+			log.Fatalf("unable to write gnuplot script (%s)", err)
+		}
+	}
+	log.Printf("wrote %d series of %d samples to %s", len(cs), s.Samples, *out)
+}
+
+// A timedColumn is a column with its times, which differ between series (e.g.
+// ThroughputSeries has one per interval, not per sample).
+type timedColumn struct {
+	analyzer.Column
+	time []float64
+}
+
+// flowColumns returns the columns of a flow's RawSamples, MinRTTSeries and
+// ThroughputSeries, whichever are present, with their times.
+func flowColumns(s *analyzer.FlowStats) (cs []timedColumn) {
+	add := func(t []float64, c []analyzer.Column) {
+		for _, v := range c {
+			cs = append(cs, timedColumn{v, t})
+		}
+	}
+	if s.RawSamples != nil {
+		add(s.RawSamples.Time, s.RawSamples.Columns())
+	}
+	if s.MinRTTSeries != nil {
+		add(s.MinRTTSeries.Time, s.MinRTTSeries.Columns())
+	}
+	if s.ThroughputSeries != nil {
+		add(s.ThroughputSeries.Time, s.ThroughputSeries.Columns())
+	}
+	return
+}
+
+// matchAddr returns true if the IP and port match the host:port spec, where an
+// empty spec, host or port matches any.
+func matchAddr(spec string, ip net.IP, port uint16) bool {
+	if spec == "" {
+		return true
+	}
+	h, p, err := net.SplitHostPort(spec)
+	if err != nil {
+		log.Fatalf("invalid address %s (%s)", spec, err)
+	}
+	if h != "" && !net.ParseIP(h).Equal(ip) {
+		return false
+	}
+	if p != "" && p != strconv.Itoa(int(port)) {
+		return false
+	}
+	return true
+}
+
+// writeSeriesCSV writes a CSV file with the time and values of a column.
+func writeSeriesCSV(path string, c analyzer.Column, t []float64) (err error) {
+	var f *os.File
+	if f, err = os.Create(path); err != nil {
+		return
+	}
+	defer func() {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "time_s,%s\n", c.Name)
+	for i, v := range c.Values {
+		fmt.Fprintf(w, "%s,%s\n", strconv.FormatFloat(t[i], 'f', -1, 64),
+			strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	err = w.Flush()
+	return
+}
+
+// writeGnuplot writes a gnuplot script that plots each column's CSV file in a
+// stacked multiplot, to series.png.
+func writeGnuplot(path string, s *analyzer.FlowStats,
+	cs []timedColumn) (err error) {
+	var f *os.File
+	if f, err = os.Create(path); err != nil {
+		return
+	}
+	defer func() {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "# %s:%d -> %s:%d, started %s\n", s.ID.SrcIP, s.ID.SrcPort,
+		s.ID.DstIP, s.ID.DstPort, s.StartTime.Format("2006-01-02T15:04:05.000Z07:00"))
+	fmt.Fprintf(w, "set terminal pngcairo size 1200,%d\n", 200*len(cs))
+	fmt.Fprintf(w, "set output 'series.png'\n")
+	fmt.Fprintf(w, "set datafile separator ','\n")
+	fmt.Fprintf(w, "set key autotitle columnhead\n")
+	fmt.Fprintf(w, "set grid\n")
+	fmt.Fprintf(w, "set multiplot layout %d,1\n", len(cs))
+	for i, c := range cs {
+		if i == len(cs)-1 {
+			fmt.Fprintf(w, "set xlabel 'time (s)'\n")
+		}
+		fmt.Fprintf(w, "plot '%s.csv' using 1:2 with steps\n", c.Name)
+	}
+	fmt.Fprintf(w, "unset multiplot\n")
+	err = w.Flush()
+	return
+}
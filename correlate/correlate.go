@@ -0,0 +1,107 @@
+// Package correlate matches the flow records written by cgmon on both
+// endpoints of connections, to combine the sender and receiver side views.
+package correlate
+
+import (
+	"net"
+	"time"
+
+	"github.com/heistp/cgmon/analyzer"
+)
+
+// A Record contains the matched flow records from the two endpoints of a
+// connection. The sender is the endpoint that had more bytes acked.
+type Record struct {
+	Sender      *analyzer.FlowStats // sender side flow
+	Receiver    *analyzer.FlowStats // receiver side flow
+	SenderHost  string              // name of the sender's input (e.g. its file)
+	StartOffset time.Duration       // receiver StartTime minus sender StartTime, including clock offset
+	EndOffset   time.Duration       // receiver EndTime minus sender EndTime, including clock offset
+}
+
+// A Result contains the matched Records, with counts of the flows that
+// weren't matched.
+type Result struct {
+	Records    []*Record
+	UnmatchedA int // flows from the first input with no match
+	UnmatchedB int // flows from the second input with no match
+}
+
+// tuple is a flow 4-tuple, with IPv4 addresses in 16 byte form.
+type tuple struct {
+	srcIP   [16]byte
+	srcPort uint16
+	dstIP   [16]byte
+	dstPort uint16
+}
+
+func newTuple(srcIP net.IP, srcPort uint16, dstIP net.IP,
+	dstPort uint16) (t tuple) {
+	copy(t.srcIP[:], srcIP.To16())
+	t.srcPort = srcPort
+	copy(t.dstIP[:], dstIP.To16())
+	t.dstPort = dstPort
+	return
+}
+
+// Match matches the flows in a and b that are the two ends of a connection,
+// by their reversed 4-tuples, and overlapping times within maxSkew, which
+// should cover the clock offset between the hosts. When a tuple was reused,
+// the candidate with the closest start time is chosen. The names of a and b
+// are used to set SenderHost.
+//
+// Tuples are compared as seen by each host, so flows through NAT aren't
+// matched.
+func Match(a []*analyzer.FlowStats, nameA string, b []*analyzer.FlowStats,
+	nameB string, maxSkew time.Duration) (r Result) {
+	idx := make(map[tuple][]*analyzer.FlowStats)
+	for _, s := range b {
+		t := newTuple(s.ID.SrcIP, s.ID.SrcPort, s.ID.DstIP, s.ID.DstPort)
+		idx[t] = append(idx[t], s)
+	}
+	used := make(map[*analyzer.FlowStats]bool)
+
+	for _, sa := range a {
+		t := newTuple(sa.ID.DstIP, sa.ID.DstPort, sa.ID.SrcIP, sa.ID.SrcPort)
+		var sb *analyzer.FlowStats
+		var best time.Duration
+		for _, c := range idx[t] {
+			if used[c] || !overlap(sa, c, maxSkew) {
+				continue
+			}
+			d := absDuration(c.StartTime.Sub(sa.StartTime))
+			if sb == nil || d < best {
+				sb, best = c, d
+			}
+		}
+		if sb == nil {
+			r.UnmatchedA++
+			continue
+		}
+		used[sb] = true
+
+		rec := &Record{sa, sb, nameA, 0, 0}
+		if sb.BytesAcked > sa.BytesAcked {
+			rec.Sender, rec.Receiver, rec.SenderHost = sb, sa, nameB
+		}
+		rec.StartOffset = rec.Receiver.StartTime.Sub(rec.Sender.StartTime)
+		rec.EndOffset = rec.Receiver.EndTime.Sub(rec.Sender.EndTime)
+		r.Records = append(r.Records, rec)
+	}
+	r.UnmatchedB = len(b) - len(used)
+
+	return
+}
+
+// overlap returns true if the times of two flows overlap, within maxSkew.
+func overlap(a, b *analyzer.FlowStats, maxSkew time.Duration) bool {
+	return !a.StartTime.After(b.EndTime.Add(maxSkew)) &&
+		!b.StartTime.After(a.EndTime.Add(maxSkew))
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,125 @@
+package cgmon
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/heistp/cgmon/analyzer"
+)
+
+// maxPhases is the maximum number of past experiment phases kept for tagging
+// flows.
+const maxPhases = 1024
+
+// MarkerType is the Type of marker records.
+const MarkerType = "marker"
+
+// Marker events.
+const (
+	MarkerStart = "start"
+	MarkerStop  = "stop"
+)
+
+// A Marker is an output record marking the start or stop of an experiment
+// phase.
+type Marker struct {
+	Type       string    // record type, always MarkerType
+	Time       time.Time // time of the event
+	Experiment string    // experiment ID
+	Phase      string    // phase label
+	Event      string    // MarkerStart or MarkerStop
+}
+
+// phase is one labeled period of an experiment.
+type phase struct {
+	name  string
+	start time.Time
+	end   time.Time // zero for the current phase
+}
+
+// experiment keeps the phase history for an experiment.
+type experiment struct {
+	id     string
+	phases []phase
+	sync.Mutex
+}
+
+// mark stops the current phase, if any, and starts a new one if name is not
+// empty, returning the markers for the changes.
+func (e *experiment) mark(name string, now time.Time) (ms []*Marker) {
+	e.Lock()
+	defer e.Unlock()
+
+	if n := len(e.phases); n > 0 && e.phases[n-1].end.IsZero() {
+		p := &e.phases[n-1]
+		p.end = now
+		ms = append(ms, &Marker{MarkerType, now, e.id, p.name, MarkerStop})
+	}
+
+	if name != "" {
+		e.phases = append(e.phases, phase{name, now, time.Time{}})
+		if len(e.phases) > maxPhases {
+			e.phases = e.phases[len(e.phases)-maxPhases:]
+		}
+		ms = append(ms, &Marker{MarkerType, now, e.id, name, MarkerStart})
+	}
+
+	return
+}
+
+// phaseAt returns the name of the phase in progress at the given time, or the
+// empty string if there was none.
+func (e *experiment) phaseAt(t time.Time) string {
+	e.Lock()
+	defer e.Unlock()
+
+	for i := len(e.phases) - 1; i >= 0; i-- {
+		p := &e.phases[i]
+		if t.Before(p.start) {
+			continue
+		}
+		if p.end.IsZero() || t.Before(p.end) {
+			return p.name
+		}
+		break
+	}
+	return ""
+}
+
+// tag sets the experiment ID and phase for flows started during a phase.
+func (e *experiment) tag(fs []*analyzer.FlowStats) {
+	for _, s := range fs {
+		if p := e.phaseAt(s.StartTime); p != "" {
+			s.Experiment = e.id
+			s.Phase = p
+		}
+	}
+}
+
+// Mark starts a new experiment phase, writing marker records to the output
+// and tagging flows started during the phase with the experiment ID and phase
+// label. An empty phase stops the current phase. Config.Experiment must be set.
+func (a *App) Mark(phase string) (err error) {
+	if a.exp == nil {
+		err = fmt.Errorf("experiment mode not enabled")
+		return
+	}
+
+	ms := a.exp.mark(phase, a.now())
+	for _, m := range ms {
+		log.Printf("experiment %s phase %s %s", m.Experiment, m.Phase, m.Event)
+	}
+	if a.writer == nil || len(ms) == 0 {
+		return
+	}
+
+	v := make([]interface{}, len(ms))
+	for i := range ms {
+		v[i] = ms[i]
+	}
+	err = a.writer.WriteValues(v...)
+
+	return
+}
@@ -0,0 +1,95 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/heistp/cgmon/sampler"
+)
+
+// dscpNames maps DSCP class names to values (RFC 2474, 2597, 3246, 5865 and
+// 8622).
+var dscpNames = map[string]uint8{
+	"cs0":  0,
+	"cs1":  8,
+	"cs2":  16,
+	"cs3":  24,
+	"cs4":  32,
+	"cs5":  40,
+	"cs6":  48,
+	"cs7":  56,
+	"af11": 10,
+	"af12": 12,
+	"af13": 14,
+	"af21": 18,
+	"af22": 20,
+	"af23": 22,
+	"af31": 26,
+	"af32": 28,
+	"af33": 30,
+	"af41": 34,
+	"af42": 36,
+	"af43": 38,
+	"ef":   46,
+	"va":   44,
+	"le":   1,
+	"be":   0,
+}
+
+// ParseDSCP parses a DSCP class name (e.g. ef, af41, cs1) or value (0-63).
+func ParseDSCP(s string) (d uint8, err error) {
+	var ok bool
+	if d, ok = dscpNames[strings.ToLower(s)]; ok {
+		return
+	}
+	var v uint64
+	if v, err = strconv.ParseUint(s, 0, 6); err != nil {
+		err = fmt.Errorf("unknown DSCP class %s", s)
+	}
+	d = uint8(v)
+	return
+}
+
+// A DSCPFilter filters samples by the DSCP of the socket's IP TOS or IPv6
+// traffic class.
+type DSCPFilter struct {
+	dscps   [64]bool
+	metrics Metrics
+}
+
+// NewDSCPFilter returns a new DSCPFilter for the configured DSCP values.
+func NewDSCPFilter(cfg Config) *DSCPFilter {
+	f := &DSCPFilter{}
+	for _, d := range cfg.DSCPs {
+		if !f.dscps[d&0x3f] {
+			f.dscps[d&0x3f] = true
+			f.metrics.Entries++
+		}
+	}
+	return f
+}
+
+// Filter removes samples whose DSCP isn't one of the configured values, in
+// place, and returns the resulting slice.
+func (f *DSCPFilter) Filter(ss []sampler.Sample) []sampler.Sample {
+	n := 0
+	for i := range ss {
+		if f.dscps[ss[i].DSCP&0x3f] {
+			ss[n] = ss[i]
+			n++
+		}
+	}
+	if d := len(ss) - n; d > 0 {
+		f.metrics.recordFiltered(d)
+	}
+
+	return ss[:n]
+}
+
+func (f *DSCPFilter) Metrics() (m Metrics) {
+	f.metrics.RLock()
+	defer f.metrics.RUnlock()
+	m = f.metrics
+	return
+}
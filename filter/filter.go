@@ -0,0 +1,290 @@
+// Package filter restricts sampling to destinations in an allow-list file,
+// which is reloaded when it changes, to sockets on given interfaces, and to
+// given DSCP classes.
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/heistp/cgmon/sampler"
+)
+
+// inotify events that indicate the file changed, including replacement by
+// rename, as done by many editors and automation tools.
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO
+
+// A Config contains the filter configuration.
+type Config struct {
+	DstFile    string   // path of the destination allow-list file
+	Interfaces []string // names of interfaces whose sockets are sampled (all if empty)
+	DSCPs      []uint8  // DSCP values of sockets sampled (all if empty)
+	Log        bool     // if true, logging is enabled
+}
+
+// Metrics contains the filter metrics.
+type Metrics struct {
+	Entries  int    // number of networks in the allow-list, interfaces or DSCPs
+	Reloads  uint64 // successful reloads after the initial load
+	Errors   uint64 // failed reloads (the previous allow-list is kept)
+	Filtered uint64 // samples dropped by the filter
+	sync.RWMutex
+}
+
+func (m *Metrics) recordLoad(entries int, reload bool) {
+	m.Lock()
+	defer m.Unlock()
+	m.Entries = entries
+	if reload {
+		m.Reloads++
+	}
+}
+
+func (m *Metrics) recordError() {
+	m.Lock()
+	defer m.Unlock()
+	m.Errors++
+}
+
+func (m *Metrics) recordFiltered(n int) {
+	m.Lock()
+	defer m.Unlock()
+	m.Filtered += uint64(n)
+}
+
+// network is an IP network with 16 byte address and mask (IPv4 is v4-mapped).
+type network struct {
+	ip   [16]byte
+	mask [16]byte
+}
+
+func (n *network) contains(ip *[16]byte) bool {
+	for i := 0; i < 16; i++ {
+		if ip[i]&n.mask[i] != n.ip[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// A DstFilter filters samples by destination, using an allow-list of CIDRs,
+// IP addresses and host names, one per line. Blank lines and lines starting
+// with # are ignored. Host names are resolved on each load.
+//
+// Flows to destinations removed from the allow-list appear to the tracker to
+// have ended.
+type DstFilter struct {
+	Config
+	nets    []network
+	metrics Metrics
+	watch   *os.File
+	mtx     sync.RWMutex
+}
+
+// NewDstFilter returns a new DstFilter, loading the allow-list and starting a
+// watch for changes.
+func NewDstFilter(cfg Config) (f *DstFilter, err error) {
+	nf := &DstFilter{Config: cfg}
+	if err = nf.load(false); err != nil {
+		return
+	}
+	if err = nf.startWatch(); err != nil {
+		return
+	}
+	f = nf
+	return
+}
+
+// Filter removes samples whose destinations aren't in the allow-list, in
+// place, and returns the resulting slice.
+func (f *DstFilter) Filter(ss []sampler.Sample) []sampler.Sample {
+	f.mtx.RLock()
+	nets := f.nets
+	f.mtx.RUnlock()
+
+	n := 0
+	for i := range ss {
+		if allowed(nets, &ss[i].DstIP) {
+			ss[n] = ss[i]
+			n++
+		}
+	}
+	if d := len(ss) - n; d > 0 {
+		f.metrics.recordFiltered(d)
+	}
+
+	return ss[:n]
+}
+
+func (f *DstFilter) Metrics() (m Metrics) {
+	f.metrics.RLock()
+	defer f.metrics.RUnlock()
+	m = f.metrics
+	return
+}
+
+// Close stops watching for changes.
+func (f *DstFilter) Close() error {
+	return f.watch.Close()
+}
+
+func allowed(nets []network, ip *[16]byte) bool {
+	for i := range nets {
+		if nets[i].contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// load reads the allow-list file and replaces the current allow-list.
+func (f *DstFilter) load(reload bool) (err error) {
+	var b []byte
+	if b, err = os.ReadFile(f.DstFile); err != nil {
+		return
+	}
+
+	var nets []network
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for ln := 1; sc.Scan(); ln++ {
+		l := strings.TrimSpace(sc.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		var ns []network
+		if ns, err = parseEntry(l); err != nil {
+			err = fmt.Errorf("%s:%d: %s", f.DstFile, ln, err)
+			return
+		}
+		nets = append(nets, ns...)
+	}
+	if err = sc.Err(); err != nil {
+		return
+	}
+
+	f.mtx.Lock()
+	f.nets = nets
+	f.mtx.Unlock()
+	f.metrics.recordLoad(len(nets), reload)
+
+	if f.Log || reload {
+		log.Printf("loaded %d destination filter entries from %s", len(nets),
+			f.DstFile)
+	}
+
+	return
+}
+
+// parseEntry parses one allow-list entry, which may be a CIDR, an IP address
+// or a host name.
+func parseEntry(l string) (ns []network, err error) {
+	if strings.Contains(l, "/") {
+		var ipn *net.IPNet
+		if _, ipn, err = net.ParseCIDR(l); err != nil {
+			return
+		}
+		ns = append(ns, newNetwork(ipn.IP, ipn.Mask))
+		return
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(l); ip != nil {
+		ips = []net.IP{ip}
+	} else if ips, err = net.LookupIP(l); err != nil {
+		return
+	}
+	for _, ip := range ips {
+		ns = append(ns, newNetwork(ip, nil))
+	}
+	return
+}
+
+// newNetwork returns a network for the given IP and mask, or a host network if
+// the mask is nil.
+func newNetwork(ip net.IP, mask net.IPMask) (n network) {
+	copy(n.ip[:], ip.To16())
+	if mask == nil {
+		for i := range n.mask {
+			n.mask[i] = 0xff
+		}
+	} else {
+		m := mask
+		if len(m) == net.IPv4len {
+			// v4-mapped prefix must match too
+			m = append(net.CIDRMask(96, 128)[:12:12], m...)
+		}
+		copy(n.mask[:], m)
+	}
+	for i := range n.ip {
+		n.ip[i] &= n.mask[i]
+	}
+	return
+}
+
+// startWatch starts watching the allow-list file's directory with inotify,
+// reloading the file when it changes.
+func (f *DstFilter) startWatch() (err error) {
+	var fd int
+	if fd, err = syscall.InotifyInit1(syscall.IN_CLOEXEC |
+		syscall.IN_NONBLOCK); err != nil {
+		return
+	}
+	dir := filepath.Dir(f.DstFile)
+	if _, err = syscall.InotifyAddWatch(fd, dir, watchMask); err != nil {
+		syscall.Close(fd)
+		return
+	}
+	f.watch = os.NewFile(uintptr(fd), "inotify")
+	go f.watchLoop(filepath.Base(f.DstFile))
+	return
+}
+
+func (f *DstFilter) watchLoop(name string) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := f.watch.Read(buf)
+		if err != nil {
+			if f.Log {
+				log.Printf("destination filter watch exiting (%s)", err)
+			}
+			return
+		}
+		if changed(buf[:n], name) {
+			if err := f.load(true); err != nil {
+				f.metrics.recordError()
+				log.Printf("error reloading destination filter, keeping previous (%s)",
+					err)
+			}
+		}
+	}
+}
+
+// changed returns true if any of the inotify events in b are for the named
+// file.
+func changed(b []byte, name string) bool {
+	for len(b) >= syscall.SizeofInotifyEvent {
+		e := (*syscall.InotifyEvent)(unsafe.Pointer(&b[0]))
+		l := syscall.SizeofInotifyEvent + int(e.Len)
+		if l > len(b) {
+			break
+		}
+		n := b[syscall.SizeofInotifyEvent:l]
+		if i := bytes.IndexByte(n, 0); i >= 0 {
+			n = n[:i]
+		}
+		if string(n) == name {
+			return true
+		}
+		b = b[l:]
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/heistp/cgmon/qdisc"
+	"github.com/heistp/cgmon/sampler"
+)
+
+// An IfaceFilter filters samples by interface. Sockets bound to an interface
+// (SO_BINDTODEVICE) are matched by the bound interface, and unbound sockets by
+// the egress interface of the route to their destination, which is cached.
+type IfaceFilter struct {
+	names   map[string]bool
+	indexes map[uint32]bool
+	routes  *qdisc.Collector
+	metrics Metrics
+}
+
+// NewIfaceFilter returns a new IfaceFilter for the configured interfaces,
+// which must exist.
+func NewIfaceFilter(cfg Config) (f *IfaceFilter, err error) {
+	nf := &IfaceFilter{
+		names:   make(map[string]bool),
+		indexes: make(map[uint32]bool),
+	}
+	for _, n := range cfg.Interfaces {
+		var i *net.Interface
+		if i, err = net.InterfaceByName(n); err != nil {
+			err = fmt.Errorf("interface %s (%s)", n, err)
+			return
+		}
+		nf.names[i.Name] = true
+		nf.indexes[uint32(i.Index)] = true
+	}
+	if nf.routes, err = qdisc.NewCollector(qdisc.Config{Log: cfg.Log}); err != nil {
+		return
+	}
+	nf.metrics.Entries = len(nf.names)
+	f = nf
+	return
+}
+
+// Filter removes samples whose sockets aren't bound to, or routed over, one of
+// the configured interfaces, in place, and returns the resulting slice.
+func (f *IfaceFilter) Filter(ss []sampler.Sample) []sampler.Sample {
+	n := 0
+	for i := range ss {
+		if f.match(&ss[i]) {
+			ss[n] = ss[i]
+			n++
+		}
+	}
+	if d := len(ss) - n; d > 0 {
+		f.metrics.recordFiltered(d)
+	}
+
+	return ss[:n]
+}
+
+// match returns true if the sample's socket is bound to one of the interfaces,
+// or it's unbound and the route to its destination uses one of them.
+func (f *IfaceFilter) match(s *sampler.Sample) bool {
+	if s.Ifindex != 0 {
+		return f.indexes[s.Ifindex]
+	}
+	return f.names[f.routes.Interface(s.DstIP)]
+}
+
+func (f *IfaceFilter) Metrics() (m Metrics) {
+	f.metrics.RLock()
+	defer f.metrics.RUnlock()
+	m = f.metrics
+	return
+}
+
+// Close closes the netlink socket used for route lookups.
+func (f *IfaceFilter) Close() error {
+	return f.routes.Close()
+}
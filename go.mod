@@ -4,5 +4,6 @@ go 1.19
 
 require (
 	github.com/pkg/profile v1.6.0
+	github.com/tetratelabs/wazero v1.5.0
 	gonum.org/v1/gonum v0.12.0
 )
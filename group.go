@@ -0,0 +1,165 @@
+package cgmon
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/heistp/cgmon/netlink"
+	"github.com/heistp/cgmon/replay"
+	"github.com/heistp/cgmon/sampler"
+	"github.com/heistp/cgmon/synthetic"
+)
+
+// A SampleGroup contains the config for a group of flows sampled with their
+// own netlink filter and interval. Groups are multiplexed onto the shared
+// tracker, and earlier groups take precedence for flows matched by more than
+// one.
+type SampleGroup struct {
+	Name     string         // group name, for metrics and logging
+	Netlink  netlink.Config // netlink config, including the group's filter
+	Interval time.Duration  // time between sample calls
+}
+
+// sampleGroup is an open SampleGroup.
+type sampleGroup struct {
+	SampleGroup
+	index    int             // index of the group, for the tracker
+	sampler  sampler.Sampler // group's sampler
+	interval time.Duration   // current sample interval, raised when adapting
+	next     time.Time       // time of the next sample
+	offset   time.Duration   // wall - timestamp clock offset of the last result, for clock jumps
+	anchored bool            // true if offset is set
+}
+
+// groupResult is a sampler Result from a group, or for destroyed sockets if
+// group is nil.
+type groupResult struct {
+	sampler.Result
+	group *sampleGroup
+}
+
+// groupSamples are the converted samples from a group, or for destroyed
+// sockets if group is nil.
+type groupSamples struct {
+	samples   []sampler.Sample
+	group     *sampleGroup
+	clockJump bool // true if the clock jumped before the samples were taken
+}
+
+// openSampleGroups opens a sampler for each of the configured Groups, or one
+// unnamed group for the Netlink config and Interval if there are none. If a
+// replay file or synthetic flows are configured, one unnamed group uses that
+// sampler instead.
+func openSampleGroups(cfg *Config) (gs []*sampleGroup, err error) {
+	var s sampler.Sampler
+	if cfg.Replay.Path != "" {
+		if s, err = replay.NewSampler(cfg.Replay); err != nil {
+			return
+		}
+	} else if cfg.Synthetic.Flows > 0 {
+		scfg := cfg.Synthetic
+		if cfg.Clock != nil {
+			scfg.Clock = cfg.Clock
+		}
+		s = synthetic.NewSampler(scfg)
+	}
+	if s != nil {
+		gs = []*sampleGroup{{SampleGroup{"", cfg.Netlink, cfg.Interval}, 0, s,
+			cfg.Interval, time.Time{}, 0, false}}
+		return
+	}
+	sgs := cfg.Groups
+	if len(sgs) == 0 {
+		sgs = []SampleGroup{{"", cfg.Netlink, cfg.Interval}}
+	}
+	for i, sg := range sgs {
+		if s, err = netlink.New(sg.Netlink); err != nil {
+			if sg.Name != "" {
+				err = fmt.Errorf("sample group %s: %w", sg.Name, err)
+			}
+			closeSampleGroups(gs)
+			gs = nil
+			return
+		}
+		gs = append(gs, &sampleGroup{sg, i, s, sg.Interval, time.Time{}, 0, false})
+	}
+	return
+}
+
+// closeSampleGroups closes the samplers for the given groups.
+func closeSampleGroups(gs []*sampleGroup) {
+	for _, g := range gs {
+		if c, ok := g.sampler.(sampler.Closer); ok {
+			if e := c.Close(); e != nil {
+				log.Printf("error closing sampler%s (%s)", g.label(), e)
+			}
+		}
+	}
+}
+
+// minInterval returns the shortest current interval of the given groups.
+func minInterval(gs []*sampleGroup) (iv time.Duration) {
+	for _, g := range gs {
+		if iv == 0 || g.interval < iv {
+			iv = g.interval
+		}
+	}
+	return
+}
+
+// nextGroup returns the group with the earliest next sample time.
+func nextGroup(gs []*sampleGroup) (g *sampleGroup) {
+	for _, h := range gs {
+		if g == nil || h.next.Before(g.next) {
+			g = h
+		}
+	}
+	return
+}
+
+// schedule sets the time of the group's next sample to one interval after the
+// last, or one interval from now if that has passed, so missed samples are
+// dropped, as for a time.Ticker.
+func (g *sampleGroup) schedule(now time.Time) {
+	if g.next = g.next.Add(g.interval); g.next.Before(now) {
+		g.next = now.Add(g.interval)
+	}
+}
+
+// netlinkMetrics returns the metrics for the group's netlink sampler, or zero
+// Metrics if its sampler isn't netlink (replay or synthetic).
+func (g *sampleGroup) netlinkMetrics() netlink.Metrics {
+	s, ok := g.sampler.(netlinkMetricser)
+	if !ok {
+		return netlink.Metrics{}
+	}
+	return s.Metrics()
+}
+
+// label returns the group name for log messages, or an empty string if the
+// group is unnamed.
+func (g *sampleGroup) label() string {
+	if g.Name == "" {
+		return ""
+	}
+	return " for group " + g.Name
+}
+
+// destroyedResult is a Result containing samples for destroyed sockets.
+type destroyedResult []sampler.Sample
+
+func (r destroyedResult) Samples() []sampler.Sample {
+	return r
+}
+
+// recycleResult returns the Result to its group's sampler, if it's from a
+// group and the sampler supports it.
+func (r *groupResult) recycleResult() {
+	if r.group == nil {
+		return
+	}
+	if rr, ok := r.group.sampler.(sampler.ResultRecycler); ok {
+		rr.RecycleResult(r.Result)
+	}
+}
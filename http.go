@@ -1,13 +1,19 @@
-package main
+package cgmon
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"runtime"
+	"strconv"
+	"strings"
 	"text/template"
+	"time"
 
 	"github.com/heistp/cgmon/analyzer"
+	"github.com/heistp/cgmon/tracker"
 )
 
 type rootHandler struct {
@@ -28,7 +34,10 @@ func newRootHandler(a *App) *rootHandler {
 </pre>
 
 <a href="/flow-duration-histogram">Show Flow Duration Histogram</a>
-
+| <a href="/rtt-heatmap">Show RTT Heatmap</a>
+| <a href="/flows">Show Tracked Flows</a>
+{{if .Recent}}| <a href="/api/flows/recent">Show Recently Ended Flows</a>
+{{end}}
 <div style="margin-top: 1em">
 <form action="/" method="GET" style="float: left; margin-right: 1em">
     <input type="submit" value="Refresh" />
@@ -54,6 +63,7 @@ func (h *rootHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	d := httpServerData{
 		VERSION,
 		h.app.DumpMetrics(),
+		h.app.recent != nil,
 	}
 
 	if err := h.tmpl.Execute(w, d); err != nil {
@@ -72,7 +82,206 @@ func (h *flowDurationHistogramHandler) ServeHTTP(w http.ResponseWriter, r *http.
 	fmt.Fprintf(w, "\n")
 }
 
+// RTT heatmap SVG layout, in pixels
+const (
+	heatmapCellWidth  = 4
+	heatmapCellHeight = 12
+	heatmapLeft       = 70
+	heatmapTop        = 10
+	heatmapBottom     = 30
+	heatmapRight      = 20
+)
+
+// rttHeatmapHandler renders the analyzer's RTT heatmap as an SVG, with end
+// time on the x axis, flow median RTT on a log y axis, and flow counts as
+// color.
+type rttHeatmapHandler struct {
+	analyzer *analyzer.Analyzer
+}
+
+func (h *rttHeatmapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hm := &h.analyzer.RTTHeatmap
+	cs, max := hm.Columns(time.Now())
+	rows := len(hm.Edges)
+	pw := len(cs) * heatmapCellWidth
+	ph := rows * heatmapCellHeight
+
+	fmt.Fprintf(w, "<html>\n<head>\n<title>cgmon %s RTT heatmap</title>\n</head>\n", VERSION)
+	fmt.Fprintf(w, "<h2>Median RTT of ended flows, by end time (max %d flows per cell)</h2>\n", max)
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="11">`+"\n",
+		heatmapLeft+pw+heatmapRight, heatmapTop+ph+heatmapBottom)
+	fmt.Fprintf(w, `<rect x="%d" y="%d" width="%d" height="%d" fill="#f8f8f8" stroke="#888"/>`+"\n",
+		heatmapLeft, heatmapTop, pw, ph)
+
+	for i, col := range cs {
+		for j, c := range col {
+			if c == 0 {
+				continue
+			}
+			lo := 0.0
+			if j > 0 {
+				lo = hm.Edges[j-1]
+			}
+			fmt.Fprintf(w, `<rect x="%d" y="%d" width="%d" height="%d" fill="%s"><title>%s: %d flows, %s-%s</title></rect>`+"\n",
+				heatmapLeft+i*heatmapCellWidth,
+				heatmapTop+(rows-1-j)*heatmapCellHeight,
+				heatmapCellWidth, heatmapCellHeight, heatColor(c, max),
+				agoString(hm.Interval*time.Duration(len(cs)-1-i)), c,
+				msString(lo), msString(hm.Edges[j]))
+		}
+	}
+
+	// y ticks at powers of ten
+	for j, e := range hm.Edges {
+		if l := math.Log10(e); math.Abs(l-math.Round(l)) > 1e-9 {
+			continue
+		}
+		y := heatmapTop + (rows-1-j)*heatmapCellHeight
+		fmt.Fprintf(w, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#888"/>`+"\n",
+			heatmapLeft-4, y, heatmapLeft, y)
+		fmt.Fprintf(w, `<text x="%d" y="%d" text-anchor="end">%s</text>`+"\n",
+			heatmapLeft-6, y+4, msString(e))
+	}
+
+	// x ticks at quarters
+	for q := 0; q <= 4; q++ {
+		i := q * len(cs) / 4
+		x := heatmapLeft + i*heatmapCellWidth
+		y := heatmapTop + ph
+		fmt.Fprintf(w, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#888"/>`+"\n",
+			x, y, x, y+4)
+		fmt.Fprintf(w, `<text x="%d" y="%d" text-anchor="middle">%s</text>`+"\n",
+			x, y+16, agoString(hm.Interval*time.Duration(len(cs)-i)))
+	}
+
+	fmt.Fprintf(w, "</svg>\n</html>\n")
+}
+
+// heatColor returns a color from light yellow to dark red, by the log of the
+// count relative to the maximum.
+func heatColor(c, max int) string {
+	f := math.Log1p(float64(c)) / math.Log1p(float64(max))
+	lerp := func(a, b float64) int {
+		return int(a + f*(b-a))
+	}
+	return fmt.Sprintf("rgb(%d,%d,%d)", lerp(255, 189), lerp(237, 0),
+		lerp(160, 38))
+}
+
+// msString formats a value in milliseconds with ms or s units.
+func msString(ms float64) string {
+	if ms >= 1000 {
+		return fmt.Sprintf("%.3gs", ms/1000)
+	}
+	return fmt.Sprintf("%.3gms", ms)
+}
+
+// agoString formats a duration before now, without zero minutes or seconds.
+func agoString(d time.Duration) string {
+	if d == 0 {
+		return "now"
+	}
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return "-" + s
+}
+
+// experimentHandler starts and stops experiment phases, with the phase label
+// in the phase query parameter (empty to stop the current phase).
+type experimentHandler struct {
+	app *App
+}
+
+func (h *experimentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h.app.Mark(r.URL.Query().Get("phase")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "ok\n")
+}
+
+// flowsHandler writes a snapshot of the tracked flows, with their latest
+// samples, as JSON.
+type flowsHandler struct {
+	tracker *tracker.Tracker
+}
+
+func (h *flowsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	if err := e.Encode(h.tracker.Flows()); err != nil {
+		log.Printf("http server error writing flows (%s)", err)
+	}
+}
+
+// defaultRecentLimit is the number of flows per page from recentFlowsHandler
+// if no limit is given.
+const defaultRecentLimit = 100
+
+// recentFlowsHandler writes a page of the stats of recently ended flows as
+// JSON, newest first, by the offset and limit query parameters. With the
+// export query parameter, it writes all of the kept stats as a JSON array
+// attachment instead.
+type recentFlowsHandler struct {
+	recent *recentFlows
+}
+
+// recentFlowsPage is a page of recentFlowsHandler output.
+type recentFlowsPage struct {
+	Offset int                   // offset of the first flow from the newest
+	Limit  int                   // maximum number of flows in the page
+	Kept   int                   // number of flows kept
+	Total  uint64                // total number of flows ended since startup
+	Flows  []*analyzer.FlowStats // stats for the flows, newest first
+}
+
+func (h *recentFlowsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	atoi := func(name string, dflt int) (n int, err error) {
+		n = dflt
+		if v := q.Get(name); v != "" {
+			if n, err = strconv.Atoi(v); err == nil && n < 0 {
+				err = fmt.Errorf("%s must not be negative", name)
+			}
+		}
+		return
+	}
+	offset, err := atoi("offset", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := atoi("limit", defaultRecentLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	var v interface{}
+	if _, ok := q["export"]; ok {
+		w.Header().Set("Content-Disposition",
+			`attachment; filename="cgmon-recent-flows.json"`)
+		v, _, _ = h.recent.page(0, 0)
+	} else {
+		p := recentFlowsPage{Offset: offset, Limit: limit}
+		p.Flows, p.Kept, p.Total = h.recent.page(offset, limit)
+		v = p
+	}
+	if err := e.Encode(v); err != nil {
+		log.Printf("http server error writing recent flows (%s)", err)
+	}
+}
+
 type httpServerData struct {
 	Version string
 	Metrics string
+	Recent  bool
 }
@@ -8,3 +8,42 @@ const (
 	TCPI_OPT_ECN_SEEN   = 16 // we received at least one packet with ECT
 	TCPI_OPT_SYN_DATA   = 32 // SYN-ACK acked data in SYN sent or rcvd
 )
+
+// TCP congestion avoidance states (linux/tcp.h)
+const (
+	TCP_CA_Open     = 0 // normal state
+	TCP_CA_Disorder = 1 // dupacks or SACKs seen
+	TCP_CA_CWR      = 2 // cwnd reduced due to ECN or local congestion
+	TCP_CA_Recovery = 3 // fast retransmit / fast recovery
+	TCP_CA_Loss     = 4 // loss recovery after an RTO
+)
+
+// TCP states (net/tcp_states.h)
+const (
+	TCP_ESTABLISHED = 1
+	TCP_SYN_SENT    = 2
+	TCP_SYN_RECV    = 3
+	TCP_FIN_WAIT1   = 4
+	TCP_FIN_WAIT2   = 5
+	TCP_TIME_WAIT   = 6
+	TCP_CLOSE       = 7
+	TCP_CLOSE_WAIT  = 8
+	TCP_LAST_ACK    = 9
+	TCP_LISTEN      = 10
+	TCP_CLOSING     = 11
+)
+
+// TCPStateNames maps TCP states to the names used by ss(8).
+var TCPStateNames = map[uint8]string{
+	TCP_ESTABLISHED: "established",
+	TCP_SYN_SENT:    "syn-sent",
+	TCP_SYN_RECV:    "syn-recv",
+	TCP_FIN_WAIT1:   "fin-wait-1",
+	TCP_FIN_WAIT2:   "fin-wait-2",
+	TCP_TIME_WAIT:   "time-wait",
+	TCP_CLOSE:       "close",
+	TCP_CLOSE_WAIT:  "close-wait",
+	TCP_LAST_ACK:    "last-ack",
+	TCP_LISTEN:      "listen",
+	TCP_CLOSING:     "closing",
+}
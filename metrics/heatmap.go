@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Heatmap counts values in log-spaced rows over a ring of fixed width time
+// columns, for a time vs value view of recent history.
+type Heatmap struct {
+	Interval time.Duration // width of each column
+	Edges    []float64     // upper edges of the rows (the last row includes values above it)
+	cols     [][]int       // ring of columns, indexed by column number
+	last     int64         // number of the newest column (time / Interval)
+	sync.RWMutex
+}
+
+// NewHeatmap returns a Heatmap with the given number of columns of width
+// interval, and rows from min to max with perDecade rows per power of 10.
+func NewHeatmap(interval time.Duration, columns int, min, max float64,
+	perDecade int) (h Heatmap) {
+	h.Interval = interval
+	for k := 1; ; k++ {
+		e := min * math.Pow(10, float64(k)/float64(perDecade))
+		h.Edges = append(h.Edges, e)
+		if e >= max {
+			break
+		}
+	}
+	h.cols = make([][]int, columns)
+	for i := range h.cols {
+		h.cols[i] = make([]int, len(h.Edges))
+	}
+	return
+}
+
+// Push adds a value at time t. Values older than the oldest column are
+// ignored.
+func (h *Heatmap) Push(t time.Time, v float64) {
+	h.Lock()
+	defer h.Unlock()
+
+	c := h.column(t)
+	n := int64(len(h.cols))
+	if c <= h.last-n {
+		return
+	}
+	if c-h.last > n {
+		h.last = c - n
+	}
+	for ; h.last < c; h.last++ {
+		col := h.cols[(h.last+1)%n]
+		for i := range col {
+			col[i] = 0
+		}
+	}
+
+	r := sort.SearchFloat64s(h.Edges, v)
+	if r >= len(h.Edges) {
+		r = len(h.Edges) - 1
+	}
+	h.cols[c%n][r]++
+}
+
+// Columns returns copies of the columns, oldest first, with the last column
+// containing now, and the maximum count in any cell.
+func (h *Heatmap) Columns(now time.Time) (cs [][]int, max int) {
+	h.RLock()
+	defer h.RUnlock()
+
+	n := int64(len(h.cols))
+	nc := h.column(now)
+	cs = make([][]int, n)
+	for i := int64(0); i < n; i++ {
+		cs[i] = make([]int, len(h.Edges))
+		c := nc - n + 1 + i
+		if c > h.last || c <= h.last-n {
+			continue
+		}
+		copy(cs[i], h.cols[c%n])
+		for _, v := range cs[i] {
+			if v > max {
+				max = v
+			}
+		}
+	}
+
+	return
+}
+
+func (h *Heatmap) column(t time.Time) int64 {
+	return t.UnixNano() / int64(h.Interval)
+}
@@ -0,0 +1,169 @@
+package netlink
+
+import (
+	"log"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/heistp/cgmon/sampler"
+)
+
+// sock_diag multicast groups for destroyed TCP sockets (linux/sock_diag.h)
+const (
+	sknlgrpInetTCPDestroy  = 1
+	sknlgrpInet6TCPDestroy = 3
+)
+
+// destroyPollInterval is the receive timeout for destroy broadcasts, which
+// limits how long Receive blocks, so the listener may be stopped.
+const destroyPollInterval = 250 * time.Millisecond
+
+// A DestroyListener receives the sock_diag broadcasts sent when TCP sockets
+// are destroyed, which contain their final tcp_info, so flows may be ended
+// when their sockets close instead of when they miss a sample. Receiving the
+// broadcasts requires CAP_NET_ADMIN. The broadcasts can't be filtered by the
+// kernel, so samples are returned for all destroyed sockets, and sample
+// fields not in the broadcasts (mark, UID, inode and congestion control) are
+// left zero.
+type DestroyListener struct {
+	Config
+	metrics DestroyMetrics
+	fd      int
+	buf     []byte
+}
+
+// DestroyMetrics contains the counters for a DestroyListener.
+type DestroyMetrics struct {
+	Received  uint64 // destroyed socket samples received
+	Overflows uint64 // receive buffer overflows, when broadcasts were lost
+	sync.RWMutex
+}
+
+// NewDestroyListener opens a netlink socket subscribed to the destroy
+// broadcasts for the configured address families.
+func NewDestroyListener(cfg Config) (l *DestroyListener, err error) {
+	var fd int
+	if err = inNetns(cfg.Netns, func() (err error) {
+		fd, err = syscall.Socket(syscall.AF_NETLINK,
+			syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC,
+			syscall.NETLINK_INET_DIAG)
+		return
+	}); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			syscall.Close(fd)
+		}
+	}()
+
+	tv := syscall.NsecToTimeval(int64(destroyPollInterval))
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET,
+		syscall.SO_RCVTIMEO, &tv); err != nil {
+		return
+	}
+	if cfg.ReceiveBufSize > 0 {
+		if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET,
+			syscall.SO_RCVBUF, cfg.ReceiveBufSize); err != nil {
+			return
+		}
+	}
+	if cfg.ReceiveBufSizeForce > 0 {
+		if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET,
+			syscall.SO_RCVBUFFORCE, cfg.ReceiveBufSizeForce); err != nil {
+			return
+		}
+	}
+
+	var g uint32
+	v4, v6 := cfg.IPv4, cfg.IPv6
+	if !v4 && !v6 {
+		v4, v6 = true, true
+	}
+	if v4 {
+		g |= 1 << (sknlgrpInetTCPDestroy - 1)
+	}
+	if v6 {
+		g |= 1 << (sknlgrpInet6TCPDestroy - 1)
+	}
+	if err = syscall.Bind(fd, &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK, Groups: g}); err != nil {
+		return
+	}
+
+	l = &DestroyListener{
+		Config: cfg,
+		fd:     fd,
+		buf:    make([]byte, cfg.ReadBufSize),
+	}
+
+	if cfg.Log {
+		log.Printf("listening for sock_diag destroy broadcasts")
+	}
+
+	return
+}
+
+// Receive waits up to destroyPollInterval for destroy broadcasts, and returns
+// samples for the destroyed sockets, timestamped when received.
+func (l *DestroyListener) Receive() (ss []sampler.Sample, err error) {
+	var n int
+	if n, _, err = syscall.Recvfrom(l.fd, l.buf, 0); err != nil {
+		switch err {
+		case syscall.EAGAIN, syscall.EINTR:
+			err = nil
+		case syscall.ENOBUFS:
+			l.metrics.recordOverflow()
+			if l.Log {
+				log.Printf("destroy broadcasts lost due to receive buffer overflow")
+			}
+			err = nil
+		}
+		return
+	}
+
+	ts := clockNanos(l.tstampClock())
+	b := l.buf[:n]
+	for len(b) >= nlmsgHdrLen {
+		m := int(nativeEndian.Uint32(b[0:4]))
+		if m < nlmsgHdrLen || m > len(b) {
+			break
+		}
+		if nativeEndian.Uint16(b[4:6]) == sockDiagByFamily &&
+			m > nlmsgHdrLen+inetDiagMsgLen {
+			ss = parse(b[nlmsgHdrLen:m], ts, ss)
+		}
+		if nlmAlign(m) >= len(b) {
+			break
+		}
+		b = b[nlmAlign(m):]
+	}
+	l.metrics.recordReceived(len(ss))
+
+	return
+}
+
+func (l *DestroyListener) Metrics() (m DestroyMetrics) {
+	l.metrics.RLock()
+	defer l.metrics.RUnlock()
+	m = l.metrics
+	return
+}
+
+// Close closes the listener. It must not be called concurrently with Receive.
+func (l *DestroyListener) Close() error {
+	return syscall.Close(l.fd)
+}
+
+func (m *DestroyMetrics) recordReceived(n int) {
+	m.Lock()
+	defer m.Unlock()
+	m.Received += uint64(n)
+}
+
+func (m *DestroyMetrics) recordOverflow() {
+	m.Lock()
+	defer m.Unlock()
+	m.Overflows++
+}
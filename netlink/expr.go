@@ -0,0 +1,530 @@
+package netlink
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/heistp/cgmon/linux"
+)
+
+// A Filter is a parsed filter expression, which is compiled to inet_diag
+// bytecode for the kernel, similar to the filters of ss(8).
+//
+// Expressions are made of terms combined with and (&&), or (||), not (!) and
+// parentheses, with and implied between adjacent terms. The terms are:
+//
+//	sport|dport [op] port   source (local) or dest (peer) port, where op is
+//	                        one of = == != > < >= <= eq ne gt lt ge le (= if
+//	                        omitted), and the port may be prefixed with :
+//	src|dst [=] net         source or dest address or CIDR network
+//	mark [=] mark[/mask]    socket mark (requires CAP_NET_ADMIN)
+//	state [=] name          TCP state, as named by ss (e.g. established)
+//
+// As inet_diag selects states in the dump request instead of the bytecode,
+// state terms may only be used at the top level, alone or or'd with other
+// state terms, and and'd with the rest of the expression, e.g.:
+//
+//	dport 443 and src 10.0.0.0/8 and (state established or state close-wait)
+type Filter struct {
+	expr   bcExpr // kernel filter, or nil if the expression only selects states
+	States uint32 // bitmask of TCP states selected (1 << linux.TCP_*), or 0 if none
+	src    string
+}
+
+func (f *Filter) String() string {
+	return f.src
+}
+
+// ParseFilter parses a filter expression.
+func ParseFilter(s string) (f *Filter, err error) {
+	p := &exprParser{toks: tokenize(s)}
+	if len(p.toks) == 0 {
+		err = fmt.Errorf("empty filter expression")
+		return
+	}
+	var e bcExpr
+	if e, err = p.parseOr(); err != nil {
+		return
+	}
+	if t := p.peek(); t != "" {
+		err = fmt.Errorf("unexpected %s", t)
+		return
+	}
+	f = &Filter{src: s}
+	err = f.setStates(e)
+	return
+}
+
+// setStates sets the Filter's States from the top level state terms of e,
+// and its expr to the rest of e.
+func (f *Filter) setStates(e bcExpr) (err error) {
+	var rest bcAnd
+	all := ^uint32(0)
+	states := all
+	for _, c := range conjuncts(e) {
+		if m, ok := stateMask(c); ok {
+			states &= m
+			continue
+		}
+		if hasState(c) {
+			err = fmt.Errorf("state terms may only be and'd at the top level")
+			return
+		}
+		rest = append(rest, c)
+	}
+	if states == 0 {
+		err = fmt.Errorf("no TCP states match the filter")
+		return
+	}
+	if states != all {
+		f.States = states
+	}
+	switch len(rest) {
+	case 0:
+	case 1:
+		f.expr = rest[0]
+	default:
+		f.expr = rest
+	}
+	return
+}
+
+// conjuncts returns the terms of e and'd at the top level.
+func conjuncts(e bcExpr) (cs []bcExpr) {
+	if a, ok := e.(bcAnd); ok {
+		for _, x := range a {
+			cs = append(cs, conjuncts(x)...)
+		}
+		return
+	}
+	return []bcExpr{e}
+}
+
+// stateMask returns the states selected by e, and true if e consists only of
+// state terms or'd together.
+func stateMask(e bcExpr) (m uint32, ok bool) {
+	switch x := e.(type) {
+	case stateExpr:
+		return uint32(x), true
+	case bcOr:
+		for _, y := range x {
+			var n uint32
+			if n, ok = stateMask(y); !ok {
+				return
+			}
+			m |= n
+		}
+		return
+	}
+	return
+}
+
+// hasState returns true if e contains any state terms.
+func hasState(e bcExpr) bool {
+	switch x := e.(type) {
+	case stateExpr:
+		return true
+	case bcAnd:
+		for _, y := range x {
+			if hasState(y) {
+				return true
+			}
+		}
+	case bcOr:
+		for _, y := range x {
+			if hasState(y) {
+				return true
+			}
+		}
+	case bcNot:
+		return hasState(x.e)
+	}
+	return false
+}
+
+// tokenize splits a filter expression into words, parentheses and operators.
+func tokenize(s string) (toks []string) {
+	isOp := func(c byte) bool {
+		return strings.IndexByte("=!<>&|", c) >= 0
+	}
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			toks = append(toks, s[i:i+1])
+			i++
+		case isOp(c):
+			j := i + 1
+			for j < len(s) && isOp(s[j]) && !(c == '!' && s[j] == '!') {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		default:
+			j := i + 1
+			for j < len(s) && !isOp(s[j]) &&
+				strings.IndexByte(" \t\n()", s[j]) < 0 {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		}
+	}
+	return
+}
+
+// exprParser is a recursive descent parser for filter expressions.
+type exprParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *exprParser) peek() string {
+	if p.pos >= len(p.toks) {
+		return ""
+	}
+	return p.toks[p.pos]
+}
+
+func (p *exprParser) next() (t string) {
+	t = p.peek()
+	if t != "" {
+		p.pos++
+	}
+	return
+}
+
+func (p *exprParser) parseOr() (e bcExpr, err error) {
+	if e, err = p.parseAnd(); err != nil {
+		return
+	}
+	o := bcOr{e}
+	for t := p.peek(); t == "or" || t == "||"; t = p.peek() {
+		p.next()
+		var x bcExpr
+		if x, err = p.parseAnd(); err != nil {
+			return
+		}
+		o = append(o, x)
+	}
+	if len(o) > 1 {
+		e = o
+	}
+	return
+}
+
+func (p *exprParser) parseAnd() (e bcExpr, err error) {
+	if e, err = p.parseUnary(); err != nil {
+		return
+	}
+	a := bcAnd{e}
+	for {
+		t := p.peek()
+		if t == "and" || t == "&&" {
+			p.next()
+		} else if t == "" || t == "or" || t == "||" || t == ")" {
+			break
+		}
+		var x bcExpr
+		if x, err = p.parseUnary(); err != nil {
+			return
+		}
+		a = append(a, x)
+	}
+	if len(a) > 1 {
+		e = a
+	}
+	return
+}
+
+func (p *exprParser) parseUnary() (e bcExpr, err error) {
+	switch t := p.next(); t {
+	case "not", "!":
+		var x bcExpr
+		if x, err = p.parseUnary(); err != nil {
+			return
+		}
+		e = bcNot{x}
+	case "(":
+		if e, err = p.parseOr(); err != nil {
+			return
+		}
+		if p.next() != ")" {
+			err = fmt.Errorf("missing )")
+		}
+	case "":
+		err = fmt.Errorf("unexpected end of expression")
+	default:
+		e, err = p.parseTerm(t)
+	}
+	return
+}
+
+// portOps maps port comparison operators to their canonical form.
+var portOps = map[string]string{
+	"=": "=", "==": "=", "eq": "=",
+	"!=": "!=", "ne": "!=",
+	">": ">", "gt": ">",
+	"<": "<", "lt": "<",
+	">=": ">=", "ge": ">=",
+	"<=": "<=", "le": "<=",
+}
+
+func (p *exprParser) parseTerm(t string) (e bcExpr, err error) {
+	switch t {
+	case "sport", "dport":
+		op := "="
+		if o, ok := portOps[p.peek()]; ok {
+			op = o
+			p.next()
+		}
+		var n uint64
+		v := strings.TrimPrefix(p.next(), ":")
+		if n, err = strconv.ParseUint(v, 10, 16); err != nil {
+			err = fmt.Errorf("invalid port %s", v)
+			return
+		}
+		if (op == ">" && n == 0xffff) || (op == "<" && n == 0) {
+			err = fmt.Errorf("no ports %s %d", op, n)
+			return
+		}
+		e = portExpr{t == "dport", op, uint16(n)}
+	case "src", "dst":
+		p.skipEq()
+		v := p.next()
+		var n *net.IPNet
+		if _, n, err = net.ParseCIDR(v); err != nil {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				err = fmt.Errorf("invalid address %s", v)
+				return
+			}
+			err = nil
+			b := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, b = ip4, 8*net.IPv4len
+			}
+			n = &net.IPNet{IP: ip, Mask: net.CIDRMask(b, b)}
+		}
+		e = bcTest{bcSCond, hostcond(n)}
+		if t == "dst" {
+			e = bcTest{bcDCond, hostcond(n)}
+		}
+	case "mark":
+		p.skipEq()
+		v := p.next()
+		ms := strings.SplitN(v, "/", 2)
+		m := MarkCond{Mask: 0xffffffff}
+		var n uint64
+		if n, err = strconv.ParseUint(ms[0], 0, 32); err != nil {
+			err = fmt.Errorf("invalid mark %s", v)
+			return
+		}
+		m.Mark = uint32(n)
+		if len(ms) > 1 {
+			if n, err = strconv.ParseUint(ms[1], 0, 32); err != nil {
+				err = fmt.Errorf("invalid mark mask %s", v)
+				return
+			}
+			m.Mask = uint32(n)
+		}
+		e = markGroup([]MarkCond{m})[0][0]
+	case "state":
+		p.skipEq()
+		v := p.next()
+		for st, n := range linux.TCPStateNames {
+			if n == v {
+				e = stateExpr(1 << st)
+				return
+			}
+		}
+		err = fmt.Errorf("unknown state %s", v)
+	default:
+		err = fmt.Errorf("unknown term %s", t)
+	}
+	return
+}
+
+// skipEq skips an optional = before a term's value.
+func (p *exprParser) skipEq() {
+	if t := p.peek(); t == "=" || t == "==" {
+		p.next()
+	}
+}
+
+// bcExpr is a node of a kernel filter expression, which generates bytecode
+// that continues to the next op if the expression is true, or jumps to label
+// f if false.
+type bcExpr interface {
+	gen(c *bcCompiler, f int)
+}
+
+// bcAnd is true if all of its expressions are true.
+type bcAnd []bcExpr
+
+func (a bcAnd) gen(c *bcCompiler, f int) {
+	for _, e := range a {
+		e.gen(c, f)
+	}
+}
+
+// bcOr is true if any of its expressions are true.
+type bcOr []bcExpr
+
+func (o bcOr) gen(c *bcCompiler, f int) {
+	t := c.label()
+	for i, e := range o {
+		if i == len(o)-1 {
+			e.gen(c, f)
+			break
+		}
+		n := c.label()
+		e.gen(c, n)
+		c.jmp(t)
+		c.mark(n)
+	}
+	c.mark(t)
+}
+
+// bcNot is true if its expression is false.
+type bcNot struct {
+	e bcExpr
+}
+
+func (n bcNot) gen(c *bcCompiler, f int) {
+	t := c.label()
+	n.e.gen(c, t)
+	c.jmp(f)
+	c.mark(t)
+}
+
+func (t bcTest) gen(c *bcCompiler, f int) {
+	c.test(t.code, t.data, f)
+}
+
+func (d bcCond) gen(c *bcCompiler, f int) {
+	for _, t := range d {
+		t.gen(c, f)
+	}
+}
+
+func (g bcGroup) gen(c *bcCompiler, f int) {
+	o := make(bcOr, len(g))
+	for i, d := range g {
+		o[i] = d
+	}
+	o.gen(c, f)
+}
+
+// portExpr compares a source or dest port.
+type portExpr struct {
+	dest bool
+	op   string
+	port uint16
+}
+
+func (p portExpr) gen(c *bcCompiler, f int) {
+	ge, le, eq := uint8(bcSGe), uint8(bcSLe), uint8(bcSEq)
+	if p.dest {
+		ge, le, eq = bcDGe, bcDLe, bcDEq
+	}
+	var e bcExpr
+	switch p.op {
+	case "=", "!=":
+		if c.eq {
+			e = bcTest{eq, portOp(p.port)}
+		} else {
+			e = bcCond{{ge, portOp(p.port)}, {le, portOp(p.port)}}
+		}
+		if p.op == "!=" {
+			e = bcNot{e}
+		}
+	case ">":
+		e = bcTest{ge, portOp(p.port + 1)}
+	case ">=":
+		e = bcTest{ge, portOp(p.port)}
+	case "<":
+		e = bcTest{le, portOp(p.port - 1)}
+	case "<=":
+		e = bcTest{le, portOp(p.port)}
+	}
+	e.gen(c, f)
+}
+
+// stateExpr selects a TCP state bitmask. It's applied in the dump request,
+// so it generates no bytecode.
+type stateExpr uint32
+
+func (s stateExpr) gen(c *bcCompiler, f int) {
+}
+
+// labelReject is the label of the op past the end of the bytecode, which
+// rejects the socket. Reaching the end itself accepts it.
+const labelReject = -1
+
+// bcCompiler generates bytecode for a bcExpr. All jumps are forward, and the
+// jump offsets are resolved after the ops are generated.
+type bcCompiler struct {
+	ops    []bcInst
+	labels []int // index of the op each label points to
+	eq     bool  // true if the port equality op is supported
+}
+
+// bcInst is one generated op, which jumps to label no if false.
+type bcInst struct {
+	bcTest
+	no int
+}
+
+// label returns a new label, which must be marked before resolving.
+func (c *bcCompiler) label() int {
+	c.labels = append(c.labels, -1)
+	return len(c.labels) - 1
+}
+
+// mark points a label at the next op.
+func (c *bcCompiler) mark(l int) {
+	c.labels[l] = len(c.ops)
+}
+
+// test adds a test op that jumps to label f if false.
+func (c *bcCompiler) test(code uint8, data []byte, f int) {
+	c.ops = append(c.ops, bcInst{bcTest{code, data}, f})
+}
+
+// jmp adds an unconditional jump to label l.
+func (c *bcCompiler) jmp(l int) {
+	c.ops = append(c.ops, bcInst{bcTest{bcJmp, nil}, l})
+}
+
+// bytecode returns the bytecode for an expression.
+func bytecode(e bcExpr, eq bool) (b []byte, err error) {
+	c := &bcCompiler{eq: eq}
+	e.gen(c, labelReject)
+
+	pos := make([]int, len(c.ops)+1) // byte offset of each op, and the end
+	for i, o := range c.ops {
+		pos[i+1] = pos[i] + bcOpLen + len(o.data)
+	}
+	l := pos[len(c.ops)]
+	if l+bcOpLen > 0xffff {
+		err = fmt.Errorf("kernel filter too long (%d bytes)", l)
+		return
+	}
+
+	b = make([]byte, 0, l)
+	for i, o := range c.ops {
+		to := l + bcOpLen
+		if o.no != labelReject {
+			to = pos[c.labels[o.no]]
+		}
+		b = append(b, o.code, uint8(bcOpLen+len(o.data)), 0, 0)
+		nativeEndian.PutUint16(b[len(b)-2:], uint16(to-pos[i]))
+		b = append(b, o.data...)
+	}
+	return
+}
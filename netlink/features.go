@@ -0,0 +1,95 @@
+package netlink
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// minRTTWlenPath is the sysctl with the window length in seconds of the
+// kernel's windowed min filter for tcpi_min_rtt (4.6 and later).
+const minRTTWlenPath = "/proc/sys/net/ipv4/tcp_min_rtt_wlen"
+
+// Features describes the running kernel's support for the tcp_info fields used
+// by the samplers. Fields beyond TCPInfoLen are sampled as zero.
+type Features struct {
+	KernelRelease string // kernel release, from uname
+	TCPInfoLen    int    // length of the kernel's struct tcp_info (0 if unknown)
+	// MinRTTWindow is the window over which tcpi_min_rtt is a windowed
+	// minimum rather than the all-time minimum, or 0 if unknown.
+	MinRTTWindow time.Duration
+}
+
+// ProbeFeatures returns the Features of the running kernel.
+func ProbeFeatures() (f Features, err error) {
+	if f.KernelRelease, err = kernelRelease(); err != nil {
+		return
+	}
+	f.MinRTTWindow = minRTTWindow()
+	f.TCPInfoLen, err = tcpInfoLen()
+	return
+}
+
+// Missing returns the names of the tcp_info fields used by the samplers that
+// the kernel doesn't provide, or nil if all are available or the length of
+// tcp_info is unknown.
+func (f Features) Missing() (m []string) {
+	if f.TCPInfoLen == 0 {
+		return
+	}
+	for _, t := range tcpInfoFields {
+		if t.end() > f.TCPInfoLen {
+			m = append(m, t.name)
+		}
+	}
+	return
+}
+
+// String returns a description of the Features.
+func (f Features) String() string {
+	s := fmt.Sprintf("kernel %s, tcp_info length %d", f.KernelRelease,
+		f.TCPInfoLen)
+	for _, t := range tcpInfoFields {
+		if f.TCPInfoLen > 0 && t.end() > f.TCPInfoLen {
+			s += fmt.Sprintf(", no %s (requires %s)", t.name, t.kernel)
+		}
+	}
+	if f.MinRTTWindow > 0 {
+		s += fmt.Sprintf(", tcpi_min_rtt window %s", f.MinRTTWindow)
+	}
+	return s
+}
+
+// minRTTWindow returns the window of the kernel's min RTT filter from sysctl,
+// or 0 if it can't be read.
+func minRTTWindow() time.Duration {
+	b, err := os.ReadFile(minRTTWlenPath)
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+// kernelRelease returns the kernel release from uname.
+func kernelRelease() (rel string, err error) {
+	var un syscall.Utsname
+	if err = syscall.Uname(&un); err != nil {
+		return
+	}
+	b := make([]byte, 0, len(un.Release))
+	for _, c := range un.Release {
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(c))
+	}
+	rel = string(b)
+	return
+}
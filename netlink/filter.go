@@ -0,0 +1,132 @@
+package netlink
+
+import (
+	"net"
+	"syscall"
+)
+
+// inet_diag host and mark condition op codes and struct sizes (linux/inet_diag.h)
+const (
+	bcSCond     = 7
+	bcDCond     = 8
+	bcMarkCond  = 10
+	hostcondLen = 8
+	markcondLen = 8
+)
+
+// bcTest is one inet_diag bytecode op that jumps to the next op if true, or
+// the next condition if false. data follows the op, and is an inet_diag_bc_op
+// holding a port for port ops, an inet_diag_hostcond for host ops, or an
+// inet_diag_markcond for mark ops.
+type bcTest struct {
+	code uint8
+	data []byte
+}
+
+// bcCond is a condition that is true if all of its tests are true.
+type bcCond []bcTest
+
+// bcGroup is a group of conditions that is true if any of its conditions are
+// true.
+type bcGroup []bcCond
+
+// kernelFilter returns inet_diag bytecode to filter by the source and dest
+// ports and networks, the marks and the Filter expression in the Config, or
+// nil if there is nothing to filter by. Each non-empty list is OR'd, and the
+// lists are AND'd together, with the Filter, and with shard, if not empty. eq
+// is true if the port equality op is supported.
+func kernelFilter(cfg *Config, shard bcGroup, eq bool) (b []byte, err error) {
+	var a bcAnd
+	for _, g := range []bcGroup{
+		portGroup(cfg.SrcPorts, false, eq),
+		portGroup(cfg.DstPorts, true, eq),
+		netGroup(cfg.SrcNets, false),
+		netGroup(cfg.DstNets, true),
+		markGroup(cfg.Marks),
+	} {
+		if len(g) > 0 {
+			a = append(a, g)
+		}
+	}
+	if cfg.Filter != nil && cfg.Filter.expr != nil {
+		a = append(a, cfg.Filter.expr)
+	}
+	if len(shard) > 0 {
+		a = append(a, shard)
+	}
+	if len(a) == 0 {
+		return
+	}
+	b, err = bytecode(a, eq)
+	return
+}
+
+// portGroup returns a group for the given port ranges.
+func portGroup(ports []uint16, dest bool, eq bool) (g bcGroup) {
+	for i := 0; i < len(ports); i += 2 {
+		if eq && ports[i] == ports[i+1] {
+			c := uint8(bcSEq)
+			if dest {
+				c = bcDEq
+			}
+			g = append(g, bcCond{{c, portOp(ports[i])}})
+		} else {
+			ge, le := uint8(bcSGe), uint8(bcSLe)
+			if dest {
+				ge, le = bcDGe, bcDLe
+			}
+			g = append(g, bcCond{
+				{ge, portOp(ports[i])},
+				{le, portOp(ports[i+1])},
+			})
+		}
+	}
+	return
+}
+
+// portOp returns the op following a port op, which holds the port.
+func portOp(port uint16) (b []byte) {
+	b = make([]byte, bcOpLen)
+	nativeEndian.PutUint16(b[2:4], port)
+	return
+}
+
+// netGroup returns a group for the given networks. The kernel also matches
+// IPv4 conditions against v4-mapped addresses of IPv6 sockets.
+func netGroup(nets []*net.IPNet, dest bool) (g bcGroup) {
+	c := uint8(bcSCond)
+	if dest {
+		c = bcDCond
+	}
+	for _, n := range nets {
+		g = append(g, bcCond{{c, hostcond(n)}})
+	}
+	return
+}
+
+// hostcond returns an inet_diag_hostcond for the given network, matching any
+// port.
+func hostcond(n *net.IPNet) (b []byte) {
+	ip, fam := n.IP.To4(), uint8(syscall.AF_INET)
+	if ip == nil {
+		ip, fam = n.IP.To16(), syscall.AF_INET6
+	}
+	ones, _ := n.Mask.Size()
+	b = make([]byte, hostcondLen+len(ip))
+	b[0] = fam
+	b[1] = uint8(ones)
+	nativeEndian.PutUint32(b[4:8], 0xffffffff) // port -1 (any)
+	copy(b[hostcondLen:], ip)
+	return
+}
+
+// markGroup returns a group for the given mark conditions.
+func markGroup(marks []MarkCond) (g bcGroup) {
+	for _, m := range marks {
+		b := make([]byte, markcondLen)
+		nativeEndian.PutUint32(b[0:4], m.Mark)
+		nativeEndian.PutUint32(b[4:8], m.Mask)
+		g = append(g, bcCond{{bcMarkCond, b}})
+	}
+	return
+}
@@ -0,0 +1,578 @@
+package netlink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/heistp/cgmon/sampler"
+)
+
+// netlink and inet_diag constants (linux/netlink.h, linux/inet_diag.h)
+const (
+	nlmsgHdrLen         = 16
+	nlmsgDone           = 3
+	nlmsgError          = 2
+	nlmFRequest         = 0x1
+	nlmFDump            = 0x300
+	sockDiagByFamily    = 20
+	inetDiagReqV2Len    = 56
+	inetDiagMsgLen      = 72
+	inetDiagMsgIf       = 40
+	inetDiagMsgCookie   = 44
+	inetDiagMsgUID      = 64
+	inetDiagMsgInode    = 68
+	inetDiagReqBytecode = 1
+	inetDiagInfo        = 2
+	inetDiagCong        = 4
+	inetDiagSkMeminfo   = 7
+	inetDiagTOS         = 5
+	inetDiagTClass      = 6
+	inetDiagMark        = 15
+	inetDiagCgroupID    = 21
+	rtaHdrLen           = 4
+	bcOpLen             = 4
+)
+
+// inet_diag bytecode op codes (linux/inet_diag.h)
+const (
+	bcJmp  = 1
+	bcSGe  = 2
+	bcSLe  = 3
+	bcDGe  = 4
+	bcDLe  = 5
+	bcSEq  = 11 // 4.16 and later
+	bcDEq  = 12 // 4.16 and later
+	bcNone = 0
+)
+
+// socket memory info offsets (SK_MEMINFO_* in linux/sock_diag.h, as uint32
+// indexes * 4)
+const (
+	skMeminfoRmemAlloc  = 0 * 4
+	skMeminfoRcvBuf     = 1 * 4
+	skMeminfoSndBuf     = 3 * 4
+	skMeminfoWmemQueued = 5 * 4
+)
+
+// nativeEndian is the host byte order, used for netlink headers and tcp_info.
+var nativeEndian binary.ByteOrder
+
+func init() {
+	i := uint16(1)
+	if *(*byte)(unsafe.Pointer(&i)) == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+var eqOpOnce sync.Once
+
+var eqOpSupported bool
+
+// eqOpSupport returns true if the running kernel supports the port equality
+// filter ops (4.16 and later).
+func eqOpSupport(logEnabled bool) bool {
+	eqOpOnce.Do(func() {
+		var maj, min int
+		rel, err := kernelRelease()
+		if err != nil {
+			log.Printf("unable to determine OS version (%s)", err)
+			return
+		}
+		if _, err := fmt.Sscanf(rel, "%d.%d", &maj, &min); err != nil {
+			log.Printf("unable to parse OS version %s (%s)", rel, err)
+			return
+		}
+		eqOpSupported = maj > 4 || (maj == 4 && min >= 16)
+		if logEnabled {
+			var s string
+			if eqOpSupported {
+				s = "supported"
+			} else {
+				s = "not supported, using ge&le"
+			}
+			log.Printf("go netlink initialized, port equality kernel filter op %s", s)
+		}
+	})
+	return eqOpSupported
+}
+
+// GoSampler is a netlink inet_diag sampler implemented in pure Go, using raw
+// netlink sockets. It has the same behavior as Sampler, but doesn't require
+// cgo.
+type GoSampler struct {
+	Config
+	metrics   Metrics
+	fd        int
+	filter    []byte
+	shard     bcGroup // port range filter, when one shard of a ShardedSampler
+	buf       []byte
+	samplesCh chan []sampler.Sample
+	sync.Mutex
+}
+
+func NewGoSampler(cfg Config) *GoSampler {
+	return &GoSampler{
+		Config:    cfg,
+		fd:        -1,
+		samplesCh: make(chan []sampler.Sample, 32),
+	}
+}
+
+func (s *GoSampler) Sample() (r sampler.Result, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	t0 := time.Now()
+
+	var gr *GoResult
+	var st sampleStats
+	for i := 0; ; i++ {
+		if err = s.open(); err != nil {
+			return
+		}
+		if gr, st, err = s.sample(); err == nil {
+			break
+		}
+		s.close()
+		if !s.metrics.recordOverrun(err, i) {
+			return
+		}
+	}
+
+	el := time.Since(t0)
+	s.metrics.recordSampleTime(el)
+	s.metrics.recordAnchor(gr.monoNs, gr.wallNs)
+
+	if s.Log {
+		log.Printf("go netlink sample time=%s samples=%d msgs=%d msgslen=%d",
+			el, st.samples, st.msgs, st.msgsLen)
+	}
+
+	r = gr
+
+	return
+}
+
+func (s *GoSampler) RecycleSamples(ss []sampler.Sample) {
+	select {
+	case s.samplesCh <- ss:
+	default:
+	}
+}
+
+func (s *GoSampler) Metrics() (m Metrics) {
+	s.metrics.RLock()
+	defer s.metrics.RUnlock()
+	m = s.metrics
+	return
+}
+
+func (s *GoSampler) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.close()
+}
+
+func (s *GoSampler) open() (err error) {
+	if s.fd >= 0 {
+		return
+	}
+
+	var fd int
+	if err = inNetns(s.Netns, func() (err error) {
+		fd, err = syscall.Socket(syscall.AF_NETLINK,
+			syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC,
+			syscall.NETLINK_INET_DIAG)
+		return
+	}); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			syscall.Close(fd)
+		}
+	}()
+
+	tv := syscall.NsecToTimeval(int64(s.ReceiveTimeout))
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET,
+		syscall.SO_RCVTIMEO, &tv); err != nil {
+		return
+	}
+	if s.ReceiveBufSize > 0 {
+		if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET,
+			syscall.SO_RCVBUF, s.ReceiveBufSize); err != nil {
+			return
+		}
+	}
+	if s.ReceiveBufSizeForce > 0 {
+		if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET,
+			syscall.SO_RCVBUFFORCE, s.ReceiveBufSizeForce); err != nil {
+			return
+		}
+	}
+
+	var rb int
+	if rb, err = syscall.GetsockoptInt(fd, syscall.SOL_SOCKET,
+		syscall.SO_RCVBUF); err != nil {
+		return
+	}
+
+	if s.filter, err = kernelFilter(&s.Config, s.shard, eqOpSupport(s.Log)); err != nil {
+		return
+	}
+	s.buf = make([]byte, s.ReadBufSize)
+	s.fd = fd
+
+	if s.Log {
+		log.Printf("opened go netlink socket, SO_RCVBUF=%d", rb)
+	}
+
+	return
+}
+
+func (s *GoSampler) close() (err error) {
+	if s.fd >= 0 {
+		err = syscall.Close(s.fd)
+		s.fd = -1
+	}
+	return
+}
+
+// sample sends inet_diag requests for the configured address families and
+// returns the parsed results.
+func (s *GoSampler) sample() (r *GoResult, st sampleStats, err error) {
+	r = &GoResult{}
+
+	select {
+	case r.samples = <-s.samplesCh:
+		r.samples = r.samples[:0]
+	default:
+	}
+
+	// anchor clocks before requests are sent
+	r.monoNs, r.wallNs = anchor(s.tstampClock())
+
+	v4, v6 := s.IPv4, s.IPv6
+	if !v4 && !v6 {
+		v4, v6 = true, true
+	}
+	if v4 {
+		if err = s.dump(syscall.AF_INET, r, &st); err != nil {
+			return
+		}
+	}
+	if v6 {
+		if err = s.dump(syscall.AF_INET6, r, &st); err != nil {
+			return
+		}
+	}
+	st.samples = len(r.samples)
+
+	return
+}
+
+// dump sends an inet_diag request for one address family and appends the
+// results to the Result's samples.
+func (s *GoSampler) dump(family uint8, r *GoResult, st *sampleStats) (err error) {
+	if err = syscall.Sendto(s.fd, s.request(family), 0,
+		&syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return
+	}
+
+	// read until message with NLMSG_DONE is received
+	for {
+		var n int
+		if n, _, err = syscall.Recvfrom(s.fd, s.buf, 0); err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return
+		}
+
+		ts := r.monoNs
+		if !s.DumpTimestamps {
+			ts = clockNanos(s.tstampClock())
+		}
+		st.msgs++
+		st.msgsLen += n
+
+		b := s.buf[:n]
+		for len(b) >= nlmsgHdrLen {
+			l := int(nativeEndian.Uint32(b[0:4]))
+			if l < nlmsgHdrLen || l > len(b) {
+				break
+			}
+			switch nativeEndian.Uint16(b[4:6]) {
+			case nlmsgDone:
+				return
+			case nlmsgError:
+				if l < nlmsgHdrLen+4 {
+					err = syscall.ENODATA
+				} else {
+					err = syscall.Errno(-int32(nativeEndian.Uint32(b[16:20])))
+				}
+				return
+			}
+			if l > nlmsgHdrLen+inetDiagMsgLen && s.uidMatch(nativeEndian.Uint32(
+				b[nlmsgHdrLen+inetDiagMsgUID:])) {
+				r.samples = parse(b[nlmsgHdrLen:l], ts, r.samples)
+			}
+			if nlmAlign(l) >= len(b) {
+				break
+			}
+			b = b[nlmAlign(l):]
+		}
+	}
+}
+
+// request returns an inet_diag request for the given address family.
+func (s *GoSampler) request(family uint8) (b []byte) {
+	l := nlmsgHdrLen + inetDiagReqV2Len
+	if len(s.filter) > 0 {
+		l += rtaHdrLen + len(s.filter)
+	}
+	b = make([]byte, l)
+
+	// nlmsghdr
+	nativeEndian.PutUint32(b[0:4], uint32(l))
+	nativeEndian.PutUint16(b[4:6], sockDiagByFamily)
+	nativeEndian.PutUint16(b[6:8], nlmFRequest|nlmFDump)
+
+	// inet_diag_req_v2, requesting tcp_info and TOS for sockets in the configured
+	// states
+	q := b[nlmsgHdrLen:]
+	q[0] = family
+	q[1] = syscall.IPPROTO_TCP
+	q[2] = 1<<(inetDiagInfo-1) | 1<<(inetDiagCong-1) | 1<<(inetDiagSkMeminfo-1) |
+		1<<(inetDiagTOS-1) | 1<<(inetDiagTClass-1)
+	nativeEndian.PutUint32(q[4:8], s.states())
+
+	// maybe add the filter
+	if len(s.filter) > 0 {
+		a := q[inetDiagReqV2Len:]
+		nativeEndian.PutUint16(a[0:2], uint16(rtaHdrLen+len(s.filter)))
+		nativeEndian.PutUint16(a[2:4], inetDiagReqBytecode)
+		copy(a[rtaHdrLen:], s.filter)
+	}
+
+	return
+}
+
+// parse reads one inet_diag_msg and its attributes, and appends a sample for
+// its tcp_info, if present.
+func parse(m []byte, tstampNs uint64, ss []sampler.Sample) []sampler.Sample {
+	family := m[0]
+	id := sampler.ID{
+		SrcPort: binary.BigEndian.Uint16(m[4:6]),
+		DstPort: binary.BigEndian.Uint16(m[6:8]),
+	}
+	copyAddr(&id.SrcIP, family, m[8:24])
+	copyAddr(&id.DstIP, family, m[24:40])
+
+	var info, cong, meminfo []byte
+	var mark uint32
+	var tos, tclass uint8
+	var cgroupID uint64
+	a := m[inetDiagMsgLen:]
+	for len(a) >= rtaHdrLen {
+		l := int(nativeEndian.Uint16(a[0:2]))
+		if l < rtaHdrLen || l > len(a) {
+			break
+		}
+		switch nativeEndian.Uint16(a[2:4]) {
+		case inetDiagInfo:
+			info = a[rtaHdrLen:l]
+		case inetDiagCong:
+			cong = a[rtaHdrLen:l]
+		case inetDiagSkMeminfo:
+			meminfo = a[rtaHdrLen:l]
+		case inetDiagMark:
+			if l >= rtaHdrLen+4 {
+				mark = nativeEndian.Uint32(a[rtaHdrLen : rtaHdrLen+4])
+			}
+		case inetDiagTOS:
+			if l >= rtaHdrLen+1 {
+				tos = a[rtaHdrLen]
+			}
+		case inetDiagTClass:
+			if l >= rtaHdrLen+1 {
+				tclass = a[rtaHdrLen]
+			}
+		case inetDiagCgroupID:
+			if l >= rtaHdrLen+8 {
+				cgroupID = nativeEndian.Uint64(a[rtaHdrLen : rtaHdrLen+8])
+			}
+		}
+		if nlmAlign(l) >= len(a) {
+			break
+		}
+		a = a[nlmAlign(l):]
+	}
+
+	if info != nil {
+		d := tcpInfoData(info, meminfo, m[1], mark, dscp(tos, tclass),
+			nativeEndian.Uint32(m[inetDiagMsgUID:]), tstampNs)
+		d.CongestionControl = ccName(cong)
+		ss = append(ss, sampler.Sample{id, d,
+			nativeEndian.Uint32(m[inetDiagMsgInode:]), cgroupID,
+			nativeEndian.Uint32(m[inetDiagMsgIf:]),
+			uint64(nativeEndian.Uint32(m[inetDiagMsgCookie+4:]))<<32 |
+				uint64(nativeEndian.Uint32(m[inetDiagMsgCookie:]))})
+	}
+
+	return ss
+}
+
+// tcpInfoData returns the sampled Data from a tcp_info struct and the socket
+// memory info array. Fields beyond the length of either returned by the kernel
+// are left zero.
+func tcpInfoData(t, mi []byte, state uint8, mark uint32, dscp uint8,
+	uid uint32, tstampNs uint64) sampler.Data {
+	sws, rws := wscales(tcpiWscale.u8(t))
+	return sampler.Data{
+		tstampNs,
+		tcpiOptions.u8(t),
+		state,
+		mark,
+		dscp,
+		uid,
+		tcpiCAState.u8(t),
+		tcpiBackoff.u8(t),
+		tcpiProbes.u8(t),
+		tcpiRTO.u32(t),
+		tcpiATO.u32(t),
+		tcpiLastDataSent.u32(t),
+		tcpiLastDataRecv.u32(t),
+		tcpiLastAckRecv.u32(t),
+		tcpiRTT.u32(t),
+		tcpiMinRTT.u32(t),
+		tcpiRTTVar.u32(t),
+		tcpiSndCwnd.u32(t) * tcpiSndMss.u32(t),
+		tcpiSndCwnd.u32(t),
+		tcpiPacingRate.u64(t),
+		tcpiDeliveryRate.u64(t),
+		tcpiTotalRetrans.u32(t),
+		tcpiDelivered.u32(t),
+		tcpiDeliveredCE.u32(t),
+		tcpiBytesAcked.u64(t),
+		tcpiBusyTime.u64(t),
+		tcpiRwndLimited.u64(t),
+		tcpiSndbufLimited.u64(t),
+		tcpiBytesSent.u64(t),
+		tcpiBytesRetrans.u64(t),
+		tcpiBytesReceived.u64(t),
+		tcpiRcvRTT.u32(t),
+		tcpiRcvSpace.u32(t),
+		tcpiSndWnd.u32(t),
+		tcpiRcvWnd.u32(t),
+		tcpiSndMss.u32(t),
+		tcpiAdvMSS.u32(t),
+		tcpiPMTU.u32(t),
+		sws,
+		rws,
+		tcpiSndSsthresh.u32(t),
+		tcpiReordering.u32(t),
+		tcpiSacked.u32(t),
+		tcpiLost.u32(t),
+		tcpiDSACKDups.u32(t),
+		tcpiReordSeen.u32(t),
+		tcpiRcvOOOPack.u32(t),
+		skmem(mi, skMeminfoRmemAlloc),
+		skmem(mi, skMeminfoRcvBuf),
+		skmem(mi, skMeminfoWmemQueued),
+		skmem(mi, skMeminfoSndBuf),
+		"",
+	}
+}
+
+// dscp returns the DSCP of the IPv6 traffic class, if set, or else the IP TOS,
+// which dual-stack sockets use for IPv4 connections.
+func dscp(tos, tclass uint8) uint8 {
+	if tclass != 0 {
+		return tclass >> 2
+	}
+	return tos >> 2
+}
+
+// wscales returns the send and receive window scales from the tcp_info byte
+// containing the tcpi_snd_wscale and tcpi_rcv_wscale bitfields, which are
+// allocated from the low bits on little-endian hosts, and the high bits on
+// big-endian hosts.
+func wscales(b uint8) (snd, rcv uint8) {
+	if nativeEndian == binary.LittleEndian {
+		return b & 0xf, b >> 4
+	}
+	return b >> 4, b & 0xf
+}
+
+// skmem returns the value at the given offset of the socket memory info
+// array, or 0 if the array is too short.
+func skmem(mi []byte, off int) uint32 {
+	if off+4 > len(mi) {
+		return 0
+	}
+	return nativeEndian.Uint32(mi[off : off+4])
+}
+
+// copyAddr copies an inet_diag address to a 16 byte address, converting IPv4
+// addresses to v4-mapped IPv6 addresses.
+func copyAddr(dst *[16]byte, family uint8, src []byte) {
+	if family == syscall.AF_INET {
+		*dst = [16]byte{10: 0xff, 11: 0xff}
+		copy(dst[12:], src[:4])
+	} else {
+		copy(dst[:], src[:16])
+	}
+}
+
+func nlmAlign(l int) int {
+	return (l + 3) &^ 3
+}
+
+// clockNanos returns the time in nanoseconds from the given clock.
+func clockNanos(clk uintptr) uint64 {
+	var ts syscall.Timespec
+	// no error checking- if this call fails we've got other problems
+	syscall.RawSyscall(syscall.SYS_CLOCK_GETTIME, clk,
+		uintptr(unsafe.Pointer(&ts)), 0)
+	return uint64(ts.Nano())
+}
+
+// anchor reads the given timestamp clock and the wall clock as close together
+// as possible, using the midpoint of two timestamp reads around the wall clock
+// read.
+func anchor(clk uintptr) (monoNs, wallNs uint64) {
+	m0 := clockNanos(clk)
+	wallNs = clockNanos(0) // CLOCK_REALTIME
+	m1 := clockNanos(clk)
+	monoNs = m0 + (m1-m0)/2
+	return
+}
+
+// GoResult holds the results from one GoSampler call.
+type GoResult struct {
+	samples []sampler.Sample
+	monoNs  uint64
+	wallNs  uint64
+}
+
+func (r *GoResult) Samples() []sampler.Sample {
+	return r.samples
+}
+
+// Anchor returns the monotonic nsec time and corresponding wall clock time
+// read just before the dump request was sent, which may be used to convert
+// sample timestamps to wall time.
+func (r *GoResult) Anchor() (monoNs uint64, wall time.Time) {
+	monoNs = r.monoNs
+	wall = time.Unix(0, int64(r.wallNs))
+	return
+}
@@ -0,0 +1,232 @@
+package netlink
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/heistp/cgmon/linux"
+	"github.com/heistp/cgmon/metrics"
+	"github.com/heistp/cgmon/sampler"
+)
+
+// Sampler backends.
+const (
+	BackendCgo = "cgo" // C implementation, requires cgo
+	BackendGo  = "go"  // pure Go implementation
+)
+
+// Ports to shard dumps by.
+const (
+	ShardBySport = "sport" // source (local) port, for hosts that are mostly clients
+	ShardByDport = "dport" // dest (remote) port, for hosts that are mostly servers
+)
+
+// Config contains the netlink client configuration.
+type Config struct {
+	ReadBufSize         int           // size of userspace read buffer (>32K no benefit in kernels 4.9-5.2, at least)
+	ReceiveBufSize      int           // socket receive buffer size
+	ReceiveBufSizeForce int           // force socket receive buffer size (requires CAP_NET_ADMIN or root)
+	SrcPorts            []uint16      // source (local) ports for kernel to filter by
+	DstPorts            []uint16      // dest (remote) ports for kernel to filter by
+	SrcNets             []*net.IPNet  // source (local) networks for kernel to filter by
+	DstNets             []*net.IPNet  // dest (remote) networks for kernel to filter by
+	Marks               []MarkCond    // socket marks for kernel to filter by (requires CAP_NET_ADMIN)
+	Filter              *Filter       // filter expression for kernel to filter by, AND'd with the above, with its states overriding States (see ParseFilter)
+	UIDs                []uint32      // socket UIDs to sample (filtered in the sampler, as inet_diag can't filter by UID)
+	ReceiveTimeout      time.Duration // socket receive timeout
+	DumpTimestamps      bool          // if true, use one timestamp per dump taken before the request, instead of one per receive
+	BootTime            bool          // if true, timestamp samples with CLOCK_BOOTTIME, which advances during suspend, instead of CLOCK_MONOTONIC
+	IPv4                bool          // if true, dump IPv4 sockets (if neither IPv4 nor IPv6 is set, both are dumped)
+	IPv6                bool          // if true, dump IPv6 sockets
+	States              uint32        // bitmask of TCP states to dump (1 << linux.TCP_*), 0 for only ESTABLISHED
+	Backend             string        // sampler implementation, BackendCgo or BackendGo (empty means BackendCgo)
+	Netns               string        // path of the network namespace to sample (e.g. /var/run/netns/NAME or /proc/PID/ns/net), empty for the current one
+	Shards              int           // number of parallel dumps, each for an equal range of ports (0 or 1 for a single dump)
+	ShardBy             string        // port to shard dumps by, ShardBySport or ShardByDport (empty means ShardByDport)
+	Log                 bool          // if true enable logging
+}
+
+// A MarkCond matches sockets with marks (SO_MARK) for which mark & Mask ==
+// Mark.
+type MarkCond struct {
+	Mark uint32
+	Mask uint32
+}
+
+// uidMatch returns true if sockets with the given UID should be sampled.
+func (c *Config) uidMatch(uid uint32) bool {
+	if len(c.UIDs) == 0 {
+		return true
+	}
+	for _, u := range c.UIDs {
+		if u == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// tstampClock returns the clock ID for sample timestamps.
+func (c *Config) tstampClock() uintptr {
+	if c.BootTime {
+		return 7 // CLOCK_BOOTTIME
+	}
+	return 1 // CLOCK_MONOTONIC
+}
+
+// states returns the bitmask of TCP states to dump.
+func (c *Config) states() uint32 {
+	if c.Filter != nil && c.Filter.States != 0 {
+		return c.Filter.States
+	}
+	if c.States == 0 {
+		return 1 << linux.TCP_ESTABLISHED
+	}
+	return c.States
+}
+
+// maxOverrunRetries is the maximum number of times a dump is retried after a
+// receive buffer overrun.
+const maxOverrunRetries = 2
+
+type Metrics struct {
+	SampleTimes      metrics.DurationStats
+	ConvertTimes     metrics.DurationStats
+	ShardSampleTimes []metrics.DurationStats // sample times of each shard, for a ShardedSampler
+	Clock            ClockStats
+	Overruns         uint64 // dumps that failed due to receive buffer overruns (ENOBUFS)
+	sync.RWMutex
+}
+
+// ClockStats contains diagnostics for the offset between the wall clock and
+// the monotonic clock used for sample timestamps. Changes in the offset are
+// due to wall clock adjustments (e.g. by NTP), and are the error incurred when
+// converting monotonic timestamps to wall time using an earlier anchor.
+type ClockStats struct {
+	Anchors     uint64        // number of clock anchors taken (one per dump)
+	FirstOffset time.Duration // wall - monotonic offset at the first anchor
+	LastOffset  time.Duration // wall - monotonic offset at the last anchor
+	MaxStep     time.Duration // maximum absolute offset change between consecutive anchors
+}
+
+// Drift returns the change in the wall - monotonic offset since the first
+// anchor.
+func (c *ClockStats) Drift() time.Duration {
+	return c.LastOffset - c.FirstOffset
+}
+
+func (m *Metrics) recordAnchor(monoNs, wallNs uint64) {
+	m.Lock()
+	defer m.Unlock()
+	o := time.Duration(int64(wallNs) - int64(monoNs))
+	c := &m.Clock
+	if c.Anchors == 0 {
+		c.FirstOffset = o
+	} else {
+		st := o - c.LastOffset
+		if st < 0 {
+			st = -st
+		}
+		if st > c.MaxStep {
+			c.MaxStep = st
+		}
+	}
+	c.LastOffset = o
+	c.Anchors++
+}
+
+// recordOverrun records a dump that failed with err, if it's a receive
+// buffer overrun, and returns true if the dump should be retried.
+func (m *Metrics) recordOverrun(err error, retries int) (retry bool) {
+	if err != syscall.ENOBUFS {
+		return
+	}
+	m.Lock()
+	m.Overruns++
+	m.Unlock()
+	if retry = retries < maxOverrunRetries; retry {
+		log.Printf("netlink receive buffer overrun, retrying dump (consider raising the receive buffer size)")
+	} else {
+		log.Printf("netlink receive buffer overrun, giving up after %d retries",
+			retries)
+	}
+	return
+}
+
+func (m *Metrics) recordSampleTime(d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.SampleTimes.Push(d)
+}
+
+func (m *Metrics) recordConvertTime(d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.ConvertTimes.Push(d)
+}
+
+// sampleStats contains the stats for a netlink sample call.
+type sampleStats struct {
+	samples int
+	msgs    int
+	msgsLen int
+}
+
+// ccNames interns congestion control algorithm names, so a string isn't
+// allocated for each sample.
+var ccNames = struct {
+	m map[string]string
+	sync.Mutex
+}{m: make(map[string]string)}
+
+// ccName returns the interned congestion control algorithm name for the given
+// NUL terminated (or unterminated) bytes.
+func ccName(b []byte) (name string) {
+	for i, c := range b {
+		if c == 0 {
+			b = b[:i]
+			break
+		}
+	}
+	if len(b) == 0 {
+		return
+	}
+
+	ccNames.Lock()
+	defer ccNames.Unlock()
+	var ok bool
+	if name, ok = ccNames.m[string(b)]; !ok {
+		name = string(b)
+		ccNames.m[name] = name
+	}
+	return
+}
+
+// New returns a new netlink sampler using the configured Backend, or a
+// ShardedSampler if more than one shard is configured.
+func New(cfg Config) (s sampler.Sampler, err error) {
+	if cfg.Shards > 1 {
+		return NewShardedSampler(cfg)
+	}
+	return newSampler(cfg, nil)
+}
+
+// newSampler returns a new netlink sampler using the configured Backend,
+// filtering by the given shard, if not empty.
+func newSampler(cfg Config, shard bcGroup) (s sampler.Sampler, err error) {
+	switch cfg.Backend {
+	case BackendCgo, "":
+		s, err = newCgoSampler(cfg, shard)
+	case BackendGo:
+		g := NewGoSampler(cfg)
+		g.shard = shard
+		s = g
+	default:
+		err = fmt.Errorf("unknown netlink backend: %s", cfg.Backend)
+	}
+	return
+}
@@ -0,0 +1,122 @@
+package netlink
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"syscall"
+)
+
+// cloneNewNet is CLONE_NEWNET, for setns.
+const cloneNewNet = 0x40000000
+
+// netnsDir is the directory of named network namespaces, as used by ip-netns.
+const netnsDir = "/var/run/netns"
+
+// A Netns is a network namespace to sample.
+type Netns struct {
+	Name string // name for labelling (ip-netns name, or pid<N> for a process)
+	Path string // path of the namespace file
+}
+
+// inNetns calls f with the calling goroutine's thread in the network
+// namespace at path, then restores the thread's namespace. Sockets created by
+// f stay in the namespace. If path is empty, f is called directly.
+func inNetns(path string, f func() error) (err error) {
+	if path == "" {
+		return f()
+	}
+
+	runtime.LockOSThread()
+	var orig, ns *os.File
+	if orig, err = os.Open("/proc/thread-self/ns/net"); err != nil {
+		runtime.UnlockOSThread()
+		return
+	}
+	defer orig.Close()
+	if ns, err = os.Open(path); err != nil {
+		runtime.UnlockOSThread()
+		return
+	}
+	defer ns.Close()
+	if err = setns(ns); err != nil {
+		runtime.UnlockOSThread()
+		err = fmt.Errorf("unable to enter network namespace %s (%s)", path, err)
+		return
+	}
+
+	err = f()
+
+	// if the namespace can't be restored, the thread is left locked, so the
+	// runtime terminates it when the goroutine exits
+	if e := setns(orig); e != nil {
+		panic(fmt.Sprintf("unable to restore network namespace (%s)", e))
+	}
+	runtime.UnlockOSThread()
+	return
+}
+
+func setns(f *os.File) error {
+	if _, _, e := syscall.RawSyscall(sysSetns, f.Fd(), cloneNewNet, 0); e != 0 {
+		return e
+	}
+	return nil
+}
+
+// AllNetns returns the distinct network namespaces on the host, from the
+// named namespaces in /var/run/netns, then those of running processes that
+// aren't named. The namespace of the calling process is first, with an empty
+// Path. Reading the namespaces of other processes requires CAP_SYS_PTRACE.
+func AllNetns() (nss []Netns, err error) {
+	seen := make(map[uint64]bool)
+	var self uint64
+	if self, err = netnsInode("/proc/self/ns/net"); err != nil {
+		return
+	}
+	seen[self] = true
+	nss = append(nss, Netns{"self", ""})
+
+	if ms, _ := filepath.Glob(filepath.Join(netnsDir, "*")); ms != nil {
+		for _, p := range ms {
+			if i, e := netnsInode(p); e == nil && !seen[i] {
+				seen[i] = true
+				nss = append(nss, Netns{filepath.Base(p), p})
+			}
+		}
+	}
+
+	var ents []os.DirEntry
+	if ents, err = os.ReadDir("/proc"); err != nil {
+		return
+	}
+	var pids []int
+	for _, e := range ents {
+		if p, e := strconv.Atoi(e.Name()); e == nil {
+			pids = append(pids, p)
+		}
+	}
+	sort.Ints(pids)
+	for _, pid := range pids {
+		p := fmt.Sprintf("/proc/%d/ns/net", pid)
+		// processes may exit, or their namespaces be unreadable
+		if i, e := netnsInode(p); e == nil && !seen[i] {
+			seen[i] = true
+			nss = append(nss, Netns{"pid" + strconv.Itoa(pid), p})
+		}
+	}
+	return
+}
+
+// netnsInode returns the inode of the network namespace file at path, which
+// identifies the namespace.
+func netnsInode(path string) (ino uint64, err error) {
+	var st syscall.Stat_t
+	if err = syscall.Stat(path, &st); err != nil {
+		return
+	}
+	ino = st.Ino
+	return
+}
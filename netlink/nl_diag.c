@@ -16,7 +16,6 @@
 #include <linux/inet_diag.h>
 #include <arpa/inet.h>
 #include "nl_diag.h"
-#include "nl_filter.h"
 
 // kernel tcp states (net/tcp_states.h)
 enum {
@@ -38,6 +37,41 @@ enum {
 // 12 states with the first state in position 1, so 13 bit mask.
 #define TCP_ALL_STATES_MASK 0x1FFF
 
+// INET_DIAG_CGROUP_ID attribute type (5.7 and later), defined here for older
+// headers
+#define NL_INET_DIAG_CGROUP_ID 21
+
+// tcp_info offset of tcpi_delivery_rate, which was added in 4.9
+#define TCPI_DELIVERY_RATE_OFFSET 160
+
+// tcp_info offsets of tcpi_busy_time, tcpi_rwnd_limited and
+// tcpi_sndbuf_limited, which were added in 4.10, read by offset for the same
+// reason as below
+#define TCPI_BUSY_TIME_OFFSET      168
+#define TCPI_RWND_LIMITED_OFFSET   176
+#define TCPI_SNDBUF_LIMITED_OFFSET 184
+
+// tcp_info offsets of tcpi_delivered and tcpi_delivered_ce, which were added in
+// 4.18, so they're read by offset to allow compiling with older headers
+#define TCPI_DELIVERED_OFFSET    192
+#define TCPI_DELIVERED_CE_OFFSET 196
+
+// tcp_info offsets of tcpi_bytes_sent and tcpi_bytes_retrans, which were added
+// in 4.19
+#define TCPI_BYTES_SENT_OFFSET    200
+#define TCPI_BYTES_RETRANS_OFFSET 208
+
+// tcp_info offsets of tcpi_dsack_dups and tcpi_reord_seen, which were added in
+// 5.0
+#define TCPI_DSACK_DUPS_OFFSET 216
+#define TCPI_REORD_SEEN_OFFSET 220
+
+// tcp_info offsets of tcpi_rcv_ooopack and tcpi_snd_wnd, added in 5.4, and
+// tcpi_rcv_wnd, added in 6.2
+#define TCPI_RCV_OOOPACK_OFFSET 224
+#define TCPI_SND_WND_OFFSET     228
+#define TCPI_RCV_WND_OFFSET     232
+
 // how many samples to add with each array growth
 #define GROW_SAMPLES_INCREMENT 4096
 
@@ -88,8 +122,10 @@ int setsockopts(int fd, struct nl_config *cfg) {
 }
 
 // nl_open opens a netlink session.
-int nl_open(struct nl_config *cfg, uint16_t *sports, int splen,
-		uint16_t *dports, int dplen, struct nl_session **nls) {
+// filter is inet_diag bytecode, which is copied, or NULL for no filter. uids
+// are the socket UIDs to sample, which are copied, or NULL for all UIDs.
+int nl_open(struct nl_config *cfg, uint8_t *filter, int filter_len,
+		uint32_t *uids, int nuids, struct nl_session **nls) {
 	int fd;
 	struct nl_session *s;
 	socklen_t rbsz = sizeof(s->rcv_bufsize);
@@ -108,15 +144,30 @@ int nl_open(struct nl_config *cfg, uint16_t *sports, int splen,
 		goto err_sockopt;
 
 	s->fd = fd;
+	s->tstamp_dump = cfg->tstamp_dump;
+	s->tstamp_clock = cfg->tstamp_boottime ? CLOCK_BOOTTIME : CLOCK_MONOTONIC;
+	s->families = cfg->families;
+	s->states = cfg->states;
 	s->read_bufsize = cfg->read_bufsize;
-	s->filter_len = nl_port_filter(sports, splen, dports, dplen, &s->filter);
-	if (s->filter_len == -1)
-		goto err_filter;
+	if (filter_len > 0) {
+		if (!(s->filter = malloc(filter_len)))
+			goto err_filter;
+		memcpy(s->filter, filter, filter_len);
+		s->filter_len = filter_len;
+	}
+	if (nuids > 0) {
+		if (!(s->uids = malloc(nuids * sizeof(*uids))))
+			goto err_uids;
+		memcpy(s->uids, uids, nuids * sizeof(*uids));
+		s->nuids = nuids;
+	}
 
 	*nls = s;
 
 	return 0;
 
+err_uids:
+	free(s->filter);
 err_filter:
 err_sockopt:
 	close(s->fd);
@@ -132,13 +183,15 @@ int nl_close(struct nl_session *nls) {
 
 	ret = close(nls->fd);
 	free(nls->filter);
+	free(nls->uids);
 	free(nls);
 
 	return ret;
 }
 
-// send_inet_diag sends one inet_diag request and returns the result from sendmsg.
-int send_inet_diag(struct nl_session *nls) {
+// send_inet_diag sends one inet_diag request for the given address family and
+// returns the result from sendmsg.
+int send_inet_diag(struct nl_session *nls, uint8_t family) {
 	struct msghdr msg;
 	struct nlmsghdr h;
 	struct inet_diag_req_v2 conn_req;
@@ -152,15 +205,18 @@ int send_inet_diag(struct nl_session *nls) {
 	memset(&conn_req, 0, sizeof(conn_req));
 
 	sa.nl_family = AF_NETLINK;
-	conn_req.sdiag_family = AF_INET;
+	conn_req.sdiag_family = family;
 	conn_req.sdiag_protocol = IPPROTO_TCP;
 
-	//conn_req.idiag_states = TCP_ALL_STATES_MASK & 
-	//	~((1 << TCP_SYN_RECV) | (1 << TCP_TIME_WAIT) | (1 << TCP_CLOSE));
-	conn_req.idiag_states = (1 << TCP_ESTABLISHED);
+	conn_req.idiag_states = nls->states;
 
-	// request tcp_info, further possibilities in inet_diag.h
+	// request tcp_info, congestion control name, socket memory info and TOS,
+	// further possibilities in inet_diag.h
 	conn_req.idiag_ext |= (1 << (INET_DIAG_INFO - 1));
+	conn_req.idiag_ext |= (1 << (INET_DIAG_CONG - 1));
+	conn_req.idiag_ext |= (1 << (INET_DIAG_SKMEMINFO - 1));
+	conn_req.idiag_ext |= (1 << (INET_DIAG_TOS - 1));
+	conn_req.idiag_ext |= (1 << (INET_DIAG_TCLASS - 1));
 
 	h.nlmsg_len = NLMSG_LENGTH(sizeof(conn_req));
 	h.nlmsg_flags = NLM_F_DUMP | NLM_F_REQUEST;
@@ -200,69 +256,236 @@ struct nl_sample* grow(struct nl_sample **s, int *scap) {
 	return *s;
 }
 
-// parse reads one message and append samples for each embedded tcp_info.
+// copy_addr copies an inet_diag address to a 16 byte address, converting
+// IPv4 addresses to v4-mapped IPv6 addresses.
+static void copy_addr(uint8_t *dst, uint8_t family, __be32 *src) {
+	if (family == AF_INET) {
+		memset(dst, 0, 10);
+		dst[10] = 0xff;
+		dst[11] = 0xff;
+		memcpy(dst + 12, src, 4);
+	} else {
+		memcpy(dst, src, 16);
+	}
+}
+
+// tcpi_u32 reads a u32 at the given offset of a tcp_info returned by the
+// kernel, or returns 0 if the kernel's tcp_info is too short to contain it.
+static inline uint32_t tcpi_u32(void *tcpi, size_t len, size_t off) {
+	uint32_t v = 0;
+
+	if (off + sizeof(v) <= len)
+		memcpy(&v, (uint8_t *)tcpi + off, sizeof(v));
+
+	return v;
+}
+
+// tcpi_u64 reads a u64 at the given offset of a tcp_info returned by the
+// kernel, or returns 0 if the kernel's tcp_info is too short to contain it.
+static inline uint64_t tcpi_u64(void *tcpi, size_t len, size_t off) {
+	uint64_t v = 0;
+
+	if (off + sizeof(v) <= len)
+		memcpy(&v, (uint8_t *)tcpi + off, sizeof(v));
+
+	return v;
+}
+
+// skmem returns the value at index i of the INET_DIAG_SKMEMINFO attribute,
+// or 0 if the attribute is missing or too short.
+static uint32_t skmem(struct rtattr *meminfo, int i) {
+	if (!meminfo || RTA_PAYLOAD(meminfo) < (i + 1) * sizeof(uint32_t))
+		return 0;
+	return ((uint32_t *)RTA_DATA(meminfo))[i];
+}
+
+// dscp returns the DSCP of the IPv6 traffic class, if set, or else the IP TOS,
+// which dual-stack sockets use for IPv4 connections.
+static uint8_t dscp(struct rtattr *tos, struct rtattr *tclass) {
+	uint8_t v = 0;
+
+	if (tclass && RTA_PAYLOAD(tclass) >= sizeof(uint8_t))
+		v = *(uint8_t *)RTA_DATA(tclass);
+	if (!v && tos && RTA_PAYLOAD(tos) >= sizeof(uint8_t))
+		v = *(uint8_t *)RTA_DATA(tos);
+
+	return v >> 2;
+}
+
+// parse reads one message and appends a sample for its tcp_info, if present.
 void parse(struct inet_diag_msg *msg, int rtalen, uint64_t tstamp_ns,
 		struct nl_sample **samples, int *samples_cap, int *nsamples) {
 	struct rtattr *attr;
-	struct tcp_info *tcpi;
+	struct rtattr *info = NULL;
+	struct rtattr *cong = NULL;
+	struct rtattr *mark = NULL;
+	struct rtattr *cgroup = NULL;
+	struct rtattr *meminfo = NULL;
+	struct rtattr *tos = NULL;
+	struct rtattr *tclass = NULL;
+	struct tcp_info tcpi_buf;
+	struct tcp_info *tcpi = &tcpi_buf;
+	size_t tcpi_len, rta_len, cong_len;
 	struct nl_sample *s = *samples;
 	int ns = *nsamples;
 
 	attr = (struct rtattr*) (msg+1);
 
 	while (RTA_OK(attr, rtalen)) {
-		if(attr->rta_type == INET_DIAG_INFO){
-			tcpi = (struct tcp_info*) RTA_DATA(attr);
-
-			if (ns + 1 > *samples_cap)
-				s = grow(samples, samples_cap);
-
-			s[ns] = (struct nl_sample) {
-				tstamp_ns,
-				{0},
-				ntohs(msg->id.idiag_sport),
-				{0},
-				ntohs(msg->id.idiag_dport),
-				tcpi->tcpi_options,
-				tcpi->tcpi_rtt,
-				tcpi->tcpi_min_rtt,
-				tcpi->tcpi_rttvar,
-				tcpi->tcpi_snd_cwnd * tcpi->tcpi_snd_mss,
-				tcpi->tcpi_pacing_rate,
-				tcpi->tcpi_total_retrans,
-				//tcpi->tcpi_delivered,
-				//tcpi->tcpi_delivered_ce,
-				tcpi->tcpi_bytes_acked,
-			};
-			// len for IPv6: msg->idiag_family == AF_INET ? 4 : 16
-			memcpy(s[ns].saddr, msg->id.idiag_src, 4);
-			memcpy(s[ns].daddr, msg->id.idiag_dst, 4);
-
-			ns++;
-		}
+		if (attr->rta_type == INET_DIAG_INFO)
+			info = attr;
+		else if (attr->rta_type == INET_DIAG_CONG)
+			cong = attr;
+		else if (attr->rta_type == INET_DIAG_MARK)
+			mark = attr;
+		else if (attr->rta_type == NL_INET_DIAG_CGROUP_ID)
+			cgroup = attr;
+		else if (attr->rta_type == INET_DIAG_SKMEMINFO)
+			meminfo = attr;
+		else if (attr->rta_type == INET_DIAG_TOS)
+			tos = attr;
+		else if (attr->rta_type == INET_DIAG_TCLASS)
+			tclass = attr;
 		attr = RTA_NEXT(attr, rtalen); 
 	}
 
+	if (!info)
+		return;
+
+	// copy into a zeroed struct, so fields not provided by older kernels are
+	// zero
+	rta_len = tcpi_len = RTA_PAYLOAD(info);
+	if (tcpi_len > sizeof(tcpi_buf))
+		tcpi_len = sizeof(tcpi_buf);
+	memset(&tcpi_buf, 0, sizeof(tcpi_buf));
+	memcpy(&tcpi_buf, RTA_DATA(info), tcpi_len);
+
+	if (ns + 1 > *samples_cap)
+		s = grow(samples, samples_cap);
+
+	s[ns] = (struct nl_sample) {
+		tstamp_ns,
+		{0},
+		ntohs(msg->id.idiag_sport),
+		{0},
+		ntohs(msg->id.idiag_dport),
+		tcpi->tcpi_options,
+		msg->idiag_state,
+		mark && RTA_PAYLOAD(mark) >= sizeof(uint32_t) ?
+			*(uint32_t *)RTA_DATA(mark) : 0,
+		dscp(tos, tclass),
+		msg->idiag_uid,
+		msg->idiag_inode,
+		cgroup && RTA_PAYLOAD(cgroup) >= sizeof(uint64_t) ?
+			*(uint64_t *)RTA_DATA(cgroup) : 0,
+		msg->id.idiag_if,
+		(uint64_t)msg->id.idiag_cookie[1] << 32 | msg->id.idiag_cookie[0],
+		tcpi->tcpi_ca_state,
+		tcpi->tcpi_backoff,
+		tcpi->tcpi_probes,
+		tcpi->tcpi_rto,
+		tcpi->tcpi_ato,
+		tcpi->tcpi_last_data_sent,
+		tcpi->tcpi_last_data_recv,
+		tcpi->tcpi_last_ack_recv,
+		tcpi->tcpi_rtt,
+		tcpi->tcpi_min_rtt,
+		tcpi->tcpi_rttvar,
+		tcpi->tcpi_snd_cwnd * tcpi->tcpi_snd_mss,
+		tcpi->tcpi_snd_cwnd,
+		tcpi->tcpi_pacing_rate,
+		tcpi_u64(RTA_DATA(info), rta_len, TCPI_DELIVERY_RATE_OFFSET),
+		tcpi->tcpi_total_retrans,
+		tcpi_u32(RTA_DATA(info), rta_len, TCPI_DELIVERED_OFFSET),
+		tcpi_u32(RTA_DATA(info), rta_len, TCPI_DELIVERED_CE_OFFSET),
+		tcpi->tcpi_bytes_acked,
+		tcpi_u64(RTA_DATA(info), rta_len, TCPI_BUSY_TIME_OFFSET),
+		tcpi_u64(RTA_DATA(info), rta_len, TCPI_RWND_LIMITED_OFFSET),
+		tcpi_u64(RTA_DATA(info), rta_len, TCPI_SNDBUF_LIMITED_OFFSET),
+		tcpi_u64(RTA_DATA(info), rta_len, TCPI_BYTES_SENT_OFFSET),
+		tcpi_u64(RTA_DATA(info), rta_len, TCPI_BYTES_RETRANS_OFFSET),
+		tcpi->tcpi_bytes_received,
+		tcpi->tcpi_rcv_rtt,
+		tcpi->tcpi_rcv_space,
+		tcpi_u32(RTA_DATA(info), rta_len, TCPI_SND_WND_OFFSET),
+		tcpi_u32(RTA_DATA(info), rta_len, TCPI_RCV_WND_OFFSET),
+		tcpi->tcpi_snd_mss,
+		tcpi->tcpi_advmss,
+		tcpi->tcpi_pmtu,
+		tcpi->tcpi_snd_wscale,
+		tcpi->tcpi_rcv_wscale,
+		tcpi->tcpi_snd_ssthresh,
+		tcpi->tcpi_reordering,
+		tcpi->tcpi_sacked,
+		tcpi->tcpi_lost,
+		tcpi_u32(RTA_DATA(info), rta_len, TCPI_DSACK_DUPS_OFFSET),
+		tcpi_u32(RTA_DATA(info), rta_len, TCPI_REORD_SEEN_OFFSET),
+		tcpi_u32(RTA_DATA(info), rta_len, TCPI_RCV_OOOPACK_OFFSET),
+		skmem(meminfo, SK_MEMINFO_RMEM_ALLOC),
+		skmem(meminfo, SK_MEMINFO_RCVBUF),
+		skmem(meminfo, SK_MEMINFO_WMEM_QUEUED),
+		skmem(meminfo, SK_MEMINFO_SNDBUF),
+		{0},
+	};
+	copy_addr(s[ns].saddr, msg->idiag_family, msg->id.idiag_src);
+	copy_addr(s[ns].daddr, msg->idiag_family, msg->id.idiag_dst);
+	if (cong) {
+		cong_len = RTA_PAYLOAD(cong);
+		if (cong_len > NL_CONG_NAME_MAX - 1)
+			cong_len = NL_CONG_NAME_MAX - 1;
+		memcpy(s[ns].cong, RTA_DATA(cong), cong_len);
+	}
+
 	*samples = s;
-	*nsamples = ns;
+	*nsamples = ns + 1;
 }
 
-// tstamp_nanos returns the time in nanoseconds from the monotonic clock.
-inline uint64_t tstamp_nanos() {
+// clock_nanos returns the time in nanoseconds from the given clock.
+static inline uint64_t clock_nanos(clockid_t clk) {
 	struct timespec ts;
 
 	// no error checking- if this call fails we've got other problems
-	clock_gettime(CLOCK_MONOTONIC, &ts);
+	clock_gettime(clk, &ts);
 
 	return ((uint64_t)ts.tv_sec * 1000000000) + ts.tv_nsec;
 }
 
-// nl_sample sends an inet_diag request and writes the results into the
-// samples array, growing it as necessary.
-int nl_sample(struct nl_session *nls, struct nl_sample **samples,
-		int *samples_cap, struct nl_sample_stats *stats) {
+// tstamp_nanos returns the time in nanoseconds from the session's timestamp
+// clock (CLOCK_MONOTONIC, or CLOCK_BOOTTIME).
+static inline uint64_t tstamp_nanos(struct nl_session *nls) {
+	return clock_nanos(nls->tstamp_clock);
+}
+
+// anchor reads the timestamp and wall clocks as close together as possible,
+// using the midpoint of two timestamp reads around the wall clock read.
+static void anchor(struct nl_session *nls, uint64_t *mono_ns,
+		uint64_t *wall_ns) {
+	uint64_t m0, m1;
+
+	m0 = tstamp_nanos(nls);
+	*wall_ns = clock_nanos(CLOCK_REALTIME);
+	m1 = tstamp_nanos(nls);
+	*mono_ns = m0 + (m1 - m0) / 2;
+}
+
+// uid_match returns true if sockets with the given UID should be sampled.
+static bool uid_match(struct nl_session *nls, uint32_t uid) {
+	int i;
+
+	if (nls->nuids == 0)
+		return true;
+	for (i = 0; i < nls->nuids; i++)
+		if (nls->uids[i] == uid)
+			return true;
+	return false;
+}
+
+// dump sends an inet_diag request for one address family and appends the
+// results to the samples array, growing it as necessary.
+static int dump(struct nl_session *nls, uint8_t family,
+		struct nl_sample **samples, int *samples_cap, int *nsamples,
+		struct nl_sample_stats *stats) {
 	int n, rtalen;
-	int msgs = 0, msgslen = 0, nsamples = 0;
 	struct nlmsghdr *h;
 	uint8_t read_buf[nls->read_bufsize];
 	struct inet_diag_msg *msg;
@@ -270,7 +493,7 @@ int nl_sample(struct nl_session *nls, struct nl_sample **samples,
 	uint64_t ts;
 
 	// send request
-	if (send_inet_diag(nls) < 0)
+	if (send_inet_diag(nls, family) < 0)
 		return -1;
 
 	// read until message with NLMSG_DONE is received
@@ -278,18 +501,14 @@ int nl_sample(struct nl_session *nls, struct nl_sample **samples,
 		if ((n = recv(nls->fd, read_buf, sizeof(read_buf), 0)) == -1)
 			return -1;
 
-		ts = tstamp_nanos();
-		msgs++;
-		msgslen += n;
+		ts = nls->tstamp_dump ? stats->anchor_mono_ns : tstamp_nanos(nls);
+		stats->msgs++;
+		stats->msgslen += n;
 
 		h = (struct nlmsghdr*) read_buf;
 		while (NLMSG_OK(h, n)) {
-			if(h->nlmsg_type == NLMSG_DONE) {
-				stats->samples = nsamples;
-				stats->msgs = msgs;
-				stats->msgslen = msgslen;
+			if(h->nlmsg_type == NLMSG_DONE)
 				return 0;
-			}
 
 			if(h->nlmsg_type == NLMSG_ERROR) {
 				err = (struct nlmsgerr*)NLMSG_DATA(h);
@@ -302,10 +521,35 @@ int nl_sample(struct nl_session *nls, struct nl_sample **samples,
 
 			msg = (struct inet_diag_msg*) NLMSG_DATA(h);
 			rtalen = h->nlmsg_len - NLMSG_LENGTH(sizeof(*msg));
-			if (rtalen > 0)
-				parse(msg, rtalen, ts, samples, samples_cap, &nsamples);
+			if (rtalen > 0 && uid_match(nls, msg->idiag_uid))
+				parse(msg, rtalen, ts, samples, samples_cap, nsamples);
 
 			h = NLMSG_NEXT(h, n); 
 		}
 	}
 }
+
+// nl_sample sends inet_diag requests for the configured address families and
+// writes the results into the samples array, growing it as necessary.
+int nl_sample(struct nl_session *nls, struct nl_sample **samples,
+		int *samples_cap, struct nl_sample_stats *stats) {
+	int nsamples = 0;
+
+	stats->msgs = 0;
+	stats->msgslen = 0;
+
+	// anchor clocks before requests are sent
+	anchor(nls, &stats->anchor_mono_ns, &stats->anchor_wall_ns);
+
+	if ((nls->families & NL_FAMILY_INET) &&
+			dump(nls, AF_INET, samples, samples_cap, &nsamples, stats) == -1)
+		return -1;
+
+	if ((nls->families & NL_FAMILY_INET6) &&
+			dump(nls, AF_INET6, samples, samples_cap, &nsamples, stats) == -1)
+		return -1;
+
+	stats->samples = nsamples;
+
+	return 0;
+}
@@ -9,45 +9,108 @@ struct nl_config {
 	int rcv_bufsize;
 	int rcv_bufsize_force;
 	int rcv_timeout_ms;
+	int tstamp_dump;
+	int tstamp_boottime;
+	int families;
+	uint32_t states;
 };
 
+// address families to dump, for nl_config.families
+#define NL_FAMILY_INET  1
+#define NL_FAMILY_INET6 2
+
+// max length of congestion control name, including NUL (TCP_CA_NAME_MAX)
+#define NL_CONG_NAME_MAX 16
+
 struct nl_session {
 	int fd;
+	int tstamp_dump;
+	int tstamp_clock;
+	int families;
+	uint32_t states;
 	int read_bufsize;
 	int rcv_bufsize;
-	struct inet_diag_bc_op *filter;
+	uint8_t *filter;
 	int filter_len;
+	uint32_t *uids;
+	int nuids;
 };
 
 struct nl_sample {
 	uint64_t tstamp_ns;           // monotonic nanosecond timestamp on sample receipt
-	uint8_t saddr[4];             // source (local) IP address
+	uint8_t saddr[16];            // source (local) IP address (IPv4 is v4-mapped)
 	uint16_t sport;               // source (local) port
-	uint8_t daddr[4];             // dest (remote) IP address
+	uint8_t daddr[16];            // dest (remote) IP address (IPv4 is v4-mapped)
 	uint16_t dport;               // dest (remote) port
 	uint8_t options;              // TCP options (TCPI_OPT_* in linux/tcp.h)
+	uint8_t state;                // TCP state (net/tcp_states.h)
+	uint32_t mark;                // socket mark (SO_MARK, requires CAP_NET_ADMIN, else 0)
+	uint8_t dscp;                 // DSCP of the IP TOS or IPv6 traffic class
+	uint32_t uid;                 // socket owner UID
+	uint32_t inode;               // socket inode
+	uint64_t cgroup_id;           // socket cgroup v2 ID (5.7 and later, else 0)
+	uint32_t ifindex;             // bound interface index (SO_BINDTODEVICE, else 0)
+	uint64_t cookie;              // socket cookie
+	uint8_t ca_state;             // TCP congestion avoidance state (TCP_CA_* in linux/tcp.h)
+	uint8_t backoff;              // TCP RTO backoff
+	uint8_t probes;               // TCP unanswered zero window or keepalive probes
+	uint32_t rto_us;              // TCP retransmission timeout in usec
+	uint32_t ato_us;              // TCP delayed ACK timeout in usec
+	uint32_t last_data_sent_ms;   // TCP time since last data sent in msec
+	uint32_t last_data_recv_ms;   // TCP time since last data received in msec
+	uint32_t last_ack_recv_ms;    // TCP time since last ACK received in msec
 	uint32_t rtt_us;              // TCP round-trip time in usec
 	uint32_t min_rtt_us;          // min TCP round-trip time in usec
 	uint32_t rtt_var_us;          // TCP round-trip time variance in usec
-	uint32_t snd_cwnd_bytes;      // TCP send cwnd in bytes
+	uint32_t snd_cwnd_bytes;      // TCP send cwnd in bytes (snd_cwnd * snd_mss)
+	uint32_t snd_cwnd;            // TCP send cwnd in segments
 	uint64_t pacing_rate_Bps;     // TCP pacing rate in bytes/sec
+	uint64_t delivery_rate_Bps;   // TCP most recent delivery rate in bytes/sec (4.9 and later, else 0)
 	uint32_t total_retrans;       // TCP total retransmits
-	// delivery stats only available in 4.18 and later
-	//uint32_t delivered;           // TCP delivered packets
-	//uint32_t delivered_ce;        // TCP CE on delivered packets (ECE received)
+	uint32_t delivered;           // TCP delivered packets (4.18 and later, else 0)
+	uint32_t delivered_ce;        // TCP CE on delivered packets (ECE received, 4.18 and later, else 0)
 	uint64_t bytes_acked;         // TCP bytes acked
+	uint64_t busy_time_us;        // TCP time busy sending in usec (4.10 and later, else 0)
+	uint64_t rwnd_limited_us;     // TCP time limited by receive window in usec (4.10 and later, else 0)
+	uint64_t sndbuf_limited_us;   // TCP time limited by send buffer in usec (4.10 and later, else 0)
+	uint64_t bytes_sent;          // TCP data bytes sent incl. retransmits (4.19 and later, else 0)
+	uint64_t bytes_retrans;       // TCP data bytes retransmitted (4.19 and later, else 0)
+	uint64_t bytes_received;      // TCP bytes received
+	uint32_t rcv_rtt_us;          // TCP receiver side RTT estimate in usec (0 if no estimate)
+	uint32_t rcv_space;           // TCP receive buffer space estimate in bytes
+	uint32_t snd_wnd;             // TCP peer's advertised receive window in bytes (5.4 and later, else 0)
+	uint32_t rcv_wnd;             // TCP local advertised receive window in bytes (6.2 and later, else 0)
+	uint32_t snd_mss;             // TCP sender MSS in bytes
+	uint32_t advmss;              // TCP advertised MSS in bytes
+	uint32_t pmtu;                // path MTU in bytes
+	uint8_t snd_wscale;           // TCP send window scale shift
+	uint8_t rcv_wscale;           // TCP receive window scale shift
+	uint32_t snd_ssthresh;        // TCP slow start threshold in segments
+	uint32_t reordering;          // TCP reordering distance estimate in segments
+	uint32_t sacked;              // TCP segments currently SACKed
+	uint32_t lost;                // TCP segments currently considered lost
+	uint32_t dsack_dups;          // TCP total duplicate segments reported by DSACK (5.0 and later, else 0)
+	uint32_t reord_seen;          // TCP total reordering events seen (5.0 and later, else 0)
+	uint32_t rcv_ooopack;         // TCP total out-of-order packets received (5.4 and later, else 0)
+	uint32_t rmem_alloc;          // socket receive queue memory in bytes
+	uint32_t rcvbuf;              // socket receive buffer size in bytes
+	uint32_t wmem_queued;         // socket send queue memory in bytes (unsent and unacked data)
+	uint32_t sndbuf;              // socket send buffer size in bytes
+	char cong[NL_CONG_NAME_MAX];  // congestion control algorithm name (NUL terminated)
 };
 
 struct nl_sample_stats {
 	int samples; // number of samples in call
 	int msgs;    // number of netlink messages returned
 	int msgslen; // total length of all netlink messages
+	uint64_t anchor_mono_ns; // monotonic nsec time just before request sent
+	uint64_t anchor_wall_ns; // wall clock (realtime) nsec time read with anchor_mono_ns
 };
 
 int nl_init();
 
-int nl_open(struct nl_config *cfg, uint16_t *sports, int splen,
-		uint16_t *dports, int dplen, struct nl_session **nls);
+int nl_open(struct nl_config *cfg, uint8_t *filter, int filter_len,
+		uint32_t *uids, int nuids, struct nl_session **nls);
 
 int nl_sample(struct nl_session *nls, struct nl_sample **samples,
 		int *samples_cap, struct nl_sample_stats *stats);
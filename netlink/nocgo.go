@@ -0,0 +1,17 @@
+//go:build !cgo
+// +build !cgo
+
+package netlink
+
+import (
+	"fmt"
+
+	"github.com/heistp/cgmon/sampler"
+)
+
+// newCgoSampler returns an error, as the cgo backend isn't available in builds
+// without cgo.
+func newCgoSampler(cfg Config, shard bcGroup) (sampler.Sampler, error) {
+	return nil, fmt.Errorf("netlink backend %s not available in this build, use %s",
+		BackendCgo, BackendGo)
+}
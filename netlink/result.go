@@ -32,25 +32,69 @@ func (r *Result) Samples() (ss []sampler.Sample) {
 	for i, s := range cs {
 		ss[i] = sampler.Sample{
 			sampler.ID{
-				byteArray4(s.saddr),
+				byteArray16(s.saddr),
 				uint16(s.sport),
-				byteArray4(s.daddr),
+				byteArray16(s.daddr),
 				uint16(s.dport),
 			},
 			sampler.Data{
 				uint64(s.tstamp_ns),
 				uint8(s.options),
+				uint8(s.state),
+				uint32(s.mark),
+				uint8(s.dscp),
+				uint32(s.uid),
+				uint8(s.ca_state),
+				uint8(s.backoff),
+				uint8(s.probes),
+				uint32(s.rto_us),
+				uint32(s.ato_us),
+				uint32(s.last_data_sent_ms),
+				uint32(s.last_data_recv_ms),
+				uint32(s.last_ack_recv_ms),
 				uint32(s.rtt_us),
 				uint32(s.min_rtt_us),
 				uint32(s.rtt_var_us),
 				uint32(s.snd_cwnd_bytes),
+				uint32(s.snd_cwnd),
 				uint64(s.pacing_rate_Bps),
+				uint64(s.delivery_rate_Bps),
 				uint32(s.total_retrans),
-				// delivery stats only available in 4.18 and later
-				//uint32(s.delivered),
-				//uint32(s.delivered_ce),
+				uint32(s.delivered),
+				uint32(s.delivered_ce),
 				uint64(s.bytes_acked),
+				uint64(s.busy_time_us),
+				uint64(s.rwnd_limited_us),
+				uint64(s.sndbuf_limited_us),
+				uint64(s.bytes_sent),
+				uint64(s.bytes_retrans),
+				uint64(s.bytes_received),
+				uint32(s.rcv_rtt_us),
+				uint32(s.rcv_space),
+				uint32(s.snd_wnd),
+				uint32(s.rcv_wnd),
+				uint32(s.snd_mss),
+				uint32(s.advmss),
+				uint32(s.pmtu),
+				uint8(s.snd_wscale),
+				uint8(s.rcv_wscale),
+				uint32(s.snd_ssthresh),
+				uint32(s.reordering),
+				uint32(s.sacked),
+				uint32(s.lost),
+				uint32(s.dsack_dups),
+				uint32(s.reord_seen),
+				uint32(s.rcv_ooopack),
+				uint32(s.rmem_alloc),
+				uint32(s.rcvbuf),
+				uint32(s.wmem_queued),
+				uint32(s.sndbuf),
+				ccName((*[C.NL_CONG_NAME_MAX]byte)(unsafe.Pointer(&s.cong))[:]),
 			},
+			uint32(s.inode),
+			uint64(s.cgroup_id),
+			uint32(s.ifindex),
+			uint64(s.cookie),
 		}
 	}
 
@@ -64,6 +108,15 @@ func (r *Result) Samples() (ss []sampler.Sample) {
 	return ss
 }
 
+// Anchor returns the monotonic nsec time and corresponding wall clock time
+// read just before the dump request was sent, which may be used to convert
+// sample timestamps to wall time.
+func (r *Result) Anchor() (monoNs uint64, wall time.Time) {
+	monoNs = uint64(r.stats.anchor_mono_ns)
+	wall = time.Unix(0, int64(r.stats.anchor_wall_ns))
+	return
+}
+
 func (r *Result) sampleStats() (s sampleStats) {
 	s.samples = int(r.stats.samples)
 	s.msgs = int(r.stats.msgs)
@@ -99,17 +152,9 @@ func (r *Result) samplesSlice(l int) (ss []sampler.Sample) {
 	return
 }
 
-func byteArray4(c [4]C.uchar) (b [4]byte) {
-	b[0] = byte(c[0])
-	b[1] = byte(c[1])
-	b[2] = byte(c[2])
-	b[3] = byte(c[3])
+func byteArray16(c [16]C.uchar) (b [16]byte) {
+	for i := 0; i < 16; i++ {
+		b[i] = byte(c[i])
+	}
 	return b
 }
-
-// sampleStats contains the stats for a netlink sample call.
-type sampleStats struct {
-	samples int
-	msgs    int
-	msgsLen int
-}
@@ -16,7 +16,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/heistp/cgmon/metrics"
 	"github.com/heistp/cgmon/sampler"
 )
 
@@ -24,39 +23,11 @@ var initMutex = sync.Mutex{}
 
 var netlinkInitialized = false
 
-// Config contains the netlink client configuration.
-type Config struct {
-	ReadBufSize         int           // size of userspace read buffer (>32K no benefit in kernels 4.9-5.2, at least)
-	ReceiveBufSize      int           // socket receive buffer size
-	ReceiveBufSizeForce int           // force socket receive buffer size (requires CAP_NET_ADMIN or root)
-	SrcPorts            []uint16      // source (local) ports for kernel to filter by
-	DstPorts            []uint16      // dest (remote) ports for kernel to filter by
-	ReceiveTimeout      time.Duration // socket receive timeout
-	Log                 bool          // if true enable logging
-}
-
-type Metrics struct {
-	SampleTimes  metrics.DurationStats
-	ConvertTimes metrics.DurationStats
-	sync.RWMutex
-}
-
-func (m *Metrics) recordSampleTime(d time.Duration) {
-	m.Lock()
-	defer m.Unlock()
-	m.SampleTimes.Push(d)
-}
-
-func (m *Metrics) recordConvertTime(d time.Duration) {
-	m.Lock()
-	defer m.Unlock()
-	m.ConvertTimes.Push(d)
-}
-
 type Sampler struct {
 	Config
 	metrics   Metrics
 	session   *C.struct_nl_session
+	shard     bcGroup // port range filter, when one shard of a ShardedSampler
 	resultsCh chan *Result
 	samplesCh chan []sampler.Sample
 	sync.Mutex
@@ -73,30 +44,45 @@ func NewSampler(cfg Config) *Sampler {
 	return &Sampler{cfg,
 		Metrics{},
 		nil,
+		nil,
 		make(chan *Result, 32),
 		make(chan []sampler.Sample, 32),
 		sync.Mutex{},
 	}
 }
 
+// newCgoSampler returns a new cgo Sampler for New, filtering by the given
+// shard, if not empty.
+func newCgoSampler(cfg Config, shard bcGroup) (sampler.Sampler, error) {
+	s := NewSampler(cfg)
+	s.shard = shard
+	return s, nil
+}
+
 func (s *Sampler) Sample() (r sampler.Result, err error) {
 	s.Lock()
 	defer s.Unlock()
 
 	t0 := time.Now()
 
-	if err = s.nlOpen(); err != nil {
-		return
-	}
-
 	var nr *Result
-	if nr, err = s.nlSample(); err != nil {
+	for i := 0; ; i++ {
+		if err = s.nlOpen(); err != nil {
+			return
+		}
+		if nr, err = s.nlSample(); err == nil {
+			break
+		}
 		s.nlClose()
-		return
+		if !s.metrics.recordOverrun(err, i) {
+			return
+		}
 	}
 
 	el := time.Since(t0)
 	s.metrics.recordSampleTime(el)
+	s.metrics.recordAnchor(uint64(nr.stats.anchor_mono_ns),
+		uint64(nr.stats.anchor_wall_ns))
 
 	if s.Log {
 		ss := nr.sampleStats()
@@ -139,16 +125,47 @@ func (s *Sampler) Close() error {
 
 func (s *Sampler) nlOpen() (err error) {
 	if s.session == nil {
-		sp, spl := ushortArray(s.SrcPorts)
-		dp, dpl := ushortArray(s.DstPorts)
+		var f []byte
+		if f, err = kernelFilter(&s.Config, s.shard, bool(C.eq_op_support)); err != nil {
+			return
+		}
+		var fp *C.uint8_t
+		if len(f) > 0 {
+			fp = (*C.uint8_t)(&f[0])
+		}
 		nc := &C.struct_nl_config{
 			read_bufsize:      C.int(s.ReadBufSize),
 			rcv_bufsize:       C.int(s.ReceiveBufSize),
 			rcv_bufsize_force: C.int(s.ReceiveBufSizeForce),
 			rcv_timeout_ms:    C.int(int64(s.ReceiveTimeout) / 1e6),
+			states:            C.uint32_t(s.states()),
+		}
+		if s.DumpTimestamps {
+			nc.tstamp_dump = 1
+		}
+		if s.BootTime {
+			nc.tstamp_boottime = 1
+		}
+		if s.IPv4 {
+			nc.families |= C.NL_FAMILY_INET
+		}
+		if s.IPv6 {
+			nc.families |= C.NL_FAMILY_INET6
+		}
+		if nc.families == 0 {
+			nc.families = C.NL_FAMILY_INET | C.NL_FAMILY_INET6
+		}
+
+		var up *C.uint32_t
+		if len(s.UIDs) > 0 {
+			up = (*C.uint32_t)(&s.UIDs[0])
 		}
 
-		if _, err = C.nl_open(nc, sp, spl, dp, dpl, &s.session); err != nil {
+		if err = inNetns(s.Netns, func() (err error) {
+			_, err = C.nl_open(nc, fp, C.int(len(f)), up, C.int(len(s.UIDs)),
+				&s.session)
+			return
+		}); err != nil {
 			return
 		}
 		if s.Log {
@@ -181,13 +198,6 @@ func (s *Sampler) nlClose() (err error) {
 	return
 }
 
-func ushortArray(a []uint16) (p *C.ushort, l C.int) {
-	if l = C.int(len(a)); l > 0 {
-		p = (*C.ushort)(&a[0])
-	}
-	return
-}
-
 func nlInit(logEnabled bool) {
 	var stat string
 	if i, err := C.nl_init(); err != nil {
@@ -0,0 +1,4 @@
+package netlink
+
+// sysSetns is the setns syscall number.
+const sysSetns = 308
@@ -0,0 +1,189 @@
+package netlink
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/heistp/cgmon/sampler"
+)
+
+// A ShardedSampler dumps sockets in parallel with one sampler per shard, each
+// with its own netlink socket and a kernel filter for an equal range of source
+// or dest ports, and merges the results. This is for hosts where a single dump
+// takes longer than the sample interval. Ports are seldom uniformly
+// distributed, so ShardBy should be the port that's ephemeral for most flows.
+type ShardedSampler struct {
+	Config
+	shards    []sampler.Sampler
+	metrics   Metrics
+	samplesCh chan []sampler.Sample
+	sync.Mutex
+}
+
+// NewShardedSampler returns a new ShardedSampler with the configured number of
+// Shards, using the configured Backend.
+func NewShardedSampler(cfg Config) (s *ShardedSampler, err error) {
+	var dest bool
+	switch cfg.ShardBy {
+	case ShardByDport, "":
+		dest = true
+	case ShardBySport:
+	default:
+		err = fmt.Errorf("unknown port to shard by: %s", cfg.ShardBy)
+		return
+	}
+	if cfg.Shards < 2 || cfg.Shards > 65536 {
+		err = fmt.Errorf("invalid number of shards: %d", cfg.Shards)
+		return
+	}
+
+	s = &ShardedSampler{
+		Config:    cfg,
+		samplesCh: make(chan []sampler.Sample, 32),
+	}
+	w := (65536 + cfg.Shards - 1) / cfg.Shards
+	for lo := 0; lo < 65536; lo += w {
+		hi := lo + w - 1
+		if hi > 65535 {
+			hi = 65535
+		}
+		var sh sampler.Sampler
+		if sh, err = newSampler(cfg, portGroup([]uint16{uint16(lo), uint16(hi)},
+			dest, false)); err != nil {
+			s.Close()
+			s = nil
+			return
+		}
+		s.shards = append(s.shards, sh)
+	}
+	return
+}
+
+func (s *ShardedSampler) Sample() (r sampler.Result, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	t0 := time.Now()
+
+	rs := make([]sampler.Result, len(s.shards))
+	errs := make([]error, len(s.shards))
+	var wg sync.WaitGroup
+	for i, sh := range s.shards {
+		wg.Add(1)
+		go func(i int, sh sampler.Sampler) {
+			defer wg.Done()
+			rs[i], errs[i] = sh.Sample()
+		}(i, sh)
+	}
+	wg.Wait()
+
+	for i, e := range errs {
+		if e != nil {
+			err = fmt.Errorf("shard %d: %w", i, e)
+			break
+		}
+	}
+	if err != nil {
+		for i, sr := range rs {
+			if sr != nil {
+				recycleResult(s.shards[i], sr)
+			}
+		}
+		return
+	}
+
+	s.metrics.recordSampleTime(time.Since(t0))
+	sr := &shardedResult{sampler: s, results: rs}
+	if a, ok := rs[0].(sampler.Anchorer); ok {
+		sr.anchorMonoNs, sr.anchorWall = a.Anchor()
+	}
+	r = sr
+
+	return
+}
+
+func (s *ShardedSampler) RecycleSamples(ss []sampler.Sample) {
+	select {
+	case s.samplesCh <- ss:
+	default:
+	}
+}
+
+// Metrics returns the metrics for the merged dumps, with the sample times of
+// each shard in ShardSampleTimes, and the overruns and clock stats of the
+// shards.
+func (s *ShardedSampler) Metrics() (m Metrics) {
+	s.metrics.RLock()
+	m.SampleTimes = s.metrics.SampleTimes
+	m.ConvertTimes = s.metrics.ConvertTimes
+	s.metrics.RUnlock()
+
+	for i, sh := range s.shards {
+		sm := sh.(interface{ Metrics() Metrics }).Metrics()
+		m.ShardSampleTimes = append(m.ShardSampleTimes, sm.SampleTimes)
+		m.Overruns += sm.Overruns
+		if i == 0 {
+			m.Clock = sm.Clock
+		}
+	}
+	return
+}
+
+func (s *ShardedSampler) Close() (err error) {
+	for _, sh := range s.shards {
+		if c, ok := sh.(sampler.Closer); ok {
+			if e := c.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return
+}
+
+// recycleResult returns a Result to the sampler that created it, if supported.
+func recycleResult(s sampler.Sampler, r sampler.Result) {
+	if rr, ok := s.(sampler.ResultRecycler); ok {
+		rr.RecycleResult(r)
+	}
+}
+
+// shardedResult contains the Results from each shard of a ShardedSampler.
+type shardedResult struct {
+	sampler      *ShardedSampler
+	results      []sampler.Result
+	anchorMonoNs uint64    // monotonic nsec time of the first shard's anchor
+	anchorWall   time.Time // wall time of the first shard's anchor
+}
+
+// Samples returns the merged samples from the shards, recycling the shards'
+// Results and Samples once they're copied.
+func (r *shardedResult) Samples() (ss []sampler.Sample) {
+	t0 := time.Now()
+
+	select {
+	case ss = <-r.sampler.samplesCh:
+		ss = ss[:0]
+	default:
+	}
+	for i, sr := range r.results {
+		sh := r.sampler.shards[i]
+		s := sr.Samples()
+		ss = append(ss, s...)
+		if rc, ok := sh.(sampler.SamplesRecycler); ok {
+			rc.RecycleSamples(s)
+		}
+		recycleResult(sh, sr)
+	}
+	r.results = nil
+
+	r.sampler.metrics.recordConvertTime(time.Since(t0))
+
+	return
+}
+
+// Anchor returns the anchor of the first shard's Result. As the timestamps
+// are monotonic, any shard's anchor may be used to convert them to wall time.
+func (r *shardedResult) Anchor() (monoNs uint64, wall time.Time) {
+	return r.anchorMonoNs, r.anchorWall
+}
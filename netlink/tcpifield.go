@@ -0,0 +1,118 @@
+package netlink
+
+// A tcpiField is a tcp_info field (linux/tcp.h), with its offset and size, and
+// the kernel version that added it, if it's optional.
+//
+// Fields are extracted with length checks, so a binary built against a newer
+// kernel's tcp_info degrades gracefully on older kernels, with fields beyond
+// the returned length (or only partly within it) sampled as zero. The offsets
+// are the same on all architectures, as tcp_info contains only fixed width
+// types, with the 64-bit fields naturally aligned. Only the order of the
+// tcpi_snd_wscale and tcpi_rcv_wscale bitfields depends on the byte order (see
+// wscales).
+type tcpiField struct {
+	name   string
+	off    int
+	size   int
+	kernel string
+}
+
+// tcp_info fields used by the Go sampler
+var (
+	tcpiCAState       = tcpiField{"tcpi_ca_state", 1, 1, ""}
+	tcpiProbes        = tcpiField{"tcpi_probes", 3, 1, ""}
+	tcpiBackoff       = tcpiField{"tcpi_backoff", 4, 1, ""}
+	tcpiOptions       = tcpiField{"tcpi_options", 5, 1, ""}
+	tcpiWscale        = tcpiField{"tcpi_snd_wscale", 6, 1, ""}
+	tcpiRTO           = tcpiField{"tcpi_rto", 8, 4, ""}
+	tcpiATO           = tcpiField{"tcpi_ato", 12, 4, ""}
+	tcpiSndMss        = tcpiField{"tcpi_snd_mss", 16, 4, ""}
+	tcpiSacked        = tcpiField{"tcpi_sacked", 28, 4, ""}
+	tcpiLost          = tcpiField{"tcpi_lost", 32, 4, ""}
+	tcpiLastDataSent  = tcpiField{"tcpi_last_data_sent", 44, 4, ""}
+	tcpiLastDataRecv  = tcpiField{"tcpi_last_data_recv", 52, 4, ""}
+	tcpiLastAckRecv   = tcpiField{"tcpi_last_ack_recv", 56, 4, ""}
+	tcpiPMTU          = tcpiField{"tcpi_pmtu", 60, 4, ""}
+	tcpiRTT           = tcpiField{"tcpi_rtt", 68, 4, ""}
+	tcpiRTTVar        = tcpiField{"tcpi_rttvar", 72, 4, ""}
+	tcpiSndSsthresh   = tcpiField{"tcpi_snd_ssthresh", 76, 4, ""}
+	tcpiSndCwnd       = tcpiField{"tcpi_snd_cwnd", 80, 4, ""}
+	tcpiAdvMSS        = tcpiField{"tcpi_advmss", 84, 4, ""}
+	tcpiReordering    = tcpiField{"tcpi_reordering", 88, 4, ""}
+	tcpiRcvRTT        = tcpiField{"tcpi_rcv_rtt", 92, 4, ""}
+	tcpiRcvSpace      = tcpiField{"tcpi_rcv_space", 96, 4, ""}
+	tcpiTotalRetrans  = tcpiField{"tcpi_total_retrans", 100, 4, ""}
+	tcpiPacingRate    = tcpiField{"tcpi_pacing_rate", 104, 8, "3.15"}
+	tcpiBytesAcked    = tcpiField{"tcpi_bytes_acked", 120, 8, "4.1"}
+	tcpiBytesReceived = tcpiField{"tcpi_bytes_received", 128, 8, "4.1"}
+	tcpiMinRTT        = tcpiField{"tcpi_min_rtt", 148, 4, "4.6"}
+	tcpiDeliveryRate  = tcpiField{"tcpi_delivery_rate", 160, 8, "4.9"}
+	tcpiBusyTime      = tcpiField{"tcpi_busy_time", 168, 8, "4.10"}
+	tcpiRwndLimited   = tcpiField{"tcpi_rwnd_limited", 176, 8, "4.10"}
+	tcpiSndbufLimited = tcpiField{"tcpi_sndbuf_limited", 184, 8, "4.10"}
+	tcpiDelivered     = tcpiField{"tcpi_delivered", 192, 4, "4.18"}
+	tcpiDeliveredCE   = tcpiField{"tcpi_delivered_ce", 196, 4, "4.18"}
+	tcpiBytesSent     = tcpiField{"tcpi_bytes_sent", 200, 8, "4.19"}
+	tcpiBytesRetrans  = tcpiField{"tcpi_bytes_retrans", 208, 8, "4.19"}
+	tcpiDSACKDups     = tcpiField{"tcpi_dsack_dups", 216, 4, "5.0"}
+	tcpiReordSeen     = tcpiField{"tcpi_reord_seen", 220, 4, "5.0"}
+	tcpiRcvOOOPack    = tcpiField{"tcpi_rcv_ooopack", 224, 4, "5.4"}
+	tcpiSndWnd        = tcpiField{"tcpi_snd_wnd", 228, 4, "5.4"}
+	tcpiRcvWnd        = tcpiField{"tcpi_rcv_wnd", 232, 4, "6.2"}
+)
+
+// tcpInfoFields lists the optional tcp_info fields used by the samplers.
+var tcpInfoFields = []tcpiField{
+	tcpiPacingRate,
+	tcpiBytesAcked,
+	tcpiBytesReceived,
+	tcpiMinRTT,
+	tcpiDeliveryRate,
+	tcpiBusyTime,
+	tcpiRwndLimited,
+	tcpiSndbufLimited,
+	tcpiDelivered,
+	tcpiDeliveredCE,
+	tcpiBytesSent,
+	tcpiBytesRetrans,
+	tcpiDSACKDups,
+	tcpiReordSeen,
+	tcpiRcvOOOPack,
+	tcpiSndWnd,
+	tcpiRcvWnd,
+}
+
+// end returns the tcp_info length required to include the field.
+func (f tcpiField) end() int {
+	return f.off + f.size
+}
+
+// value returns the field's value from tcp_info t, or 0 if t doesn't include
+// all of it.
+func (f tcpiField) value(t []byte) (v uint64) {
+	if f.end() > len(t) {
+		return
+	}
+	b := t[f.off:f.end()]
+	switch f.size {
+	case 1:
+		v = uint64(b[0])
+	case 4:
+		v = uint64(nativeEndian.Uint32(b))
+	case 8:
+		v = nativeEndian.Uint64(b)
+	}
+	return
+}
+
+func (f tcpiField) u8(t []byte) uint8 {
+	return uint8(f.value(t))
+}
+
+func (f tcpiField) u32(t []byte) uint32 {
+	return uint32(f.value(t))
+}
+
+func (f tcpiField) u64(t []byte) uint64 {
+	return f.value(t)
+}
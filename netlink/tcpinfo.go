@@ -0,0 +1,32 @@
+//go:build !386
+// +build !386
+
+package netlink
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// tcpInfoLen returns the length of the kernel's struct tcp_info, by calling
+// getsockopt TCP_INFO with a larger buffer on an unconnected socket.
+func tcpInfoLen() (l int, err error) {
+	var fd int
+	if fd, err = syscall.Socket(syscall.AF_INET,
+		syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0); err != nil {
+		return
+	}
+	defer syscall.Close(fd)
+
+	var b [512]byte
+	n := uint32(len(b))
+	if _, _, e := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd),
+		syscall.IPPROTO_TCP, syscall.TCP_INFO, uintptr(unsafe.Pointer(&b[0])),
+		uintptr(unsafe.Pointer(&n)), 0); e != 0 {
+		err = e
+		return
+	}
+	l = int(n)
+
+	return
+}
@@ -0,0 +1,7 @@
+package netlink
+
+// tcpInfoLen returns 0 (unknown) on 386, where getsockopt is only available
+// through socketcall.
+func tcpInfoLen() (l int, err error) {
+	return
+}
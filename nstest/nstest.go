@@ -0,0 +1,296 @@
+// Package nstest is a harness for end-to-end tests of the cgmon pipeline. It
+// creates a network namespace connected to the current one by a veth pair,
+// with netem on the host side to inject delay and loss, generates real TCP
+// flows from the namespace to a server in the current namespace, then runs the
+// sampler, tracker and analyzer on the server side of those flows.
+//
+// The harness requires root (or CAP_NET_ADMIN and CAP_SYS_ADMIN) and the ip
+// and tc commands from iproute2. A typical test looks like:
+//
+//	h, err := nstest.New(nstest.Config{Name: "cgmon0", Delay: 20 * time.Millisecond})
+//	if err != nil {
+//		t.Skipf("unable to create harness (%s)", err)
+//	}
+//	defer h.Close()
+//	fs, err := h.Run(nstest.Flow{Port: 5001, Bytes: 10 << 20})
+//	...
+//	s := nstest.FindFlow(fs, 5001)
+//	if s == nil || s.MinRTTKernelms < 20 {
+//		t.Errorf("unexpected flow stats %+v", s)
+//	}
+package nstest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/heistp/cgmon/analyzer"
+	"github.com/heistp/cgmon/netlink"
+	"github.com/heistp/cgmon/sampler"
+	"github.com/heistp/cgmon/tracker"
+	"gonum.org/v1/gonum/stat"
+)
+
+// cloneNewNet is CLONE_NEWNET, for setns.
+const cloneNewNet = 0x40000000
+
+// A Config contains the harness configuration.
+type Config struct {
+	Name     string        // name of the network namespace and prefix for veth names
+	HostIP   string        // IP address of the host side veth (default 10.199.0.1)
+	PeerIP   string        // IP address of the namespace side veth (default 10.199.0.2)
+	Delay    time.Duration // netem delay on the host side veth
+	Jitter   time.Duration // netem delay jitter
+	LossPct  float64       // netem loss percentage
+	RateMbit int           // netem rate limit in Mbit/s (0 for none)
+	Interval time.Duration // sample interval (default 10ms)
+	Backend  string        // netlink sampler backend (default netlink.BackendGo, which doesn't require cgo)
+}
+
+// A Flow describes one TCP flow to generate, sending Bytes from the server in
+// the current namespace to a client in the test namespace.
+type Flow struct {
+	Port  uint16 // server port
+	Bytes int    // bytes to send
+}
+
+// A Harness is a network namespace and veth pair for end-to-end tests.
+type Harness struct {
+	Config
+	hostIf string
+	peerIf string
+}
+
+// New creates the network namespace and veth pair and adds netem. Any
+// leftovers from previous runs with the same name are removed first.
+func New(cfg Config) (h *Harness, err error) {
+	if cfg.Name == "" {
+		err = fmt.Errorf("harness name required")
+		return
+	}
+	if cfg.HostIP == "" {
+		cfg.HostIP = "10.199.0.1"
+	}
+	if cfg.PeerIP == "" {
+		cfg.PeerIP = "10.199.0.2"
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = 10 * time.Millisecond
+	}
+	if cfg.Backend == "" {
+		cfg.Backend = netlink.BackendGo
+	}
+
+	h = &Harness{cfg, cfg.Name + "h", cfg.Name + "p"}
+	h.cleanup()
+
+	cmds := [][]string{
+		{"ip", "netns", "add", h.Name},
+		{"ip", "link", "add", h.hostIf, "type", "veth", "peer", "name", h.peerIf},
+		{"ip", "link", "set", h.peerIf, "netns", h.Name},
+		{"ip", "addr", "add", h.HostIP + "/24", "dev", h.hostIf},
+		{"ip", "link", "set", h.hostIf, "up"},
+		{"ip", "-n", h.Name, "addr", "add", h.PeerIP + "/24", "dev", h.peerIf},
+		{"ip", "-n", h.Name, "link", "set", h.peerIf, "up"},
+		{"ip", "-n", h.Name, "link", "set", "lo", "up"},
+	}
+	if h.Delay > 0 || h.LossPct > 0 || h.RateMbit > 0 {
+		cmds = append(cmds, h.netemCommand())
+	}
+	for _, c := range cmds {
+		if err = run(c...); err != nil {
+			h.cleanup()
+			h = nil
+			return
+		}
+	}
+
+	return
+}
+
+// Close deletes the network namespace and veth pair.
+func (h *Harness) Close() error {
+	return h.cleanup()
+}
+
+// Run generates the given flows concurrently while sampling, and returns the
+// FlowStats for all flows that ended, after a few sample intervals of idle
+// time so the last flows are seen to end.
+func (h *Harness) Run(flows ...Flow) (fs []*analyzer.FlowStats, err error) {
+	var s sampler.Sampler
+	if s, err = netlink.New(netlink.Config{
+		ReadBufSize:    32 * 1024,
+		SrcPorts:       ports(flows),
+		ReceiveTimeout: time.Second,
+		Backend:        h.Backend,
+	}); err != nil {
+		return
+	}
+	if c, ok := s.(sampler.Closer); ok {
+		defer c.Close()
+	}
+	t := tracker.NewTracker(tracker.Config{})
+	a := analyzer.NewAnalyzer(analyzer.Config{
+		SamplerInterval: h.Interval,
+		CumulantKind:    stat.LinInterp,
+	})
+
+	// first track marks flows as pre-existing, so do it before starting flows
+	var r sampler.Result
+	if r, err = s.Sample(); err != nil {
+		return
+	}
+	t.Track(r.Samples())
+
+	done := make(chan error, len(flows))
+	for _, f := range flows {
+		go func(f Flow) {
+			done <- h.flow(f)
+		}(f)
+	}
+
+	tck := time.NewTicker(h.Interval)
+	defer tck.Stop()
+	pending := len(flows)
+	idle := 0
+	for idle < 5 {
+		select {
+		case e := <-done:
+			if e != nil && err == nil {
+				err = e
+			}
+			pending--
+			continue
+		case <-tck.C:
+		}
+		if r, err = s.Sample(); err != nil {
+			return
+		}
+		fs = append(fs, a.Analyze(t.Track(r.Samples()))...)
+		if pending == 0 {
+			idle++
+		}
+	}
+
+	return
+}
+
+// FindFlow returns the stats for the first flow with the given source
+// (server) port, or nil if there are none.
+func FindFlow(fs []*analyzer.FlowStats, port uint16) *analyzer.FlowStats {
+	for _, s := range fs {
+		if s.ID.SrcPort == port {
+			return s
+		}
+	}
+	return nil
+}
+
+// flow runs a server in the current namespace, and a client in the test
+// namespace that reads until the server closes the connection.
+func (h *Harness) flow(f Flow) (err error) {
+	var l net.Listener
+	addr := net.JoinHostPort(h.HostIP, strconv.Itoa(int(f.Port)))
+	if l, err = net.Listen("tcp4", addr); err != nil {
+		return
+	}
+	defer l.Close()
+
+	cerr := make(chan error, 1)
+	go func() {
+		cerr <- h.client(addr)
+	}()
+
+	var c net.Conn
+	if c, err = l.Accept(); err != nil {
+		return
+	}
+	buf := make([]byte, 64*1024)
+	for n := 0; n < f.Bytes; n += len(buf) {
+		w := buf
+		if f.Bytes-n < len(w) {
+			w = w[:f.Bytes-n]
+		}
+		if _, err = c.Write(w); err != nil {
+			c.Close()
+			return
+		}
+	}
+	if err = c.Close(); err != nil {
+		return
+	}
+
+	err = <-cerr
+	return
+}
+
+// client connects to addr from within the test namespace and reads until EOF.
+// The goroutine's thread is left in the namespace and is therefore not unlocked,
+// which causes the runtime to terminate the thread when the goroutine exits.
+func (h *Harness) client(addr string) (err error) {
+	runtime.LockOSThread()
+
+	var ns *os.File
+	if ns, err = os.Open("/var/run/netns/" + h.Name); err != nil {
+		return
+	}
+	defer ns.Close()
+	if _, _, e := syscall.RawSyscall(sysSetns, ns.Fd(), cloneNewNet, 0); e != 0 {
+		err = fmt.Errorf("setns failed (%s)", e)
+		return
+	}
+
+	var c net.Conn
+	if c, err = net.Dial("tcp4", addr); err != nil {
+		return
+	}
+	defer c.Close()
+	_, err = io.Copy(io.Discard, c)
+	return
+}
+
+func (h *Harness) netemCommand() (c []string) {
+	c = []string{"tc", "qdisc", "add", "dev", h.hostIf, "root", "netem"}
+	if h.Delay > 0 {
+		c = append(c, "delay", h.Delay.String())
+		if h.Jitter > 0 {
+			c = append(c, h.Jitter.String())
+		}
+	}
+	if h.LossPct > 0 {
+		c = append(c, "loss", strconv.FormatFloat(h.LossPct, 'f', -1, 64)+"%")
+	}
+	if h.RateMbit > 0 {
+		c = append(c, "rate", strconv.Itoa(h.RateMbit)+"mbit")
+	}
+	return
+}
+
+func (h *Harness) cleanup() (err error) {
+	// deleting the namespace deletes the peer, and with it the host veth
+	err = run("ip", "netns", "del", h.Name)
+	run("ip", "link", "del", h.hostIf)
+	return
+}
+
+func ports(flows []Flow) (p []uint16) {
+	for _, f := range flows {
+		p = append(p, f.Port, f.Port)
+	}
+	return
+}
+
+func run(args ...string) (err error) {
+	var out []byte
+	if out, err = exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		err = fmt.Errorf("%v failed (%s): %s", args, err, out)
+	}
+	return
+}
@@ -0,0 +1,48 @@
+package nstest
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// TestNetem runs one flow through a netem delay with loss, and checks that its
+// RTT and retransmit stats reflect them.
+func TestNetem(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	for _, c := range []string{"ip", "tc"} {
+		if _, err := exec.LookPath(c); err != nil {
+			t.Skipf("requires %s (%s)", c, err)
+		}
+	}
+	h, err := New(Config{
+		Name:    "cgmontest",
+		Delay:   20 * time.Millisecond,
+		LossPct: 2,
+	})
+	if err != nil {
+		t.Skipf("unable to create harness (%s)", err)
+	}
+	defer h.Close()
+
+	fs, err := h.Run(Flow{Port: 5001, Bytes: 10 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := FindFlow(fs, 5001)
+	if s == nil {
+		t.Fatalf("flow not found in %d ended flows", len(fs))
+	}
+	if s.MinRTTKernelms < 20 {
+		t.Errorf("kernel min RTT %.3fms less than netem delay", s.MinRTTKernelms)
+	}
+	if s.RTTSummary[3] < 20 {
+		t.Errorf("median RTT %.3fms less than netem delay", s.RTTSummary[3])
+	}
+	if s.TotalRetransmits == 0 {
+		t.Errorf("no retransmits with %.0f%% loss", h.LossPct)
+	}
+}
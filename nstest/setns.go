@@ -0,0 +1,9 @@
+//go:build !amd64 && !386
+// +build !amd64,!386
+
+package nstest
+
+import "syscall"
+
+// sysSetns is the setns syscall number.
+const sysSetns = syscall.SYS_SETNS
@@ -0,0 +1,4 @@
+package nstest
+
+// sysSetns is the setns syscall number.
+const sysSetns = 308
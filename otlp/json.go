@@ -0,0 +1,81 @@
+package otlp
+
+import "strconv"
+
+// The types below are the subset of the OTLP/JSON protobuf mapping used for
+// exporting spans. IDs are hex encoded, and 64-bit integers are strings.
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []attribute `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope  `json:"scope"`
+	Spans []span `json:"spans"`
+}
+
+type scope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type span struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []attribute `json:"attributes"`
+}
+
+type attribute struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string     `json:"stringValue,omitempty"`
+	BoolValue   *bool       `json:"boolValue,omitempty"`
+	IntValue    string      `json:"intValue,omitempty"`
+	DoubleValue *float64    `json:"doubleValue,omitempty"`
+	ArrayValue  *arrayValue `json:"arrayValue,omitempty"`
+}
+
+type arrayValue struct {
+	Values []anyValue `json:"values"`
+}
+
+func stringAttr(k, v string) attribute {
+	return attribute{k, anyValue{StringValue: &v}}
+}
+
+func boolAttr(k string, v bool) attribute {
+	return attribute{k, anyValue{BoolValue: &v}}
+}
+
+func intAttr(k string, v int64) attribute {
+	return attribute{k, anyValue{IntValue: strconv.FormatInt(v, 10)}}
+}
+
+func doubleAttr(k string, v float64) attribute {
+	return attribute{k, anyValue{DoubleValue: &v}}
+}
+
+func doubleArrayAttr(k string, v []float64) attribute {
+	v = append([]float64(nil), v...)
+	a := &arrayValue{make([]anyValue, len(v))}
+	for i := range v {
+		a.Values[i].DoubleValue = &v[i]
+	}
+	return attribute{k, anyValue{ArrayValue: a}}
+}
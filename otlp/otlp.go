@@ -0,0 +1,277 @@
+// Package otlp exports ended flows as OpenTelemetry spans, using OTLP/HTTP
+// with JSON encoding, so flows may be viewed and correlated with application
+// traces by time and peer address.
+package otlp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/heistp/cgmon/analyzer"
+	"github.com/heistp/cgmon/tracker"
+)
+
+// maxQueue is the maximum number of spans waiting to be exported, after
+// which new spans are dropped.
+const maxQueue = 16384
+
+// Span kinds: SPAN_KIND_INTERNAL for flows whose direction isn't known, as
+// flows are observed, and SPAN_KIND_SERVER or SPAN_KIND_CLIENT for inbound or
+// outbound flows.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// A Config contains the OTLP exporter configuration.
+type Config struct {
+	URL         string        // OTLP/HTTP traces endpoint URL (empty disables)
+	Interval    time.Duration // interval on which queued spans are exported
+	ServiceName string        // value of the service.name resource attribute
+	HostName    string        // value of the host.name resource attribute (empty omits it)
+	Version     string        // version of the instrumentation scope
+	Log         bool          // if true, logging is enabled
+}
+
+// Metrics contains the OTLP exporter metrics.
+type Metrics struct {
+	Exported uint64 // spans exported
+	Dropped  uint64 // spans dropped due to a full queue or failed export
+	Exports  uint64 // successful export requests
+	Errors   uint64 // failed export requests
+	sync.RWMutex
+}
+
+func (m *Metrics) recordExport(spans int) {
+	m.Lock()
+	defer m.Unlock()
+	m.Exports++
+	m.Exported += uint64(spans)
+}
+
+func (m *Metrics) recordError(spans int) {
+	m.Lock()
+	defer m.Unlock()
+	m.Errors++
+	m.Dropped += uint64(spans)
+}
+
+func (m *Metrics) recordDropped(spans int) {
+	m.Lock()
+	defer m.Unlock()
+	m.Dropped += uint64(spans)
+}
+
+// An Exporter queues a span for each ended flow, and exports the queue on the
+// configured interval. Each flow is the root span of its own trace. Failed
+// exports are not retried, and their spans are dropped.
+type Exporter struct {
+	Config
+	client   *http.Client
+	resource resource
+	queue    []span
+	metrics  Metrics
+	stop     chan bool
+	done     chan bool
+	mtx      sync.Mutex
+}
+
+// NewExporter returns a new Exporter, and starts exporting to the configured
+// URL.
+func NewExporter(cfg Config) (e *Exporter, err error) {
+	var u *url.URL
+	if u, err = url.Parse(cfg.URL); err != nil {
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		err = fmt.Errorf("unsupported URL scheme: %s", u.Scheme)
+		return
+	}
+	if cfg.Interval <= 0 {
+		err = fmt.Errorf("invalid interval: %s", cfg.Interval)
+		return
+	}
+
+	r := resource{[]attribute{stringAttr("service.name", cfg.ServiceName)}}
+	if cfg.HostName != "" {
+		r.Attributes = append(r.Attributes, stringAttr("host.name", cfg.HostName))
+	}
+	e = &Exporter{
+		Config:   cfg,
+		client:   &http.Client{Timeout: cfg.Interval},
+		resource: r,
+		stop:     make(chan bool),
+		done:     make(chan bool),
+	}
+
+	go e.run()
+
+	if cfg.Log {
+		log.Printf("exporting flow spans to %s every %s", cfg.URL, cfg.Interval)
+	}
+
+	return
+}
+
+// Add queues spans for ended flows.
+func (e *Exporter) Add(fs []*analyzer.FlowStats) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	for i, s := range fs {
+		if len(e.queue) >= maxQueue {
+			e.metrics.recordDropped(len(fs) - i)
+			return
+		}
+		e.queue = append(e.queue, newSpan(s))
+	}
+}
+
+func (e *Exporter) Metrics() (m Metrics) {
+	e.metrics.RLock()
+	defer e.metrics.RUnlock()
+	m = e.metrics
+	return
+}
+
+// Close stops the Exporter, after a final export.
+func (e *Exporter) Close() {
+	close(e.stop)
+	<-e.done
+}
+
+func (e *Exporter) run() {
+	defer close(e.done)
+	t := time.NewTicker(e.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			e.export()
+		case <-e.stop:
+			e.export()
+			return
+		}
+	}
+}
+
+// export sends the queued spans to the endpoint.
+func (e *Exporter) export() {
+	e.mtx.Lock()
+	q := e.queue
+	e.queue = nil
+	e.mtx.Unlock()
+	if len(q) == 0 {
+		return
+	}
+
+	var err error
+	defer func() {
+		if err != nil {
+			e.metrics.recordError(len(q))
+			log.Printf("OTLP export to %s failed (%s)", e.URL, err)
+		}
+	}()
+
+	var body []byte
+	if body, err = json.Marshal(exportRequest{[]resourceSpans{{
+		e.resource,
+		[]scopeSpans{{scope{"cgmon", e.Version}, q}},
+	}}}); err != nil {
+		return
+	}
+
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodPost, e.URL,
+		bytes.NewReader(body)); err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "cgmon")
+
+	var resp *http.Response
+	if resp, err = e.client.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+
+	e.metrics.recordExport(len(q))
+	if e.Log {
+		log.Printf("OTLP exported %d spans (%d bytes)", len(q), len(body))
+	}
+}
+
+// newSpan returns a span for an ended flow, with attributes named after the
+// OpenTelemetry network semantic conventions where they apply.
+func newSpan(s *analyzer.FlowStats) (p span) {
+	var id [24]byte
+	rand.Read(id[:])
+	p.TraceID = hex.EncodeToString(id[:16])
+	p.SpanID = hex.EncodeToString(id[16:])
+	p.Name = "tcp flow"
+	switch s.Direction {
+	case tracker.DirectionInbound:
+		p.Kind = spanKindServer
+	case tracker.DirectionOutbound:
+		p.Kind = spanKindClient
+	default:
+		p.Kind = spanKindInternal
+	}
+	p.StartTimeUnixNano = strconv.FormatInt(s.StartTime.UnixNano(), 10)
+	p.EndTimeUnixNano = strconv.FormatInt(s.EndTime.UnixNano(), 10)
+
+	a := []attribute{
+		stringAttr("network.transport", "tcp"),
+		stringAttr("network.local.address", s.ID.SrcIP.String()),
+		intAttr("network.local.port", int64(s.ID.SrcPort)),
+		stringAttr("network.peer.address", s.ID.DstIP.String()),
+		intAttr("network.peer.port", int64(s.ID.DstPort)),
+		stringAttr("cgmon.congestion_control", s.CongestionControl),
+		doubleAttr("cgmon.rtt_median_ms", s.RTTSummary[3]),
+		doubleArrayAttr("cgmon.rtt_summary_ms", s.RTTSummary[:]),
+		doubleAttr("cgmon.min_rtt_ms", s.MinRTTKernelms),
+		intAttr("cgmon.bytes_acked", int64(s.BytesAcked)),
+		intAttr("cgmon.retransmits", int64(s.TotalRetransmits)),
+		intAttr("cgmon.rto_events", int64(s.RTOEvents)),
+		doubleAttr("cgmon.send_throughput_mbps", s.SendThroughputMbps),
+		intAttr("cgmon.samples", int64(s.Samples)),
+	}
+	if s.PID != 0 {
+		a = append(a, intAttr("process.pid", int64(s.PID)),
+			stringAttr("process.executable.name", s.Process))
+	}
+	if s.ContainerID != "" {
+		a = append(a, stringAttr("container.id", s.ContainerID))
+	}
+	if s.PodUID != "" {
+		a = append(a, stringAttr("k8s.pod.uid", s.PodUID))
+	}
+	if s.Tag != "" {
+		a = append(a, stringAttr("cgmon.tag", s.Tag))
+	}
+	if s.Partial {
+		a = append(a, boolAttr("cgmon.partial", true))
+	}
+	if s.Targeted {
+		a = append(a, boolAttr("cgmon.targeted", true))
+	}
+	p.Attributes = a
+
+	return
+}
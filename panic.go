@@ -0,0 +1,61 @@
+package cgmon
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+// PanicMetrics contains the number of panics recovered in each pipeline stage.
+type PanicMetrics struct {
+	Recovered [numStages]uint64 // panics recovered, after which the batch was dropped
+	sync.RWMutex
+}
+
+func (m *PanicMetrics) record(s stage) {
+	m.Lock()
+	defer m.Unlock()
+	m.Recovered[s]++
+}
+
+// total returns the total number of panics recovered in all stages.
+func (m *PanicMetrics) total() (n uint64) {
+	for _, r := range m.Recovered {
+		n += r
+	}
+	return
+}
+
+// errPanic is returned for a sample call that panicked, so it's counted and
+// retried like other sample errors.
+var errPanic = fmt.Errorf("sampler panicked")
+
+// guard calls f for one batch in a pipeline stage, and returns true if it
+// completed. If Recover is set and f panics, the panic is logged with a
+// stack trace and recorded in the metrics, and false is returned so the batch
+// is dropped, instead of the panic taking down the process.
+func (a *App) guard(s stage, f func()) (ok bool) {
+	if !a.Recover {
+		f()
+		ok = true
+		return
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			a.panics.record(s)
+			log.Printf("recovered from panic in %s stage, dropping batch (%v)\n%s",
+				s, p, debug.Stack())
+		}
+	}()
+	f()
+	ok = true
+	return
+}
+
+func (a *App) panicMetrics() (m PanicMetrics) {
+	a.panics.RLock()
+	defer a.panics.RUnlock()
+	m = a.panics
+	return
+}
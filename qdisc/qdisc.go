@@ -0,0 +1,407 @@
+// Package qdisc collects tc qdisc statistics for configured interfaces using
+// rtnetlink, as a time series that may be joined to flow records by interface.
+package qdisc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// rtnetlink constants (linux/rtnetlink.h, linux/pkt_sched.h, linux/gen_stats.h)
+const (
+	nlmsgHdrLen     = 16
+	rtaHdrLen       = 4
+	tcmsgLen        = 20
+	rtmsgLen        = 12
+	rtmNewRoute     = 24
+	rtmGetRoute     = 26
+	rtmNewQdisc     = 36
+	rtmGetQdisc     = 38
+	rtaDst          = 1
+	rtaOif          = 4
+	tcaKind         = 1
+	tcaStats2       = 7
+	tcaStatsBasic   = 1
+	tcaStatsQueue   = 3
+	tcHRoot         = 0xFFFFFFFF
+	tcHIngress      = 0xFFFFFFF1
+	routeCacheLimit = 65536
+)
+
+// nativeEndian is the host byte order, used for netlink messages.
+var nativeEndian binary.ByteOrder
+
+func init() {
+	i := uint16(1)
+	if *(*byte)(unsafe.Pointer(&i)) == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// A Config contains the qdisc collector configuration.
+type Config struct {
+	Interfaces []string      // names of interfaces to collect qdisc stats for
+	Interval   time.Duration // interval on which to collect stats
+	Log        bool          // if true, logging is enabled
+}
+
+// RecordType is the Type of qdisc records.
+const RecordType = "qdisc"
+
+// A Record contains the stats for one qdisc at one point in time.
+type Record struct {
+	Type       string    // record type, always RecordType
+	Time       time.Time // time the stats were collected
+	Interface  string    // interface name
+	Kind       string    // qdisc kind (e.g. fq_codel, cake)
+	Handle     string    // qdisc handle (e.g. 8001:)
+	Parent     string    // parent handle, or root or ingress
+	Bytes      uint64    // bytes sent
+	Packets    uint32    // packets sent
+	Drops      uint32    // packets dropped
+	Overlimits uint32    // overlimit events
+	Requeues   uint32    // requeues
+	Backlog    uint32    // bytes in queue
+	Qlen       uint32    // packets in queue
+}
+
+// A Collector collects qdisc stats from the kernel, and looks up the egress
+// interface for flow destinations.
+type Collector struct {
+	Config
+	ifaces map[int32]string
+	routes map[[16]byte]string
+	last   time.Time
+	fd     int
+	buf    []byte
+	seq    uint32
+	sync.Mutex
+}
+
+// NewCollector returns a new Collector, resolving the configured interface
+// names.
+func NewCollector(cfg Config) (c *Collector, err error) {
+	nc := &Collector{
+		Config: cfg,
+		ifaces: make(map[int32]string),
+		routes: make(map[[16]byte]string),
+		fd:     -1,
+		buf:    make([]byte, 32*1024),
+	}
+	for _, n := range cfg.Interfaces {
+		var i *net.Interface
+		if i, err = net.InterfaceByName(n); err != nil {
+			return
+		}
+		nc.ifaces[int32(i.Index)] = i.Name
+	}
+	c = nc
+	return
+}
+
+// Collect returns the stats for the qdiscs on the configured interfaces, or nil
+// if Interval has not elapsed since the last collection.
+func (c *Collector) Collect(now time.Time) (r []*Record, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.last.IsZero() && now.Sub(c.last) < c.Interval {
+		return
+	}
+	c.last = now
+
+	// routes may change, so refresh destination interfaces with each
+	// collection
+	c.routes = make(map[[16]byte]string)
+
+	if err = c.open(); err != nil {
+		return
+	}
+
+	t0 := time.Now()
+	req := c.request(rtmGetQdisc, syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP,
+		make([]byte, tcmsgLen))
+	err = c.roundTrip(req, func(typ uint16, b []byte) {
+		if typ != rtmNewQdisc || len(b) < tcmsgLen {
+			return
+		}
+		ifi := int32(nativeEndian.Uint32(b[4:8]))
+		name, ok := c.ifaces[ifi]
+		if !ok {
+			return
+		}
+		q := &Record{
+			Type:      RecordType,
+			Time:      now,
+			Interface: name,
+			Handle:    handle(nativeEndian.Uint32(b[8:12])),
+			Parent:    handle(nativeEndian.Uint32(b[12:16])),
+		}
+		parseAttrs(b[tcmsgLen:], func(typ uint16, a []byte) {
+			switch typ {
+			case tcaKind:
+				q.Kind = cstring(a)
+			case tcaStats2:
+				parseAttrs(a, q.parseStats)
+			}
+		})
+		r = append(r, q)
+	})
+	if err != nil {
+		c.close()
+		return
+	}
+
+	if c.Log {
+		log.Printf("qdisc collect time=%s qdiscs=%d", time.Since(t0), len(r))
+	}
+
+	return
+}
+
+// Interface returns the name of the egress interface for the given
+// destination address (IPv4 addresses are v4-mapped), or the empty string if
+// it can't be determined.
+func (c *Collector) Interface(dst [16]byte) (name string) {
+	c.Lock()
+	defer c.Unlock()
+
+	var ok bool
+	if name, ok = c.routes[dst]; ok {
+		return
+	}
+
+	var err error
+	if name, err = c.lookupRoute(dst); err != nil && c.Log {
+		log.Printf("qdisc route lookup failed for %s (%s)", net.IP(dst[:]), err)
+	}
+	if len(c.routes) < routeCacheLimit {
+		c.routes[dst] = name
+	}
+
+	return
+}
+
+// Close closes the netlink socket.
+func (c *Collector) Close() error {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.close()
+}
+
+func (c *Collector) lookupRoute(dst [16]byte) (name string, err error) {
+	if err = c.open(); err != nil {
+		return
+	}
+
+	ip := net.IP(dst[:])
+	m := make([]byte, rtmsgLen)
+	var a []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		m[0] = syscall.AF_INET
+		m[1] = 32
+		a = ip4
+	} else {
+		m[0] = syscall.AF_INET6
+		m[1] = 128
+		a = ip
+	}
+	m = appendAttr(m, rtaDst, a)
+
+	var oif int32
+	err = c.roundTrip(c.request(rtmGetRoute, syscall.NLM_F_REQUEST, m),
+		func(typ uint16, b []byte) {
+			if typ != rtmNewRoute || len(b) < rtmsgLen {
+				return
+			}
+			parseAttrs(b[rtmsgLen:], func(typ uint16, a []byte) {
+				if typ == rtaOif && len(a) >= 4 {
+					oif = int32(nativeEndian.Uint32(a))
+				}
+			})
+		})
+	if err != nil {
+		c.close()
+		return
+	}
+
+	if oif == 0 {
+		return
+	}
+	if name = c.ifaces[oif]; name != "" {
+		return
+	}
+	var i *net.Interface
+	if i, err = net.InterfaceByIndex(int(oif)); err != nil {
+		return
+	}
+	name = i.Name
+
+	return
+}
+
+func (c *Collector) open() (err error) {
+	if c.fd >= 0 {
+		return
+	}
+	var fd int
+	if fd, err = syscall.Socket(syscall.AF_NETLINK,
+		syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE); err != nil {
+		return
+	}
+	tv := syscall.NsecToTimeval(int64(time.Second))
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET,
+		syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return
+	}
+	c.fd = fd
+	return
+}
+
+func (c *Collector) close() (err error) {
+	if c.fd >= 0 {
+		err = syscall.Close(c.fd)
+		c.fd = -1
+	}
+	return
+}
+
+// request returns a netlink message with the given type, flags and payload.
+func (c *Collector) request(typ uint16, flags uint16, p []byte) (b []byte) {
+	c.seq++
+	b = make([]byte, nlmsgHdrLen+len(p))
+	nativeEndian.PutUint32(b[0:4], uint32(len(b)))
+	nativeEndian.PutUint16(b[4:6], typ)
+	nativeEndian.PutUint16(b[6:8], flags)
+	nativeEndian.PutUint32(b[8:12], c.seq)
+	copy(b[nlmsgHdrLen:], p)
+	return
+}
+
+// roundTrip sends a request and calls f with the type and payload of each
+// message in the response, until the response is complete.
+func (c *Collector) roundTrip(req []byte, f func(uint16, []byte)) (err error) {
+	if err = syscall.Sendto(c.fd, req, 0,
+		&syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return
+	}
+	dump := nativeEndian.Uint16(req[6:8])&syscall.NLM_F_DUMP != 0
+	for {
+		var n int
+		if n, _, err = syscall.Recvfrom(c.fd, c.buf, 0); err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return
+		}
+		b := c.buf[:n]
+		for len(b) >= nlmsgHdrLen {
+			l := int(nativeEndian.Uint32(b[0:4]))
+			if l < nlmsgHdrLen || l > len(b) {
+				break
+			}
+			typ := nativeEndian.Uint16(b[4:6])
+			if nativeEndian.Uint32(b[8:12]) == c.seq {
+				switch typ {
+				case syscall.NLMSG_DONE:
+					return
+				case syscall.NLMSG_ERROR:
+					if l >= nlmsgHdrLen+4 {
+						if e := int32(nativeEndian.Uint32(b[16:20])); e != 0 {
+							err = syscall.Errno(-e)
+						}
+					}
+					return
+				}
+				f(typ, b[nlmsgHdrLen:l])
+				if !dump {
+					return
+				}
+			}
+			if align(l) >= len(b) {
+				break
+			}
+			b = b[align(l):]
+		}
+	}
+}
+
+// parseStats parses the TCA_STATS2 nested attributes.
+func (q *Record) parseStats(typ uint16, a []byte) {
+	switch typ {
+	case tcaStatsBasic:
+		if len(a) >= 12 {
+			q.Bytes = nativeEndian.Uint64(a[0:8])
+			q.Packets = nativeEndian.Uint32(a[8:12])
+		}
+	case tcaStatsQueue:
+		if len(a) >= 20 {
+			q.Qlen = nativeEndian.Uint32(a[0:4])
+			q.Backlog = nativeEndian.Uint32(a[4:8])
+			q.Drops = nativeEndian.Uint32(a[8:12])
+			q.Requeues = nativeEndian.Uint32(a[12:16])
+			q.Overlimits = nativeEndian.Uint32(a[16:20])
+		}
+	}
+}
+
+// parseAttrs calls f with the type and payload of each rtattr in b.
+func parseAttrs(b []byte, f func(uint16, []byte)) {
+	for len(b) >= rtaHdrLen {
+		l := int(nativeEndian.Uint16(b[0:2]))
+		if l < rtaHdrLen || l > len(b) {
+			return
+		}
+		f(nativeEndian.Uint16(b[2:4])&^syscall.NLA_F_NESTED, b[rtaHdrLen:l])
+		if align(l) >= len(b) {
+			return
+		}
+		b = b[align(l):]
+	}
+}
+
+// appendAttr appends an rtattr to b.
+func appendAttr(b []byte, typ uint16, p []byte) []byte {
+	a := make([]byte, align(rtaHdrLen+len(p)))
+	nativeEndian.PutUint16(a[0:2], uint16(rtaHdrLen+len(p)))
+	nativeEndian.PutUint16(a[2:4], typ)
+	copy(a[rtaHdrLen:], p)
+	return append(b, a...)
+}
+
+// handle returns a tc handle in the format used by tc.
+func handle(h uint32) string {
+	switch h {
+	case tcHRoot:
+		return "root"
+	case tcHIngress:
+		return "ingress"
+	}
+	if h&0xFFFF == 0 {
+		return fmt.Sprintf("%x:", h>>16)
+	}
+	return fmt.Sprintf("%x:%x", h>>16, h&0xFFFF)
+}
+
+func cstring(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+func align(l int) int {
+	return (l + 3) &^ 3
+}
@@ -0,0 +1,60 @@
+package cgmon
+
+import (
+	"sync"
+
+	"github.com/heistp/cgmon/analyzer"
+)
+
+// recentFlows is a ring buffer of the stats of the most recently ended flows,
+// served by the HTTP API so recent flows may be checked without reading the
+// output files.
+type recentFlows struct {
+	mtx   sync.RWMutex
+	buf   []*analyzer.FlowStats
+	next  int    // index in buf of the next stats to add
+	len   int    // number of stats in buf
+	total uint64 // total number of stats added
+}
+
+// newRecentFlows returns a new recentFlows that keeps up to n stats.
+func newRecentFlows(n int) *recentFlows {
+	return &recentFlows{buf: make([]*analyzer.FlowStats, n)}
+}
+
+// add adds flow stats, replacing the oldest once full.
+func (r *recentFlows) add(fs []*analyzer.FlowStats) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, s := range fs {
+		r.buf[r.next] = s
+		r.next = (r.next + 1) % len(r.buf)
+		if r.len < len(r.buf) {
+			r.len++
+		}
+		r.total++
+	}
+}
+
+// page returns up to limit stats, newest first, starting offset stats from the
+// newest, with the number of stats kept and the total number added. A limit
+// <= 0 returns all stats from offset.
+func (r *recentFlows) page(offset, limit int) (fs []*analyzer.FlowStats,
+	kept int, total uint64) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	kept, total = r.len, r.total
+	if offset < 0 || offset >= r.len {
+		fs = []*analyzer.FlowStats{}
+		return
+	}
+	n := r.len - offset
+	if limit > 0 && limit < n {
+		n = limit
+	}
+	fs = make([]*analyzer.FlowStats, n)
+	for i := range fs {
+		fs[i] = r.buf[(r.next-1-offset-i+len(r.buf))%len(r.buf)]
+	}
+	return
+}
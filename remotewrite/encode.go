@@ -0,0 +1,98 @@
+package remotewrite
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// maxLiteral is the maximum length of the literal elements in snappy blocks.
+const maxLiteral = 65536
+
+// A label is a Prometheus label name and value.
+type label struct {
+	name  string
+	value string
+}
+
+// A series is one time series with a single sample.
+type series struct {
+	labels []label // labels, sorted by name
+	value  float64 // sample value
+	ts     int64   // sample timestamp, in milliseconds since the epoch
+}
+
+// encodeWriteRequest encodes a prometheus.WriteRequest protobuf message
+// containing the given series:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(ss []series) (b []byte) {
+	var t, m []byte
+	for _, s := range ss {
+		t = t[:0]
+		for _, l := range s.labels {
+			m = m[:0]
+			m = appendString(m, 1, l.name)
+			m = appendString(m, 2, l.value)
+			t = appendBytes(t, 1, m)
+		}
+		m = m[:0]
+		m = appendTag(m, 1, wireFixed64)
+		m = binary.LittleEndian.AppendUint64(m, math.Float64bits(s.value))
+		m = appendTag(m, 2, wireVarint)
+		m = binary.AppendUvarint(m, uint64(s.ts))
+		t = appendBytes(t, 2, m)
+		b = appendBytes(b, 1, t)
+	}
+	return
+}
+
+func appendTag(b []byte, field int, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wire))
+}
+
+func appendBytes(b []byte, field int, v []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendString(b []byte, field int, v string) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// snappyBlock returns src in the snappy block format, as required by
+// remote_write. Only literal elements are used, so the block isn't
+// compressed, but any snappy decoder accepts it, and the requests are small.
+func snappyBlock(src []byte) (b []byte) {
+	b = binary.AppendUvarint(make([]byte, 0, len(src)+len(src)/maxLiteral*3+8),
+		uint64(len(src)))
+	for len(src) > 0 {
+		n := len(src)
+		if n > maxLiteral {
+			n = maxLiteral
+		}
+		switch l := n - 1; {
+		case l < 60:
+			b = append(b, byte(l)<<2)
+		case l < 1<<8:
+			b = append(b, 60<<2, byte(l))
+		default:
+			b = append(b, 61<<2, byte(l), byte(l>>8))
+		}
+		b = append(b, src[:n]...)
+		src = src[n:]
+	}
+	return
+}
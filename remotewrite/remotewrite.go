@@ -0,0 +1,323 @@
+// Package remotewrite pushes per-port aggregates of ended flows to a
+// Prometheus remote_write endpoint (e.g. a Mimir or Thanos receiver), so
+// hosts too short-lived to be scraped can still be monitored.
+package remotewrite
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/heistp/cgmon/analyzer"
+	"gonum.org/v1/gonum/stat"
+)
+
+// rttQuantiles are the quantiles of flow median RTTs pushed for each port.
+var rttQuantiles = [3]float64{0.1, 0.5, 0.9}
+
+// otherPort is the key for flows not on one of the configured Ports, which
+// can't be a TCP port, and is labeled port="other".
+const otherPort = 0
+
+// A Config contains the remote_write configuration.
+type Config struct {
+	URL      string        // remote_write endpoint URL (empty disables)
+	Interval time.Duration // interval on which series are pushed
+	Ports    []uint16      // if not empty, ports with their own series, with other flows under port="other"
+	Instance string        // value of the instance label (empty omits it)
+	Log      bool          // if true, logging is enabled
+}
+
+// Metrics contains the remote_write metrics.
+type Metrics struct {
+	Pushes uint64 // successful pushes
+	Errors uint64 // failed pushes
+	Series int    // series in the last successful push
+	sync.RWMutex
+}
+
+func (m *Metrics) recordPush(series int) {
+	m.Lock()
+	defer m.Unlock()
+	m.Pushes++
+	m.Series = series
+}
+
+func (m *Metrics) recordError() {
+	m.Lock()
+	defer m.Unlock()
+	m.Errors++
+}
+
+// port accumulates data for the flows on one service port.
+type port struct {
+	flows       uint64    // cumulative ended flows
+	bytesAcked  uint64    // cumulative bytes acked by ended flows
+	retransmits uint64    // cumulative retransmits of ended flows
+	rtts        []float64 // median RTTs of flows ended since the last push
+}
+
+// An Exporter accumulates stats for ended flows by service port, and pushes
+// them as series on the configured interval. Flow, byte and retransmit totals
+// are pushed as counters, so rates may be taken with rate(), and RTTs as
+// quantiles of the median RTTs of flows ended since the last push. The latest
+// established connection counts, if set, are pushed as gauges by destination
+// port.
+//
+// Pushes that fail are not retried, as the counters are included in the next
+// push, but the RTT quantiles for the interval are lost.
+type Exporter struct {
+	Config
+	client  *http.Client
+	ports   map[uint16]*port
+	only    map[uint16]bool
+	conns   map[uint16]int // established connections by port key, if set
+	metrics Metrics
+	stop    chan bool
+	done    chan bool
+	mtx     sync.Mutex
+}
+
+// NewExporter returns a new Exporter, and starts pushing to the configured URL.
+func NewExporter(cfg Config) (e *Exporter, err error) {
+	var u *url.URL
+	if u, err = url.Parse(cfg.URL); err != nil {
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		err = fmt.Errorf("unsupported URL scheme: %s", u.Scheme)
+		return
+	}
+	if cfg.Interval <= 0 {
+		err = fmt.Errorf("invalid interval: %s", cfg.Interval)
+		return
+	}
+
+	e = &Exporter{
+		Config: cfg,
+		client: &http.Client{Timeout: cfg.Interval},
+		ports:  make(map[uint16]*port),
+		stop:   make(chan bool),
+		done:   make(chan bool),
+	}
+	if len(cfg.Ports) > 0 {
+		e.only = make(map[uint16]bool)
+		for _, p := range cfg.Ports {
+			e.only[p] = true
+		}
+	}
+
+	go e.run()
+
+	if cfg.Log {
+		log.Printf("pushing series to %s every %s", cfg.URL, cfg.Interval)
+	}
+
+	return
+}
+
+// Add adds stats for ended flows.
+func (e *Exporter) Add(fs []*analyzer.FlowStats) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	for _, s := range fs {
+		p := e.port(e.servicePort(s))
+		p.flows++
+		p.bytesAcked += s.BytesAcked
+		p.retransmits += uint64(s.TotalRetransmits)
+		p.rtts = append(p.rtts, s.RTTSummary[3])
+	}
+}
+
+// SetConnections sets the established connections by destination port for
+// the next push. If Ports is set, connections to other ports are pushed under
+// port="other". Ports that no longer have connections are pushed as zero.
+func (e *Exporter) SetConnections(ports map[uint16]int) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.conns == nil {
+		e.conns = make(map[uint16]int)
+	}
+	for p := range e.conns {
+		e.conns[p] = 0
+	}
+	for p, n := range ports {
+		if e.only != nil && !e.only[p] {
+			p = otherPort
+		}
+		e.conns[p] += n
+	}
+}
+
+func (e *Exporter) Metrics() (m Metrics) {
+	e.metrics.RLock()
+	defer e.metrics.RUnlock()
+	m = e.metrics
+	return
+}
+
+// Close stops the Exporter, after a final push.
+func (e *Exporter) Close() {
+	close(e.stop)
+	<-e.done
+}
+
+func (e *Exporter) run() {
+	defer close(e.done)
+	t := time.NewTicker(e.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			e.push(now)
+		case <-e.stop:
+			e.push(time.Now())
+			return
+		}
+	}
+}
+
+// push sends the current series to the endpoint.
+func (e *Exporter) push(now time.Time) {
+	ss := e.series(now)
+	if len(ss) == 0 {
+		return
+	}
+
+	var err error
+	defer func() {
+		if err != nil {
+			e.metrics.recordError()
+			log.Printf("remote_write push to %s failed (%s)", e.URL, err)
+		}
+	}()
+
+	var req *http.Request
+	body := snappyBlock(encodeWriteRequest(ss))
+	if req, err = http.NewRequest(http.MethodPost, e.URL,
+		bytes.NewReader(body)); err != nil {
+		return
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "cgmon")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	var resp *http.Response
+	if resp, err = e.client.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+
+	e.metrics.recordPush(len(ss))
+	if e.Log {
+		log.Printf("remote_write pushed %d series (%d bytes)", len(ss), len(body))
+	}
+}
+
+// series returns the series for all ports, sorted by port, and starts a new
+// interval for the RTT quantiles.
+func (e *Exporter) series(now time.Time) (ss []series) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	ks := make([]uint16, 0, len(e.ports))
+	for k := range e.ports {
+		ks = append(ks, k)
+	}
+	sort.Slice(ks, func(i, j int) bool {
+		return ks[i]-1 < ks[j]-1 // otherPort last
+	})
+
+	ts := now.UnixMilli()
+	add := func(name, port string, v float64, extra ...label) {
+		ls := []label{{"__name__", name}}
+		if e.Instance != "" {
+			ls = append(ls, label{"instance", e.Instance})
+		}
+		ls = append(ls, label{"job", "cgmon"}, label{"port", port})
+		ss = append(ss, series{append(ls, extra...), v, ts})
+	}
+	for _, pk := range ks {
+		p := e.ports[pk]
+		k := portLabel(pk)
+		add("cgmon_flows_ended_total", k, float64(p.flows))
+		add("cgmon_flow_bytes_acked_total", k, float64(p.bytesAcked))
+		add("cgmon_flow_retransmits_total", k, float64(p.retransmits))
+		if len(p.rtts) == 0 {
+			continue
+		}
+		sort.Float64s(p.rtts)
+		for _, q := range rttQuantiles {
+			add("cgmon_flow_rtt_milliseconds", k,
+				stat.Quantile(q, stat.LinInterp, p.rtts, nil),
+				label{"quantile", strconv.FormatFloat(q, 'f', -1, 64)})
+		}
+		p.rtts = p.rtts[:0]
+	}
+
+	if e.conns != nil {
+		cs := make([]uint16, 0, len(e.conns))
+		for k := range e.conns {
+			cs = append(cs, k)
+		}
+		sort.Slice(cs, func(i, j int) bool {
+			return cs[i]-1 < cs[j]-1 // otherPort last
+		})
+		for _, pk := range cs {
+			add("cgmon_established_connections", portLabel(pk),
+				float64(e.conns[pk]))
+		}
+	}
+
+	return
+}
+
+// servicePort returns the port key for a flow. If Ports is set, this is
+// the local or remote port in Ports, otherwise the lower of the two, which
+// for most client and server flows is the service rather than ephemeral port.
+func (e *Exporter) servicePort(s *analyzer.FlowStats) uint16 {
+	sp, dp := s.ID.SrcPort, s.ID.DstPort
+	if e.only != nil {
+		switch {
+		case e.only[sp]:
+			return sp
+		case e.only[dp]:
+			return dp
+		}
+		return otherPort
+	}
+	if dp < sp {
+		return dp
+	}
+	return sp
+}
+
+func (e *Exporter) port(k uint16) (p *port) {
+	var ok bool
+	if p, ok = e.ports[k]; !ok {
+		p = &port{}
+		e.ports[k] = p
+	}
+	return
+}
+
+func portLabel(p uint16) string {
+	if p == otherPort {
+		return "other"
+	}
+	return strconv.Itoa(int(p))
+}
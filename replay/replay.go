@@ -0,0 +1,369 @@
+// Package replay implements a sampler that replays samples from a file, so
+// analysis may be tested deterministically offline, without a live kernel.
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/heistp/cgmon/analyzer"
+	"github.com/heistp/cgmon/linux"
+	"github.com/heistp/cgmon/sampler"
+	"github.com/heistp/cgmon/writer"
+)
+
+// Config contains the replay sampler configuration.
+type Config struct {
+	Path string // path of the file to replay (may be gzip compressed)
+	Log  bool   // if true, logging is enabled
+}
+
+// A Dump is one dump of samples in a trace file. Trace files contain a
+// sequence of Dumps as JSON objects, which are returned by the Sampler in
+// order.
+type Dump struct {
+	TstampNs uint64 // monotonic nsec time of the dump, for Flows without one
+	Flows    []Flow // sampled flows
+}
+
+// A Flow is one flow's sample in a Dump. The Data fields are at the top level
+// of the JSON object, and those not given are zero.
+type Flow struct {
+	Src string // source (local) address as host:port
+	Dst string // dest (remote) address as host:port
+	sampler.Data
+	Inode    uint32 // socket inode
+	CgroupID uint64 // ID of the socket's cgroup v2
+}
+
+// Sampler is a sampler.Sampler that returns the dumps read from a file, then
+// a nil Result when there are no more.
+//
+// The file may be a trace of Dumps, or output written with
+// -analyzer-raw-samples, in which case the flows' RawSamples are converted
+// back to samples. That conversion is lossy, as only the fields in Series
+// and the last values in FlowStats are known. Samples are re-grouped into
+// dumps in time order, and flows are repeated in the dumps spanned by their
+// lifetime, as the de-duplicated samples would have been, so the tracker
+// doesn't end them early. The first dump is empty, so no flows are marked as
+// pre-existing, and so is the last, so all flows end.
+type Sampler struct {
+	Config
+	dumps [][]sampler.Sample
+	next  int
+	sync.Mutex
+}
+
+// NewSampler returns a new Sampler for the dumps in the configured file.
+func NewSampler(cfg Config) (s *Sampler, err error) {
+	var f *os.File
+	if f, err = os.Open(cfg.Path); err != nil {
+		return
+	}
+	defer f.Close()
+	s = &Sampler{Config: cfg}
+	if s.dumps, err = readDumps(f); err != nil {
+		s = nil
+		err = fmt.Errorf("unable to read replay file %s (%s)", cfg.Path, err)
+		return
+	}
+	if cfg.Log {
+		log.Printf("read %d dumps from replay file %s", len(s.dumps), cfg.Path)
+	}
+	return
+}
+
+func (s *Sampler) Sample() (r sampler.Result, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.next >= len(s.dumps) {
+		if s.Log {
+			log.Printf("replay complete after %d dumps", s.next)
+		}
+		return
+	}
+	r = Result(s.dumps[s.next])
+	s.next++
+	return
+}
+
+// Result is a replayed dump.
+type Result []sampler.Sample
+
+func (r Result) Samples() []sampler.Sample {
+	return r
+}
+
+// readDumps reads the dumps from a trace, or the flows in cgmon output, which
+// may be gzip compressed or delta encoded. Other records in the output are
+// skipped.
+func readDumps(r io.Reader) (dumps [][]sampler.Sample, err error) {
+	br := bufio.NewReader(r)
+	var m []byte
+	if m, err = br.Peek(2); err == nil && m[0] == 0x1f && m[1] == 0x8b {
+		var gr *gzip.Reader
+		if gr, err = gzip.NewReader(br); err != nil {
+			return
+		}
+		defer gr.Close()
+		br = bufio.NewReader(gr)
+	}
+	err = nil
+
+	var fs []*analyzer.FlowStats
+	if writer.IsDelta(br) {
+		var ds []*analyzer.FlowStats
+		if ds, err = writer.ReadFlowStats(br); err != nil {
+			return
+		}
+		for _, s := range writer.SelectAnalysis(ds, "") {
+			if s.RawSamples != nil && len(s.RawSamples.Time) > 0 {
+				fs = append(fs, s)
+			}
+		}
+		if dumps = flowDumps(fs); len(dumps) == 0 {
+			err = fmt.Errorf("no flow records with RawSamples")
+		}
+		return
+	}
+	dec := json.NewDecoder(br)
+	for {
+		var raw json.RawMessage
+		if err = dec.Decode(&raw); err != nil {
+			if err == io.EOF {
+				err = nil
+				break
+			}
+			return
+		}
+		var typ string
+		if typ, err = writer.RecordType(raw); err != nil {
+			return
+		}
+		switch {
+		case typ != "": // not a flow or dump
+		case bytes.Contains(raw, []byte(`"TstampStartNs"`)):
+			s := &analyzer.FlowStats{}
+			if err = json.Unmarshal(raw, s); err != nil {
+				return
+			}
+			if !s.Compared && s.RawSamples != nil &&
+				len(s.RawSamples.Time) > 0 {
+				fs = append(fs, s)
+			}
+		case bytes.Contains(raw, []byte(`"Flows"`)):
+			d := Dump{}
+			if err = json.Unmarshal(raw, &d); err != nil {
+				return
+			}
+			var ss []sampler.Sample
+			if ss, err = d.samples(); err != nil {
+				err = fmt.Errorf("dump %d: %w", len(dumps), err)
+				return
+			}
+			dumps = append(dumps, ss)
+		}
+	}
+
+	if len(fs) > 0 {
+		if len(dumps) > 0 {
+			err = fmt.Errorf("file contains both trace dumps and flow records")
+			return
+		}
+		dumps = flowDumps(fs)
+	}
+	if len(dumps) == 0 {
+		err = fmt.Errorf("no trace dumps, or flow records with RawSamples")
+	}
+	return
+}
+
+// samples returns the Dump's samples.
+func (d *Dump) samples() (ss []sampler.Sample, err error) {
+	ss = make([]sampler.Sample, len(d.Flows))
+	for i, f := range d.Flows {
+		s := &ss[i]
+		if s.SrcIP, s.SrcPort, err = parseAddr(f.Src); err != nil {
+			return
+		}
+		if s.DstIP, s.DstPort, err = parseAddr(f.Dst); err != nil {
+			return
+		}
+		s.Data = f.Data
+		if s.TstampNs == 0 {
+			s.TstampNs = d.TstampNs
+		}
+		if s.State == 0 {
+			s.State = linux.TCP_ESTABLISHED
+		}
+		s.Inode = f.Inode
+		s.CgroupID = f.CgroupID
+	}
+	return
+}
+
+// parseAddr parses a host:port address, with IPv4 addresses v4-mapped.
+func parseAddr(a string) (ip [16]byte, port uint16, err error) {
+	var h, p string
+	if h, p, err = net.SplitHostPort(a); err != nil {
+		return
+	}
+	nip := net.ParseIP(h)
+	if nip == nil {
+		err = fmt.Errorf("invalid IP address in %s", a)
+		return
+	}
+	copy(ip[:], nip.To16())
+	var n uint64
+	if n, err = strconv.ParseUint(p, 10, 16); err != nil {
+		err = fmt.Errorf("invalid port in %s", a)
+		return
+	}
+	port = uint16(n)
+	return
+}
+
+// point is one sample of a flow, for grouping into dumps.
+type point struct {
+	flow  int    // index of the flow
+	index int    // index of the sample, or -1 for the end of the flow
+	ts    uint64 // monotonic nsec timestamp
+}
+
+// flowDumps returns dumps for the RawSamples of the given flows. A new dump
+// starts in time order when a flow already in the current dump is seen
+// again. Flows with no sample in a dump within their lifetime, which ends at
+// their last sample including de-duplicated ones, are repeated with their
+// previous sample, which the tracker de-duplicates.
+func flowDumps(fs []*analyzer.FlowStats) (dumps [][]sampler.Sample) {
+	ends := make([]uint64, len(fs))
+	var ps []point
+	for i, s := range fs {
+		ends[i] = s.ID.TstampStartNs + uint64(s.Duration)
+		for j, t := range s.RawSamples.Time {
+			ps = append(ps, point{i, j, s.ID.TstampStartNs + uint64(t*1e9)})
+		}
+		if s.SamplesDeduped > 0 {
+			ps = append(ps, point{i, -1, ends[i]})
+		}
+	}
+	sort.SliceStable(ps, func(i, j int) bool {
+		return ps[i].ts < ps[j].ts
+	})
+
+	dumps = append(dumps, nil)
+	in := make(map[int]bool)
+	last := make([]int, len(fs)) // index of each flow's last sample + 1
+	var ss []sampler.Sample
+	end := func() {
+		t0 := ss[0].TstampNs
+		for i, s := range fs {
+			if !in[i] && last[i] > 0 && ends[i] > t0 {
+				ss = append(ss, flowSample(s, last[i]-1, t0))
+			}
+		}
+		dumps = append(dumps, ss)
+		ss = nil
+		in = make(map[int]bool)
+	}
+	for _, p := range ps {
+		if in[p.flow] {
+			end()
+		}
+		if p.index < 0 { // repeat the last sample at the flow's end
+			p.index = last[p.flow] - 1
+		}
+		ss = append(ss, flowSample(fs[p.flow], p.index, p.ts))
+		in[p.flow] = true
+		last[p.flow] = p.index + 1
+	}
+	if len(ss) > 0 {
+		end()
+	}
+	dumps = append(dumps, nil)
+	return
+}
+
+// flowSample returns the sample at index i of a flow's RawSamples, with the
+// given timestamp.
+func flowSample(s *analyzer.FlowStats, i int, tstampNs uint64) (x sampler.Sample) {
+	copy(x.SrcIP[:], s.ID.SrcIP.To16())
+	x.SrcPort = s.ID.SrcPort
+	copy(x.DstIP[:], s.ID.DstIP.To16())
+	x.DstPort = s.ID.DstPort
+	x.CgroupID = s.CgroupID
+
+	r := s.RawSamples
+	d := &x.Data
+	d.TstampNs = tstampNs
+	d.State = linux.TCP_ESTABLISHED
+	d.Options = options(s)
+	d.Mark = s.Mark
+	d.DSCP = s.DSCP
+	d.UID = s.UID
+	d.CAState = uint8(at(r.CAState, i))
+	d.RTTus = uint32(at(r.RTTms, i) * 1000)
+	d.MinRTTus = uint32(s.MinRTTKernelms * 1000)
+	if s.MinRTTSeries != nil {
+		d.MinRTTus = uint32(at(s.MinRTTSeries.Kernelms, i) * 1000)
+	}
+	d.RTTVarus = uint32(at(r.RTTVarms, i) * 1000)
+	d.RTOus = uint32(at(r.RTOms, i) * 1000)
+	d.SndCwndBytes = uint32(at(r.CwndBytes, i))
+	d.SndCwnd = uint32(at(r.CwndPackets, i))
+	d.PacingRateBps = uint64(at(r.PacingRateMbps, i) * 1e6 / 8)
+	d.TotalRetransmits = uint32(at(r.Retransmits, i))
+	d.DeliveredCE = uint32(at(r.DeliveredCE, i))
+	d.BytesAcked = uint64(at(r.BytesAcked, i))
+	d.SndMSS = s.SndMSS
+	d.AdvMSS = s.AdvMSS
+	d.PMTU = s.PMTU
+	d.SndWscale = s.SndWscale
+	d.RcvWscale = s.RcvWscale
+	if s.SndMSS > 0 {
+		d.SndSsthresh = uint32(at(r.SsthreshBytes, i) / float64(s.SndMSS))
+	}
+	d.RmemAlloc = uint32(at(r.RcvQueueBytes, i))
+	d.WmemQueued = uint32(at(r.SndQueueBytes, i))
+	d.CongestionControl = s.CongestionControl
+	return
+}
+
+// options returns the TCP options for a flow's stats.
+func options(s *analyzer.FlowStats) (o uint8) {
+	for _, b := range []struct {
+		set bool
+		opt uint8
+	}{
+		{s.Timestamps, linux.TCPI_OPT_TIMESTAMPS},
+		{s.SACK, linux.TCPI_OPT_SACK},
+		{s.WindowScaling, linux.TCPI_OPT_WSCALE},
+		{s.ECN, linux.TCPI_OPT_ECN},
+		{s.ECNSeen, linux.TCPI_OPT_ECN_SEEN},
+	} {
+		if b.set {
+			o |= b.opt
+		}
+	}
+	return
+}
+
+// at returns the value at index i, or 0 if the slice is too short, as for
+// series in output written before the value was added.
+func at(v []float64, i int) float64 {
+	if i >= len(v) {
+		return 0
+	}
+	return v[i]
+}
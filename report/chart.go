@@ -0,0 +1,66 @@
+package report
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"strings"
+)
+
+// bar chart dimensions, in pixels
+const (
+	chartHeight = 160
+	chartLeft   = 50
+	chartBottom = 70
+	chartTop    = 10
+	barWidth    = 18
+	barGap      = 2
+)
+
+// barChart returns an inline SVG bar chart of the bins, with rotated labels
+// below each bar, and the value in each bar's tooltip.
+func barChart(bs []Bin) template.HTML {
+	if len(bs) == 0 {
+		return "<p>No data.</p>"
+	}
+	var max float64
+	for _, b := range bs {
+		max = math.Max(max, b.Value)
+	}
+	if max == 0 {
+		max = 1
+	}
+
+	var w strings.Builder
+	pw := len(bs) * (barWidth + barGap)
+	fmt.Fprintf(&w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="10">`+"\n",
+		chartLeft+pw+barWidth, chartTop+chartHeight+chartBottom)
+	fmt.Fprintf(&w, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#888"/>`+"\n",
+		chartLeft, chartTop+chartHeight, chartLeft+pw, chartTop+chartHeight)
+	fmt.Fprintf(&w, `<text x="%d" y="%d" text-anchor="end">%s</text>`+"\n",
+		chartLeft-4, chartTop+8, valueString(max))
+	fmt.Fprintf(&w, `<text x="%d" y="%d" text-anchor="end">0</text>`+"\n",
+		chartLeft-4, chartTop+chartHeight)
+
+	for i, b := range bs {
+		h := int(math.Round(b.Value / max * chartHeight))
+		x := chartLeft + i*(barWidth+barGap)
+		l := template.HTMLEscapeString(b.Label)
+		fmt.Fprintf(&w, `<rect x="%d" y="%d" width="%d" height="%d" fill="#4a7ab5"><title>%s: %s</title></rect>`+"\n",
+			x, chartTop+chartHeight-h, barWidth, h, l, valueString(b.Value))
+		lx, ly := x+barWidth/2, chartTop+chartHeight+8
+		fmt.Fprintf(&w, `<text x="%d" y="%d" text-anchor="end" transform="rotate(-60 %d %d)">%s</text>`+"\n",
+			lx, ly, lx, ly, l)
+	}
+	fmt.Fprintf(&w, "</svg>")
+
+	return template.HTML(w.String())
+}
+
+// valueString formats a count or value for a chart.
+func valueString(v float64) string {
+	if v == math.Trunc(v) {
+		return fmt.Sprintf("%.0f", v)
+	}
+	return fmt.Sprintf("%.3g", v)
+}
@@ -0,0 +1,397 @@
+// Package report summarizes flow stats from cgmon output, as a self-contained
+// HTML report with inline charts, or plain text.
+package report
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/heistp/cgmon/analyzer"
+	"gonum.org/v1/gonum/stat"
+)
+
+// topDests is the number of destinations in the top destinations table.
+const topDests = 20
+
+// trendBuckets is the number of time buckets for the retransmit trends.
+const trendBuckets = 48
+
+// 1-2-5 series bin edges for the distributions
+var (
+	rttEdges        = series125(0.1, 10000)
+	throughputEdges = series125(0.01, 10000)
+	durationEdges   = series125(0.01, 10000)
+)
+
+//go:embed report.html
+var htmlTemplate string
+
+// A Report contains the summary of a set of flows.
+type Report struct {
+	Files        []string  // input files
+	Generated    time.Time // time the report was generated
+	Flows        int       // number of flows, with the segments of segmented flows joined
+	Segments     int       // number of segment records joined into flows by FlowUID
+	Start        time.Time // earliest flow start time
+	End          time.Time // latest flow end time
+	BytesAcked   uint64    // total bytes acked
+	Retransmits  uint64    // total retransmits
+	Destinations int       // number of distinct destination IPs
+	RTT          []Bin     // distribution of flow median RTTs
+	Throughput   []Bin     // distribution of flow send throughputs
+	Duration     []Bin     // distribution of flow durations
+	TopDests     []Dest    // top destinations by bytes acked
+	ECN          ECN       // ECN adoption
+	CCs          []CC      // flows by congestion control algorithm
+	Trend        []Trend   // retransmit trends over time
+}
+
+// A Bin is one bin of a distribution or time series.
+type Bin struct {
+	Label string  // bin label
+	Value float64 // count or value
+}
+
+// A Dest contains the stats for one destination.
+type Dest struct {
+	IP          string  // destination IP address
+	Flows       int     // number of flows
+	BytesAcked  uint64  // total bytes acked
+	MedianRTTms float64 // median of flow median RTTs, in milliseconds
+	Retransmits uint64  // total retransmits
+}
+
+// ECN contains the ECN adoption stats.
+type ECN struct {
+	Negotiated      int     // flows with ECN negotiated
+	Seen            int     // flows that received ECT packets
+	Marked          int     // flows with at least one CE mark
+	MeanMarkRate    float64 // mean ECNMarkRate of flows with ECN negotiated
+	NegotiatedPct   float64 // percentage of flows with ECN negotiated
+	SeenPct         float64 // percentage of flows that received ECT packets
+	MarkedPct       float64 // percentage of ECN flows with at least one CE mark
+	MissingDelivery bool    // true if the kernel didn't provide delivered_ce
+}
+
+// A CC contains the stats for one congestion control algorithm.
+type CC struct {
+	Name        string  // algorithm name
+	Flows       int     // number of flows
+	ECNPct      float64 // percentage of flows with ECN negotiated
+	MedianRTTms float64 // median of flow median RTTs, in milliseconds
+	Mbps        float64 // median send throughput, in Mbps
+}
+
+// A Trend contains the retransmit stats for flows ending in one time bucket.
+type Trend struct {
+	Time             time.Time // start of the bucket
+	Flows            int       // flows ended
+	Retransmits      uint64    // total retransmits
+	RetransPerFlow   float64   // mean retransmits per flow
+	RetransByteRatio float64   // bytes retransmitted / bytes sent (4.19 and later)
+}
+
+// New returns a Report for the given flows, read from files.
+func New(fs []*analyzer.FlowStats, files []string) (r *Report) {
+	fs, n := join(fs)
+	r = &Report{
+		Files:     files,
+		Generated: time.Now(),
+		Flows:     len(fs),
+		Segments:  n,
+	}
+	if len(fs) == 0 {
+		return
+	}
+
+	var rtts, mbps, durs []float64
+	for i, s := range fs {
+		if i == 0 || s.StartTime.Before(r.Start) {
+			r.Start = s.StartTime
+		}
+		if s.EndTime.After(r.End) {
+			r.End = s.EndTime
+		}
+		r.BytesAcked += s.BytesAcked
+		r.Retransmits += uint64(s.TotalRetransmits)
+		rtts = append(rtts, s.RTTSummary[3])
+		mbps = append(mbps, s.SendThroughputMbps)
+		durs = append(durs, s.Duration.Seconds())
+	}
+	r.RTT = histogram(rtts, rttEdges, "ms")
+	r.Throughput = histogram(mbps, throughputEdges, "")
+	r.Duration = histogram(durs, durationEdges, "s")
+	r.dests(fs)
+	r.ecn(fs)
+	r.ccs(fs)
+	r.trend(fs)
+
+	return
+}
+
+func (r *Report) dests(fs []*analyzer.FlowStats) {
+	type dest struct {
+		Dest
+		rtts []float64
+	}
+	m := make(map[[16]byte]*dest)
+	for _, s := range fs {
+		var k [16]byte
+		copy(k[:], s.ID.DstIP.To16())
+		d, ok := m[k]
+		if !ok {
+			d = &dest{}
+			d.IP = net.IP(k[:]).String()
+			m[k] = d
+		}
+		d.Flows++
+		d.BytesAcked += s.BytesAcked
+		d.Retransmits += uint64(s.TotalRetransmits)
+		d.rtts = append(d.rtts, s.RTTSummary[3])
+	}
+	r.Destinations = len(m)
+
+	ds := make([]*dest, 0, len(m))
+	for _, d := range m {
+		ds = append(ds, d)
+	}
+	sort.Slice(ds, func(i, j int) bool {
+		if ds[i].BytesAcked != ds[j].BytesAcked {
+			return ds[i].BytesAcked > ds[j].BytesAcked
+		}
+		return ds[i].IP < ds[j].IP
+	})
+	if len(ds) > topDests {
+		ds = ds[:topDests]
+	}
+	for _, d := range ds {
+		d.MedianRTTms = median(d.rtts)
+		r.TopDests = append(r.TopDests, d.Dest)
+	}
+}
+
+func (r *Report) ecn(fs []*analyzer.FlowStats) {
+	e := &r.ECN
+	var rate float64
+	for _, s := range fs {
+		if s.ECN {
+			e.Negotiated++
+			rate += s.ECNMarkRate
+			if s.DeliveredCE > 0 {
+				e.Marked++
+			}
+		}
+		if s.ECNSeen {
+			e.Seen++
+		}
+		for _, m := range s.MissingFields {
+			if m == "tcpi_delivered_ce" {
+				e.MissingDelivery = true
+			}
+		}
+	}
+	e.NegotiatedPct = pct(e.Negotiated, len(fs))
+	e.SeenPct = pct(e.Seen, len(fs))
+	if e.Negotiated > 0 {
+		e.MarkedPct = pct(e.Marked, e.Negotiated)
+		e.MeanMarkRate = rate / float64(e.Negotiated)
+	}
+}
+
+func (r *Report) ccs(fs []*analyzer.FlowStats) {
+	type cc struct {
+		CC
+		ecn        int
+		rtts, mbps []float64
+	}
+	m := make(map[string]*cc)
+	for _, s := range fs {
+		c, ok := m[s.CongestionControl]
+		if !ok {
+			c = &cc{}
+			c.Name = s.CongestionControl
+			m[s.CongestionControl] = c
+		}
+		c.Flows++
+		if s.ECN {
+			c.ecn++
+		}
+		c.rtts = append(c.rtts, s.RTTSummary[3])
+		c.mbps = append(c.mbps, s.SendThroughputMbps)
+	}
+	for _, c := range m {
+		c.ECNPct = pct(c.ecn, c.Flows)
+		c.MedianRTTms = median(c.rtts)
+		c.Mbps = median(c.mbps)
+		r.CCs = append(r.CCs, c.CC)
+	}
+	sort.Slice(r.CCs, func(i, j int) bool {
+		if r.CCs[i].Flows != r.CCs[j].Flows {
+			return r.CCs[i].Flows > r.CCs[j].Flows
+		}
+		return r.CCs[i].Name < r.CCs[j].Name
+	})
+}
+
+func (r *Report) trend(fs []*analyzer.FlowStats) {
+	span := r.End.Sub(r.Start)
+	w := span / trendBuckets
+	if w < time.Second {
+		w = time.Second
+	}
+	n := int(span/w) + 1
+	sent := make([]uint64, n)
+	retrans := make([]uint64, n)
+	r.Trend = make([]Trend, n)
+	for i := range r.Trend {
+		r.Trend[i].Time = r.Start.Add(time.Duration(i) * w)
+	}
+	for _, s := range fs {
+		i := int(s.EndTime.Sub(r.Start) / w)
+		t := &r.Trend[i]
+		t.Flows++
+		t.Retransmits += uint64(s.TotalRetransmits)
+		sent[i] += s.BytesSent
+		retrans[i] += s.BytesRetrans
+	}
+	for i := range r.Trend {
+		t := &r.Trend[i]
+		if t.Flows > 0 {
+			t.RetransPerFlow = float64(t.Retransmits) / float64(t.Flows)
+		}
+		if sent[i] > 0 {
+			t.RetransByteRatio = float64(retrans[i]) / float64(sent[i])
+		}
+	}
+}
+
+// RetransPerFlowTrend returns the mean retransmits per flow over time.
+func (r *Report) RetransPerFlowTrend() []Bin {
+	return r.trendBins(func(t Trend) float64 { return t.RetransPerFlow })
+}
+
+// RetransByteRatioTrend returns the retransmitted byte percentage over time.
+func (r *Report) RetransByteRatioTrend() []Bin {
+	return r.trendBins(func(t Trend) float64 { return 100 * t.RetransByteRatio })
+}
+
+func (r *Report) trendBins(value func(Trend) float64) (bs []Bin) {
+	f := "15:04:05"
+	if r.End.Sub(r.Start) > 24*time.Hour {
+		f = "01-02 15:04"
+	}
+	for _, t := range r.Trend {
+		bs = append(bs, Bin{t.Time.Format(f), value(t)})
+	}
+	return
+}
+
+// WriteHTML writes the report as a self-contained HTML page.
+func (r *Report) WriteHTML(w io.Writer) error {
+	t, err := template.New("report").Funcs(template.FuncMap{
+		"bars":  barChart,
+		"bytes": bytesString,
+		"time":  func(t time.Time) string { return t.Format(time.RFC3339) },
+	}).Parse(htmlTemplate)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, r)
+}
+
+// WriteText writes a plain text summary of the report.
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Flows:\t%d\n", r.Flows)
+	if r.Segments > 0 {
+		fmt.Fprintf(tw, "Segments joined:\t%d\n", r.Segments)
+	}
+	fmt.Fprintf(tw, "Time range:\t%s - %s\n", r.Start.Format(time.RFC3339),
+		r.End.Format(time.RFC3339))
+	fmt.Fprintf(tw, "Bytes acked:\t%s\n", bytesString(r.BytesAcked))
+	fmt.Fprintf(tw, "Retransmits:\t%d\n", r.Retransmits)
+	fmt.Fprintf(tw, "Destinations:\t%d\n", r.Destinations)
+	fmt.Fprintf(tw, "ECN negotiated:\t%.1f%%\n", r.ECN.NegotiatedPct)
+	fmt.Fprintf(tw, "\n")
+	fmt.Fprintf(tw, "Destination\tFlows\tBytes acked\tMedian RTT (ms)\tRetransmits\n")
+	for _, d := range r.TopDests {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%.2f\t%d\n", d.IP, d.Flows,
+			bytesString(d.BytesAcked), d.MedianRTTms, d.Retransmits)
+	}
+	fmt.Fprintf(tw, "\n")
+	fmt.Fprintf(tw, "Congestion control\tFlows\tECN %%\tMedian RTT (ms)\tMedian Mbps\n")
+	for _, c := range r.CCs {
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%.2f\t%.2f\n", c.Name, c.Flows, c.ECNPct,
+			c.MedianRTTms, c.Mbps)
+	}
+	return tw.Flush()
+}
+
+// histogram returns the counts of values in the bins with the given upper
+// edges, with values above the last edge in a final bin.
+func histogram(vs []float64, edges []float64, unit string) (bs []Bin) {
+	bs = make([]Bin, len(edges)+1)
+	lo := 0.0
+	for i, e := range edges {
+		bs[i].Label = fmt.Sprintf("%g-%g%s", lo, e, unit)
+		lo = e
+	}
+	bs[len(edges)].Label = fmt.Sprintf(">%g%s", lo, unit)
+	for _, v := range vs {
+		bs[sort.SearchFloat64s(edges, v)].Value++
+	}
+	// trim empty bins from the ends
+	i, j := 0, len(bs)
+	for i < j && bs[i].Value == 0 {
+		i++
+	}
+	for j > i && bs[j-1].Value == 0 {
+		j--
+	}
+	return bs[i:j]
+}
+
+// series125 returns the 1-2-5 series of values from min to max.
+func series125(min, max float64) (s []float64) {
+	for d := min; d <= max*1.0001; d *= 10 {
+		for _, m := range []float64{1, 2, 5} {
+			if v := d * m; v <= max*1.0001 {
+				s = append(s, float64(float32(v)))
+			}
+		}
+	}
+	return
+}
+
+func median(vs []float64) float64 {
+	sort.Float64s(vs)
+	return stat.Quantile(0.5, stat.LinInterp, vs, nil)
+}
+
+func pct(n, d int) float64 {
+	if d == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(d)
+}
+
+// bytesString formats a byte count with binary units.
+func bytesString(b uint64) string {
+	const units = "KMGTPE"
+	if b < 1024 {
+		return fmt.Sprintf("%d B", b)
+	}
+	v := float64(b)
+	i := -1
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", v, units[i])
+}
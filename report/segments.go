@@ -0,0 +1,91 @@
+package report
+
+import (
+	"sort"
+
+	"github.com/heistp/cgmon/analyzer"
+)
+
+// join returns the flows with the segments of each segmented flow joined into
+// one record by FlowUID, and the number of segment records joined. Segments
+// hold cumulative counters for the segment only, so their counters are summed,
+// and the rates the report uses are recomputed for the whole flow. The flow's
+// median RTT is the median of its segments' median RTTs. Other fields are
+// those of the first segment.
+func join(fs []*analyzer.FlowStats) (js []*analyzer.FlowStats, n int) {
+	segs := make(map[string][]*analyzer.FlowStats)
+	for _, s := range fs {
+		if segmented(s) {
+			segs[s.FlowUID] = append(segs[s.FlowUID], s)
+		}
+	}
+	if len(segs) == 0 {
+		return fs, 0
+	}
+	js = make([]*analyzer.FlowStats, 0, len(fs))
+	for _, s := range fs {
+		if !segmented(s) {
+			js = append(js, s)
+			continue
+		}
+		// the joined flow takes the place of its first segment read
+		if ss, ok := segs[s.FlowUID]; ok {
+			js = append(js, joinSegments(ss))
+			n += len(ss)
+			delete(segs, s.FlowUID)
+		}
+	}
+	return
+}
+
+// segmented returns true if the record is a segment that can be joined.
+func segmented(s *analyzer.FlowStats) bool {
+	return s.Segment > 0 && s.FlowUID != ""
+}
+
+// joinSegments returns one record for the segments of a flow.
+func joinSegments(ss []*analyzer.FlowStats) *analyzer.FlowStats {
+	sort.Slice(ss, func(i, j int) bool { return ss[i].Segment < ss[j].Segment })
+	j := *ss[0]
+	j.MissingFields = append([]string(nil), j.MissingFields...)
+	var rtts []float64
+	for i, s := range ss {
+		rtts = append(rtts, s.RTTSummary[3])
+		if i == 0 {
+			continue
+		}
+		if s.StartTime.Before(j.StartTime) {
+			j.StartTime = s.StartTime
+		}
+		if s.EndTime.After(j.EndTime) {
+			j.EndTime = s.EndTime
+		}
+		j.Duration += s.Duration
+		j.TotalRetransmits += s.TotalRetransmits
+		j.BytesAcked += s.BytesAcked
+		j.BytesSent += s.BytesSent
+		j.BytesRetrans += s.BytesRetrans
+		j.Delivered += s.Delivered
+		j.DeliveredCE += s.DeliveredCE
+		j.ECN = j.ECN || s.ECN
+		j.ECNSeen = j.ECNSeen || s.ECNSeen
+		j.MissingFields = append(j.MissingFields, s.MissingFields...)
+		j.CongestionControl = s.CongestionControl
+		j.Continued = s.Continued
+		j.IsFinal = s.IsFinal
+	}
+	j.RTTSummary[3] = median(rtts)
+	j.RetransByteRatio, j.ECNMarkRate, j.SendThroughputMbps = 0, 0, 0
+	if j.BytesSent > 0 {
+		j.RetransByteRatio = float64(j.BytesRetrans) / float64(j.BytesSent)
+	}
+	if j.Delivered > 0 {
+		j.ECNMarkRate = float64(j.DeliveredCE) / float64(j.Delivered)
+	}
+	if d := j.EndTime.Sub(j.StartTime); d > 0 {
+		j.SendThroughputMbps = float64(j.BytesAcked) * 8 / 1000000 /
+			d.Seconds()
+	}
+	j.Segment = 0
+	return &j
+}
@@ -1,51 +1,168 @@
 package sampler
 
+import (
+	"bytes"
+	"time"
+)
+
 // A Config contains the sampler configuration.
 type Config struct {
 	Log bool
 }
 
 // An ID uniquely identifies samples within a given sampler run.
+// IPv4 addresses are stored as v4-mapped IPv6 addresses.
 type ID struct {
-	SrcIP   [4]byte // source (local) IP address
-	SrcPort uint16  // source (local) port
-	DstIP   [4]byte // dest (remote) IP address
-	DstPort uint16  // dest (remote) port
+	SrcIP   [16]byte // source (local) IP address
+	SrcPort uint16   // source (local) port
+	DstIP   [16]byte // dest (remote) IP address
+	DstPort uint16   // dest (remote) port
+}
+
+// v4InV6Prefix is the prefix for v4-mapped IPv6 addresses.
+var v4InV6Prefix = [12]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
+
+// IsIPv4 returns true if the ID's addresses are v4-mapped IPv4 addresses.
+func (id *ID) IsIPv4() bool {
+	return bytes.Equal(id.DstIP[:12], v4InV6Prefix[:])
 }
 
 // A Data contains the sampled values for a flow.
 type Data struct {
-	TstampNs         uint64 // monotonic nsec receive timestamp
-	Options          uint8  // TCP options (TCPI_OPT_* in linux/tcp.h)
-	RTTus            uint32 // TCP RTT in microseconds
-	MinRTTus         uint32 // min TCP RTT in microseconds
-	RTTVarus         uint32 // TCP RTT variance in microseconds
-	SndCwndBytes     uint32 // TCP cwnd in bytes
-	PacingRateBps    uint64 // TCP pacing rate in bytes / second
-	TotalRetransmits uint32 // total retransmit counter
-	// delivery stats only available in 4.18 and later
-	//Delivered        uint32 // total delivered packets
-	//DeliveredCE      uint32 // total delivered packets acked with ECE
-	BytesAcked uint64 // bytes acked
+	TstampNs          uint64 // monotonic nsec timestamp (per receive, or per dump, depending on sampler config)
+	Options           uint8  // TCP options (TCPI_OPT_* in linux/tcp.h)
+	State             uint8  // TCP state (TCP_* in the linux package)
+	Mark              uint32 // socket mark (SO_MARK), if permitted (requires CAP_NET_ADMIN)
+	DSCP              uint8  // DSCP of the socket's IP TOS or IPv6 traffic class
+	UID               uint32 // socket owner UID
+	CAState           uint8  // congestion avoidance state (TCP_CA_* in the linux package)
+	Backoff           uint8  // RTO exponential backoff count
+	Probes            uint8  // unanswered zero window or keepalive probes
+	RTOus             uint32 // retransmission timeout in microseconds
+	ATOus             uint32 // delayed ACK timeout in microseconds
+	LastDataSentms    uint32 // time since the last data was sent, in milliseconds
+	LastDataRecvms    uint32 // time since the last data was received, in milliseconds
+	LastAckRecvms     uint32 // time since the last ACK was received, in milliseconds
+	RTTus             uint32 // TCP RTT in microseconds
+	MinRTTus          uint32 // min TCP RTT in microseconds
+	RTTVarus          uint32 // TCP RTT variance in microseconds
+	SndCwndBytes      uint32 // TCP cwnd in bytes (SndCwnd * SndMSS)
+	SndCwnd           uint32 // TCP cwnd in segments, as reported by the kernel
+	PacingRateBps     uint64 // TCP pacing rate in bytes / second
+	DeliveryRateBps   uint64 // most recent delivery rate sample in bytes / second (4.9 and later)
+	TotalRetransmits  uint32 // total retransmit counter
+	Delivered         uint32 // total delivered packets (4.18 and later)
+	DeliveredCE       uint32 // total delivered packets acked with ECE (4.18 and later)
+	BytesAcked        uint64 // bytes acked
+	BusyTimeus        uint64 // total time with data to send in microseconds (4.10 and later)
+	RwndLimitedus     uint64 // time limited by the receive window in microseconds (4.10 and later)
+	SndbufLimitedus   uint64 // time limited by the send buffer in microseconds (4.10 and later)
+	BytesSent         uint64 // data bytes sent, including retransmits (4.19 and later)
+	BytesRetrans      uint64 // data bytes retransmitted (4.19 and later)
+	BytesReceived     uint64 // bytes received (4.1 and later)
+	RcvRTTus          uint32 // receiver side RTT estimate in microseconds (0 if no estimate)
+	RcvSpace          uint32 // receive buffer space autotuning estimate in bytes
+	SndWnd            uint32 // peer's advertised receive window in bytes (5.4 and later)
+	RcvWnd            uint32 // local advertised receive window in bytes (6.2 and later)
+	SndMSS            uint32 // sender MSS in bytes
+	AdvMSS            uint32 // advertised MSS in bytes
+	PMTU              uint32 // path MTU in bytes
+	SndWscale         uint8  // send window scale shift (if TCPI_OPT_WSCALE)
+	RcvWscale         uint8  // receive window scale shift (if TCPI_OPT_WSCALE)
+	SndSsthresh       uint32 // slow start threshold in segments
+	Reordering        uint32 // reordering distance estimate in segments
+	Sacked            uint32 // segments currently SACKed
+	Lost              uint32 // segments currently considered lost
+	DSACKDups         uint32 // total duplicate segments reported by DSACK (5.0 and later)
+	ReordSeen         uint32 // total reordering events seen (5.0 and later)
+	RcvOOOPack        uint32 // total out-of-order packets received, which are ACKed immediately (5.4 and later)
+	RmemAlloc         uint32 // receive queue memory in bytes (SK_MEMINFO_RMEM_ALLOC)
+	RcvBuf            uint32 // receive buffer size in bytes (SK_MEMINFO_RCVBUF)
+	WmemQueued        uint32 // send queue memory in bytes, for unsent and unacked data (SK_MEMINFO_WMEM_QUEUED)
+	SndBuf            uint32 // send buffer size in bytes (SK_MEMINFO_SNDBUF)
+	CongestionControl string // congestion control algorithm name (e.g. cubic, bbr)
 }
 
-// EquivalentTo returns true if all fields excluding the timestamp are the same
-// as the given data.
+// EquivalentTo returns true if all fields excluding the timestamp and the
+// times since the last activity, which advance while a flow is idle, are the
+// same as the given data.
 func (d *Data) EquivalentTo(d1 *Data) bool {
-	return d.RTTus == d1.RTTus &&
+	return d.State == d1.State &&
+		d.Mark == d1.Mark &&
+		d.DSCP == d1.DSCP &&
+		d.CAState == d1.CAState &&
+		d.Backoff == d1.Backoff &&
+		d.Probes == d1.Probes &&
+		d.RTOus == d1.RTOus &&
+		d.ATOus == d1.ATOus &&
+		d.RTTus == d1.RTTus &&
 		d.RTTVarus == d1.RTTVarus &&
 		d.BytesAcked == d1.BytesAcked &&
+		d.BusyTimeus == d1.BusyTimeus &&
+		d.RwndLimitedus == d1.RwndLimitedus &&
+		d.SndbufLimitedus == d1.SndbufLimitedus &&
+		d.BytesSent == d1.BytesSent &&
+		d.BytesRetrans == d1.BytesRetrans &&
+		d.BytesReceived == d1.BytesReceived &&
+		d.RcvRTTus == d1.RcvRTTus &&
+		d.RcvSpace == d1.RcvSpace &&
+		d.SndWnd == d1.SndWnd &&
+		d.RcvWnd == d1.RcvWnd &&
+		d.SndMSS == d1.SndMSS &&
+		d.AdvMSS == d1.AdvMSS &&
+		d.PMTU == d1.PMTU &&
+		d.SndWscale == d1.SndWscale &&
+		d.RcvWscale == d1.RcvWscale &&
+		d.SndSsthresh == d1.SndSsthresh &&
+		d.Reordering == d1.Reordering &&
+		d.Sacked == d1.Sacked &&
+		d.Lost == d1.Lost &&
+		d.DSACKDups == d1.DSACKDups &&
+		d.ReordSeen == d1.ReordSeen &&
+		d.RcvOOOPack == d1.RcvOOOPack &&
+		d.RmemAlloc == d1.RmemAlloc &&
+		d.RcvBuf == d1.RcvBuf &&
+		d.WmemQueued == d1.WmemQueued &&
+		d.SndBuf == d1.SndBuf &&
+		d.Delivered == d1.Delivered &&
+		d.DeliveredCE == d1.DeliveredCE &&
 		d.PacingRateBps == d1.PacingRateBps &&
+		d.DeliveryRateBps == d1.DeliveryRateBps &&
 		d.TotalRetransmits == d1.TotalRetransmits &&
 		d.SndCwndBytes == d1.SndCwndBytes &&
+		d.SndCwnd == d1.SndCwnd &&
 		d.MinRTTus == d1.MinRTTus
 	//d.MaxPacingRateBps == d1.MaxPacingRateBps
 }
 
+// SinceData returns the time from the last data sent or received to the
+// sample.
+func (d *Data) SinceData() time.Duration {
+	ms := d.LastDataSentms
+	if d.LastDataRecvms < ms {
+		ms = d.LastDataRecvms
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// SinceActivity returns the time from the last data sent or received, or ACK
+// received, to the sample.
+func (d *Data) SinceActivity() time.Duration {
+	a := time.Duration(d.LastAckRecvms) * time.Millisecond
+	if s := d.SinceData(); s < a {
+		return s
+	}
+	return a
+}
+
 // A Sample contains a sample ID and its data.
 type Sample struct {
 	ID
 	Data
+	Inode    uint32 // socket inode, for attribution to processes
+	CgroupID uint64 // ID of the socket's cgroup v2 (5.7 and later)
+	Ifindex  uint32 // index of the interface the socket is bound to, 0 if unbound
+	Cookie   uint64 // socket cookie, unique to the socket while the host is up
 }
 
 // Sampler is the interface that wraps the Sample method.
@@ -62,6 +179,14 @@ type Result interface {
 	Samples() []Sample
 }
 
+// Anchorer is the interface that wraps the Anchor method. It may be
+// implemented by Results to provide a wall clock time for a monotonic
+// timestamp, read as close together as possible, to convert sample
+// timestamps to wall time.
+type Anchorer interface {
+	Anchor() (monoNs uint64, wall time.Time)
+}
+
 // ResultRecycler is the interface that wraps the RecycleResult method. It should
 // be implemented by samplers that can reuse previously allocated Results.
 type ResultRecycler interface {
@@ -0,0 +1,106 @@
+package sandbox
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// landlock constants (linux/landlock.h), syscall numbers are the same on all
+// architectures
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+	landlockRulePathBeneath  = 1
+	oPath                    = 0x200000 // O_PATH, missing from package syscall
+)
+
+// landlock filesystem write access rights (ABI version 1)
+const (
+	accessFsWriteFile   = 1 << 1
+	accessFsRemoveDir   = 1 << 4
+	accessFsRemoveFile  = 1 << 5
+	accessFsMakeChar    = 1 << 6
+	accessFsMakeDir     = 1 << 7
+	accessFsMakeReg     = 1 << 8
+	accessFsMakeSock    = 1 << 9
+	accessFsMakeFifo    = 1 << 10
+	accessFsMakeBlock   = 1 << 11
+	accessFsMakeSym     = 1 << 12
+	accessFsWriteAccess = accessFsWriteFile | accessFsRemoveDir |
+		accessFsRemoveFile | accessFsMakeChar | accessFsMakeDir |
+		accessFsMakeReg | accessFsMakeSock | accessFsMakeFifo |
+		accessFsMakeBlock | accessFsMakeSym
+)
+
+// landlockRulesetAttr is struct landlock_ruleset_attr.
+type landlockRulesetAttr struct {
+	handledAccessFs uint64
+}
+
+// landlockPathBeneathAttr is struct landlock_path_beneath_attr, which is
+// packed in the kernel headers.
+type landlockPathBeneathAttr [12]byte
+
+func newPathBeneathAttr(access uint64, fd int32) (a landlockPathBeneathAttr) {
+	*(*uint64)(unsafe.Pointer(&a[0])) = access
+	*(*int32)(unsafe.Pointer(&a[8])) = fd
+	return
+}
+
+// applyLandlock restricts filesystem writes to beneath the given dirs.
+//
+// Landlock domains apply only to the calling thread and its future children,
+// so the restriction must be made on all threads using AllThreadsSyscall. The
+// Go runtime does not support this when cgo is in use, so this fails with
+// ENOTSUP in cgo builds.
+func applyLandlock(dirs []string) (err error) {
+	attr := landlockRulesetAttr{accessFsWriteAccess}
+	r, _, e := syscall.RawSyscall(sysLandlockCreateRuleset,
+		uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if e != 0 {
+		err = fmt.Errorf("landlock not available (%s)", e)
+		return
+	}
+	rfd := int(r)
+	defer syscall.Close(rfd)
+
+	for _, d := range dirs {
+		if err = landlockAllow(rfd, d); err != nil {
+			return
+		}
+	}
+
+	if _, _, e = syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs,
+		1, 0); e != 0 {
+		err = fmt.Errorf("unable to set no_new_privs on all threads (%s)", e)
+		return
+	}
+
+	if _, _, e = syscall.AllThreadsSyscall(sysLandlockRestrictSelf,
+		uintptr(rfd), 0, 0); e != 0 {
+		err = fmt.Errorf("unable to restrict all threads (%s)", e)
+	}
+
+	return
+}
+
+// landlockAllow adds a rule to the ruleset allowing writes beneath dir.
+func landlockAllow(rfd int, dir string) (err error) {
+	var fd int
+	if fd, err = syscall.Open(dir, oPath|syscall.O_CLOEXEC, 0); err != nil {
+		err = fmt.Errorf("unable to open %s (%s)", dir, err)
+		return
+	}
+	defer syscall.Close(fd)
+
+	pb := newPathBeneathAttr(accessFsWriteAccess, int32(fd))
+	if _, _, e := syscall.RawSyscall6(sysLandlockAddRule, uintptr(rfd),
+		landlockRulePathBeneath, uintptr(unsafe.Pointer(&pb)), 0, 0,
+		0); e != 0 {
+		err = fmt.Errorf("unable to add landlock rule for %s (%s)", dir, e)
+	}
+
+	return
+}
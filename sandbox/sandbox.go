@@ -0,0 +1,38 @@
+// Package sandbox restricts what the cgmon process may do once initialized,
+// since it often runs with elevated capabilities and handles data derived
+// from the network.
+package sandbox
+
+import (
+	"log"
+)
+
+// prSetNoNewPrivs is PR_SET_NO_NEW_PRIVS from linux/prctl.h.
+const prSetNoNewPrivs = 38
+
+// A Config contains the sandbox configuration.
+type Config struct {
+	Seccomp    bool     // if true, install a seccomp filter denying unneeded syscalls
+	Landlock   bool     // if true, restrict filesystem writes to WriteDirs with landlock
+	WriteDirs  []string // dirs beneath which writes are allowed when Landlock is true
+	AllowSetns bool     // if true, the seccomp filter allows setns, for sampling other network namespaces
+	AllowExec  bool     // if true, the seccomp filter allows execve and execveat, for starting and restarting a writer command
+}
+
+// Apply applies the configured restrictions to the current process. Landlock
+// is best effort, as it requires kernel 5.13 or later and is not supported by
+// the Go runtime in cgo builds, so a failure to apply it is logged but not
+// returned.
+func Apply(cfg Config) (err error) {
+	if cfg.Landlock {
+		if e := applyLandlock(cfg.WriteDirs); e != nil {
+			log.Printf("continuing without landlock (%s)", e)
+		}
+	}
+
+	if cfg.Seccomp {
+		err = applySeccomp(cfg.AllowSetns, cfg.AllowExec)
+	}
+
+	return
+}
@@ -0,0 +1,107 @@
+//go:build amd64 || arm64
+// +build amd64 arm64
+
+package sandbox
+
+import (
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// seccomp and BPF constants (linux/seccomp.h, linux/filter.h, linux/prctl.h)
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+	seccompDataNrOffset    = 0
+	seccompDataArchOffset  = 4
+	bpfLdWAbs              = 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfJmpJeqK             = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJmpJgeK             = 0x35 // BPF_JMP | BPF_JGE | BPF_K
+	bpfRetK                = 0x06 // BPF_RET | BPF_K
+	maxDeniedSyscalls      = 250  // jump offsets are limited to 8 bits
+	errnoRet               = seccompRetErrno | uint32(syscall.EPERM)
+)
+
+// sockFilter is struct sock_filter from linux/filter.h.
+type sockFilter struct {
+	code uint16
+	jt   uint8
+	jf   uint8
+	k    uint32
+}
+
+// sockFprog is struct sock_fprog from linux/filter.h.
+type sockFprog struct {
+	len    uint16
+	filter *sockFilter
+}
+
+// applySeccomp installs a seccomp filter on all threads that fails the denied
+// syscalls with EPERM. A deny list is used instead of an allow list so that
+// changes in the syscalls used by the Go runtime and libc don't break cgmon.
+// If allowSetns is true, setns is removed from the denied syscalls, and if
+// allowExec is true, execve and execveat are.
+func applySeccomp(allowSetns, allowExec bool) (err error) {
+	var denied []uint32
+	for _, nr := range deniedSyscalls {
+		if allowSetns && nr == sysSetns {
+			continue
+		}
+		if allowExec && (nr == sysExecve || nr == sysExecveat) {
+			continue
+		}
+		denied = append(denied, nr)
+	}
+	prog := seccompProgram(denied)
+	fp := sockFprog{uint16(len(prog)), &prog[0]}
+
+	// no_new_privs is per-thread, but TSYNC propagates it to the other threads
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if _, _, e := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs,
+		1, 0); e != 0 {
+		err = e
+		return
+	}
+
+	if _, _, e := syscall.RawSyscall(sysSeccomp, seccompSetModeFilter,
+		seccompFilterFlagTsync, uintptr(unsafe.Pointer(&fp))); e != 0 {
+		err = e
+	}
+	runtime.KeepAlive(prog)
+
+	return
+}
+
+// seccompProgram returns the BPF program for the seccomp filter, denying the
+// given syscalls.
+func seccompProgram(denied []uint32) (p []sockFilter) {
+	n := len(denied)
+	if n > maxDeniedSyscalls {
+		panic("too many denied syscalls for seccomp filter")
+	}
+
+	// fail syscalls made using an ABI other than the one filtered
+	p = append(p,
+		sockFilter{bpfLdWAbs, 0, 0, seccompDataArchOffset},
+		sockFilter{bpfJmpJeqK, 1, 0, auditArch},
+		sockFilter{bpfRetK, 0, 0, errnoRet},
+		sockFilter{bpfLdWAbs, 0, 0, seccompDataNrOffset},
+	)
+	if abiBit != 0 {
+		p = append(p, sockFilter{bpfJmpJgeK, uint8(n + 1), 0, abiBit})
+	}
+	for i, nr := range denied {
+		p = append(p, sockFilter{bpfJmpJeqK, uint8(n - i), 0, nr})
+	}
+	p = append(p,
+		sockFilter{bpfRetK, 0, 0, seccompRetAllow},
+		sockFilter{bpfRetK, 0, 0, errnoRet},
+	)
+
+	return
+}
@@ -0,0 +1,55 @@
+package sandbox
+
+// auditArch is AUDIT_ARCH_X86_64.
+const auditArch = 0xc000003e
+
+// abiBit is __X32_SYSCALL_BIT, used to reject x32 ABI syscalls.
+const abiBit = 0x40000000
+
+// sysSeccomp is the seccomp syscall number.
+const sysSeccomp = 317
+
+// sysSetns is the setns syscall number.
+const sysSetns = 308
+
+// sysExecve and sysExecveat are the execve and execveat syscall numbers.
+const (
+	sysExecve   = 59
+	sysExecveat = 322
+)
+
+// deniedSyscalls are syscalls cgmon never needs after initialization.
+var deniedSyscalls = []uint32{
+	59,  // execve
+	322, // execveat
+	101, // ptrace
+	310, // process_vm_readv
+	311, // process_vm_writev
+	165, // mount
+	166, // umount2
+	155, // pivot_root
+	161, // chroot
+	308, // setns
+	272, // unshare
+	246, // kexec_load
+	320, // kexec_file_load
+	175, // init_module
+	313, // finit_module
+	176, // delete_module
+	321, // bpf
+	298, // perf_event_open
+	323, // userfaultfd
+	169, // reboot
+	167, // swapon
+	168, // swapoff
+	163, // acct
+	248, // add_key
+	249, // request_key
+	250, // keyctl
+	164, // settimeofday
+	227, // clock_settime
+	159, // adjtimex
+	135, // personality
+	172, // iopl
+	173, // ioperm
+}
@@ -0,0 +1,53 @@
+package sandbox
+
+// auditArch is AUDIT_ARCH_AARCH64.
+const auditArch = 0xc00000b7
+
+// abiBit is unused on arm64, which has a single syscall ABI.
+const abiBit = 0
+
+// sysSeccomp is the seccomp syscall number.
+const sysSeccomp = 277
+
+// sysSetns is the setns syscall number.
+const sysSetns = 268
+
+// sysExecve and sysExecveat are the execve and execveat syscall numbers.
+const (
+	sysExecve   = 221
+	sysExecveat = 281
+)
+
+// deniedSyscalls are syscalls cgmon never needs after initialization.
+var deniedSyscalls = []uint32{
+	221, // execve
+	281, // execveat
+	117, // ptrace
+	270, // process_vm_readv
+	271, // process_vm_writev
+	40,  // mount
+	39,  // umount2
+	41,  // pivot_root
+	51,  // chroot
+	268, // setns
+	97,  // unshare
+	104, // kexec_load
+	294, // kexec_file_load
+	105, // init_module
+	273, // finit_module
+	106, // delete_module
+	280, // bpf
+	241, // perf_event_open
+	282, // userfaultfd
+	142, // reboot
+	224, // swapon
+	225, // swapoff
+	89,  // acct
+	217, // add_key
+	218, // request_key
+	219, // keyctl
+	170, // settimeofday
+	112, // clock_settime
+	171, // adjtimex
+	92,  // personality
+}
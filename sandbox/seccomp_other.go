@@ -0,0 +1,13 @@
+//go:build !amd64 && !arm64
+// +build !amd64,!arm64
+
+package sandbox
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func applySeccomp(allowSetns, allowExec bool) error {
+	return fmt.Errorf("seccomp filter not supported on %s", runtime.GOARCH)
+}
@@ -0,0 +1,109 @@
+package schema
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+)
+
+// WriteJSONSchema writes a JSON Schema for the JSON encoding of the struct
+// type t, with version as the generating binary's version. Nested struct
+// types are in $defs.
+func WriteJSONSchema(w io.Writer, t reflect.Type, docs Docs,
+	version string) (err error) {
+	ts := structs(t)
+	var defs object
+	for _, d := range ts[1:] {
+		defs = append(defs, member{d.Name(), objectSchema(d, docs)})
+	}
+	s := object{
+		{"$schema", JSONSchemaDialect},
+		{"$id", "urn:cgmon:" + t.Name() + ":" + version},
+		{"title", t.Name()},
+		{"x-cgmon-version", version},
+	}
+	s = append(s, objectSchema(t, docs)...)
+	if len(defs) > 0 {
+		s = append(s, member{"$defs", defs})
+	}
+	var b []byte
+	if b, err = json.MarshalIndent(s, "", "\t"); err != nil {
+		return
+	}
+	_, err = w.Write(append(b, '\n'))
+	return
+}
+
+// objectSchema returns the schema of a struct type.
+func objectSchema(t reflect.Type, docs Docs) object {
+	var props object
+	var req []string
+	for _, f := range fields(t) {
+		s := typeSchema(f.typ, !f.omitEmpty)
+		if d, ok := docs[t.Name()+"."+f.name]; ok {
+			s = append(object{{"description", d}}, s...)
+		}
+		props = append(props, member{f.jsonName, s})
+		if !f.omitEmpty {
+			req = append(req, f.jsonName)
+		}
+	}
+	o := object{
+		{"type", "object"},
+		{"properties", props},
+	}
+	if len(req) > 0 {
+		o = append(o, member{"required", req})
+	}
+	return append(o, member{"additionalProperties", false})
+}
+
+// typeSchema returns the schema of a type. If nullable is true, nil slices,
+// maps and pointers are encoded as null, as they're not omitted when empty.
+func typeSchema(t reflect.Type, nullable bool) object {
+	switch t {
+	case timeType:
+		return object{{"type", "string"}, {"format", "date-time"}}
+	case durationType:
+		return object{{"type", "integer"},
+			{"$comment", "time.Duration in nanoseconds"}}
+	case ipType:
+		return object{{"type", "string"}, {"anyOf", []object{
+			{{"format", "ipv4"}},
+			{{"format", "ipv6"}},
+		}}}
+	}
+	var s object
+	switch t.Kind() {
+	case reflect.Bool:
+		return object{{"type", "boolean"}}
+	case reflect.String:
+		return object{{"type", "string"}}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		return object{{"type", "integer"}}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		return object{{"type", "integer"}, {"minimum", 0}}
+	case reflect.Float32, reflect.Float64:
+		return object{{"type", "number"}}
+	case reflect.Array:
+		return object{{"type", "array"}, {"items", typeSchema(t.Elem(), false)},
+			{"minItems", t.Len()}, {"maxItems", t.Len()}}
+	case reflect.Slice:
+		s = object{{"type", "array"}, {"items", typeSchema(t.Elem(), false)}}
+	case reflect.Map:
+		s = object{{"type", "object"},
+			{"additionalProperties", typeSchema(t.Elem(), false)}}
+	case reflect.Pointer:
+		s = typeSchema(t.Elem(), false)
+	case reflect.Struct:
+		return object{{"$ref", "#/$defs/" + t.Name()}}
+	default:
+		return object{}
+	}
+	if nullable {
+		s = object{{"anyOf", []object{s, {{"type", "null"}}}}}
+	}
+	return s
+}
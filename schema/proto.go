@@ -0,0 +1,120 @@
+package schema
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// WriteProto writes protobuf (proto3) definitions for the struct type t and
+// the struct types it contains, with version as the generating binary's
+// version. Field names are the snake case of the JSON names, with json_name
+// set so the protobuf JSON mapping matches the JSON output. Field numbers
+// follow the struct field order, so they're only stable for a given version.
+func WriteProto(w io.Writer, t reflect.Type, docs Docs, pkg,
+	version string) (err error) {
+	ts := structs(t)
+	var imp bool
+	for _, s := range ts {
+		for _, f := range fields(s) {
+			if f.typ == timeType {
+				imp = true
+			}
+		}
+	}
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "// Generated by cgmon version %s. Do not edit.\n\n", version)
+	fmt.Fprintf(b, "syntax = \"proto3\";\n\npackage %s;\n", pkg)
+	if imp {
+		fmt.Fprintf(b, "\nimport \"google/protobuf/timestamp.proto\";\n")
+	}
+	for _, s := range ts {
+		fmt.Fprintf(b, "\nmessage %s {\n", s.Name())
+		for i, f := range fields(s) {
+			pt, c := protoType(f.typ)
+			d := docs[s.Name()+"."+f.name]
+			if c != "" {
+				d = strings.TrimSpace(d + " (" + c + ")")
+			}
+			if d != "" {
+				fmt.Fprintf(b, "  // %s\n", d)
+			}
+			fmt.Fprintf(b, "  %s %s = %d [json_name = \"%s\"];\n", pt,
+				snakeCase(f.jsonName), i+1, f.jsonName)
+		}
+		fmt.Fprintf(b, "}\n")
+	}
+	return b.Flush()
+}
+
+// protoType returns the protobuf type of a field, and a comment about its
+// encoding, if needed.
+func protoType(t reflect.Type) (pt, comment string) {
+	switch t {
+	case timeType:
+		return "google.protobuf.Timestamp", ""
+	case durationType:
+		return "int64", "nanoseconds"
+	case ipType:
+		return "string", "IP address"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		pt = "bool"
+	case reflect.String:
+		pt = "string"
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		pt = "int32"
+	case reflect.Int, reflect.Int64:
+		pt = "int64"
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		pt = "uint32"
+	case reflect.Uint, reflect.Uint64:
+		pt = "uint64"
+	case reflect.Float32:
+		pt = "float"
+	case reflect.Float64:
+		pt = "double"
+	case reflect.Array, reflect.Slice:
+		pt, comment = protoType(t.Elem())
+		pt = "repeated " + pt
+	case reflect.Map:
+		var v string
+		v, comment = protoType(t.Elem())
+		pt = fmt.Sprintf("map<%s, %s>", protoKey(t.Key()), v)
+	case reflect.Pointer:
+		pt, comment = protoType(t.Elem())
+	case reflect.Struct:
+		pt = t.Name()
+	default:
+		pt = "bytes"
+	}
+	return
+}
+
+// protoKey returns the protobuf type of a map key.
+func protoKey(t reflect.Type) string {
+	if t.Kind() == reflect.String {
+		return "string"
+	}
+	k, _ := protoType(t)
+	return k
+}
+
+// snakeCase converts a Go style name to snake case, keeping initialisms
+// together (e.g. MinRTTKernelms to min_rtt_kernelms).
+func snakeCase(s string) string {
+	r := []rune(s)
+	var b strings.Builder
+	for i, c := range r {
+		if i > 0 && unicode.IsUpper(c) && (!unicode.IsUpper(r[i-1]) ||
+			(i+1 < len(r) && unicode.IsLower(r[i+1]))) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToLower(c))
+	}
+	return b.String()
+}
@@ -0,0 +1,130 @@
+// Package schema generates machine-readable descriptions of the output
+// records from their Go types and field comments, as JSON Schema and protobuf
+// definitions, so downstream consumers have an accurate description of the
+// output of the binary that generated them.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// JSONSchemaDialect is the JSON Schema dialect of the generated schemas.
+const JSONSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// Docs contains the descriptions of struct fields, keyed by type and field
+// name (e.g. "FlowStats.RTTSummary").
+type Docs map[string]string
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+	ipType       = reflect.TypeOf(net.IP{})
+)
+
+// A field is an exported struct field as encoded by encoding/json.
+type field struct {
+	name      string // Go field name
+	jsonName  string // name in the JSON encoding
+	omitEmpty bool   // true if the field is omitted when empty
+	typ       reflect.Type
+}
+
+// fields returns the fields of a struct type that appear in its JSON
+// encoding, including those of embedded structs.
+func fields(t reflect.Type) (fs []field) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct {
+			fs = append(fs, fields(sf.Type)...)
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fs = append(fs, field{sf.Name, name,
+			strings.Contains(","+opts+",", ",omitempty,"), sf.Type})
+	}
+	return
+}
+
+// structType returns the struct type of t, or t's element if it's a pointer,
+// or nil if it's not a struct that's encoded as an object.
+func structType(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t == timeType {
+		return nil
+	}
+	return t
+}
+
+// structs returns the struct types reachable from t, in the order first seen,
+// starting with t.
+func structs(t reflect.Type) (ts []reflect.Type) {
+	seen := make(map[reflect.Type]bool)
+	var walk func(reflect.Type)
+	walk = func(t reflect.Type) {
+		switch t.Kind() {
+		case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+			walk(t.Elem())
+			return
+		}
+		if t = structType(t); t == nil || seen[t] {
+			return
+		}
+		seen[t] = true
+		ts = append(ts, t)
+		for _, f := range fields(t) {
+			walk(f.typ)
+		}
+	}
+	walk(t)
+	return
+}
+
+// A member is a name and value in an object.
+type member struct {
+	name  string
+	value interface{}
+}
+
+// An object is a JSON object that keeps the order of its members.
+type object []member
+
+// MarshalJSON implements json.Marshaler.
+func (o object) MarshalJSON() ([]byte, error) {
+	b := &bytes.Buffer{}
+	b.WriteByte('{')
+	for i, m := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, err := json.Marshal(m.name)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(m.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
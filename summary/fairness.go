@@ -0,0 +1,93 @@
+package summary
+
+import (
+	"net"
+	"sort"
+
+	"github.com/heistp/cgmon/sampler"
+	"github.com/heistp/cgmon/tracker"
+)
+
+// Fairness grouping modes.
+const (
+	FairnessSubnet    = "subnet"    // group by destination subnet
+	FairnessInterface = "interface" // group by egress interface
+)
+
+// Destination prefix lengths for FairnessSubnet.
+const (
+	fairnessPrefixLen  = 24
+	fairnessPrefixLen6 = 64
+)
+
+// A Fairness contains Jain's fairness index for the throughputs of flows that
+// were active concurrently during an interval and share a destination subnet
+// or egress interface.
+type Fairness struct {
+	Group     string  // destination subnet or interface name
+	Flows     int     // number of flows that acked data during the interval
+	JainIndex float64 // (sum x)^2 / (n * sum x^2), from 1/Flows (one flow gets all) to 1 (equal)
+	MinMbps   float64 // minimum flow throughput
+	MaxMbps   float64 // maximum flow throughput
+}
+
+// fairness returns the fairness for each group of at least two flows, sorted
+// by group. iface returns the egress interface for a destination, for
+// FairnessInterface.
+func fairness(tp map[sampler.ID]*tracker.FlowThroughput, mode string,
+	iface func([16]byte) string) (fs []Fairness) {
+	groups := make(map[string][]float64)
+	for _, t := range tp {
+		var g string
+		switch mode {
+		case FairnessSubnet:
+			g = subnet(t.DstIP)
+		case FairnessInterface:
+			if iface != nil {
+				g = iface(t.DstIP)
+			}
+		}
+		if g == "" {
+			continue
+		}
+		groups[g] = append(groups[g], t.Mbps())
+	}
+
+	for g, x := range groups {
+		if len(x) < 2 {
+			continue
+		}
+		f := Fairness{Group: g, Flows: len(x), MinMbps: x[0], MaxMbps: x[0]}
+		var sum, sumsq float64
+		for _, v := range x {
+			sum += v
+			sumsq += v * v
+			if v < f.MinMbps {
+				f.MinMbps = v
+			}
+			if v > f.MaxMbps {
+				f.MaxMbps = v
+			}
+		}
+		if sumsq > 0 {
+			f.JainIndex = sum * sum / (float64(len(x)) * sumsq)
+		}
+		fs = append(fs, f)
+	}
+	sort.Slice(fs, func(i, j int) bool {
+		return fs[i].Group < fs[j].Group
+	})
+
+	return
+}
+
+// subnet returns the destination subnet for an address, in CIDR notation.
+func subnet(ip [16]byte) string {
+	a := net.IP(ip[:])
+	if a4 := a.To4(); a4 != nil {
+		m := net.CIDRMask(fairnessPrefixLen, 32)
+		return (&net.IPNet{IP: a4.Mask(m), Mask: m}).String()
+	}
+	m := net.CIDRMask(fairnessPrefixLen6, 128)
+	return (&net.IPNet{IP: a.Mask(m), Mask: m}).String()
+}
@@ -0,0 +1,153 @@
+package summary
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// iflaStats64 is IFLA_STATS64 (linux/if_link.h).
+const iflaStats64 = 23
+
+// nativeEndian is the host byte order, used for netlink messages.
+var nativeEndian binary.ByteOrder
+
+func init() {
+	i := uint16(1)
+	if *(*byte)(unsafe.Pointer(&i)) == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// linkCounters contains the counters for one interface.
+type linkCounters struct {
+	rxPackets uint64
+	txPackets uint64
+	rxBytes   uint64
+	txBytes   uint64
+	speedMbps int // link speed, or 0 if unknown
+}
+
+// readLinks returns the counters for the given interfaces, or all non-loopback
+// interfaces if none are given, using a netlink link dump.
+func readLinks(ifaces []string) (m map[string]linkCounters, err error) {
+	var b []byte
+	if b, err = syscall.NetlinkRIB(syscall.RTM_GETLINK,
+		syscall.AF_UNSPEC); err != nil {
+		return
+	}
+	var msgs []syscall.NetlinkMessage
+	if msgs, err = syscall.ParseNetlinkMessage(b); err != nil {
+		return
+	}
+
+	m = make(map[string]linkCounters)
+	for i := range msgs {
+		nm := &msgs[i]
+		if nm.Header.Type != syscall.RTM_NEWLINK ||
+			len(nm.Data) < syscall.SizeofIfInfomsg {
+			continue
+		}
+		flags := nativeEndian.Uint32(nm.Data[8:12])
+		var attrs []syscall.NetlinkRouteAttr
+		if attrs, err = syscall.ParseNetlinkRouteAttr(nm); err != nil {
+			return
+		}
+		var name string
+		var c linkCounters
+		var ok bool
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case syscall.IFLA_IFNAME:
+				name = strings.TrimRight(string(a.Value), "\x00")
+			case iflaStats64:
+				if len(a.Value) >= 32 {
+					c.rxPackets = nativeEndian.Uint64(a.Value[0:8])
+					c.txPackets = nativeEndian.Uint64(a.Value[8:16])
+					c.rxBytes = nativeEndian.Uint64(a.Value[16:24])
+					c.txBytes = nativeEndian.Uint64(a.Value[24:32])
+					ok = true
+				}
+			}
+		}
+		if !ok || !includeLink(name, flags, ifaces) {
+			continue
+		}
+		c.speedMbps = linkSpeed(name)
+		m[name] = c
+	}
+
+	return
+}
+
+// includeLink returns true if the named interface should be included.
+func includeLink(name string, flags uint32, ifaces []string) bool {
+	if len(ifaces) == 0 {
+		return flags&syscall.IFF_LOOPBACK == 0
+	}
+	for _, i := range ifaces {
+		if i == name {
+			return true
+		}
+	}
+	return false
+}
+
+// linkSpeed returns the speed of the named interface in Mbps from sysfs, or 0
+// if it's unknown (e.g. for virtual interfaces).
+func linkSpeed(name string) (mbps int) {
+	b, err := os.ReadFile(filepath.Join("/sys/class/net", name, "speed"))
+	if err != nil {
+		return
+	}
+	if mbps, err = strconv.Atoi(strings.TrimSpace(string(b))); err != nil ||
+		mbps < 0 {
+		mbps = 0
+	}
+	return
+}
+
+// linkDelta contains the change in link counters between two reads, for one
+// bucket.
+type linkDelta struct {
+	rxPackets uint64
+	txPackets uint64
+	rxBytes   uint64
+	txBytes   uint64
+	speedMbps int // total speed of the links, or 0 if any are unknown
+}
+
+// delta returns the total change in counters from prev to cur, for links
+// present in both. Counters that went backwards (e.g. after a link was
+// recreated) are skipped.
+func delta(prev, cur map[string]linkCounters) (d linkDelta) {
+	known := true
+	for n, c := range cur {
+		p, ok := prev[n]
+		if !ok {
+			continue
+		}
+		if c.rxBytes >= p.rxBytes && c.rxPackets >= p.rxPackets {
+			d.rxBytes += c.rxBytes - p.rxBytes
+			d.rxPackets += c.rxPackets - p.rxPackets
+		}
+		if c.txBytes >= p.txBytes && c.txPackets >= p.txPackets {
+			d.txBytes += c.txBytes - p.txBytes
+			d.txPackets += c.txPackets - p.txPackets
+		}
+		if c.speedMbps == 0 {
+			known = false
+		}
+		d.speedMbps += c.speedMbps
+	}
+	if !known {
+		d.speedMbps = 0
+	}
+	return
+}
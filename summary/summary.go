@@ -0,0 +1,239 @@
+package summary
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/heistp/cgmon/analyzer"
+	"github.com/heistp/cgmon/sampler"
+	"github.com/heistp/cgmon/tracker"
+)
+
+// Interval is the interval on which summaries are emitted.
+const Interval = 1 * time.Minute
+
+// windows is the number of intervals in the longest rolling window.
+const windows = 5
+
+// A Config contains the summarizer configuration.
+type Config struct {
+	Enabled        bool     // if true, host summaries are emitted
+	Links          bool     // if true, link counters are included in summaries
+	LinkInterfaces []string // interfaces for link counters (all non-loopback if empty)
+	Fairness       string   // group flows for fairness indexes by FairnessSubnet or FairnessInterface ("" disables)
+	Log            bool     // if true, logging is enabled
+}
+
+// A Window contains host-level TCP stats over a rolling window.
+type Window struct {
+	Duration          time.Duration // actual duration of the window
+	FlowsEnded        int           // flows ended during the window (excluding short flows)
+	ShortFlows        int           // flows ended during the window, but too short for detailed stats
+	ShortBytesAcked   uint64        // total bytes acked by short flows
+	BytesAcked        uint64        // total bytes acked by ended flows
+	ThroughputMbps    float64       // bytes acked by ended flows over the window, in Mbps
+	MeanQueueDelayms  float64       // mean of ended flow median RTTs less their minimum RTTs, in milliseconds
+	Retransmits       uint64        // total retransmits of ended flows
+	RetransmitsPerSec float64       // retransmits per second over the window
+	LinkRxMbps        float64       `json:",omitempty"` // receive rate of the summarized links, in Mbps
+	LinkTxMbps        float64       `json:",omitempty"` // transmit rate of the summarized links, in Mbps
+	LinkRxPPS         float64       `json:",omitempty"` // receive rate of the summarized links, in packets/sec
+	LinkTxPPS         float64       `json:",omitempty"` // transmit rate of the summarized links, in packets/sec
+	LinkRxUtilization float64       `json:",omitempty"` // LinkRxMbps over the total link speed (0 if any speed unknown)
+	LinkTxUtilization float64       `json:",omitempty"` // LinkTxMbps over the total link speed (0 if any speed unknown)
+}
+
+// SummaryType is the Type of summary records.
+const SummaryType = "summary"
+
+// A Summary is a sar-style host-level summary emitted every Interval.
+type Summary struct {
+	Type         string     // record type, always SummaryType
+	Time         time.Time  // time the summary was made
+	TrackedFlows int        // number of flows tracked at the time of the summary
+	Window1m     Window     // stats for the last minute
+	Window5m     Window     // stats for the last five minutes
+	Fairness     []Fairness `json:",omitempty"` // throughput fairness over the last interval, per group of concurrent flows
+}
+
+// bucket accumulates stats for one interval.
+type bucket struct {
+	start       time.Time
+	end         time.Time
+	ended       int
+	short       int
+	shortBytes  uint64
+	bytesAcked  uint64
+	retransmits uint64
+	queueDelay  float64
+	link        linkDelta
+}
+
+// A Summarizer accumulates stats for ended flows and returns host-level
+// summaries for rolling one and five minute windows every Interval.
+type Summarizer struct {
+	Config
+	cur   bucket
+	prev  []bucket
+	last  *Summary
+	links map[string]linkCounters
+	iface func([16]byte) string
+	mtx   sync.RWMutex
+}
+
+// NewSummarizer returns a new Summarizer. iface returns the egress interface
+// for a destination, and is required for FairnessInterface.
+func NewSummarizer(cfg Config, iface func([16]byte) string) *Summarizer {
+	return &Summarizer{Config: cfg, iface: iface}
+}
+
+// Due returns true if the next call to Add will return a Summary.
+func (s *Summarizer) Due(now time.Time) bool {
+	return !s.cur.start.IsZero() && now.Sub(s.cur.start) >= Interval
+}
+
+// Add adds stats for ended flows and short flow counts, and returns a
+// Summary if Interval has elapsed since the last one. tp contains the flow
+// throughputs since the last Summary, for fairness indexes, and may be nil if
+// the Summary is not Due or Fairness is disabled. tracked is the number of
+// flows currently tracked.
+func (s *Summarizer) Add(fs []*analyzer.FlowStats,
+	dc map[[16]byte]*tracker.DestCounts,
+	tp map[sampler.ID]*tracker.FlowThroughput, tracked int,
+	now time.Time) (sum *Summary) {
+	if s.cur.start.IsZero() {
+		s.cur.start = now
+		s.readLinks()
+	}
+
+	for _, c := range dc {
+		s.cur.short += c.Short
+		s.cur.shortBytes += c.ShortBytesAcked
+	}
+
+	for _, f := range fs {
+		s.cur.ended++
+		s.cur.bytesAcked += f.BytesAcked
+		s.cur.retransmits += uint64(f.TotalRetransmits)
+		s.cur.queueDelay += queueDelay(f)
+	}
+
+	if now.Sub(s.cur.start) < Interval {
+		return
+	}
+
+	s.cur.end = now
+	if s.links != nil {
+		prev := s.links
+		if s.readLinks() {
+			s.cur.link = delta(prev, s.links)
+		}
+	}
+	s.prev = append(s.prev, s.cur)
+	if len(s.prev) > windows {
+		s.prev = s.prev[len(s.prev)-windows:]
+	}
+	s.cur = bucket{start: now}
+
+	sum = &Summary{
+		Type:         SummaryType,
+		Time:         now,
+		TrackedFlows: tracked,
+		Window1m:     window(s.prev[len(s.prev)-1:]),
+		Window5m:     window(s.prev),
+	}
+	if s.Fairness != "" {
+		sum.Fairness = fairness(tp, s.Fairness, s.iface)
+	}
+
+	s.mtx.Lock()
+	s.last = sum
+	s.mtx.Unlock()
+
+	if s.Log {
+		log.Printf("summary tracked=%d ended1m=%d ended5m=%d",
+			tracked, sum.Window1m.FlowsEnded, sum.Window5m.FlowsEnded)
+	}
+
+	return
+}
+
+// readLinks reads the link counters, if enabled, and returns true if they
+// were read successfully.
+func (s *Summarizer) readLinks() bool {
+	if !s.Links {
+		return false
+	}
+	l, err := readLinks(s.LinkInterfaces)
+	if err != nil {
+		log.Printf("unable to read link counters (%s)", err)
+		return false
+	}
+	s.links = l
+	return true
+}
+
+// Last returns the most recent Summary, or nil if there is none yet.
+func (s *Summarizer) Last() *Summary {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.last
+}
+
+// window returns a Window for the given buckets.
+func window(bs []bucket) (w Window) {
+	var qd float64
+	var l linkDelta
+	var capBits float64
+	for _, b := range bs {
+		l.rxBytes += b.link.rxBytes
+		l.txBytes += b.link.txBytes
+		l.rxPackets += b.link.rxPackets
+		l.txPackets += b.link.txPackets
+		if b.link.speedMbps == 0 {
+			capBits = -1
+		} else if capBits >= 0 {
+			capBits += float64(b.link.speedMbps) * 1000000 *
+				b.end.Sub(b.start).Seconds()
+		}
+		w.Duration += b.end.Sub(b.start)
+		w.FlowsEnded += b.ended
+		w.ShortFlows += b.short
+		w.ShortBytesAcked += b.shortBytes
+		w.BytesAcked += b.bytesAcked
+		w.Retransmits += b.retransmits
+		qd += b.queueDelay
+	}
+	if w.FlowsEnded > 0 {
+		w.MeanQueueDelayms = qd / float64(w.FlowsEnded)
+	}
+	if sec := w.Duration.Seconds(); sec > 0 {
+		w.ThroughputMbps = float64(w.BytesAcked) * 8 / 1000000 / sec
+		w.RetransmitsPerSec = float64(w.Retransmits) / sec
+		w.LinkRxMbps = float64(l.rxBytes) * 8 / 1000000 / sec
+		w.LinkTxMbps = float64(l.txBytes) * 8 / 1000000 / sec
+		w.LinkRxPPS = float64(l.rxPackets) / sec
+		w.LinkTxPPS = float64(l.txPackets) / sec
+	}
+	if capBits > 0 {
+		w.LinkRxUtilization = float64(l.rxBytes) * 8 / capBits
+		w.LinkTxUtilization = float64(l.txBytes) * 8 / capBits
+	}
+	return
+}
+
+// queueDelay returns the estimated queueing delay for a flow, in
+// milliseconds. The RTT baseline is used if available, otherwise the kernel's
+// minimum RTT.
+func queueDelay(f *analyzer.FlowStats) (d float64) {
+	if f.BaselineRTTms > 0 {
+		d = f.ExcessRTTms
+	} else {
+		d = f.RTTSummary[3] - f.MinRTTKernelms
+	}
+	if d < 0 {
+		d = 0
+	}
+	return
+}
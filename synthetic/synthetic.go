@@ -0,0 +1,232 @@
+// Package synthetic implements a sampler that fabricates plausible flows and
+// samples, to benchmark the throughput and memory use of the rest of the
+// pipeline without generating real traffic.
+package synthetic
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/heistp/cgmon/clock"
+	"github.com/heistp/cgmon/linux"
+	"github.com/heistp/cgmon/sampler"
+)
+
+// Config contains the synthetic sampler configuration.
+type Config struct {
+	Flows        int         // number of concurrent flows (0 disables the synthetic sampler)
+	Lifetime     int         // mean flow lifetime in samples, exponentially distributed
+	IdleFraction float64     // fraction of flows whose samples don't change, which the tracker de-duplicates
+	Seed         int64       // random seed
+	Rand         *rand.Rand  // random source (nil for one seeded with Seed)
+	Clock        clock.Clock // clock for sample timestamps (nil for the wall clock)
+	Log          bool        // if true, logging is enabled
+}
+
+const (
+	mss              = 1448       // sender MSS
+	maxCwnd          = 10000      // cwnd limit in segments
+	infiniteSsthresh = 0x7fffffff // initial ssthresh (TCP_INFINITE_SSTHRESH)
+	lossProb         = 0.01       // probability of a loss event per sample
+	initRTOus        = 1000000    // initial RTO (TCP_TIMEOUT_INIT)
+	minRTOus         = 200000     // minimum RTO variance term (TCP_RTO_MIN)
+	atoUs            = 40000      // delayed ACK timeout (TCP_ATO_MIN)
+	minBaseRTTus     = 1000       // minimum base RTT
+	maxBaseRTTus     = 200000     // maximum base RTT
+)
+
+// flow is the state of one synthetic flow.
+type flow struct {
+	sampler.Sample
+	baseRTTus float64 // base RTT, which samples inflate with queueing delay
+	idle      bool    // if true, the flow's data doesn't change
+	left      int     // samples left before the flow ends
+}
+
+// Sampler is a sampler.Sampler that returns samples for Config.Flows
+// concurrent synthetic flows. Each flow has a random base RTT and lifetime,
+// and grows its cwnd in slow start then congestion avoidance, with random loss
+// events. Ended flows are replaced with new ones with unique IDs.
+type Sampler struct {
+	Config
+	rand      *rand.Rand
+	clock     clock.Clock
+	flows     []flow
+	seq       uint64 // sequence number of the next flow, for its ID
+	start     time.Time
+	samplesCh chan []sampler.Sample
+	sync.Mutex
+}
+
+// NewSampler returns a new Sampler.
+func NewSampler(cfg Config) (s *Sampler) {
+	r := cfg.Rand
+	if r == nil {
+		r = rand.New(rand.NewSource(cfg.Seed))
+	}
+	c := clock.Or(cfg.Clock)
+	s = &Sampler{
+		Config:    cfg,
+		rand:      r,
+		clock:     c,
+		flows:     make([]flow, cfg.Flows),
+		start:     c.Now(),
+		samplesCh: make(chan []sampler.Sample, 32),
+	}
+	for i := range s.flows {
+		s.newFlow(&s.flows[i])
+	}
+	return
+}
+
+func (s *Sampler) Sample() (r sampler.Result, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	t0 := time.Now()
+	ts := uint64(s.clock.Now().Sub(s.start)) + 1
+
+	var ss []sampler.Sample
+	select {
+	case ss = <-s.samplesCh:
+	default:
+	}
+	if cap(ss) < len(s.flows) {
+		ss = make([]sampler.Sample, len(s.flows))
+	}
+	ss = ss[:len(s.flows)]
+
+	for i := range s.flows {
+		f := &s.flows[i]
+		if f.left--; f.left < 0 {
+			s.newFlow(f)
+		}
+		s.step(f, ts)
+		ss[i] = f.Sample
+	}
+
+	if s.Log {
+		log.Printf("synthetic sample time=%s samples=%d", time.Since(t0),
+			len(ss))
+	}
+	r = Result(ss)
+
+	return
+}
+
+func (s *Sampler) RecycleSamples(ss []sampler.Sample) {
+	select {
+	case s.samplesCh <- ss:
+	default:
+	}
+}
+
+// Result is one dump of synthetic samples.
+type Result []sampler.Sample
+
+func (r Result) Samples() []sampler.Sample {
+	return r
+}
+
+// newFlow initializes f as a new flow with a unique ID.
+func (s *Sampler) newFlow(f *flow) {
+	n := s.seq
+	s.seq++
+
+	*f = flow{}
+	f.SrcIP = v4Mapped(10, byte(n>>24), byte(n>>16), byte(n>>8))
+	f.SrcPort = uint16(1024 + n%64512)
+	f.DstIP = v4Mapped(203, 0, 113, byte(n))
+	f.DstPort = 443
+	f.Inode = uint32(n) + 1
+
+	f.baseRTTus = minBaseRTTus * math.Pow(maxBaseRTTus/minBaseRTTus,
+		s.rand.Float64())
+	f.idle = s.rand.Float64() < s.IdleFraction
+	f.left = 1 + int(s.rand.ExpFloat64()*float64(s.Lifetime))
+
+	d := &f.Data
+	d.Options = linux.TCPI_OPT_TIMESTAMPS | linux.TCPI_OPT_SACK |
+		linux.TCPI_OPT_WSCALE
+	d.State = linux.TCP_ESTABLISHED
+	d.RTTus = uint32(f.baseRTTus)
+	d.MinRTTus = uint32(f.baseRTTus)
+	d.RTTVarus = uint32(f.baseRTTus / 2)
+	d.RTOus = initRTOus
+	d.ATOus = atoUs
+	d.SndCwnd = 10
+	d.SndCwndBytes = d.SndCwnd * mss
+	d.SndSsthresh = infiniteSsthresh
+	d.SndMSS = mss
+	d.AdvMSS = mss
+	d.PMTU = 1500
+	d.SndWscale = 7
+	d.RcvWscale = 7
+	d.RcvSpace = 14480
+	d.SndWnd = 3 << 20
+	d.RcvWnd = 65535
+	d.RcvBuf = 131072
+	d.SndBuf = 87040
+	d.CongestionControl = "cubic"
+}
+
+// step advances the flow's data to the timestamp ts.
+func (s *Sampler) step(f *flow, ts uint64) {
+	d := &f.Data
+	dt := ts - d.TstampNs
+	first := d.TstampNs == 0
+	d.TstampNs = ts
+	if f.idle || first {
+		return
+	}
+
+	rtt := f.baseRTTus * (1 + 0.5*s.rand.Float64())
+	d.RTTus = uint32(rtt)
+	d.RTTVarus = uint32(rtt / 4)
+	d.RTOus = d.RTTus + minRTOus
+	if v := 4 * d.RTTVarus; v > minRTOus {
+		d.RTOus = d.RTTus + v
+	}
+	d.CAState = linux.TCP_CA_Open
+	if s.rand.Float64() < lossProb {
+		d.TotalRetransmits++
+		d.Lost = 1
+		d.BytesRetrans += mss
+		d.CAState = linux.TCP_CA_Recovery
+		d.SndSsthresh = d.SndCwnd * 7 / 10
+		d.SndCwnd = d.SndSsthresh
+	} else {
+		d.Lost = 0
+		if d.SndCwnd < d.SndSsthresh {
+			d.SndCwnd *= 2
+		} else {
+			d.SndCwnd++
+		}
+	}
+	if d.SndCwnd < 2 {
+		d.SndCwnd = 2
+	} else if d.SndCwnd > maxCwnd {
+		d.SndCwnd = maxCwnd
+	}
+	d.SndCwndBytes = d.SndCwnd * mss
+
+	// cwnd bytes per RTT over the elapsed time
+	b := uint64(float64(d.SndCwndBytes) * float64(dt) / 1000 / rtt)
+	d.BytesAcked += b
+	d.BytesSent += b
+	d.Delivered += uint32(b / mss)
+	d.BusyTimeus += dt / 1000
+	d.PacingRateBps = uint64(float64(d.SndCwndBytes) * 1e6 / rtt * 1.2)
+	d.DeliveryRateBps = uint64(float64(d.SndCwndBytes) * 1e6 / rtt)
+	d.WmemQueued = d.SndCwndBytes
+}
+
+// v4Mapped returns the v4-mapped IPv6 address for an IPv4 address.
+func v4Mapped(a, b, c, d byte) (ip [16]byte) {
+	ip[10], ip[11] = 0xff, 0xff
+	ip[12], ip[13], ip[14], ip[15] = a, b, c, d
+	return
+}
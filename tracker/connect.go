@@ -0,0 +1,81 @@
+package tracker
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/heistp/cgmon/linux"
+	"github.com/heistp/cgmon/sampler"
+)
+
+// ConnectAttemptsType is the Type of connect attempts records.
+const ConnectAttemptsType = "connect"
+
+// ConnectAttempts contains the outcomes of connection attempts to a
+// destination, accumulated since the last call to DrainConnectAttempts. An
+// attempt is a flow first sampled in SYN_SENT, so only attempts that last
+// until a dump are seen, which includes those with SYN retransmits.
+type ConnectAttempts struct {
+	Type            string    // record type, always ConnectAttemptsType
+	Time            time.Time // time of the first attempt resolved
+	EndTime         time.Time // time of the last attempt resolved
+	DstIP           net.IP    // dest (remote) IP address
+	ConnectAttempts int       // attempts resolved, which is Connected plus ConnectFailed
+	Connected       int       // attempts that left SYN_SENT (e.g. to ESTABLISHED)
+	ConnectFailed   int       // attempts that ended in SYN_SENT (reset, timeout or abort)
+	SynRetransmits  uint64    // SYN retransmits of resolved attempts, as of their last sample in SYN_SENT
+}
+
+// connecting returns true if a new flow's first sample is a connection
+// attempt to count.
+func (t *Tracker) connecting(d *sampler.Data) bool {
+	return t.Handshakes && d.State == linux.TCP_SYN_SENT
+}
+
+// handshake updates a connecting flow for a sample, counting the attempt as
+// connected once the flow leaves SYN_SENT.
+func (t *Tracker) handshake(f *Flow, d *sampler.Data, now time.Time) {
+	if d.State == linux.TCP_SYN_SENT {
+		f.synRetrans = d.TotalRetransmits
+		return
+	}
+	f.connecting = false
+	t.countConnect(f, true, now)
+}
+
+// countConnect counts the outcome of a flow's connection attempt.
+func (t *Tracker) countConnect(f *Flow, connected bool, now time.Time) {
+	t.connMtx.Lock()
+	defer t.connMtx.Unlock()
+	ca, ok := t.connects[f.ID.DstIP]
+	if !ok {
+		ca = &ConnectAttempts{Type: ConnectAttemptsType, Time: now,
+			DstIP: net.IP(f.ID.DstIP[:])}
+		t.connects[f.ID.DstIP] = ca
+	}
+	ca.EndTime = now
+	ca.ConnectAttempts++
+	if connected {
+		ca.Connected++
+	} else {
+		ca.ConnectFailed++
+	}
+	ca.SynRetransmits += uint64(f.synRetrans)
+}
+
+// DrainConnectAttempts returns the connection attempts per destination since
+// the last call, and resets them. Handshakes must be true in the Config.
+func (t *Tracker) DrainConnectAttempts() (ca []*ConnectAttempts) {
+	t.connMtx.Lock()
+	defer t.connMtx.Unlock()
+	for _, c := range t.connects {
+		ca = append(ca, c)
+	}
+	sort.Slice(ca, func(i, j int) bool {
+		return bytes.Compare(ca[i].DstIP, ca[j].DstIP) < 0
+	})
+	t.connects = make(map[[16]byte]*ConnectAttempts)
+	return
+}
@@ -0,0 +1,65 @@
+package tracker
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/heistp/cgmon/linux"
+	"github.com/heistp/cgmon/sampler"
+)
+
+// Flow directions, from the local host's point of view (see Flow.Direction).
+const (
+	DirectionOutbound = "outbound" // the local host initiated the connection (client)
+	DirectionInbound  = "inbound"  // the remote host initiated the connection (server)
+)
+
+// portRangeFile is the file with the local (ephemeral) port range.
+const portRangeFile = "/proc/sys/net/ipv4/ip_local_port_range"
+
+// defaultEphemeral is the Linux default ephemeral port range, used if
+// portRangeFile can't be read.
+var defaultEphemeral = portRange{32768, 60999}
+
+// wellKnownPorts is the range of well-known (privileged) service ports.
+var wellKnownPorts = portRange{1, 1023}
+
+// ephemeralPorts returns the local port range from which connect(2) assigns
+// source ports, or the Linux default if it can't be read.
+func ephemeralPorts() portRange {
+	b, err := os.ReadFile(portRangeFile)
+	if err != nil {
+		return defaultEphemeral
+	}
+	var lo, hi uint16
+	if _, err = fmt.Sscan(strings.TrimSpace(string(b)), &lo, &hi); err != nil ||
+		lo == 0 || lo > hi {
+		return defaultEphemeral
+	}
+	return portRange{lo, hi}
+}
+
+// direction infers whether the local host initiated a new flow, from its
+// first sample. A flow first seen in SYN_SENT is outbound. Otherwise, a flow
+// from an ephemeral or unprivileged local port to a well-known or
+// non-ephemeral remote port is outbound, and the reverse is inbound. If
+// neither applies (e.g. both ports ephemeral), the direction is unknown
+// (empty).
+func (t *Tracker) direction(id *sampler.ID, d *sampler.Data) string {
+	if d.State == linux.TCP_SYN_SENT {
+		return DirectionOutbound
+	}
+	lp, rp := id.SrcPort, id.DstPort
+	switch {
+	case wellKnownPorts.match(rp) && !wellKnownPorts.match(lp):
+		return DirectionOutbound
+	case wellKnownPorts.match(lp) && !wellKnownPorts.match(rp):
+		return DirectionInbound
+	case t.ephemeral.match(lp) && !t.ephemeral.match(rp):
+		return DirectionOutbound
+	case t.ephemeral.match(rp) && !t.ephemeral.match(lp):
+		return DirectionInbound
+	}
+	return ""
+}
@@ -0,0 +1,96 @@
+package tracker
+
+import (
+	"fmt"
+
+	"github.com/heistp/cgmon/sampler"
+)
+
+// Keyers by name, for selecting one in the configuration.
+const (
+	KeyTuple     = "tuple"     // TupleKeyer
+	KeyNamespace = "namespace" // NamespaceKeyer
+	KeyCookie    = "cookie"    // CookieKeyer
+)
+
+// A Key identifies a tracked flow. Flows with the same ID but different
+// scopes are tracked separately.
+type Key struct {
+	ID    sampler.ID // flow 4-tuple
+	Scope uint64     // scope of the ID, as set by the Keyer (0 for none)
+}
+
+// A Keyer derives the Key that a tracked flow is looked up by from its
+// samples. Keyers must return the same Key for all samples of a flow.
+type Keyer interface {
+	// Key returns the Key for a sample from the given sample group.
+	Key(s *sampler.Sample, group int) Key
+}
+
+// TupleKeyer keys flows by their 4-tuple only, so the same 4-tuple sampled by
+// more than one sample group is one flow, owned by the lowest indexed group.
+// A reused 4-tuple is detected only when its counters go backwards.
+type TupleKeyer struct{}
+
+func (TupleKeyer) Key(s *sampler.Sample, group int) Key {
+	return Key{ID: s.ID}
+}
+
+// NamespaceKeyer keys flows by their 4-tuple and the network namespace of the
+// sample group, so the same 4-tuple in different namespaces (e.g. containers
+// with the same addresses) is tracked as separate flows.
+type NamespaceKeyer struct {
+	scopes []uint64 // namespace scope by group index
+}
+
+// NewNamespaceKeyer returns a NamespaceKeyer for sample groups with the given
+// network namespace paths, by group index. Groups with the same path share a
+// namespace, and groups beyond the end are in the current namespace.
+func NewNamespaceKeyer(netns []string) *NamespaceKeyer {
+	k := &NamespaceKeyer{make([]uint64, len(netns))}
+	ns := map[string]uint64{"": 0}
+	for i, p := range netns {
+		s, ok := ns[p]
+		if !ok {
+			s = uint64(len(ns))
+			ns[p] = s
+		}
+		k.scopes[i] = s
+	}
+	return k
+}
+
+func (k *NamespaceKeyer) Key(s *sampler.Sample, group int) Key {
+	var sc uint64
+	if group < len(k.scopes) {
+		sc = k.scopes[group]
+	}
+	return Key{s.ID, sc}
+}
+
+// CookieKeyer keys flows by their 4-tuple and socket cookie, so a new socket
+// that reuses a 4-tuple starts a new flow, and sockets with the same 4-tuple
+// in different namespaces are tracked separately. Samples without cookies
+// (e.g. from replays) are keyed by 4-tuple.
+type CookieKeyer struct{}
+
+func (CookieKeyer) Key(s *sampler.Sample, group int) Key {
+	return Key{s.ID, s.Cookie}
+}
+
+// NewKeyer returns the Keyer for a name (see the Key constants), with the
+// network namespace paths of the sample groups for NamespaceKeyer.
+func NewKeyer(name string, netns []string) (k Keyer, err error) {
+	switch name {
+	case KeyTuple, "":
+		k = TupleKeyer{}
+	case KeyNamespace:
+		k = NewNamespaceKeyer(netns)
+	case KeyCookie:
+		k = CookieKeyer{}
+	default:
+		err = fmt.Errorf("unknown flow key %s (must be %s, %s or %s)", name,
+			KeyTuple, KeyNamespace, KeyCookie)
+	}
+	return
+}
@@ -0,0 +1,53 @@
+package tracker
+
+import (
+	"unsafe"
+
+	"github.com/heistp/cgmon/sampler"
+)
+
+// flowOverhead is the approximate memory used by a tracked flow, besides its
+// samples, which is the Flow and its map entry. Strings, such as the process
+// name and cgroup path, aren't counted.
+const flowOverhead = int64(unsafe.Sizeof(Flow{}) + unsafe.Sizeof(Key{}) +
+	unsafe.Sizeof(&Flow{}))
+
+// sampleSize is the memory used by each sample in a flow's data.
+const sampleSize = int64(unsafe.Sizeof(sampler.Data{}))
+
+// memSize returns the approximate memory used by a flow, including the
+// capacity of its data.
+func (f *Flow) memSize() int64 {
+	return flowOverhead + int64(cap(f.Data))*sampleSize
+}
+
+// account updates the tracker's memory estimate for a change in the size of a
+// tracked flow, or a new one.
+func (t *Tracker) account(f *Flow) {
+	if m := f.memSize(); m != f.mem {
+		t.mem.Add(m - f.mem)
+		f.mem = m
+	}
+}
+
+// release removes a flow from the tracker's memory estimate, when it's no
+// longer tracked.
+func (t *Tracker) release(f *Flow) {
+	t.mem.Add(-f.mem)
+	f.mem = 0
+}
+
+// overBudget returns true if MaxMemory is set, and the memory estimate has
+// reached it.
+func (t *Tracker) overBudget() bool {
+	return t.MaxMemory > 0 && uint64(t.mem.Load()) >= t.MaxMemory
+}
+
+// shed filters a tracked flow, releasing its data, so it's no longer recorded
+// or returned, but stays tracked until it ends so it's not started again.
+func (t *Tracker) shed(f *Flow, ts *trackStats) {
+	f.Filtered = true
+	f.Data = nil
+	t.account(f)
+	ts.Shed++
+}
@@ -0,0 +1,69 @@
+package tracker
+
+// An Observer is notified of flow lifecycle events, so embedders and other
+// subsystems can react to flows as they're tracked, without polling.
+//
+// OnFlowStart and OnFlowEnd are called from the goroutine calling Track,
+// TrackGroup or End. OnFlowSampled is called concurrently from the tracker's
+// shards, though never concurrently for the same flow, and should return
+// quickly. Observers may set fields of the Flow meant for them (e.g.
+// Capture), but must not modify its Data.
+type Observer interface {
+	// OnFlowStart is called for each new flow that's recorded (not filtered),
+	// after process attribution, cgroup resolution and Rules.
+	OnFlowStart(f *Flow)
+
+	// OnFlowSampled is called after a sample that's not a duplicate (or is kept
+	// as a Heartbeat) is added to a recorded flow, after its first.
+	OnFlowSampled(f *Flow)
+
+	// OnFlowEnd is called for each ended flow that's returned, including
+	// segments and flows ended by IdleTimeout.
+	OnFlowEnd(f *Flow)
+}
+
+// NopObserver implements Observer with methods that do nothing, for embedding
+// in Observers that only need some of the events.
+type NopObserver struct{}
+
+// OnFlowStart implements Observer.
+func (NopObserver) OnFlowStart(*Flow) {}
+
+// OnFlowSampled implements Observer.
+func (NopObserver) OnFlowSampled(*Flow) {}
+
+// OnFlowEnd implements Observer.
+func (NopObserver) OnFlowEnd(*Flow) {}
+
+// observing returns true if any Observers are configured.
+func (t *Tracker) observing() bool {
+	return len(t.Observers) > 0
+}
+
+// notifyStart calls OnFlowStart for the recorded flows.
+func (t *Tracker) notifyStart(flows []*Flow) {
+	for _, f := range flows {
+		if f.Filtered {
+			continue
+		}
+		for _, o := range t.Observers {
+			o.OnFlowStart(f)
+		}
+	}
+}
+
+// notifySampled calls OnFlowSampled for a flow.
+func (t *Tracker) notifySampled(f *Flow) {
+	for _, o := range t.Observers {
+		o.OnFlowSampled(f)
+	}
+}
+
+// notifyEnd calls OnFlowEnd for the ended flows.
+func (t *Tracker) notifyEnd(flows []*Flow) {
+	for _, f := range flows {
+		for _, o := range t.Observers {
+			o.OnFlowEnd(f)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package tracker
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heistp/cgmon/cgroup"
+)
+
+// procRoot is the mount point of procfs.
+const procRoot = "/proc"
+
+// attribute sets the owning process for flows by their socket inodes, by
+// scanning the file descriptors of all processes in /proc. Flows whose sockets
+// aren't found (e.g. owned by processes in another PID namespace, or already
+// closed) are left unattributed.
+func (t *Tracker) attribute(flows map[uint32]*Flow) {
+	t0 := time.Now()
+	n := len(flows)
+
+	ps, err := os.ReadDir(procRoot)
+	if err != nil {
+		if t.Log {
+			log.Printf("unable to read %s for process attribution (%s)",
+				procRoot, err)
+		}
+		return
+	}
+
+	for _, p := range ps {
+		if len(flows) == 0 {
+			break
+		}
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join(procRoot, p.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		var comm string
+		for _, fd := range fds {
+			l, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil {
+				continue
+			}
+			ino, ok := socketInode(l)
+			if !ok {
+				continue
+			}
+			f, ok := flows[ino]
+			if !ok {
+				continue
+			}
+			if comm == "" {
+				comm = processName(p.Name())
+			}
+			f.PID = pid
+			f.Process = comm
+			delete(flows, ino)
+		}
+	}
+
+	if t.Log {
+		log.Printf("process attribution time=%s flows=%d unattributed=%d",
+			time.Since(t0), n, len(flows))
+	}
+}
+
+// socketInode returns the inode from a file descriptor link of the form
+// socket:[inode].
+func socketInode(l string) (ino uint32, ok bool) {
+	if !strings.HasPrefix(l, "socket:[") || !strings.HasSuffix(l, "]") {
+		return
+	}
+	i, err := strconv.ParseUint(l[len("socket:["):len(l)-1], 10, 32)
+	if err != nil {
+		return
+	}
+	ino, ok = uint32(i), true
+	return
+}
+
+// processName returns the name (comm) of the process with the given PID.
+func processName(pid string) string {
+	b, err := os.ReadFile(filepath.Join(procRoot, pid, "comm"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// resolveCgroup sets the cgroup path, and container and pod IDs for a flow
+// from its cgroup ID. Flows whose cgroups aren't found (e.g. in another cgroup
+// namespace, or already removed) are left unresolved.
+func (t *Tracker) resolveCgroup(f *Flow) {
+	p, ok := t.cgroups.Path(f.CgroupID)
+	if !ok {
+		return
+	}
+	f.Cgroup = p
+	f.ContainerID, f.PodUID = cgroup.Container(p)
+}
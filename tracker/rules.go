@@ -0,0 +1,218 @@
+package tracker
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// RuleDrop is the action of a rule that drops the flows it matches.
+const RuleDrop = "drop"
+
+// Rules tag or drop new flows by the first rule that matches them, after
+// process attribution and cgroup resolution. Dropped flows are filtered, so
+// they're tracked but not recorded or returned, like those over MaxFlows.
+// Flows matching Targets are tagged but never dropped.
+//
+// Rules are read from a file, one per line, with an action followed by zero
+// or more match terms, all of which must match:
+//
+//	tag cdn dst=203.0.113.0/24 dport=443
+//	tag backup process=rsync
+//	drop dst=10.0.0.0/8 dport=9100-9199
+//
+// The action is tag with a label, or drop. Terms are src= and dst= with a CIDR
+// or IP address, sport= and dport= with a port or range, and process= with a
+// process name (comm), which may be a shell pattern (see path.Match), and
+// requires Processes in the Config. Blank lines and lines starting with # are
+// ignored.
+type Rules struct {
+	rules []rule
+}
+
+// rule is one rule from a rule file.
+type rule struct {
+	tag     string // label to tag flows with, or empty to drop them
+	src     *net.IPNet
+	dst     *net.IPNet
+	sport   portRange
+	dport   portRange
+	process string
+}
+
+// portRange is an inclusive range of ports, which matches any port if zero.
+type portRange struct {
+	lo, hi uint16
+}
+
+func (p portRange) match(port uint16) bool {
+	return p.hi == 0 || (port >= p.lo && port <= p.hi)
+}
+
+// LoadRules reads rules from a file.
+func LoadRules(name string) (r *Rules, err error) {
+	var b []byte
+	if b, err = os.ReadFile(name); err != nil {
+		return
+	}
+	nr := &Rules{}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for ln := 1; sc.Scan(); ln++ {
+		l := strings.TrimSpace(sc.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		var u rule
+		if u, err = parseRule(l); err != nil {
+			err = fmt.Errorf("%s:%d: %s", name, ln, err)
+			return
+		}
+		nr.rules = append(nr.rules, u)
+	}
+	if err = sc.Err(); err != nil {
+		return
+	}
+	r = nr
+	return
+}
+
+// Len returns the number of rules.
+func (r *Rules) Len() int {
+	return len(r.rules)
+}
+
+// Match returns the tag of the first rule that matches the flow, or drop true
+// if it's a drop rule. If no rule matches, the tag is empty and drop is false.
+func (r *Rules) Match(f *Flow) (tag string, drop bool) {
+	for i := range r.rules {
+		if u := &r.rules[i]; u.match(f) {
+			return u.tag, u.tag == ""
+		}
+	}
+	return
+}
+
+func (u *rule) match(f *Flow) bool {
+	if u.src != nil && !u.src.Contains(net.IP(f.ID.SrcIP[:])) {
+		return false
+	}
+	if u.dst != nil && !u.dst.Contains(net.IP(f.ID.DstIP[:])) {
+		return false
+	}
+	if !u.sport.match(f.ID.SrcPort) || !u.dport.match(f.ID.DstPort) {
+		return false
+	}
+	if u.process != "" {
+		if ok, _ := path.Match(u.process, f.Process); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// parseRule parses one line of a rule file.
+func parseRule(l string) (u rule, err error) {
+	fs := strings.Fields(l)
+	switch fs[0] {
+	case "tag":
+		if len(fs) < 2 || strings.Contains(fs[1], "=") {
+			err = fmt.Errorf("tag requires a label")
+			return
+		}
+		u.tag = fs[1]
+		fs = fs[2:]
+	case RuleDrop:
+		fs = fs[1:]
+	default:
+		err = fmt.Errorf("unknown action '%s' (tag or drop)", fs[0])
+		return
+	}
+	for _, t := range fs {
+		k, v, ok := strings.Cut(t, "=")
+		if !ok || v == "" {
+			err = fmt.Errorf("invalid term '%s' (expected name=value)", t)
+			return
+		}
+		switch k {
+		case "src":
+			u.src, err = parseNet(v)
+		case "dst":
+			u.dst, err = parseNet(v)
+		case "sport":
+			u.sport, err = parsePortRange(v)
+		case "dport":
+			u.dport, err = parsePortRange(v)
+		case "process":
+			if _, err = path.Match(v, ""); err == nil {
+				u.process = v
+			}
+		default:
+			err = fmt.Errorf("unknown term '%s'", k)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// parseNet parses a CIDR or IP address.
+func parseNet(s string) (n *net.IPNet, err error) {
+	if strings.Contains(s, "/") {
+		_, n, err = net.ParseCIDR(s)
+		return
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		err = fmt.Errorf("invalid IP address '%s'", s)
+		return
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		n = &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	} else {
+		n = &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+	}
+	return
+}
+
+// parsePortRange parses a port or range of ports (e.g. 9100-9199).
+func parsePortRange(s string) (p portRange, err error) {
+	lo, hi, ok := strings.Cut(s, "-")
+	if !ok {
+		hi = lo
+	}
+	var l, h uint64
+	if l, err = strconv.ParseUint(lo, 10, 16); err != nil {
+		return
+	}
+	if h, err = strconv.ParseUint(hi, 10, 16); err != nil {
+		return
+	}
+	if h == 0 || l > h {
+		err = fmt.Errorf("invalid port range '%s'", s)
+		return
+	}
+	p = portRange{uint16(l), uint16(h)}
+	return
+}
+
+// applyRules tags or drops new flows by the first rule that matches them.
+func (t *Tracker) applyRules(flows []*Flow, ts *trackStats) {
+	for _, f := range flows {
+		tag, drop := t.Rules.Match(f)
+		if drop && !f.Targeted {
+			f.Filtered = true
+			f.Data = nil
+			t.account(f)
+			ts.Dropped++
+		} else if tag != "" {
+			f.Tag = tag
+			ts.Tagged++
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package tracker
+
+import (
+	"fmt"
+
+	"github.com/heistp/cgmon/sampler"
+)
+
+// Sample policies for flows with more than MaxSamples samples.
+const (
+	// SampleDecimate keeps every Nth sample, doubling N each time the flow
+	// reaches MaxSamples, so the kept samples stay evenly spaced.
+	SampleDecimate = "decimate"
+	// SampleReservoir keeps a uniform random sample of the flow's samples
+	// (reservoir sampling), in time order.
+	SampleReservoir = "reservoir"
+)
+
+// minMaxSamples is the minimum for MaxSamples, which keeps the first and
+// latest samples and at least one between them.
+const minMaxSamples = 3
+
+// CheckMaxSamples returns an error if the maximum samples per flow or sample
+// policy are invalid.
+func CheckMaxSamples(max int, policy string) error {
+	if max > 0 && max < minMaxSamples {
+		return fmt.Errorf("max samples per flow must be at least %d",
+			minMaxSamples)
+	}
+	switch policy {
+	case SampleDecimate, SampleReservoir, "":
+		return nil
+	}
+	return fmt.Errorf("unknown sample policy %s (must be %s or %s)", policy,
+		SampleDecimate, SampleReservoir)
+}
+
+// add adds a sample to the flow's data, keeping at most MaxSamples samples
+// with SamplePolicy if MaxSamples > 0 and the flow isn't targeted. The first
+// and latest samples are always kept, as the analysis of cumulative counters
+// and end states depends on them.
+func (t *Tracker) add(sh *shard, f *Flow, d *sampler.Data) {
+	f.seen++
+	if t.MaxSamples <= 0 || len(f.Data) < t.MaxSamples || f.Targeted {
+		f.Data = append(f.Data, *d)
+		return
+	}
+	if t.SamplePolicy == SampleReservoir {
+		t.reservoir(sh, f, d)
+	} else {
+		t.decimate(f, d)
+	}
+}
+
+// decimate adds a sample for SampleDecimate. The kept samples are those whose
+// index is a multiple of the stride, plus the latest sample, which replaces
+// the previous one if its index wasn't. When the data is full, every other
+// kept sample is dropped and the stride doubles.
+func (t *Tracker) decimate(f *Flow, d *sampler.Data) {
+	if f.stride == 0 {
+		f.stride = 1
+	}
+	if (f.seen-2)%f.stride != 0 { // previous latest sample not on stride
+		f.Data = f.Data[:len(f.Data)-1]
+		f.SamplesDropped++
+	}
+	if len(f.Data) >= t.MaxSamples {
+		n := 0
+		for i := 0; i < len(f.Data); i += 2 {
+			f.Data[n] = f.Data[i]
+			n++
+		}
+		f.SamplesDropped += len(f.Data) - n
+		f.Data = f.Data[:n]
+		f.stride *= 2
+	}
+	f.Data = append(f.Data, *d)
+}
+
+// reservoir adds a sample for SampleReservoir. The first sample is kept, the
+// previous latest sample is offered to a reservoir of the samples between the
+// first and latest, replacing a random one with probability size / offered,
+// and the new sample is appended as the latest. Samples stay in time order.
+func (t *Tracker) reservoir(sh *shard, f *Flow, d *sampler.Data) {
+	n := len(f.Data)
+	size := n - 2
+	p := f.Data[n-1]
+	f.Data = f.Data[:n-1]
+	// offered samples are those after the first and before the new one
+	if j := sh.rand.Intn(f.seen - 2); j < size {
+		copy(f.Data[1+j:], f.Data[2+j:])
+		f.Data[len(f.Data)-1] = p
+	}
+	f.SamplesDropped++
+	f.Data = append(f.Data, *d)
+}
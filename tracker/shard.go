@@ -0,0 +1,177 @@
+package tracker
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/heistp/cgmon/sampler"
+)
+
+// A shard holds the flows for the keys that hash to it. During a track
+// operation, each shard is updated by its own goroutine, so the flows in a
+// shard need no locking.
+type shard struct {
+	flows   map[Key]*Flow
+	thru    map[sampler.ID]*FlowThroughput
+	thruMtx sync.Mutex
+	rand    *rand.Rand       // random source for SampleReservoir, with a fixed seed for reproducibility
+	in      []sampler.Sample // samples for the shard in the current track operation
+	ts      trackStats       // stats for the shard in the current phase of a track operation
+	ended   []*Flow          // flows ended by cleanup in the current track operation
+	elapsed time.Duration    // time spent in the current track operation
+	base    int              // flows tracked in all shards at the start of the current track operation
+	delta   int              // flows added to the shard less those deleted in the current track operation
+}
+
+func newShard(seed int64) *shard {
+	return &shard{
+		flows: make(map[Key]*Flow),
+		thru:  make(map[sampler.ID]*FlowThroughput),
+		rand:  rand.New(rand.NewSource(seed)),
+	}
+}
+
+// hash returns the FNV-1a hash of the key.
+func (k *Key) hash() (h uint64) {
+	const prime = 1099511628211
+	h = 14695981039346656037
+	for _, b := range k.ID.SrcIP {
+		h = (h ^ uint64(b)) * prime
+	}
+	for _, b := range k.ID.DstIP {
+		h = (h ^ uint64(b)) * prime
+	}
+	h = (h ^ uint64(k.ID.SrcPort)) * prime
+	h = (h ^ uint64(k.ID.DstPort)) * prime
+	h = (h ^ k.Scope) * prime
+	return
+}
+
+// uid returns the FNV-1a hash of the key and the monotonic nsec time of a
+// flow's first sample, which identifies the flow across its segments.
+func (k *Key) uid(tstampNs uint64) (h uint64) {
+	const prime = 1099511628211
+	h = k.hash()
+	for i := 0; i < 64; i += 8 {
+		h = (h ^ (tstampNs>>i)&0xff) * prime
+	}
+	return
+}
+
+// shard returns the shard for a key.
+func (t *Tracker) shard(k *Key) *shard {
+	if len(t.shards) == 1 {
+		return t.shards[0]
+	}
+	return t.shards[k.hash()%uint64(len(t.shards))]
+}
+
+// partition sets the samples for each shard in a track operation.
+func (t *Tracker) partition(ss []sampler.Sample, group int) {
+	n := t.tracked()
+	for _, sh := range t.shards {
+		sh.in = sh.in[:0]
+		sh.elapsed = 0
+		sh.base, sh.delta = n, 0
+	}
+	if len(t.shards) == 1 {
+		t.shards[0].in = ss
+		return
+	}
+	for i := range ss {
+		k := t.Keyer.Key(&ss[i], group)
+		sh := t.shard(&k)
+		sh.in = append(sh.in, ss[i])
+	}
+}
+
+// parallel calls f for each shard, in its own goroutine if there's more than
+// one, with the shard's stats reset for the group being tracked, then merges
+// the shards' stats into ts.
+func (t *Tracker) parallel(ts *trackStats, f func(sh *shard)) {
+	run := func(sh *shard) {
+		t0 := time.Now()
+		sh.ts = trackStats{group: ts.group, first: ts.first}
+		f(sh)
+		sh.elapsed += time.Since(t0)
+	}
+	if len(t.shards) == 1 {
+		run(t.shards[0])
+	} else {
+		var wg sync.WaitGroup
+		for _, sh := range t.shards {
+			wg.Add(1)
+			go func(sh *shard) {
+				defer wg.Done()
+				run(sh)
+			}(sh)
+		}
+		wg.Wait()
+	}
+	for _, sh := range t.shards {
+		ts.merge(&sh.ts)
+	}
+}
+
+// tracked returns the number of flows tracked in all shards.
+func (t *Tracker) tracked() int {
+	return int(t.nflows.Load())
+}
+
+// concurrent returns the number of flows tracked as seen by a shard during a
+// track operation, which is those tracked at the start of the operation plus
+// those added to and less those deleted from the shard. Unlike tracked, it
+// doesn't depend on the progress of the other shards, so the concurrency of
+// flows is reproducible for a given number of shards.
+func (sh *shard) concurrent() int {
+	return sh.base + sh.delta
+}
+
+// delete deletes a flow from a shard.
+func (t *Tracker) delete(sh *shard, k Key) {
+	if f, ok := sh.flows[k]; ok {
+		t.release(f)
+	}
+	delete(sh.flows, k)
+	sh.delta--
+	t.nflows.Add(-1)
+}
+
+// merge adds the stats from a shard.
+func (ts *trackStats) merge(o *trackStats) {
+	ts.New += o.New
+	ts.Filtered += o.Filtered
+	ts.Updated += o.Updated
+	ts.Deduped += o.Deduped
+	ts.Resets += o.Resets
+	ts.Idle += o.Idle
+	ts.Segments += o.Segments
+	ts.MemFiltered += o.MemFiltered
+	ts.Shed += o.Shed
+	ts.Targeted += o.Targeted
+	ts.Short += o.Short
+	ts.ShortBytes += o.ShortBytes
+	ts.Deleted += o.Deleted
+	ts.AckedBytes += o.AckedBytes
+	for i, f := range o.unattributed {
+		if ts.unattributed == nil {
+			ts.unattributed = make(map[uint32]*Flow)
+		}
+		ts.unattributed[i] = f
+	}
+	if o.groupFlows != nil {
+		if ts.groupFlows == nil {
+			ts.groupFlows = make([]int, len(o.groupFlows))
+		}
+		for i, n := range o.groupFlows {
+			ts.groupFlows[i] += n
+		}
+	}
+	ts.split = append(ts.split, o.split...)
+	ts.idle = append(ts.idle, o.idle...)
+	ts.segments = append(ts.segments, o.segments...)
+	ts.unresolved = append(ts.unresolved, o.unresolved...)
+	ts.started = append(ts.started, o.started...)
+	ts.conns.merge(&o.conns)
+}
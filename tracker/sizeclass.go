@@ -0,0 +1,38 @@
+package tracker
+
+import "time"
+
+// A SizeClass overrides MinSamples and MinDuration for flows that transferred
+// at least MinBytes, so short but large bursts may be kept while short, small
+// flows are still held back.
+type SizeClass struct {
+	MinBytes    uint64        // minimum bytes acked or received for the class
+	MinSamples  int           // minimum number of samples for flows in the class
+	MinDuration time.Duration // minimum duration from first to last sample for flows in the class
+}
+
+// minimums returns the minimum samples and duration required for the flow,
+// from the SizeClass with the largest MinBytes that the flow's bytes acked or
+// received reach, or MinSamples and MinDuration if none do.
+func (t *Tracker) minimums(f *Flow) (samples int, dur time.Duration) {
+	samples, dur = t.MinSamples, t.MinDuration
+	if len(t.SizeClasses) == 0 {
+		return
+	}
+	d := &f.Data[len(f.Data)-1]
+	b := d.BytesAcked
+	if d.BytesReceived > b {
+		b = d.BytesReceived
+	}
+	var c *SizeClass
+	for i := range t.SizeClasses {
+		s := &t.SizeClasses[i]
+		if b >= s.MinBytes && (c == nil || s.MinBytes > c.MinBytes) {
+			c = s
+		}
+	}
+	if c != nil {
+		samples, dur = c.MinSamples, c.MinDuration
+	}
+	return
+}
@@ -0,0 +1,100 @@
+package tracker
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/heistp/cgmon/sampler"
+)
+
+// A FlowState is a snapshot of a tracked flow and its latest sample, for a live
+// view of the flow table (see Tracker.Flows).
+type FlowState struct {
+	SrcIP          net.IP        // source (local) IP address
+	SrcPort        uint16        // source (local) port
+	DstIP          net.IP        // dest (remote) IP address
+	DstPort        uint16        // dest (remote) port
+	StartTime      time.Time     // time the flow (or its current segment) started being tracked
+	Group          int           // index of the sample group that owns the flow
+	Filtered       bool          // true if the flow's data isn't recorded (e.g. over MaxFlows), so Last is nil
+	PreExisting    bool          // true if the flow already existed on startup
+	Idle           bool          // true if the flow was ended by IdleTimeout, and its data hasn't changed since
+	Samples        int           // number of samples kept
+	SamplesDeduped int           // number of samples de-duped
+	Segment        int           // index of the flow's segment from 1, if it was cut by SegmentInterval
+	PID            int           `json:",omitempty"` // ID of the process owning the socket, if attributed
+	Process        string        `json:",omitempty"` // name of the process owning the socket, if attributed
+	Cgroup         string        `json:",omitempty"` // path of the socket's cgroup, if resolved
+	ContainerID    string        `json:",omitempty"` // container ID from the cgroup path, if found
+	PodUID         string        `json:",omitempty"` // Kubernetes pod UID from the cgroup path, if found
+	Tag            string        `json:",omitempty"` // label from the first tag rule matching the flow, if any
+	Direction      string        `json:",omitempty"` // DirectionOutbound or DirectionInbound, or empty if unknown
+	Targeted       bool          `json:",omitempty"` // true if the flow matches one of the Targets
+	Capture        string        `json:",omitempty"` // path of a packet capture started for the flow, if any
+	Last           *sampler.Data // latest sample, or nil if Filtered
+}
+
+// Flows returns a snapshot of the tracked flows, in order of start time, with
+// copies of their latest samples. It may be called concurrently with the other
+// methods, and waits for any track operation in progress to complete.
+func (t *Tracker) Flows() (fs []FlowState) {
+	t.flowsMtx.RLock()
+	defer t.flowsMtx.RUnlock()
+	fs = make([]FlowState, 0, t.tracked())
+	for _, sh := range t.shards {
+		for _, f := range sh.flows {
+			fs = append(fs, f.state())
+		}
+	}
+	sort.Slice(fs, func(i, j int) bool {
+		a, b := &fs[i], &fs[j]
+		if !a.StartTime.Equal(b.StartTime) {
+			return a.StartTime.Before(b.StartTime)
+		}
+		if c := bytes.Compare(a.SrcIP, b.SrcIP); c != 0 {
+			return c < 0
+		}
+		if a.SrcPort != b.SrcPort {
+			return a.SrcPort < b.SrcPort
+		}
+		if c := bytes.Compare(a.DstIP, b.DstIP); c != 0 {
+			return c < 0
+		}
+		return a.DstPort < b.DstPort
+	})
+	return
+}
+
+// state returns a snapshot of the flow.
+func (f *Flow) state() (s FlowState) {
+	s = FlowState{
+		SrcIP:          net.IP(append([]byte(nil), f.ID.SrcIP[:]...)),
+		SrcPort:        f.ID.SrcPort,
+		DstIP:          net.IP(append([]byte(nil), f.ID.DstIP[:]...)),
+		DstPort:        f.ID.DstPort,
+		StartTime:      f.StartTime,
+		Group:          f.Group,
+		Filtered:       f.Filtered,
+		PreExisting:    f.PreExisting,
+		Idle:           f.idle,
+		Samples:        len(f.Data),
+		SamplesDeduped: f.SamplesDeduped,
+		Segment:        f.Segment,
+		PID:            f.PID,
+		Process:        f.Process,
+		Cgroup:         f.Cgroup,
+		ContainerID:    f.ContainerID,
+		PodUID:         f.PodUID,
+		Tag:            f.Tag,
+		Direction:      f.Direction,
+		Targeted:       f.Targeted,
+		Capture:        f.Capture,
+	}
+	if len(f.Data) > 0 {
+		d := f.Data[len(f.Data)-1]
+		s.Last = &d
+	}
+	return
+}
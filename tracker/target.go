@@ -0,0 +1,120 @@
+package tracker
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/heistp/cgmon/sampler"
+)
+
+// A Target is a flow of interest, by its local and remote address and port,
+// any of which may be a wildcard. Targeted flows are tracked with full
+// fidelity: they're never filtered by MaxFlows, MaxMemory or drop Rules, nor
+// held back as short by MinSamples, MinDuration or SizeClasses, and all of their samples
+// are kept regardless of MaxSamples. They must still pass the sampler's
+// filters to be seen at all.
+type Target struct {
+	LocalIP    net.IP // local IP address, or nil for any
+	LocalPort  uint16 // local port, or 0 for any
+	RemoteIP   net.IP // remote IP address, or nil for any
+	RemotePort uint16 // remote port, or 0 for any
+}
+
+// ParseTargets parses a comma separated list of targets, each a local and
+// remote address and port separated by a dash, where * is a wildcard for an
+// address or port (e.g. *:*-192.0.2.1:443,[2001:db8::1]:8080-*:*).
+func ParseTargets(s string) (g []Target, err error) {
+	for _, v := range strings.Split(s, ",") {
+		var t Target
+		if t, err = parseTarget(strings.TrimSpace(v)); err != nil {
+			return
+		}
+		g = append(g, t)
+	}
+	return
+}
+
+// parseTarget parses one target.
+func parseTarget(s string) (t Target, err error) {
+	l, r, ok := strings.Cut(s, "-")
+	if !ok {
+		err = fmt.Errorf("invalid target '%s' (expected local:port-remote:port)",
+			s)
+		return
+	}
+	if t.LocalIP, t.LocalPort, err = parseEndpoint(l); err != nil {
+		return
+	}
+	t.RemoteIP, t.RemotePort, err = parseEndpoint(r)
+	return
+}
+
+// parseEndpoint parses an address and port, either of which may be *.
+func parseEndpoint(s string) (ip net.IP, port uint16, err error) {
+	var h, p string
+	if h, p, err = net.SplitHostPort(s); err != nil {
+		return
+	}
+	if h != "*" {
+		if ip = net.ParseIP(h); ip == nil {
+			err = fmt.Errorf("invalid IP address '%s'", h)
+			return
+		}
+	}
+	if p != "*" {
+		var n uint64
+		if n, err = strconv.ParseUint(p, 10, 16); err != nil {
+			return
+		}
+		if n == 0 {
+			err = fmt.Errorf("invalid port '%s'", p)
+			return
+		}
+		port = uint16(n)
+	}
+	return
+}
+
+// String returns the target in the form parsed by ParseTargets.
+func (t Target) String() string {
+	ep := func(ip net.IP, port uint16) string {
+		h, p := "*", "*"
+		if ip != nil {
+			h = ip.String()
+		}
+		if port != 0 {
+			p = strconv.Itoa(int(port))
+		}
+		return net.JoinHostPort(h, p)
+	}
+	return ep(t.LocalIP, t.LocalPort) + "-" + ep(t.RemoteIP, t.RemotePort)
+}
+
+// match returns true if the flow ID matches the target.
+func (t *Target) match(id *sampler.ID) bool {
+	if t.LocalPort != 0 && id.SrcPort != t.LocalPort {
+		return false
+	}
+	if t.RemotePort != 0 && id.DstPort != t.RemotePort {
+		return false
+	}
+	if t.LocalIP != nil && !t.LocalIP.Equal(net.IP(id.SrcIP[:])) {
+		return false
+	}
+	if t.RemoteIP != nil && !t.RemoteIP.Equal(net.IP(id.DstIP[:])) {
+		return false
+	}
+	return true
+}
+
+// targeted returns true if the flow ID matches any of the Targets.
+func (t *Tracker) targeted(id *sampler.ID) bool {
+	for i := range t.Targets {
+		if t.Targets[i].match(id) {
+			return true
+		}
+	}
+	return false
+}
@@ -3,17 +3,53 @@ package tracker
 import (
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/heistp/cgmon/cgroup"
+	"github.com/heistp/cgmon/clock"
+	"github.com/heistp/cgmon/linux"
 	"github.com/heistp/cgmon/metrics"
 	"github.com/heistp/cgmon/sampler"
 )
 
 // A Config contains the tracker configuration.
 type Config struct {
-	MaxFlows   int  // maximum number of active (non-filtered) flows allowed at a time
-	MinSamples int  // minimum number of samples required to return ended flows for further processing
-	Log        bool // if true, logging is enabled
+	MaxFlows    int           // maximum number of active (non-filtered) flows allowed at a time
+	MinSamples  int           // minimum number of samples required to return ended flows for further processing, including those dropped by MaxSamples
+	MinDuration time.Duration // minimum duration from first to last sample required to return ended flows
+	SizeClasses []SizeClass   // if set, minimums that override MinSamples and MinDuration for flows by their bytes (see SizeClass)
+	CountDests  bool          // if true, count started and short flows per destination (see DrainDestCounts)
+	Processes   bool          // if true, attribute new flows to processes by scanning /proc for their socket inodes
+	Cgroups     bool          // if true, resolve the cgroup IDs of new flows to cgroup paths and container IDs
+	// CgroupCache is the cache configuration for resolving cgroup IDs, if
+	// Cgroups is true
+	CgroupCache cgroup.CacheConfig
+	Throughputs bool          // if true, accumulate bytes acked per flow (see DrainThroughputs)
+	IdleTimeout time.Duration // if > 0, end flows idle this long, by their data not changing and the kernel's last data activity time (see Flow.Idle)
+	Heartbeat   int           // if > 0, keep every Nth consecutive unchanged sample instead of de-duplicating it, so idle flows keep their time weighting
+	// SegmentInterval, if > 0, cuts flows into segments of this length from
+	// first to last sample, returning each as ended while the flow continues
+	// (see Flow.Segment)
+	SegmentInterval time.Duration
+	// MaxSamples, if > 0, is the maximum number of samples kept per flow,
+	// beyond which samples are dropped by SamplePolicy (see CheckMaxSamples)
+	MaxSamples   int
+	SamplePolicy string // SampleDecimate or SampleReservoir (empty for SampleDecimate)
+	Keyer        Keyer  // derives the keys flows are tracked by (nil for TupleKeyer)
+	Shards       int    // number of shards flows are partitioned into by key hash, and updated in parallel (0 or 1 for one)
+	// MaxMemory, if > 0, is the approximate memory budget for tracked flows
+	// in bytes, estimated from their sample counts. When it's reached, new
+	// flows are filtered, and flows that add samples are shed.
+	MaxMemory uint64
+	// Handshakes, if true, counts the outcomes of connection attempts, from
+	// flows first sampled in SYN_SENT (see DrainConnectAttempts)
+	Handshakes bool
+	Observers  []Observer  // notified of flow lifecycle events (see Observer)
+	Rules      *Rules      // if not nil, tags or drops new flows (see Flow.Tag)
+	Targets    []Target    // flows tracked with full fidelity and never filtered (see Target)
+	Clock      clock.Clock // clock for flow start and end times, and throughputs (nil for the wall clock)
+	Log        bool        // if true, logging is enabled
 }
 
 // A Flow contains the data needed by the tracker for one flow.
@@ -27,7 +63,72 @@ type Flow struct {
 	PreExisting    bool           // true if flow already existed on startup
 	Partial        bool           // true if flow was pre-existing or no final sample was seen
 	SamplesDeduped int            // number of samples de-duped
+	SamplesDropped int            // number of samples dropped due to MaxSamples
 	EndTstampNs    uint64         // monotonic nsec time of last sample, even if it was de-duped
+	Inode          uint32         // socket inode
+	PID            int            // ID of the process owning the socket, if attributed
+	Process        string         // name (comm) of the process owning the socket, if attributed
+	CgroupID       uint64         // ID of the socket's cgroup v2 (5.7 and later)
+	Cgroup         string         // path of the socket's cgroup, if resolved
+	ContainerID    string         // container ID from the cgroup path, if found
+	PodUID         string         // Kubernetes pod UID from the cgroup path, if found
+	Concurrency    Concurrency    // flows tracked concurrently with this flow
+	Group          int            // index of the sample group that owns the flow (see TrackGroup)
+	ClockJump      bool           // true if a clock jump was seen while the flow was tracked (see MarkClockJump)
+	Idle           bool           // true if the flow was ended by IdleTimeout while its socket remained open
+	Segment        int            // index of the flow's segment from 1, if it was cut by SegmentInterval, otherwise 0
+	Continued      bool           // true if the flow continues in a later segment
+	UID            uint64         // hash of the flow's key and first sample time, the same for all of its segments
+	idle           bool           // true for the placeholder of an idle ended flow, until its data changes
+	key            Key            // key the flow is tracked by
+	seen           int            // number of samples added to Data, including dropped ones
+	stride         int            // index stride of kept samples, for SampleDecimate
+	mem            int64          // memory accounted for the flow (see MaxMemory)
+	connecting     bool           // true if the flow is a connection attempt still in SYN_SENT (see Handshakes)
+	synRetrans     uint32         // retransmits in the flow's last sample in SYN_SENT, if connecting
+	changedNs      uint64         // monotonic nsec time of the last sample whose data changed
+	unchanged      int            // consecutive unchanged samples since the last kept one, for Heartbeat
+	Capture        string         // path of a packet capture started for the flow, if any (see capture.Capturer)
+	Tag            string         // label from the first tag rule matching the flow, if any (see Rules)
+	Direction      string         // DirectionOutbound or DirectionInbound, or empty if unknown (see direction)
+	Targeted       bool           // true if the flow matches one of the Targets
+}
+
+// Concurrency contains the number of flows tracked concurrently with a flow,
+// and the aggregate throughput of all tracked flows, when the flow started and
+// over its lifetime.
+type Concurrency struct {
+	StartFlows int     // other flows tracked when the flow started
+	StartMbps  float64 // aggregate throughput in the track operation before the flow started
+	MaxFlows   int     // maximum other flows tracked during the flow
+	sumFlows   int
+	sumMbps    float64
+	n          int
+}
+
+// MeanFlows returns the mean number of other flows tracked during the flow.
+func (c *Concurrency) MeanFlows() float64 {
+	if c.n == 0 {
+		return float64(c.StartFlows)
+	}
+	return float64(c.sumFlows) / float64(c.n)
+}
+
+// MeanMbps returns the mean aggregate throughput during the flow.
+func (c *Concurrency) MeanMbps() float64 {
+	if c.n == 0 {
+		return c.StartMbps
+	}
+	return c.sumMbps / float64(c.n)
+}
+
+func (c *Concurrency) add(flows int, mbps float64) {
+	c.sumFlows += flows
+	c.sumMbps += mbps
+	c.n++
+	if flows > c.MaxFlows {
+		c.MaxFlows = flows
+	}
 }
 
 type Metrics struct {
@@ -37,12 +138,29 @@ type Metrics struct {
 	PriorEndedFlows  uint64
 	PriorTrackerTime time.Time
 	EndedFlows       uint64
+	ShortFlows       uint64 // ended flows not returned due to MinSamples or MinDuration
+	ShortBytesAcked  uint64 // total bytes acked by short flows
 	InstChurnRate    float64
+	GroupFlows       []int                   // tracked flows per sample group, if more than one
+	DestroyedFlows   uint64                  // flows ended by destroy events (see End)
+	ClockJumps       uint64                  // clock jumps seen (see MarkClockJump)
+	CounterResets    uint64                  // flows split because their cumulative counters went backwards
+	IdleFlows        uint64                  // flows ended by IdleTimeout
+	Segments         uint64                  // interim flow segments cut by SegmentInterval
+	ShardTimes       []metrics.DurationStats // time each shard spent in track operations, if more than one
+	Established      int                     // established connections in the last dump of each sample group
+	EstablishedPorts map[uint16]int          // Established by destination port
+	Memory           int64                   // approximate memory used by tracked flows, in bytes
+	ShedFlows        uint64                  // tracked flows shed due to MaxMemory
+	TaggedFlows      uint64                  // new flows tagged by Rules
+	DroppedFlows     uint64                  // new flows dropped by Rules
+	TargetedFlows    uint64                  // new flows matching Targets
+	CgroupCache      cgroup.CacheMetrics     // cgroup resolver cache metrics, if Cgroups is true
 	sync.RWMutex
 }
 
 func (m *Metrics) record(now time.Time, elapsed time.Duration,
-	tracked, ended int) {
+	tracked, ended, short int, shortBytes uint64, groupFlows []int) {
 	m.Lock()
 	defer m.Unlock()
 
@@ -53,28 +171,199 @@ func (m *Metrics) record(now time.Time, elapsed time.Duration,
 	m.TrackTimes.Push(elapsed)
 	m.TrackedFlows = tracked
 	m.EndedFlows += uint64(ended)
+	m.ShortFlows += uint64(short)
+	m.ShortBytesAcked += shortBytes
+	if groupFlows != nil {
+		m.GroupFlows = groupFlows
+	}
 	m.InstChurnRate = (float64(m.EndedFlows) - float64(m.PriorEndedFlows)) /
 		float64(now.Sub(m.PriorTrackerTime).Seconds())
 	m.PriorEndedFlows = m.EndedFlows
 	m.PriorTrackerTime = now
 }
 
+func (m *Metrics) recordShardTimes(ds []time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	if m.ShardTimes == nil {
+		m.ShardTimes = make([]metrics.DurationStats, len(ds))
+	}
+	for i, d := range ds {
+		m.ShardTimes[i].Push(d)
+	}
+}
+
+func (m *Metrics) recordConnections(c connections) {
+	m.Lock()
+	defer m.Unlock()
+	m.Established = c.established
+	m.EstablishedPorts = c.ports
+}
+
+func (m *Metrics) recordMemory(mem int64, shed int) {
+	m.Lock()
+	defer m.Unlock()
+	m.Memory = mem
+	m.ShedFlows += uint64(shed)
+}
+
+func (m *Metrics) recordRules(tagged, dropped int) {
+	m.Lock()
+	defer m.Unlock()
+	m.TaggedFlows += uint64(tagged)
+	m.DroppedFlows += uint64(dropped)
+}
+
+func (m *Metrics) recordDestroyed(n int) {
+	m.Lock()
+	defer m.Unlock()
+	m.DestroyedFlows += uint64(n)
+}
+
+func (m *Metrics) recordClockJump() {
+	m.Lock()
+	defer m.Unlock()
+	m.ClockJumps++
+}
+
+func (m *Metrics) recordCounterResets(n int) {
+	m.Lock()
+	defer m.Unlock()
+	m.CounterResets += uint64(n)
+}
+
+func (m *Metrics) recordTargeted(n int) {
+	m.Lock()
+	defer m.Unlock()
+	m.TargetedFlows += uint64(n)
+}
+
+func (m *Metrics) recordIdle(n int) {
+	m.Lock()
+	defer m.Unlock()
+	m.IdleFlows += uint64(n)
+}
+
+func (m *Metrics) recordSegments(n int) {
+	m.Lock()
+	defer m.Unlock()
+	m.Segments += uint64(n)
+}
+
 func (m *Metrics) ChurnRate() float64 {
 	return float64(m.EndedFlows) / float64(time.Since(m.StartTime).Seconds())
 }
 
+// DestCounts contains counts of flows for a destination that aren't otherwise
+// returned by the Tracker.
+type DestCounts struct {
+	Started         int    // flows started
+	Short           int    // flows ended but not returned due to MinSamples or MinDuration
+	ShortBytesAcked uint64 // total bytes acked by short flows
+}
+
+// Capacity event reasons.
+const (
+	CapacityMaxFlows  = "max-flows"  // new flows filtered due to MaxFlows
+	CapacityMaxMemory = "max-memory" // new flows filtered, or tracked flows shed, due to MaxMemory
+)
+
+// CapacityEventType is the Type of capacity event records.
+const CapacityEventType = "capacity"
+
+// A CapacityEvent records flows whose data was not recorded due to a capacity
+// limit, accumulated over the track operations since the last call to
+// DrainCapacityEvents.
+type CapacityEvent struct {
+	Type     string    // record type, always CapacityEventType
+	Time     time.Time // time of the first limited track operation
+	EndTime  time.Time // time of the last limited track operation
+	Reason   string    // reason for the limit (e.g. CapacityMaxFlows)
+	Filtered int       // number of flows affected
+	Tracked  int       // number of tracked flows after the last limited operation
+	Limit    int       // configured limit
+}
+
+// FlowThroughput contains the bytes acked by a flow between two samples.
+type FlowThroughput struct {
+	DstIP   [16]byte // destination IP address
+	Bytes   uint64   // bytes acked from StartNs to EndNs
+	StartNs uint64   // monotonic nsec time of the sample before the first that acked bytes
+	EndNs   uint64   // monotonic nsec time of the last sample
+}
+
+// add adds the bytes acked by another FlowThroughput for the same ID.
+func (f *FlowThroughput) add(o *FlowThroughput) {
+	f.Bytes += o.Bytes
+	if o.StartNs < f.StartNs {
+		f.StartNs = o.StartNs
+	}
+	if o.EndNs > f.EndNs {
+		f.EndNs = o.EndNs
+	}
+}
+
+// Mbps returns the throughput in Mbps.
+func (f *FlowThroughput) Mbps() float64 {
+	if f.EndNs <= f.StartNs {
+		return 0
+	}
+	return float64(f.Bytes) * 8 * 1000 / float64(f.EndNs-f.StartNs)
+}
+
 type Tracker struct {
 	Config
-	metrics    Metrics
-	flows      map[sampler.ID]*Flow
-	firstTrack bool
+	metrics   Metrics
+	shards    []*shard
+	nflows    atomic.Int64 // number of flows in all shards
+	mem       atomic.Int64 // approximate memory used by flows in all shards (see MaxMemory)
+	dests     map[[16]byte]*DestCounts
+	destsMtx  sync.Mutex
+	capacity  []*CapacityEvent
+	capMtx    sync.Mutex
+	connects  map[[16]byte]*ConnectAttempts
+	connMtx   sync.Mutex
+	aggMbps   float64       // aggregate throughput of tracked flows, summed over sample groups
+	groupMbps []float64     // aggregate throughput of each group's flows in its last track operation
+	lastTrack []time.Time   // time of each group's last track operation
+	conns     []connections // connections in each group's last track operation
+	cgroups   *cgroup.Resolver
+	ephemeral portRange    // local port range for ephemeral ports, for inferring flow direction
+	flowsMtx  sync.RWMutex // held while flows are updated, and while Flows reads them
 }
 
 func NewTracker(cfg Config) (t *Tracker) {
 	t = &Tracker{cfg,
 		Metrics{},
-		make(map[sampler.ID]*Flow),
-		true,
+		nil,
+		atomic.Int64{},
+		atomic.Int64{},
+		make(map[[16]byte]*DestCounts),
+		sync.Mutex{},
+		nil,
+		sync.Mutex{},
+		make(map[[16]byte]*ConnectAttempts),
+		sync.Mutex{},
+		0,
+		nil,
+		nil,
+		nil,
+		nil,
+		ephemeralPorts(),
+		sync.RWMutex{},
+	}
+	if cfg.Keyer == nil {
+		t.Keyer = TupleKeyer{}
+	}
+	n := cfg.Shards
+	if n < 1 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		t.shards = append(t.shards, newShard(int64(i+1)))
+	}
+	if cfg.Cgroups {
+		t.cgroups = cgroup.NewResolver("", cfg.CgroupCache)
 	}
 	return
 }
@@ -87,117 +376,727 @@ func NewTracker(cfg Config) (t *Tracker) {
 // flows to start in the same track operation that other flows end, but for now we
 // don't do so to avoid the added complexity.
 func (t *Tracker) Track(ss []sampler.Sample) (ended []*Flow) {
+	return t.TrackGroup(ss, 0)
+}
+
+// TrackGroup is like Track, for samples from one of several sample groups,
+// which may have their own filters and intervals. Only flows owned by the
+// group may end. A flow is owned by the lowest indexed group that has sampled
+// it, and samples from higher indexed groups for flows they don't own are
+// ignored.
+func (t *Tracker) TrackGroup(ss []sampler.Sample, group int) (ended []*Flow) {
 	t0 := time.Now()
-	ts := &trackStats{}
+	t.flowsMtx.Lock()
+	defer t.flowsMtx.Unlock()
+	now := clock.Or(t.Clock).Now()
+	for len(t.lastTrack) <= group {
+		t.lastTrack = append(t.lastTrack, time.Time{})
+		t.groupMbps = append(t.groupMbps, 0)
+		t.conns = append(t.conns, connections{})
+	}
+	ts := &trackStats{group: group, first: t.lastTrack[group].IsZero()}
 
-	t.update(ss, t0, ts)
-	ended = t.cleanup(t0, ts)
+	t.partition(ss, group)
+	t.parallel(ts, func(sh *shard) {
+		t.update(sh, sh.in, now, &sh.ts)
+	})
+	if ts.Resets > 0 {
+		t.metrics.recordCounterResets(ts.Resets)
+	}
+	if ts.Idle > 0 {
+		t.metrics.recordIdle(ts.Idle)
+	}
+	if ts.Targeted > 0 {
+		t.metrics.recordTargeted(ts.Targeted)
+	}
+	if ts.Segments > 0 {
+		t.metrics.recordSegments(ts.Segments)
+	}
+	if !ts.first {
+		if d := now.Sub(t.lastTrack[group]); d > 0 {
+			t.groupMbps[group] = float64(ts.AckedBytes) * 8 / 1000000 / d.Seconds()
+			t.aggMbps = 0
+			for _, m := range t.groupMbps {
+				t.aggMbps += m
+			}
+		}
+	}
+	t.lastTrack[group] = now
+	t.conns[group] = ts.conns
+	t.metrics.recordConnections(t.connections())
+	if len(ts.unattributed) > 0 {
+		t.attribute(ts.unattributed)
+	}
+	for _, f := range ts.unresolved {
+		t.resolveCgroup(f)
+	}
+	if t.Rules != nil && len(ts.started) > 0 {
+		t.applyRules(ts.started, ts)
+		t.metrics.recordRules(ts.Tagged, ts.Dropped)
+	}
+	t.notifyStart(ts.started)
+	ended = append(ts.split, ts.idle...)
+	ended = append(ended, ts.segments...)
+	tracked := t.tracked()
+	t.parallel(ts, func(sh *shard) {
+		sh.ended = t.cleanup(sh, now, tracked, &sh.ts)
+	})
+	for _, sh := range t.shards {
+		ended = append(ended, sh.ended...)
+		sh.ended = nil
+	}
 
 	ts.Ended = len(ended)
+	t.notifyEnd(ended)
+
+	if ts.Filtered > 0 {
+		t.recordCapacity(CapacityMaxFlows, ts.Filtered, t.MaxFlows, now)
+	}
+	if n := ts.MemFiltered + ts.Shed; n > 0 {
+		t.recordCapacity(CapacityMaxMemory, n, int(t.MaxMemory), now)
+	}
+	t.metrics.recordMemory(t.mem.Load(), ts.Shed)
+
+	el := time.Since(t0)
+	t.metrics.record(t0, el, t.tracked(), ts.Ended, ts.Short, ts.ShortBytes,
+		ts.groupFlows)
+	if len(t.shards) > 1 {
+		ds := make([]time.Duration, len(t.shards))
+		for i, sh := range t.shards {
+			ds[i] = sh.elapsed
+		}
+		t.metrics.recordShardTimes(ds)
+	}
+
+	if t.Log {
+		log.Printf("tracker group=%d time=%s new=%d filtered=%d shed=%d updated=%d deduped=%d resets=%d idle=%d segments=%d ended=%d short=%d deleted=%d",
+			group, el, ts.New, ts.Filtered+ts.MemFiltered, ts.Shed, ts.Updated, ts.Deduped, ts.Resets, ts.Idle, ts.Segments, ts.Ended, ts.Short, ts.Deleted)
+	}
 
-	if t.firstTrack {
-		t.firstTrack = false
+	return
+}
+
+// MarkClockJump marks the tracked flows as having seen a clock jump, such as a
+// suspend or wall clock step, after which their durations or wall times may be
+// inconsistent, and records it in the Metrics.
+func (t *Tracker) MarkClockJump() {
+	t.flowsMtx.Lock()
+	defer t.flowsMtx.Unlock()
+	for _, sh := range t.shards {
+		for _, f := range sh.flows {
+			f.ClockJump = true
+		}
+	}
+	t.metrics.recordClockJump()
+}
+
+// End immediately ends tracked flows for samples of destroyed sockets, adding
+// each sample as the flow's last, and returns the ended flows that pass the
+// tracker's configured constraints. Samples for untracked flows are ignored.
+// The mark, DSCP, UID and congestion control, which aren't known for destroyed
+// sockets, are copied from the flow's previous sample. Samples are keyed as
+// from the first sample group.
+func (t *Tracker) End(ss []sampler.Sample) (ended []*Flow) {
+	t0 := time.Now()
+	t.flowsMtx.Lock()
+	defer t.flowsMtx.Unlock()
+	now := clock.Or(t.Clock).Now()
+	ts := &trackStats{}
+
+	for _, s := range ss {
+		k := t.Keyer.Key(&s, 0)
+		sh := t.shard(&k)
+		f, ok := sh.flows[k]
+		if !ok {
+			continue
+		}
+		if f.idle { // already ended by IdleTimeout
+			t.delete(sh, k)
+			ts.Deleted++
+			continue
+		}
+		if f.connecting { // destroyed, connected if it transferred data
+			t.countConnect(f, s.Data.BytesAcked > 0 || s.Data.BytesReceived > 0,
+				now)
+		}
+		if !f.Filtered {
+			p := &f.Data[len(f.Data)-1]
+			if s.Data.TstampNs > p.TstampNs && !counterReset(p, &s.Data) {
+				d := s.Data
+				d.Mark, d.DSCP, d.UID, d.CongestionControl = p.Mark, p.DSCP,
+					p.UID, p.CongestionControl
+				if t.Throughputs {
+					sh.thruMtx.Lock()
+					t.recordThroughput(sh, s.ID, p, &d)
+					sh.thruMtx.Unlock()
+				}
+				t.add(sh, f, &d)
+				f.EndTstampNs = d.TstampNs
+				ts.Updated++
+			}
+		}
+		if t.end(f, now, ts) {
+			ended = append(ended, f)
+		}
+		t.delete(sh, k)
+		ts.Deleted++
 	}
+	ts.Ended = len(ended)
+	t.notifyEnd(ended)
 
 	el := time.Since(t0)
-	t.metrics.record(t0, el, len(t.flows), ts.Ended)
+	t.metrics.record(t0, el, t.tracked(), ts.Ended, ts.Short, ts.ShortBytes,
+		nil)
+	t.metrics.recordDestroyed(ts.Deleted)
 
 	if t.Log {
-		log.Printf("tracker time=%s new=%d filtered=%d updated=%d deduped=%d ended=%d deleted=%d",
-			el, ts.New, ts.Filtered, ts.Updated, ts.Deduped, ts.Ended, ts.Deleted)
+		log.Printf("tracker destroyed time=%s updated=%d ended=%d short=%d deleted=%d",
+			el, ts.Updated, ts.Ended, ts.Short, ts.Deleted)
 	}
 
 	return
 }
 
+// DrainDestCounts returns the counts of started and short flows per
+// destination IP since the last call, and resets the counts. Flows that
+// existed on startup are not counted as started. CountDests must be true in
+// the Config.
+func (t *Tracker) DrainDestCounts() (dc map[[16]byte]*DestCounts) {
+	t.destsMtx.Lock()
+	defer t.destsMtx.Unlock()
+	dc = t.dests
+	t.dests = make(map[[16]byte]*DestCounts)
+	return
+}
+
+// DrainThroughputs returns the bytes acked by each flow since the last call,
+// for flows that acked bytes, and resets them. Throughputs must be true in the
+// Config.
+func (t *Tracker) DrainThroughputs() (tp map[sampler.ID]*FlowThroughput) {
+	for _, sh := range t.shards {
+		sh.thruMtx.Lock()
+		if tp == nil {
+			tp = sh.thru
+		} else {
+			for id, ft := range sh.thru {
+				if p, ok := tp[id]; ok { // same ID with different keys
+					ft.add(p)
+				}
+				tp[id] = ft
+			}
+		}
+		sh.thru = make(map[sampler.ID]*FlowThroughput)
+		sh.thruMtx.Unlock()
+	}
+	return
+}
+
+// recordThroughput adds the bytes acked from the previous to the current
+// sample. The shard's thruMtx must be held.
+func (t *Tracker) recordThroughput(sh *shard, id sampler.ID, prev,
+	cur *sampler.Data) {
+	if cur.BytesAcked <= prev.BytesAcked {
+		return
+	}
+	ft, ok := sh.thru[id]
+	if !ok {
+		ft = &FlowThroughput{DstIP: id.DstIP, StartNs: prev.TstampNs}
+		sh.thru[id] = ft
+	}
+	ft.Bytes += cur.BytesAcked - prev.BytesAcked
+	ft.EndNs = cur.TstampNs
+}
+
+// countDest adds started and short flows to the DestCounts for a
+// destination.
+func (t *Tracker) countDest(ip [16]byte, started, short int,
+	shortBytes uint64) {
+	t.destsMtx.Lock()
+	defer t.destsMtx.Unlock()
+	dc, ok := t.dests[ip]
+	if !ok {
+		dc = &DestCounts{}
+		t.dests[ip] = dc
+	}
+	dc.Started += started
+	dc.Short += short
+	dc.ShortBytesAcked += shortBytes
+}
+
+// DrainCapacityEvents returns the capacity events since the last call, one per
+// reason, and resets them.
+func (t *Tracker) DrainCapacityEvents() (ce []*CapacityEvent) {
+	t.capMtx.Lock()
+	defer t.capMtx.Unlock()
+	ce = t.capacity
+	t.capacity = nil
+	return
+}
+
+// recordCapacity adds affected flows to the pending event for the reason.
+func (t *Tracker) recordCapacity(reason string, n, limit int, now time.Time) {
+	t.capMtx.Lock()
+	defer t.capMtx.Unlock()
+	var e *CapacityEvent
+	for _, c := range t.capacity {
+		if c.Reason == reason {
+			e = c
+			break
+		}
+	}
+	if e == nil {
+		e = &CapacityEvent{Type: CapacityEventType, Time: now, Reason: reason,
+			Limit: limit}
+		t.capacity = append(t.capacity, e)
+	}
+	e.EndTime = now
+	e.Filtered += n
+	e.Tracked = t.tracked()
+}
+
 func (t *Tracker) Metrics() (m Metrics) {
 	t.metrics.RLock()
 	defer t.metrics.RUnlock()
 	m = t.metrics
+	m.ShardTimes = append([]metrics.DurationStats(nil), t.metrics.ShardTimes...)
+	if t.cgroups != nil {
+		m.CgroupCache = t.cgroups.Metrics()
+	}
+	return
+}
+
+// connections counts established connections by destination port, as seen in
+// a dump.
+type connections struct {
+	established int
+	ports       map[uint16]int
+}
+
+// add counts a sample if its connection is established.
+func (c *connections) add(s *sampler.Sample) {
+	if s.Data.State != linux.TCP_ESTABLISHED {
+		return
+	}
+	c.established++
+	if c.ports == nil {
+		c.ports = make(map[uint16]int)
+	}
+	c.ports[s.ID.DstPort]++
+}
+
+// merge adds the counts from another connections.
+func (c *connections) merge(o *connections) {
+	c.established += o.established
+	for p, n := range o.ports {
+		if c.ports == nil {
+			c.ports = make(map[uint16]int)
+		}
+		c.ports[p] += n
+	}
+}
+
+// connections returns the established connections in the last dump of all
+// sample groups. Each connection is counted by the group that owns its flow.
+func (t *Tracker) connections() (c connections) {
+	c.ports = make(map[uint16]int)
+	for i := range t.conns {
+		c.merge(&t.conns[i])
+	}
 	return
 }
 
-// update adds new and updates existing flows.
-func (t *Tracker) update(ss []sampler.Sample, now time.Time, ts *trackStats) {
+// update adds new and updates existing flows. Existing flows whose cumulative
+// counters went backwards, as when the socket's tuple is reused, are split,
+// ending the existing flow and starting a new one with the sample. Flows idle
+// for IdleTimeout are ended (see endIdle), and if their data changes later,
+// resume as new flows that are marked partial, like pre-existing flows, as
+// their cumulative counters include the data of the ended flow. Flows longer
+// than SegmentInterval are cut into segments. The samples must belong to the
+// shard.
+func (t *Tracker) update(sh *shard, ss []sampler.Sample, now time.Time,
+	ts *trackStats) {
+	if t.Throughputs {
+		sh.thruMtx.Lock()
+		defer sh.thruMtx.Unlock()
+	}
 	for _, s := range ss {
 		var f *Flow
-		var ok bool
-		if f, ok = t.flows[s.ID]; !ok { // new flow
-			filtered := t.MaxFlows > 0 && len(t.flows)+1 > t.MaxFlows
+		var ok, resumed bool
+		k := t.Keyer.Key(&s, ts.group)
+		if f, ok = sh.flows[k]; ok && f.idle {
+			if ts.group > f.Group {
+				continue
+			}
+			f.Group = ts.group
+			f.Sampled = true
+			if f.Data[0].EquivalentTo(&s.Data) {
+				ts.conns.add(&s)
+				continue
+			}
+			t.delete(sh, k)
+			ok, resumed = false, true
+		} else if ok && t.split(sh, f, &s.Data, now, ts) {
+			ok = false
+		}
+		if !ok { // new flow
+			c := sh.concurrent()
+			n := int(t.nflows.Add(1))
+			targeted := len(t.Targets) > 0 && t.targeted(&s.ID)
+			filtered := !targeted && t.MaxFlows > 0 && n > t.MaxFlows
+			memFiltered := !targeted && !filtered && t.overBudget()
+			filtered = filtered || memFiltered
 			var data []sampler.Data
 			if !filtered {
 				data = make([]sampler.Data, 0, 16)
 				data = append(data, s.Data)
 			}
-			f = &Flow{s.ID,
-				data,
-				now,
-				time.Time{},
-				filtered,
-				true,
-				t.firstTrack,
-				true,
-				0,
-				s.Data.TstampNs,
-			}
-			t.flows[s.ID] = f
-			if filtered {
+			dir := t.direction(&s.ID, &s.Data)
+			if f != nil && f.Direction != "" { // resumed or split
+				dir = f.Direction
+			}
+			f = &Flow{
+				ID:          s.ID,
+				Data:        data,
+				StartTime:   now,
+				Filtered:    filtered,
+				Sampled:     true,
+				PreExisting: ts.first || resumed,
+				Partial:     true,
+				EndTstampNs: s.Data.TstampNs,
+				Inode:       s.Inode,
+				CgroupID:    s.CgroupID,
+				Concurrency: Concurrency{StartFlows: c, StartMbps: t.aggMbps,
+					MaxFlows: c},
+				Group:      ts.group,
+				UID:        k.uid(s.Data.TstampNs),
+				key:        k,
+				seen:       1,
+				connecting: t.connecting(&s.Data),
+				synRetrans: s.Data.TotalRetransmits,
+				changedNs:  s.Data.TstampNs,
+				Direction:  dir,
+				Targeted:   targeted,
+			}
+			sh.flows[k] = f
+			sh.delta++
+			t.account(f)
+			ts.conns.add(&s)
+			if t.CountDests && !ts.first {
+				t.countDest(s.ID.DstIP, 1, 0, 0)
+			}
+			if memFiltered {
+				ts.MemFiltered++
+			} else if filtered {
 				ts.Filtered++
 			} else {
 				ts.New++
+				if targeted {
+					ts.Targeted++
+				}
+				if t.Processes && s.Inode != 0 {
+					if ts.unattributed == nil {
+						ts.unattributed = make(map[uint32]*Flow)
+					}
+					ts.unattributed[s.Inode] = f
+				}
+				if t.cgroups != nil && s.CgroupID != 0 {
+					ts.unresolved = append(ts.unresolved, f)
+				}
+				if t.Rules != nil || t.observing() {
+					ts.started = append(ts.started, f)
+				}
 			}
 		} else { // existing flow
+			if f.Group != ts.group {
+				if ts.group > f.Group {
+					continue
+				}
+				f.Group = ts.group
+			}
 			f.Sampled = true
+			ts.conns.add(&s)
+			if f.connecting {
+				t.handshake(f, &s.Data, now)
+			}
 			if !f.Filtered {
 				f.EndTstampNs = s.Data.TstampNs
+				if p := &f.Data[len(f.Data)-1]; s.Data.BytesAcked > p.BytesAcked {
+					ts.AckedBytes += s.Data.BytesAcked - p.BytesAcked
+				}
+				if t.Throughputs {
+					t.recordThroughput(sh, s.ID, &f.Data[len(f.Data)-1],
+						&s.Data)
+				}
 				if f.Data[len(f.Data)-1].EquivalentTo(&s.Data) {
-					// de-duplicate existing flow
-					f.SamplesDeduped++
-					ts.Deduped++
-					continue
+					if !t.heartbeat(f) || t.isIdle(f) {
+						// de-duplicate existing flow
+						f.SamplesDeduped++
+						ts.Deduped++
+						t.endIdle(sh, f, now, ts)
+						continue
+					}
+				} else {
+					f.changedNs = s.Data.TstampNs
+					f.unchanged = 0
 				}
-				f.Data = append(f.Data, s.Data)
+				t.add(sh, f, &s.Data)
+				t.account(f)
 				ts.Updated++
+				if t.overBudget() && !f.Targeted {
+					t.shed(f, ts)
+					continue
+				}
+				t.notifySampled(f)
+				t.segment(sh, f, now, ts)
 			}
 		}
 	}
 }
 
-// cleanup cleans up after tracked flows that were not sampled. Filtered flows are
-// deleted but not returned as ended.
-func (t *Tracker) cleanup(now time.Time, ts *trackStats) (ended []*Flow) {
-	var deleted []sampler.ID
+// segment ends the flow as a segment if its samples span SegmentInterval, and
+// replaces it with the next segment, which starts with its last sample so the
+// segments' cumulative counters may be subtracted.
+func (t *Tracker) segment(sh *shard, f *Flow, now time.Time, ts *trackStats) {
+	p := f.Data[len(f.Data)-1]
+	if t.SegmentInterval <= 0 ||
+		time.Duration(p.TstampNs-f.Data[0].TstampNs) < t.SegmentInterval {
+		return
+	}
+	if f.Segment == 0 {
+		f.Segment = 1
+	}
+	f.Continued = true
+	if t.end(f, now, ts) {
+		ts.segments = append(ts.segments, f)
+	}
+	data := make([]sampler.Data, 0, 16)
+	n := sh.concurrent()
+	t.release(f)
+	g := &Flow{
+		ID:          f.ID,
+		Data:        append(data, p),
+		StartTime:   now,
+		Sampled:     true,
+		EndTstampNs: p.TstampNs,
+		Inode:       f.Inode,
+		PID:         f.PID,
+		Process:     f.Process,
+		CgroupID:    f.CgroupID,
+		Cgroup:      f.Cgroup,
+		ContainerID: f.ContainerID,
+		PodUID:      f.PodUID,
+		Concurrency: Concurrency{StartFlows: n - 1, StartMbps: t.aggMbps,
+			MaxFlows: n - 1},
+		Group:      f.Group,
+		Segment:    f.Segment + 1,
+		UID:        f.UID,
+		key:        f.key,
+		seen:       1,
+		connecting: f.connecting,
+		synRetrans: f.synRetrans,
+		changedNs:  f.changedNs,
+		Capture:    f.Capture,
+		Tag:        f.Tag,
+		Direction:  f.Direction,
+		Targeted:   f.Targeted,
+	}
+	sh.flows[f.key] = g
+	t.account(g)
+	ts.Segments++
+}
+
+// heartbeat returns true if an unchanged sample should be kept for Heartbeat,
+// counting it if not.
+func (t *Tracker) heartbeat(f *Flow) bool {
+	if t.Heartbeat <= 0 {
+		return false
+	}
+	if f.unchanged++; f.unchanged < t.Heartbeat {
+		return false
+	}
+	f.unchanged = 0
+	return true
+}
+
+// isIdle returns true if the flow has been idle for IdleTimeout, which is the
+// longer of the time its data hasn't changed, and the time from its last data
+// activity, by the kernel's activity times in its last kept sample.
+func (t *Tracker) isIdle(f *Flow) bool {
+	if t.IdleTimeout <= 0 {
+		return false
+	}
+	p := &f.Data[len(f.Data)-1]
+	d := time.Duration(f.EndTstampNs - f.changedNs)
+	if a := time.Duration(f.EndTstampNs-p.TstampNs) + p.SinceData(); a > d {
+		d = a
+	}
+	return d >= t.IdleTimeout
+}
+
+// endIdle ends the flow if it's idle (see isIdle), and replaces it with an
+// idle placeholder that holds its last sample, so it's not ended again while
+// its data stays the same.
+func (t *Tracker) endIdle(sh *shard, f *Flow, now time.Time, ts *trackStats) {
+	if !t.isIdle(f) {
+		return
+	}
+	p := f.Data[len(f.Data)-1]
+	f.Idle = true
+	if t.end(f, now, ts) {
+		ts.idle = append(ts.idle, f)
+	}
+	t.release(f)
+	g := &Flow{
+		ID:        f.ID,
+		Data:      []sampler.Data{p},
+		StartTime: now,
+		Sampled:   true,
+		Inode:     f.Inode,
+		CgroupID:  f.CgroupID,
+		Group:     f.Group,
+		Direction: f.Direction,
+		Targeted:  f.Targeted,
+		idle:      true,
+		key:       f.key,
+	}
+	sh.flows[f.key] = g
+	t.account(g)
+	ts.Idle++
+}
+
+// split ends the flow and deletes it, if it's owned by or may be taken over
+// by the group being tracked, and its counters went backwards in the given
+// sample. Returns true if the flow was split.
+func (t *Tracker) split(sh *shard, f *Flow, d *sampler.Data, now time.Time,
+	ts *trackStats) bool {
+	if f.Filtered || ts.group > f.Group ||
+		!counterReset(&f.Data[len(f.Data)-1], d) {
+		return false
+	}
+	if t.end(f, now, ts) {
+		ts.split = append(ts.split, f)
+	}
+	t.delete(sh, f.key)
+	ts.Resets++
+	ts.Deleted++
+	return true
+}
+
+// counterReset returns true if any cumulative counters went backwards from
+// the previous to the current sample, which can't happen within one socket.
+func counterReset(prev, cur *sampler.Data) bool {
+	return cur.BytesAcked < prev.BytesAcked ||
+		cur.TotalRetransmits < prev.TotalRetransmits
+}
+
+// cleanup cleans up after tracked flows in the shard that were not sampled.
+// Filtered flows are deleted but not returned as ended. tracked is the number
+// of flows tracked in all shards, for the concurrency of sampled flows.
+func (t *Tracker) cleanup(sh *shard, now time.Time, tracked int,
+	ts *trackStats) (ended []*Flow) {
+	var deleted []Key
+
+	if len(t.lastTrack) > 1 {
+		ts.groupFlows = make([]int, len(t.lastTrack))
+	}
 
-	for _, v := range t.flows {
+	for _, v := range sh.flows {
+		if v.Group != ts.group {
+			if ts.groupFlows != nil {
+				ts.groupFlows[v.Group]++
+			}
+			continue
+		}
 		if !v.Sampled {
-			v.Partial = v.PreExisting
-			v.EndTime = now
-			if !v.Filtered {
-				if t.MinSamples > 0 && len(v.Data) < t.MinSamples {
-					v.Filtered = true
-				} else {
-					ended = append(ended, v)
-				}
+			if v.connecting {
+				t.countConnect(v, false, now)
+			}
+			if !v.idle && t.end(v, now, ts) {
+				ended = append(ended, v)
 			}
-			deleted = append(deleted, v.ID) // delete must occur outside range loop
+			deleted = append(deleted, v.key) // delete must occur outside range loop
 		} else {
 			v.Sampled = false // prepare for next track
+			if ts.groupFlows != nil {
+				ts.groupFlows[v.Group]++
+			}
+			if !v.Filtered && !v.idle {
+				v.Concurrency.add(tracked-1, t.aggMbps)
+			}
 		}
 	}
 
-	for _, id := range deleted {
-		delete(t.flows, id)
+	for _, k := range deleted {
+		t.delete(sh, k)
 	}
-	ts.Deleted = len(deleted)
+	ts.Deleted += len(deleted)
 
 	return
 }
 
+// end marks a flow as ended, and returns true if it should be returned as
+// ended.
+func (t *Tracker) end(f *Flow, now time.Time, ts *trackStats) bool {
+	f.Partial = f.PreExisting
+	f.EndTime = now
+	if f.Filtered {
+		return false
+	}
+	if !f.Targeted && t.short(f) {
+		f.Filtered = true
+		b := f.Data[len(f.Data)-1].BytesAcked
+		ts.Short++
+		ts.ShortBytes += b
+		if t.CountDests {
+			t.countDest(f.ID.DstIP, 0, 1, b)
+		}
+		return false
+	}
+	return true
+}
+
+// short returns true if the flow has too few samples or too short a duration
+// to be returned as ended, by the minimums for its size (see SizeClass).
+// Samples are counted as seen, including those dropped by MaxSamples.
+func (t *Tracker) short(f *Flow) bool {
+	ms, md := t.minimums(f)
+	if ms > 0 && f.seen < ms {
+		return true
+	}
+	if md > 0 &&
+		time.Duration(f.EndTstampNs-f.Data[0].TstampNs) < md {
+		return true
+	}
+	return false
+}
+
 type trackStats struct {
-	New      int
-	Filtered int
-	Updated  int
-	Deduped  int
-	Ended    int
-	Deleted  int
+	New         int
+	Filtered    int
+	Updated     int
+	Deduped     int
+	Resets      int // flows split due to counter resets
+	Idle        int // flows ended by IdleTimeout
+	Segments    int // flow segments cut by SegmentInterval
+	MemFiltered int // new flows filtered due to MaxMemory
+	Shed        int // tracked flows shed due to MaxMemory
+	Tagged      int // new flows tagged by Rules
+	Dropped     int // new flows dropped by Rules
+	Targeted    int // new flows matching Targets
+	Ended       int
+	Short       int
+	ShortBytes  uint64
+	Deleted     int
+	AckedBytes  uint64 // bytes acked by all tracked flows
+
+	unattributed map[uint32]*Flow // new flows by inode, for process attribution
+	group        int              // index of the sample group being tracked
+	first        bool             // true if this is the group's first track operation
+	groupFlows   []int            // tracked flows per group after cleanup, if more than one
+	split        []*Flow          // flows ended by counter resets, to return as ended
+	idle         []*Flow          // flows ended by IdleTimeout, to return as ended
+	segments     []*Flow          // flow segments cut by SegmentInterval, to return as ended
+	unresolved   []*Flow          // new flows with cgroup IDs to resolve to cgroups
+	started      []*Flow          // new flows, for Rules and Observers
+	conns        connections      // established connections in the group's samples
 }
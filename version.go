@@ -1,3 +1,3 @@
-package main
+package cgmon
 
 const VERSION = "0.2"
@@ -0,0 +1,18 @@
+//go:build !wasmplugin
+// +build !wasmplugin
+
+package wasmplugin
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/heistp/cgmon/analyzer"
+)
+
+const WasmEnabled = false
+
+// Load returns an error, as WASM support is not enabled in this build.
+func Load(path string, timeout time.Duration) (analyzer.Plugin, error) {
+	return nil, fmt.Errorf("WASM plugins not enabled in build (use -tags wasmplugin)")
+}
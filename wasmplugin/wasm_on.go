@@ -0,0 +1,131 @@
+//go:build wasmplugin
+// +build wasmplugin
+
+package wasmplugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/heistp/cgmon/analyzer"
+	"github.com/heistp/cgmon/tracker"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+const WasmEnabled = true
+
+// plugin is an analyzer.Plugin that calls a WASM module.
+type plugin struct {
+	name    string
+	timeout time.Duration
+	runtime wazero.Runtime
+	module  api.Module
+	alloc   api.Function
+	analyze api.Function
+	free    api.Function
+}
+
+// Load compiles and instantiates the WASM module at path. Each call to the
+// module is limited to the given timeout, after which the module is closed and
+// further calls fail.
+func Load(path string, timeout time.Duration) (p analyzer.Plugin, err error) {
+	var b []byte
+	if b, err = os.ReadFile(path); err != nil {
+		return
+	}
+
+	ctx := context.Background()
+	r := wazero.NewRuntimeWithConfig(ctx,
+		wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	if _, err = wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		r.Close(ctx)
+		return
+	}
+
+	name := filepath.Base(path)
+	mc := wazero.NewModuleConfig().
+		WithName(name).
+		WithStdout(os.Stderr).
+		WithStderr(os.Stderr).
+		WithStartFunctions("_initialize")
+	var m api.Module
+	if m, err = r.InstantiateWithConfig(ctx, b, mc); err != nil {
+		r.Close(ctx)
+		return
+	}
+
+	wp := &plugin{name, timeout, r, m,
+		m.ExportedFunction("alloc"),
+		m.ExportedFunction("analyze"),
+		m.ExportedFunction("free"),
+	}
+	if wp.alloc == nil || wp.analyze == nil || m.Memory() == nil {
+		r.Close(ctx)
+		err = fmt.Errorf("%s must export memory, alloc and analyze", name)
+		return
+	}
+
+	p = wp
+	return
+}
+
+// Analyze implements analyzer.Plugin.
+func (p *plugin) Analyze(f *tracker.Flow) (m map[string]float64, err error) {
+	var in []byte
+	if in, err = marshalInput(f); err != nil {
+		return
+	}
+
+	ctx := context.Background()
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	var r []uint64
+	if r, err = p.alloc.Call(ctx, uint64(len(in))); err != nil {
+		err = fmt.Errorf("%s alloc failed (%s)", p.name, err)
+		return
+	}
+	iptr := uint32(r[0])
+	if !p.module.Memory().Write(iptr, in) {
+		err = fmt.Errorf("%s alloc returned out of range pointer", p.name)
+		return
+	}
+	defer p.release(ctx, iptr, uint32(len(in)))
+
+	if r, err = p.analyze.Call(ctx, uint64(iptr), uint64(len(in))); err != nil {
+		err = fmt.Errorf("%s analyze failed (%s)", p.name, err)
+		return
+	}
+	optr, olen := uint32(r[0]>>32), uint32(r[0])
+	if olen == 0 {
+		return
+	}
+	defer p.release(ctx, optr, olen)
+
+	out, ok := p.module.Memory().Read(optr, olen)
+	if !ok {
+		err = fmt.Errorf("%s analyze returned out of range result", p.name)
+		return
+	}
+	if err = json.Unmarshal(out, &m); err != nil {
+		err = fmt.Errorf("%s analyze returned invalid JSON (%s)", p.name, err)
+	}
+
+	return
+}
+
+// release calls the module's free function, if it exports one.
+func (p *plugin) release(ctx context.Context, ptr, size uint32) {
+	if p.free != nil {
+		p.free.Call(ctx, uint64(ptr), uint64(size))
+	}
+}
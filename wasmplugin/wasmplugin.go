@@ -0,0 +1,34 @@
+// Package wasmplugin loads WebAssembly modules as analyzer plugins. Modules run
+// sandboxed, with no access to the host other than WASI stdout and stderr.
+//
+// A module must export its memory, and the functions:
+//
+//	alloc(size i32) -> i32
+//	analyze(ptr i32, len i32) -> i64
+//
+// alloc returns a pointer to size bytes of module memory, into which the
+// flow's sample series is written as JSON with the fields ID and Data (see
+// sampler.ID and sampler.Data). analyze returns a pointer in the high 32 bits
+// and length in the low 32 bits of a JSON object mapping metric names to
+// numbers. If the module exports free(ptr i32, len i32), it's called for both
+// the input and output after each call.
+//
+// WASM support requires building with -tags wasmplugin.
+package wasmplugin
+
+import (
+	"encoding/json"
+
+	"github.com/heistp/cgmon/sampler"
+	"github.com/heistp/cgmon/tracker"
+)
+
+// input is the JSON encoded input to a plugin.
+type input struct {
+	ID   sampler.ID
+	Data []sampler.Data
+}
+
+func marshalInput(f *tracker.Flow) ([]byte, error) {
+	return json.Marshal(input{f.ID, f.Data})
+}
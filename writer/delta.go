@@ -0,0 +1,774 @@
+package writer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/bits"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/heistp/cgmon/analyzer"
+)
+
+// The delta encoding is a compact, lossless binary encoding for sending flow
+// stats over constrained links, typically six to eight times smaller than JSON
+// for batches of flows, and still compressible with gzip.
+//
+// Output is a sequence of frames, each starting with deltaMagic, a frame type
+// and the uvarint length of the payload. A flow frame contains a batch of flow
+// stats as the uvarint number of records, the schema fingerprint (so encoders
+// and decoders built from different FlowStats versions aren't mixed) and one
+// column per FlowStats field, each prefixed with its uvarint length. Within a
+// column:
+//
+//   - ints are zigzag varint deltas from the previous record's value
+//   - floats are scaled integers if they're short decimals, or else their XOR
+//     with the previous value, without leading and trailing zero bytes
+//   - byte slices, such as IPs, are the length of the prefix shared with the
+//     previous value, followed by the remaining suffix
+//   - strings are indexes into a dictionary built up over the frame
+//
+// Previous values and dictionaries are reset for each frame, so frames decode
+// independently. Other values, such as aggregate records and markers, are
+// written as JSON frames.
+const (
+	EncodingJSON  = "json"
+	EncodingDelta = "delta"
+)
+
+// deltaMagic starts each frame, and can't start JSON or gzip output.
+const deltaMagic = 0xcd
+
+// frame types
+const (
+	frameFlows = 'F'
+	frameJSON  = 'J'
+)
+
+// An encoder encodes values to the output.
+type encoder interface {
+	Encode(v interface{}) error
+}
+
+// deltaEncoder writes the delta encoding, encoding flow stats slices as flow
+// frames, and other values as JSON frames.
+type deltaEncoder struct {
+	w     io.Writer
+	codec *structCodec
+	cols  [][]byte
+	buf   []byte
+}
+
+func newDeltaEncoder(w io.Writer) *deltaEncoder {
+	c := flowStatsCodec()
+	return &deltaEncoder{
+		w:     w,
+		codec: c,
+		cols:  make([][]byte, len(c.fields)),
+	}
+}
+
+// Encode writes a frame for v, with a single Write so the output isn't rotated
+// mid-frame.
+func (e *deltaEncoder) Encode(v interface{}) (err error) {
+	var typ byte
+	var p []byte
+	if ss, ok := v.([]*analyzer.FlowStats); ok {
+		typ, p = frameFlows, e.flows(ss)
+	} else {
+		typ = frameJSON
+		if p, err = json.Marshal(v); err != nil {
+			return
+		}
+	}
+	b := append(e.buf[:0], deltaMagic, typ)
+	b = binary.AppendUvarint(b, uint64(len(p)))
+	b = append(b, p...)
+	e.buf = b
+	_, err = e.w.Write(b)
+	return
+}
+
+// flows returns the payload of a flow frame.
+func (e *deltaEncoder) flows(ss []*analyzer.FlowStats) (p []byte) {
+	e.codec.reset()
+	for i, f := range e.codec.fields {
+		c := e.cols[i][:0]
+		for _, s := range ss {
+			c = f.codec.encode(c, reflect.ValueOf(s).Elem().Field(f.index))
+		}
+		e.cols[i] = c
+	}
+	p = binary.AppendUvarint(p, uint64(len(ss)))
+	p = binary.BigEndian.AppendUint32(p, e.codec.fingerprint)
+	for _, c := range e.cols {
+		p = binary.AppendUvarint(p, uint64(len(c)))
+		p = append(p, c...)
+	}
+	return
+}
+
+// IsDelta returns true if the output in r is delta encoded.
+func IsDelta(r *bufio.Reader) bool {
+	m, err := r.Peek(1)
+	return err == nil && m[0] == deltaMagic
+}
+
+// readDelta reads the flow stats from delta encoded output, including those
+// in JSON frames.
+func readDelta(r *bufio.Reader) (fs []*analyzer.FlowStats, err error) {
+	c := flowStatsCodec()
+	err = readFrames(r, func(typ byte, p []byte) (err error) {
+		var ss []*analyzer.FlowStats
+		if typ == frameFlows {
+			ss, err = decodeFlows(c, p)
+		} else {
+			var s *analyzer.FlowStats
+			if s, err = unmarshalFlowStats(p); s != nil {
+				ss = []*analyzer.FlowStats{s}
+			}
+		}
+		fs = append(fs, ss...)
+		return
+	})
+	return
+}
+
+// readFrames calls f with the type and payload of each frame in delta encoded
+// output, until f returns an error. The payload is only valid during the call.
+func readFrames(r *bufio.Reader, f func(typ byte, p []byte) error) (err error) {
+	var p []byte
+	for {
+		var m, typ byte
+		if m, err = r.ReadByte(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		if typ, err = r.ReadByte(); err != nil {
+			return
+		}
+		if m != deltaMagic {
+			err = fmt.Errorf("invalid delta frame magic 0x%x", m)
+			return
+		}
+		var l uint64
+		if l, err = binary.ReadUvarint(r); err != nil {
+			return
+		}
+		if uint64(cap(p)) < l {
+			p = make([]byte, l)
+		}
+		p = p[:l]
+		if _, err = io.ReadFull(r, p); err != nil {
+			return
+		}
+		if typ != frameFlows && typ != frameJSON {
+			err = fmt.Errorf("unknown delta frame type 0x%x", typ)
+			return
+		}
+		if err = f(typ, p); err != nil {
+			return
+		}
+	}
+}
+
+// decodeFlows decodes the payload of a flow frame.
+func decodeFlows(c *structCodec, p []byte) (ss []*analyzer.FlowStats,
+	err error) {
+	r := &deltaReader{b: p}
+	n := int(r.uvarint())
+	if f := r.uint32(); r.err == nil && f != c.fingerprint {
+		err = fmt.Errorf("delta frame schema 0x%08x doesn't match 0x%08x", f,
+			c.fingerprint)
+		return
+	}
+	if r.err == nil && n > len(p) {
+		r.err = fmt.Errorf("delta frame record count %d too large", n)
+	}
+	if r.err != nil {
+		err = r.err
+		return
+	}
+	ss = make([]*analyzer.FlowStats, n)
+	for i := range ss {
+		ss[i] = &analyzer.FlowStats{}
+	}
+	c.reset()
+	for _, f := range c.fields {
+		cr := &deltaReader{b: r.bytes(int(r.uvarint()))}
+		for _, s := range ss {
+			f.codec.decode(cr, reflect.ValueOf(s).Elem().Field(f.index))
+		}
+		if cr.err != nil {
+			err = fmt.Errorf("delta column %s (%s)", f.name, cr.err)
+			return
+		}
+	}
+	err = r.err
+	return
+}
+
+// deltaReader reads values from a buffer, recording the first error.
+type deltaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *deltaReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	r.b = nil
+}
+
+func (r *deltaReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.fail(fmt.Errorf("invalid or truncated uvarint"))
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *deltaReader) varint() int64 {
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.fail(fmt.Errorf("invalid or truncated varint"))
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *deltaReader) uint32() uint32 {
+	b := r.bytes(4)
+	if len(b) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *deltaReader) bytes(n int) (b []byte) {
+	if n < 0 || n > len(r.b) {
+		r.fail(fmt.Errorf("truncated data"))
+		return
+	}
+	b, r.b = r.b[:n], r.b[n:]
+	return
+}
+
+// A deltaCodec encodes and decodes values of one type, relative to the
+// previous value it encoded or decoded since the last reset.
+type deltaCodec interface {
+	reset()
+	encode(b []byte, v reflect.Value) []byte
+	decode(r *deltaReader, v reflect.Value)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// newDeltaCodec returns a deltaCodec for type t.
+func newDeltaCodec(t reflect.Type) deltaCodec {
+	if t == timeType {
+		return &timeCodec{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &boolCodec{}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		return &intCodec{}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		return &uintCodec{}
+	case reflect.Float32, reflect.Float64:
+		return &floatCodec{}
+	case reflect.String:
+		return &stringCodec{}
+	case reflect.Struct:
+		return newStructCodec(t)
+	case reflect.Ptr:
+		return &ptrCodec{elem: newDeltaCodec(t.Elem())}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &bytesCodec{}
+		}
+		return &sliceCodec{elem: newDeltaCodec(t.Elem())}
+	case reflect.Array:
+		a := &arrayCodec{elems: make([]deltaCodec, t.Len())}
+		for i := range a.elems {
+			a.elems[i] = newDeltaCodec(t.Elem())
+		}
+		return a
+	case reflect.Map:
+		if t.Key().Kind() == reflect.String {
+			return &mapCodec{elem: newDeltaCodec(t.Elem())}
+		}
+	}
+	return &jsonCodec{}
+}
+
+// structField is an encoded field of a struct.
+type structField struct {
+	name  string
+	index int
+	codec deltaCodec
+}
+
+// structCodec encodes a struct's exported fields, except those ignored by
+// encoding/json.
+type structCodec struct {
+	fields      []structField
+	fingerprint uint32
+}
+
+func newStructCodec(t reflect.Type) *structCodec {
+	c := &structCodec{}
+	h := fnv.New32a()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("json") == "-" {
+			continue
+		}
+		c.fields = append(c.fields, structField{f.Name, i, newDeltaCodec(f.Type)})
+		fmt.Fprintf(h, "%s %s;", f.Name, f.Type)
+	}
+	c.fingerprint = h.Sum32()
+	return c
+}
+
+// flowStatsCodec returns a new structCodec for FlowStats.
+func flowStatsCodec() *structCodec {
+	return newStructCodec(reflect.TypeOf(analyzer.FlowStats{}))
+}
+
+func (c *structCodec) reset() {
+	for _, f := range c.fields {
+		f.codec.reset()
+	}
+}
+
+func (c *structCodec) encode(b []byte, v reflect.Value) []byte {
+	for _, f := range c.fields {
+		b = f.codec.encode(b, v.Field(f.index))
+	}
+	return b
+}
+
+func (c *structCodec) decode(r *deltaReader, v reflect.Value) {
+	for _, f := range c.fields {
+		f.codec.decode(r, v.Field(f.index))
+	}
+}
+
+type boolCodec struct{}
+
+func (boolCodec) reset() {}
+
+func (boolCodec) encode(b []byte, v reflect.Value) []byte {
+	if v.Bool() {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+func (boolCodec) decode(r *deltaReader, v reflect.Value) {
+	if b := r.bytes(1); len(b) > 0 {
+		v.SetBool(b[0] != 0)
+	}
+}
+
+type intCodec struct {
+	prev int64
+}
+
+func (c *intCodec) reset() {
+	c.prev = 0
+}
+
+func (c *intCodec) encode(b []byte, v reflect.Value) []byte {
+	i := v.Int()
+	b = binary.AppendVarint(b, i-c.prev)
+	c.prev = i
+	return b
+}
+
+func (c *intCodec) decode(r *deltaReader, v reflect.Value) {
+	c.prev += r.varint()
+	v.SetInt(c.prev)
+}
+
+type uintCodec struct {
+	prev uint64
+}
+
+func (c *uintCodec) reset() {
+	c.prev = 0
+}
+
+func (c *uintCodec) encode(b []byte, v reflect.Value) []byte {
+	u := v.Uint()
+	b = binary.AppendVarint(b, int64(u-c.prev))
+	c.prev = u
+	return b
+}
+
+func (c *uintCodec) decode(r *deltaReader, v reflect.Value) {
+	c.prev += uint64(r.varint())
+	v.SetUint(c.prev)
+}
+
+// floatCodec encodes floats that are short decimals, such as RTTs converted
+// from microseconds, as a byte with the number of decimal places followed by
+// the varint scaled value. Others are encoded as their XOR with the previous
+// value, as a byte with the number of leading and trailing zero bytes, followed
+// by the remaining bytes, so repeated and similar values are short.
+type floatCodec struct {
+	prev uint64
+}
+
+// maxFloatDecimals is the maximum number of decimal places for short decimal
+// floats.
+const maxFloatDecimals = 6
+
+// floatXOR is added to the header byte of XOR encoded floats.
+const floatXOR = 0x80
+
+var pow10 = [maxFloatDecimals + 1]float64{1, 1e1, 1e2, 1e3, 1e4, 1e5, 1e6}
+
+func (c *floatCodec) reset() {
+	c.prev = 0
+}
+
+func (c *floatCodec) encode(b []byte, v reflect.Value) []byte {
+	f := v.Float()
+	x := math.Float64bits(f)
+	defer func() {
+		c.prev = x
+	}()
+	if !math.Signbit(f) || f != 0 {
+		for k, p := range pow10 {
+			m := math.Round(f * p)
+			if math.Abs(m) < 1<<53 && m/p == f {
+				b = append(b, byte(k))
+				return binary.AppendVarint(b, int64(m))
+			}
+		}
+	}
+	d := x ^ c.prev
+	l, t := 8, 0
+	if d != 0 {
+		l, t = bits.LeadingZeros64(d)/8, bits.TrailingZeros64(d)/8
+	}
+	b = append(b, byte(floatXOR+l*9+t))
+	for i := 7 - l; i >= t; i-- {
+		b = append(b, byte(d>>(i*8)))
+	}
+	return b
+}
+
+func (c *floatCodec) decode(r *deltaReader, v reflect.Value) {
+	h := r.bytes(1)
+	if len(h) == 0 {
+		return
+	}
+	if h[0] <= maxFloatDecimals {
+		f := float64(r.varint()) / pow10[h[0]]
+		c.prev = math.Float64bits(f)
+		v.SetFloat(f)
+		return
+	}
+	l, t := int(h[0]-floatXOR)/9, int(h[0]-floatXOR)%9
+	if h[0] < floatXOR || l+t > 8 {
+		r.fail(fmt.Errorf("invalid float header 0x%x", h[0]))
+		return
+	}
+	var d uint64
+	for _, y := range r.bytes(8 - l - t) {
+		d = d<<8 | uint64(y)
+	}
+	c.prev ^= d << (t * 8)
+	v.SetFloat(math.Float64frombits(c.prev))
+}
+
+// timeCodec encodes times as Unix nanoseconds, with the zero time as
+// math.MinInt64.
+type timeCodec struct {
+	prev int64
+}
+
+func (c *timeCodec) reset() {
+	c.prev = 0
+}
+
+func (c *timeCodec) encode(b []byte, v reflect.Value) []byte {
+	t := v.Interface().(time.Time)
+	ns := int64(math.MinInt64)
+	if !t.IsZero() {
+		ns = t.UnixNano()
+	}
+	b = binary.AppendVarint(b, ns-c.prev)
+	c.prev = ns
+	return b
+}
+
+func (c *timeCodec) decode(r *deltaReader, v reflect.Value) {
+	c.prev += r.varint()
+	var t time.Time
+	if c.prev != math.MinInt64 {
+		t = time.Unix(0, c.prev)
+	}
+	v.Set(reflect.ValueOf(t))
+}
+
+type stringCodec struct {
+	dict map[string]int
+	list []string
+}
+
+func (c *stringCodec) reset() {
+	c.dict = nil
+	c.list = c.list[:0]
+}
+
+func (c *stringCodec) encode(b []byte, v reflect.Value) []byte {
+	s := v.String()
+	if i, ok := c.dict[s]; ok {
+		return binary.AppendUvarint(b, uint64(i))
+	}
+	if c.dict == nil {
+		c.dict = make(map[string]int)
+	}
+	c.dict[s] = len(c.list)
+	b = binary.AppendUvarint(b, uint64(len(c.list)))
+	c.list = append(c.list, s)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func (c *stringCodec) decode(r *deltaReader, v reflect.Value) {
+	i := r.uvarint()
+	if i < uint64(len(c.list)) {
+		v.SetString(c.list[i])
+		return
+	}
+	if i > uint64(len(c.list)) {
+		r.fail(fmt.Errorf("string index %d out of range", i))
+		return
+	}
+	s := string(r.bytes(int(r.uvarint())))
+	c.list = append(c.list, s)
+	v.SetString(s)
+}
+
+// bytesCodec encodes byte slices as the uvarint length plus one (0 for nil),
+// the length of the prefix shared with the previous value, and the suffix.
+type bytesCodec struct {
+	prev []byte
+}
+
+func (c *bytesCodec) reset() {
+	c.prev = nil
+}
+
+func (c *bytesCodec) encode(b []byte, v reflect.Value) []byte {
+	p := v.Bytes()
+	if v.IsNil() {
+		return append(b, 0)
+	}
+	n := 0
+	for n < len(p) && n < len(c.prev) && p[n] == c.prev[n] {
+		n++
+	}
+	b = binary.AppendUvarint(b, uint64(len(p)+1))
+	b = binary.AppendUvarint(b, uint64(n))
+	b = append(b, p[n:]...)
+	c.prev = p
+	return b
+}
+
+func (c *bytesCodec) decode(r *deltaReader, v reflect.Value) {
+	l := r.uvarint()
+	if l == 0 {
+		return
+	}
+	n := r.uvarint()
+	if n > l-1 || n > uint64(len(c.prev)) {
+		r.fail(fmt.Errorf("shared prefix %d too long", n))
+		return
+	}
+	p := make([]byte, l-1)
+	copy(p, c.prev[:n])
+	copy(p[n:], r.bytes(int(l-1-n)))
+	c.prev = p
+	v.SetBytes(p)
+}
+
+// ptrCodec encodes a pointer as a byte indicating if it's non-nil, followed by
+// the value.
+type ptrCodec struct {
+	elem deltaCodec
+}
+
+func (c *ptrCodec) reset() {
+	c.elem.reset()
+}
+
+func (c *ptrCodec) encode(b []byte, v reflect.Value) []byte {
+	if v.IsNil() {
+		return append(b, 0)
+	}
+	return c.elem.encode(append(b, 1), v.Elem())
+}
+
+func (c *ptrCodec) decode(r *deltaReader, v reflect.Value) {
+	if b := r.bytes(1); len(b) == 0 || b[0] == 0 {
+		return
+	}
+	v.Set(reflect.New(v.Type().Elem()))
+	c.elem.decode(r, v.Elem())
+}
+
+// sliceCodec encodes a slice as the uvarint length plus one (0 for nil),
+// followed by the elements, each relative to the one before.
+type sliceCodec struct {
+	elem deltaCodec
+}
+
+func (c *sliceCodec) reset() {
+	c.elem.reset()
+}
+
+func (c *sliceCodec) encode(b []byte, v reflect.Value) []byte {
+	if v.IsNil() {
+		return append(b, 0)
+	}
+	b = binary.AppendUvarint(b, uint64(v.Len()+1))
+	for i := 0; i < v.Len(); i++ {
+		b = c.elem.encode(b, v.Index(i))
+	}
+	return b
+}
+
+func (c *sliceCodec) decode(r *deltaReader, v reflect.Value) {
+	l := r.uvarint()
+	if l == 0 {
+		return
+	}
+	if l-1 > uint64(len(r.b)) {
+		r.fail(fmt.Errorf("slice length %d too large", l-1))
+		return
+	}
+	s := reflect.MakeSlice(v.Type(), int(l-1), int(l-1))
+	for i := 0; i < s.Len(); i++ {
+		c.elem.decode(r, s.Index(i))
+	}
+	v.Set(s)
+}
+
+// arrayCodec encodes each element of an array relative to the same element of
+// the previous array.
+type arrayCodec struct {
+	elems []deltaCodec
+}
+
+func (c *arrayCodec) reset() {
+	for _, e := range c.elems {
+		e.reset()
+	}
+}
+
+func (c *arrayCodec) encode(b []byte, v reflect.Value) []byte {
+	for i, e := range c.elems {
+		b = e.encode(b, v.Index(i))
+	}
+	return b
+}
+
+func (c *arrayCodec) decode(r *deltaReader, v reflect.Value) {
+	for i, e := range c.elems {
+		e.decode(r, v.Index(i))
+	}
+}
+
+// mapCodec encodes a map with string keys as the uvarint length plus one (0
+// for nil), followed by the keys and values in key order.
+type mapCodec struct {
+	key  stringCodec
+	elem deltaCodec
+}
+
+func (c *mapCodec) reset() {
+	c.key.reset()
+	c.elem.reset()
+}
+
+func (c *mapCodec) encode(b []byte, v reflect.Value) []byte {
+	if v.IsNil() {
+		return append(b, 0)
+	}
+	ks := v.MapKeys()
+	sort.Slice(ks, func(i, j int) bool {
+		return ks[i].String() < ks[j].String()
+	})
+	b = binary.AppendUvarint(b, uint64(len(ks)+1))
+	for _, k := range ks {
+		b = c.key.encode(b, k)
+		b = c.elem.encode(b, v.MapIndex(k))
+	}
+	return b
+}
+
+func (c *mapCodec) decode(r *deltaReader, v reflect.Value) {
+	l := r.uvarint()
+	if l == 0 {
+		return
+	}
+	if l-1 > uint64(len(r.b)) {
+		r.fail(fmt.Errorf("map length %d too large", l-1))
+		return
+	}
+	t := v.Type()
+	m := reflect.MakeMapWithSize(t, int(l-1))
+	for i := uint64(0); i < l-1 && r.err == nil; i++ {
+		k := reflect.New(t.Key()).Elem()
+		e := reflect.New(t.Elem()).Elem()
+		c.key.decode(r, k)
+		c.elem.decode(r, e)
+		m.SetMapIndex(k, e)
+	}
+	v.Set(m)
+}
+
+// jsonCodec encodes values of types without a specific codec as JSON.
+type jsonCodec struct{}
+
+func (jsonCodec) reset() {}
+
+func (jsonCodec) encode(b []byte, v reflect.Value) []byte {
+	j, err := json.Marshal(v.Interface())
+	if err != nil {
+		j = nil
+	}
+	b = binary.AppendUvarint(b, uint64(len(j)))
+	return append(b, j...)
+}
+
+func (jsonCodec) decode(r *deltaReader, v reflect.Value) {
+	j := r.bytes(int(r.uvarint()))
+	if len(j) == 0 {
+		return
+	}
+	if err := json.Unmarshal(j, v.Addr().Interface()); err != nil {
+		r.fail(err)
+	}
+}
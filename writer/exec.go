@@ -0,0 +1,163 @@
+package writer
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const (
+	execBackoffMin  = 1 * time.Second  // initial restart backoff
+	execBackoffMax  = 1 * time.Minute  // maximum restart backoff
+	execStopTimeout = 10 * time.Second // time to wait for exit on close
+)
+
+// execWriter is an io.Writer that pipes output to the stdin of a subprocess,
+// restarting it with exponential backoff if it exits. Output is dropped while
+// the subprocess is not running.
+type execWriter struct {
+	*Config
+	metrics   *Metrics
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	bw        *bufio.Writer
+	exited    chan error
+	started   time.Time
+	backoff   time.Duration
+	nextStart time.Time
+}
+
+func newExecWriter(cfg *Config, m *Metrics) (w *execWriter, err error) {
+	w = &execWriter{Config: cfg, metrics: m, backoff: execBackoffMin}
+	err = w.start()
+	return
+}
+
+func (w *execWriter) Write(p []byte) (n int, err error) {
+	if !w.running() {
+		if time.Now().Before(w.nextStart) {
+			w.metrics.recordExecDrop()
+			return len(p), nil
+		}
+		if e := w.start(); e != nil {
+			log.Printf("writer unable to start '%s' (%s)", w.Exec, e)
+			w.scheduleRestart()
+			w.metrics.recordExecDrop()
+			return len(p), nil
+		}
+		w.metrics.recordExecRestart()
+	}
+
+	if n, err = w.bw.Write(p); err != nil {
+		log.Printf("writer error writing to '%s' (%s)", w.Exec, err)
+		w.kill()
+		w.metrics.recordExecDrop()
+		return len(p), nil
+	}
+
+	return
+}
+
+func (w *execWriter) Flush() (err error) {
+	if !w.running() {
+		return
+	}
+	if err = w.bw.Flush(); err != nil {
+		log.Printf("writer error flushing to '%s' (%s)", w.Exec, err)
+		w.kill()
+		err = nil
+	}
+	return
+}
+
+func (w *execWriter) Close() (err error) {
+	if w.cmd == nil {
+		return
+	}
+	if err = w.bw.Flush(); err != nil {
+		log.Printf("writer error flushing to '%s' on close (%s)", w.Exec, err)
+	}
+	w.stdin.Close()
+	select {
+	case err = <-w.exited:
+	case <-time.After(execStopTimeout):
+		log.Printf("writer timed out waiting for '%s' to exit", w.Exec)
+		w.cmd.Process.Kill()
+		err = <-w.exited
+	}
+	w.cmd = nil
+	return
+}
+
+// start starts the subprocess.
+func (w *execWriter) start() (err error) {
+	cmd := exec.Command("/bin/sh", "-c", w.Exec)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	var stdin io.WriteCloser
+	if stdin, err = cmd.StdinPipe(); err != nil {
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	if w.Log {
+		log.Printf("writer started '%s' with pid %d", w.Exec, cmd.Process.Pid)
+	}
+
+	w.cmd = cmd
+	w.stdin = stdin
+	w.bw = bufio.NewWriter(stdin)
+	w.exited = make(chan error, 1)
+	w.started = time.Now()
+	go func(cmd *exec.Cmd, exited chan error) {
+		exited <- cmd.Wait()
+	}(cmd, w.exited)
+
+	return
+}
+
+// running returns true if the subprocess is running, and handles its exit if
+// it's not.
+func (w *execWriter) running() bool {
+	if w.cmd == nil {
+		return false
+	}
+	select {
+	case err := <-w.exited:
+		log.Printf("writer subprocess '%s' exited (%v)", w.Exec, err)
+		w.cmd = nil
+		w.scheduleRestart()
+		return false
+	default:
+		return true
+	}
+}
+
+// kill kills the subprocess after a write error, and schedules a restart.
+func (w *execWriter) kill() {
+	w.stdin.Close()
+	w.cmd.Process.Kill()
+	<-w.exited
+	w.cmd = nil
+	w.scheduleRestart()
+}
+
+// scheduleRestart sets the next start time using exponential backoff, which is
+// reset if the subprocess ran for longer than the maximum backoff.
+func (w *execWriter) scheduleRestart() {
+	if !w.started.IsZero() && time.Since(w.started) > execBackoffMax {
+		w.backoff = execBackoffMin
+	}
+	w.nextStart = time.Now().Add(w.backoff)
+	if w.Log {
+		log.Printf("writer restarting '%s' in %s", w.Exec, w.backoff)
+	}
+	w.backoff *= 2
+	if w.backoff > execBackoffMax {
+		w.backoff = execBackoffMax
+	}
+}
@@ -0,0 +1,97 @@
+package writer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ChecksumExt is the extension of the SHA-256 sidecar written for each rotated
+// file, in the format of sha256sum, so it can be checked with sha256sum -c.
+const ChecksumExt = ".sha256"
+
+// ManifestExt is the extension of the manifest, which has the name of the
+// output file without its extensions, and contains one ManifestEntry per line
+// for each rotated file, in rotation order.
+const ManifestExt = ".manifest"
+
+// A ManifestEntry describes a rotated output file, so downstream ingestion can
+// verify the completeness and integrity of transferred captures.
+type ManifestEntry struct {
+	File      string     // path of the rotated file, relative to the manifest's directory
+	SHA256    string     // hex SHA-256 of the file
+	Size      int64      // size of the file in bytes
+	Records   int64      // number of records (frames in the delta encoding), or -1 if unknown
+	StartTime *time.Time `json:",omitempty"` // time of the first write, unless the file was appended to
+	EndTime   time.Time  // time of rotation
+}
+
+// checksum writes the SHA-256 sidecar for a rotated file, and appends its
+// entry to the manifest.
+func (w *fileWriter) checksum(path string, records int64, start,
+	end time.Time) (err error) {
+	e := ManifestEntry{
+		Records: records,
+		EndTime: end,
+	}
+	if e.File, err = filepath.Rel(filepath.Dir(w.manifestPath()), path); err != nil {
+		return
+	}
+	if !start.IsZero() {
+		e.StartTime = &start
+	}
+	if e.SHA256, e.Size, err = sha256File(path); err != nil {
+		return
+	}
+	if err = os.WriteFile(path+ChecksumExt,
+		[]byte(fmt.Sprintf("%s  %s\n", e.SHA256, filepath.Base(path))), 0644); err != nil {
+		return
+	}
+
+	var b []byte
+	if b, err = json.Marshal(e); err != nil {
+		return
+	}
+	var f *os.File
+	if f, err = os.OpenFile(w.manifestPath(),
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+		return
+	}
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return
+	}
+	err = f.Close()
+	return
+}
+
+// manifestPath returns the path of the manifest, which is the output path
+// without its extensions (e.g. .json.gz) plus ManifestExt.
+func (w *fileWriter) manifestPath() string {
+	p := w.path
+	if filepath.Ext(p) == ".gz" {
+		p = strings.TrimSuffix(p, ".gz")
+	}
+	return strings.TrimSuffix(p, filepath.Ext(p)) + ManifestExt
+}
+
+// sha256File returns the hex SHA-256 and size of a file.
+func sha256File(path string) (sum string, size int64, err error) {
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		return
+	}
+	defer f.Close()
+	h := sha256.New()
+	if size, err = io.Copy(h, f); err != nil {
+		return
+	}
+	sum = hex.EncodeToString(h.Sum(nil))
+	return
+}
@@ -0,0 +1,96 @@
+package writer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Partition layouts by name, for selecting one in the configuration.
+const (
+	PartitionHour = "hour" // PartitionHourLayout
+	PartitionDay  = "day"  // PartitionDayLayout
+)
+
+// Time layouts for the subdirectories of time-partitioned output.
+const (
+	PartitionHourLayout = "2006/01/02/15"
+	PartitionDayLayout  = "2006/01/02"
+)
+
+// PartitionLayout returns the time layout for a partition name (see the
+// Partition constants), or the name itself if it's a custom time layout for a
+// relative path (e.g. year=2006/month=01/day=02/hour=15 for Hive-style
+// key=value partitions). An empty name returns an empty layout, for a flat
+// output directory.
+func PartitionLayout(name string) (layout string, err error) {
+	switch name {
+	case "":
+	case PartitionHour:
+		layout = PartitionHourLayout
+	case PartitionDay:
+		layout = PartitionDayLayout
+	default:
+		p := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC).Format(name)
+		if filepath.IsAbs(p) || p != filepath.Clean(p) ||
+			strings.HasPrefix(p, "..") {
+			err = fmt.Errorf("partition layout %s must be a clean, relative "+
+				"path (or %s or %s)", name, PartitionHour, PartitionDay)
+			return
+		}
+		if p == name {
+			err = fmt.Errorf("partition layout %s has no time elements "+
+				"(e.g. 2006/01/02/15)", name)
+			return
+		}
+		layout = name
+	}
+	return
+}
+
+// partitionDir returns the directory for a rotated file whose data starts at
+// the given time, creating it if needed. It's Dir, or its subdirectory for the
+// time in UTC if Partition is set.
+func (w *fileWriter) partitionDir(t time.Time) (dir string, err error) {
+	if w.Partition == "" {
+		dir = filepath.Dir(w.path)
+		return
+	}
+	dir = filepath.Join(w.Dir, t.UTC().Format(w.Partition))
+	err = os.MkdirAll(dir, 0755)
+	return
+}
+
+// move renames a file, or if that fails with EXDEV, copies it and removes the
+// original. Landlock (ABI version 1) denies renames across directories with
+// EXDEV, even beneath the allowed directory.
+func move(oldpath, newpath string) (err error) {
+	if err = os.Rename(oldpath, newpath); !errors.Is(err, syscall.EXDEV) {
+		return
+	}
+	var src, dst *os.File
+	if src, err = os.Open(oldpath); err != nil {
+		return
+	}
+	defer src.Close()
+	if dst, err = os.OpenFile(newpath, os.O_CREATE|os.O_EXCL|os.O_WRONLY,
+		0644); err != nil {
+		return
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(newpath)
+		return
+	}
+	if err = dst.Close(); err != nil {
+		os.Remove(newpath)
+		return
+	}
+	err = os.Remove(oldpath)
+	return
+}
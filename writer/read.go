@@ -0,0 +1,166 @@
+package writer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/heistp/cgmon/analyzer"
+)
+
+// CountRecords reads output written by a Writer, which may be gzip
+// compressed, checks that each record decodes, and returns the number of
+// records. In the delta encoding, each frame is one record.
+func CountRecords(r io.Reader) (n uint64, err error) {
+	var br *bufio.Reader
+	var gr *gzip.Reader
+	if br, gr, err = uncompress(r); err != nil {
+		return
+	}
+	if gr != nil {
+		defer gr.Close()
+	}
+	if IsDelta(br) {
+		c := flowStatsCodec()
+		err = readFrames(br, func(typ byte, p []byte) (err error) {
+			if typ == frameFlows {
+				_, err = decodeFlows(c, p)
+			} else if !json.Valid(p) {
+				err = fmt.Errorf("invalid JSON frame")
+			}
+			if err == nil {
+				n++
+			}
+			return
+		})
+		return
+	}
+
+	dec := json.NewDecoder(br)
+	for {
+		var raw json.RawMessage
+		if err = dec.Decode(&raw); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		n++
+	}
+}
+
+// CountRecordsFile counts the records in an output file (see CountRecords).
+func CountRecordsFile(path string) (n uint64, err error) {
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		return
+	}
+	defer f.Close()
+	n, err = CountRecords(f)
+	return
+}
+
+// uncompress returns a reader for the output in r, through a gzip.Reader if
+// it's gzip compressed, which the caller must close.
+func uncompress(r io.Reader) (br *bufio.Reader, gr *gzip.Reader, err error) {
+	br = bufio.NewReader(r)
+	var m []byte
+	if m, err = br.Peek(2); err == nil && m[0] == 0x1f && m[1] == 0x8b {
+		if gr, err = gzip.NewReader(br); err != nil {
+			return
+		}
+		br = bufio.NewReader(gr)
+	}
+	err = nil
+	return
+}
+
+// ReadFlowStats reads the flow stats from output written by a Writer, which
+// may be gzip compressed, in JSON or the delta encoding. Other records in the
+// output, which have a Type (e.g. summaries and markers), are skipped.
+func ReadFlowStats(r io.Reader) (fs []*analyzer.FlowStats, err error) {
+	var br *bufio.Reader
+	var gr *gzip.Reader
+	if br, gr, err = uncompress(r); err != nil {
+		return
+	}
+	if gr != nil {
+		defer gr.Close()
+	}
+	if IsDelta(br) {
+		fs, err = readDelta(br)
+		return
+	}
+
+	dec := json.NewDecoder(br)
+	for {
+		var raw json.RawMessage
+		if err = dec.Decode(&raw); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		var s *analyzer.FlowStats
+		if s, err = unmarshalFlowStats(raw); err != nil {
+			return
+		}
+		if s != nil {
+			fs = append(fs, s)
+		}
+	}
+}
+
+// RecordType returns the Type of a JSON record in the output, which is empty
+// for flow stats, and set for all other records (e.g. summary.SummaryType).
+func RecordType(raw []byte) (typ string, err error) {
+	var r struct {
+		Type string
+	}
+	err = json.Unmarshal(raw, &r)
+	typ = r.Type
+	return
+}
+
+// unmarshalFlowStats returns the flow stats in a JSON record, or nil if it's
+// another type of record.
+func unmarshalFlowStats(raw []byte) (s *analyzer.FlowStats, err error) {
+	var typ string
+	if typ, err = RecordType(raw); err != nil || typ != "" {
+		return
+	}
+	ns := &analyzer.FlowStats{}
+	if err = json.Unmarshal(raw, ns); err != nil {
+		return
+	}
+	s = ns
+	return
+}
+
+// SelectAnalysis returns the flow stats from the named analyzer configuration
+// (see FlowStats.Analysis), or if name is empty, those from the primary
+// configuration, so the stats from a comparison configuration aren't counted
+// as more flows.
+func SelectAnalysis(fs []*analyzer.FlowStats,
+	name string) (sel []*analyzer.FlowStats) {
+	for _, s := range fs {
+		if (name == "" && !s.Compared) || (name != "" && s.Analysis == name) {
+			sel = append(sel, s)
+		}
+	}
+	return
+}
+
+// ReadFlowStatsFile reads the flow stats from an output file.
+func ReadFlowStatsFile(path string) (fs []*analyzer.FlowStats, err error) {
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		return
+	}
+	defer f.Close()
+	fs, err = ReadFlowStats(f)
+	return
+}
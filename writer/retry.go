@@ -0,0 +1,131 @@
+package writer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// resetter is implemented by writers that can recover from a write error by
+// discarding their state and reopening their output.
+type resetter interface {
+	Reset() error
+}
+
+// encode encodes one value, retrying with exponential backoff on errors, for
+// up to maxRetryWait in total. If all retries fail and Degraded is true, the
+// value is dropped and the writer enters degraded mode, where values are
+// dropped without retries until the next backoff time, when a single attempt
+// is made to leave degraded mode.
+func (w *Writer) encode(v interface{}) (err error) {
+	if w.degraded {
+		if time.Now().Before(w.nextAttempt) {
+			w.metrics.recordDrop()
+			return
+		}
+		if err = w.reset(); err == nil {
+			err = w.enc.Encode(v)
+		}
+		if err != nil {
+			w.degradedFailed(err)
+			err = nil
+			return
+		}
+		log.Printf("writer leaving degraded mode")
+		w.degraded = false
+		w.metrics.setDegraded(false)
+		return
+	}
+
+	if err = w.enc.Encode(v); err == nil {
+		return
+	}
+
+	d := w.RetryDelay
+	var waited time.Duration
+	for i := 0; i < w.Retries && waited < maxRetryWait; i++ {
+		w.metrics.recordError()
+		if d > maxRetryWait-waited {
+			d = maxRetryWait - waited
+		}
+		log.Printf("writer error, retry %d/%d in %s (%s)", i+1, w.Retries, d,
+			err)
+		time.Sleep(d)
+		waited += d
+		d *= 2
+		w.metrics.recordRetry()
+		if err = w.reset(); err != nil {
+			continue
+		}
+		if err = w.enc.Encode(v); err == nil {
+			return
+		}
+	}
+	w.metrics.recordError()
+
+	if w.Degraded {
+		log.Printf("writer entering degraded mode, dropping records (%s)", err)
+		w.degraded = true
+		w.metrics.setDegraded(true)
+		w.backoff = w.RetryDelay
+		w.degradedFailed(err)
+		err = nil
+	}
+
+	return
+}
+
+// degradedFailed records a failure while degraded, and schedules the next
+// attempt.
+func (w *Writer) degradedFailed(err error) {
+	w.metrics.recordDrop()
+	if w.Log {
+		log.Printf("writer degraded, next attempt in %s (%s)", w.backoff, err)
+	}
+	w.nextAttempt = time.Now().Add(w.backoff)
+	w.backoff *= 2
+	if w.backoff > maxDegradedBackoff {
+		w.backoff = maxDegradedBackoff
+	}
+	if w.backoff <= 0 {
+		w.backoff = time.Second
+	}
+}
+
+// reset resets the underlying writer after an error, and replaces the
+// encoder, as the JSON encoder keeps returning its first error.
+func (w *Writer) reset() (err error) {
+	if r, ok := w.writer.(resetter); ok {
+		if err = r.Reset(); err != nil {
+			return
+		}
+	}
+	w.newEncoder()
+	return
+}
+
+// Reset implements resetter by closing the output file, moving it aside with
+// a .damaged suffix, and opening a new one. The file may end mid gzip member
+// or record, so appending to it would leave it unreadable. Any buffered data
+// not yet written is discarded.
+func (w *fileWriter) Reset() (err error) {
+	if w.file != nil {
+		w.file.Close()
+	}
+	if _, e := os.Stat(w.path); e == nil {
+		var dp string
+		for i := 1; ; i++ {
+			dp = fmt.Sprintf("%s.%d.damaged", w.path, i)
+			if _, e = os.Stat(dp); os.IsNotExist(e) {
+				break
+			}
+		}
+		if err = move(w.path, dp); err != nil {
+			return
+		}
+		log.Printf("writer moved damaged %s to %s", w.path, dp)
+	}
+	err = w.open(true)
+	return
+}
@@ -0,0 +1,48 @@
+package writer
+
+import (
+	"io"
+	"os"
+)
+
+// stdoutBufSize is the size at which stdoutWriter flushes its buffer.
+const stdoutBufSize = 4096
+
+// stdoutWriter buffers output to stdout. Unlike bufio.Writer, it keeps any
+// data it fails to write, which is written by the next Write or Flush, so
+// records aren't discarded when the writer is reset after an error.
+type stdoutWriter struct {
+	out io.Writer
+	buf []byte
+}
+
+func newStdoutWriter() *stdoutWriter {
+	return &stdoutWriter{os.Stdout, make([]byte, 0, stdoutBufSize)}
+}
+
+// Write buffers p, first flushing the buffer if p doesn't fit. If the flush
+// fails, p isn't buffered, so retrying the write doesn't duplicate it.
+func (w *stdoutWriter) Write(p []byte) (n int, err error) {
+	if len(w.buf) > 0 && len(w.buf)+len(p) > stdoutBufSize {
+		if err = w.Flush(); err != nil {
+			return
+		}
+	}
+	w.buf = append(w.buf, p...)
+	n = len(p)
+	return
+}
+
+// Flush writes the buffered data, keeping any that isn't written.
+func (w *stdoutWriter) Flush() (err error) {
+	var n int
+	n, err = w.out.Write(w.buf)
+	w.buf = w.buf[:copy(w.buf, w.buf[n:])]
+	return
+}
+
+// Reset implements resetter. The buffered data is kept, to be written by the
+// next Write or Flush.
+func (w *stdoutWriter) Reset() error {
+	return nil
+}
@@ -26,76 +26,292 @@ type Config struct {
 	RotateInterval   time.Duration
 	RotateSize       uint64
 	Partial          bool
+	Exec             string        // if set, pipe NDJSON to this command (run with /bin/sh -c)
+	Retries          int           // number of retries after a write error
+	RetryDelay       time.Duration // initial exponential backoff time between retries, up to maxRetryWait in total per write
+	Degraded         bool          // if true, drop records after retries fail, instead of returning an error
+	BatchSize        int           // if > 0, flow stats are batched and written when this many are pending
+	BatchInterval    time.Duration // if > 0, flow stats are batched and written this long after the first is pending
+	Encoding         string        // output encoding, EncodingJSON (or empty) or EncodingDelta
+	Verify           bool          // if true, read back each rotated file to verify its integrity and record count
+	Checksum         bool          // if true, write a SHA-256 sidecar for each rotated file, and add it to the manifest
+	Partition        string        // if set, move rotated files into subdirectories of Dir named by this time layout, in UTC (see PartitionLayout)
 	Log              bool
 }
 
+// maxDegradedBackoff is the maximum time between write attempts in degraded
+// mode.
+const maxDegradedBackoff = 1 * time.Minute
+
+// maxRetryWait is the maximum total time waited between retries of one write,
+// as retries block the writer and the pipeline behind it.
+const maxRetryWait = 10 * time.Second
+
+// rotatedQueueLen is the number of rotated files that may wait to be verified
+// and checksummed, before rotation blocks.
+const rotatedQueueLen = 16
+
 type Metrics struct {
-	WriteTimes metrics.DurationStats
+	WriteTimes     metrics.DurationStats
+	ExecDrops      uint64 // writes dropped while the exec subprocess wasn't running
+	ExecRestarts   uint64 // restarts of the exec subprocess
+	WriteErrors    uint64 // write errors, including those that succeeded on retry
+	WriteRetries   uint64 // write retries
+	DroppedRecords uint64 // records dropped in degraded mode
+	Degraded       bool   // true if the writer is currently in degraded mode
+	Batches        uint64 // batches written, if batching is enabled
+	BatchedRecords uint64 // records written in batches
+	VerifiedFiles  uint64 // rotated files read back and verified, if Verify is enabled
+	VerifyFailures uint64 // rotated files that failed verification
 	sync.RWMutex
 }
 
+// MeanBatchSize returns the mean number of records per batch.
+func (m *Metrics) MeanBatchSize() float64 {
+	if m.Batches == 0 {
+		return 0
+	}
+	return float64(m.BatchedRecords) / float64(m.Batches)
+}
+
+func (m *Metrics) recordBatch(n int) {
+	m.Lock()
+	defer m.Unlock()
+	m.Batches++
+	m.BatchedRecords += uint64(n)
+}
+
+func (m *Metrics) recordVerify(err error) {
+	m.Lock()
+	defer m.Unlock()
+	if err != nil {
+		m.VerifyFailures++
+	} else {
+		m.VerifiedFiles++
+	}
+}
+
 func (m *Metrics) recordWriteTime(d time.Duration) {
 	m.Lock()
 	defer m.Unlock()
 	m.WriteTimes.Push(d)
 }
 
+func (m *Metrics) recordError() {
+	m.Lock()
+	defer m.Unlock()
+	m.WriteErrors++
+}
+
+func (m *Metrics) recordRetry() {
+	m.Lock()
+	defer m.Unlock()
+	m.WriteRetries++
+}
+
+func (m *Metrics) recordDrop() {
+	m.Lock()
+	defer m.Unlock()
+	m.DroppedRecords++
+}
+
+func (m *Metrics) setDegraded(d bool) {
+	m.Lock()
+	defer m.Unlock()
+	m.Degraded = d
+}
+
+func (m *Metrics) recordExecDrop() {
+	m.Lock()
+	defer m.Unlock()
+	m.ExecDrops++
+}
+
+func (m *Metrics) recordExecRestart() {
+	m.Lock()
+	defer m.Unlock()
+	m.ExecRestarts++
+}
+
 type Writer struct {
 	Config
-	metrics Metrics
-	enc     *json.Encoder
-	writer  flushWriter
+	metrics     Metrics
+	enc         encoder
+	delta       bool // true if the delta encoding is used
+	writer      flushWriter
+	degraded    bool
+	backoff     time.Duration
+	nextAttempt time.Time
+	batch       []*analyzer.FlowStats
+	batchTimer  *time.Timer
+	batchGen    int   // incremented when a batch is written, to ignore stale timers
+	batchErr    error // error from a batch written by the timer, returned by the next call
 	sync.Mutex
 }
 
 func Open(cfg Config) (w *Writer, err error) {
+	nw := &Writer{Config: cfg}
+
+	switch cfg.Encoding {
+	case "", EncodingJSON:
+	case EncodingDelta:
+		nw.delta = true
+	default:
+		err = fmt.Errorf("unknown writer encoding: %s", cfg.Encoding)
+		return
+	}
+
 	var writer flushWriter
-	if cfg.Dir != "" {
+	if cfg.Exec != "" {
+		if writer, err = newExecWriter(&nw.Config, &nw.metrics); err != nil {
+			return
+		}
+	} else if cfg.Dir != "" {
 		// compressed: fileWriter -> gzip -> countWriter -> buf -> file
-		if writer, err = newFileWriter(&cfg); err != nil {
+		if writer, err = newFileWriter(&cfg, &nw.metrics); err != nil {
 			return
 		}
 	} else {
 		if cfg.Log {
 			log.Printf("writer using stdout")
 		}
-		writer = bufio.NewWriter(os.Stdout)
+		writer = newStdoutWriter()
 	}
 
-	var enc *json.Encoder
-	if enc = json.NewEncoder(writer); err != nil {
+	nw.writer = writer
+	nw.newEncoder()
+	w = nw
+
+	return
+}
+
+// newEncoder sets a new encoder for the output.
+func (w *Writer) newEncoder() {
+	if w.delta {
+		w.enc = newDeltaEncoder(w.writer)
 		return
 	}
-	enc.SetIndent("", "\t")
-
-	w = &Writer{
-		cfg,
-		Metrics{},
-		enc,
-		writer,
-		sync.Mutex{},
+	enc := json.NewEncoder(w.writer)
+	if w.Exec == "" { // exec uses NDJSON
+		enc.SetIndent("", "\t")
 	}
-
-	return
+	w.enc = enc
 }
 
+// Write writes flow stats, or adds them to the pending batch if batching is
+// enabled.
 func (w *Writer) Write(ss []*analyzer.FlowStats) (err error) {
 	w.Lock()
 	defer w.Unlock()
 
+	if err = w.takeBatchErr(); err != nil {
+		return
+	}
+
 	if len(ss) == 0 {
 		return
 	}
 
+	if w.batching() {
+		for _, s := range ss {
+			if w.keep(s) {
+				w.batch = append(w.batch, s)
+			}
+		}
+		if w.BatchSize > 0 && len(w.batch) >= w.BatchSize {
+			err = w.writeBatch()
+		} else if w.BatchInterval > 0 && len(w.batch) > 0 &&
+			w.batchTimer == nil {
+			g := w.batchGen
+			w.batchTimer = time.AfterFunc(w.BatchInterval, func() {
+				w.batchExpired(g)
+			})
+		}
+		return
+	}
+
+	err = w.write(ss)
+
+	return
+}
+
+// batching returns true if batching is enabled.
+func (w *Writer) batching() bool {
+	return w.BatchSize > 0 || w.BatchInterval > 0
+}
+
+// keep returns true if flow stats should be written, which they are unless
+// they're partial and Partial is false. Targeted flows are always written.
+func (w *Writer) keep(s *analyzer.FlowStats) bool {
+	return w.Partial || !s.Partial || s.Targeted
+}
+
+// writeBatch writes the pending batch. The lock must be held.
+func (w *Writer) writeBatch() (err error) {
+	w.batchGen++
+	if w.batchTimer != nil {
+		w.batchTimer.Stop()
+		w.batchTimer = nil
+	}
+	if len(w.batch) == 0 {
+		return
+	}
+	b := w.batch
+	w.batch = nil
+	w.metrics.recordBatch(len(b))
+	err = w.write(b)
+	return
+}
+
+// batchExpired writes the pending batch when the BatchInterval timer for
+// batch generation g fires.
+func (w *Writer) batchExpired(g int) {
+	w.Lock()
+	defer w.Unlock()
+	if g != w.batchGen {
+		return
+	}
+	if err := w.writeBatch(); err != nil {
+		log.Printf("writer error writing batch (%s)", err)
+		w.batchErr = err
+	}
+}
+
+// takeBatchErr returns and clears any error from a batch written by the
+// timer. The lock must be held.
+func (w *Writer) takeBatchErr() (err error) {
+	err = w.batchErr
+	w.batchErr = nil
+	return
+}
+
+// write encodes flow stats, as one frame if the delta encoding is used. The
+// lock must be held.
+func (w *Writer) write(ss []*analyzer.FlowStats) (err error) {
 	t0 := time.Now()
 
-	for _, s := range ss {
-		if w.Partial || !s.Partial {
-			if err = w.enc.Encode(s); err != nil {
-				return
+	if w.delta {
+		var fs []*analyzer.FlowStats
+		for _, s := range ss {
+			if w.keep(s) {
+				fs = append(fs, s)
+			}
+		}
+		if len(fs) > 0 {
+			err = w.encode(fs)
+		}
+	} else {
+		for _, s := range ss {
+			if w.keep(s) {
+				if err = w.encode(s); err != nil {
+					break
+				}
 			}
 		}
 	}
+	if err != nil {
+		return
+	}
 
 	if w.Flush {
 		w.writer.Flush()
@@ -111,10 +327,47 @@ func (w *Writer) Write(ss []*analyzer.FlowStats) (err error) {
 	return
 }
 
+// WriteValues writes arbitrary values, such as aggregate records, to the
+// output. The values must be encodable as JSON, and are written in JSON frames
+// if the delta encoding is used.
+func (w *Writer) WriteValues(vs ...interface{}) (err error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if err = w.takeBatchErr(); err != nil {
+		return
+	}
+
+	if len(vs) == 0 {
+		return
+	}
+
+	// write any pending batch first, to keep the output in order
+	if err = w.writeBatch(); err != nil {
+		return
+	}
+
+	for _, v := range vs {
+		if err = w.encode(v); err != nil {
+			return
+		}
+	}
+
+	if w.Flush {
+		w.writer.Flush()
+	}
+
+	return
+}
+
 func (w *Writer) Close() (err error) {
 	w.Lock()
 	defer w.Unlock()
 
+	if err = w.writeBatch(); err != nil {
+		log.Printf("writer error writing final batch (%s)", err)
+	}
+
 	if c, ok := w.writer.(io.Closer); ok {
 		err = c.Close()
 	} else if f, ok := w.writer.(flushWriter); ok {
@@ -139,18 +392,33 @@ type flushWriter interface {
 	Flush() error
 }
 
-// fileWriter is an io.Writer with file rotation support.
+// fileWriter is an io.Writer with file rotation support. Each Write is one
+// record, as encoders write each record or frame with a single Write.
 type fileWriter struct {
 	*Config
+	metrics    *Metrics
 	path       string
 	file       *os.File
 	bfw        *bufio.Writer
 	writer     flushWriter
 	cw         *countWriter
 	lastRotate time.Time
+	records    int64            // records in the current file, or -1 if unknown
+	start      time.Time        // time of the first write to the current file, if it was new
+	appended   bool             // true if the current file had data when opened
+	rotations  chan rotatedFile // rotated files to verify and checksum, in rotation order, if Verify or Checksum
+	done       chan struct{}    // closed when the rotated files have been processed
+}
+
+// A rotatedFile is a rotated output file, to verify and checksum.
+type rotatedFile struct {
+	path    string
+	records int64     // records written, or -1 if unknown
+	start   time.Time // time of the first write, or zero if unknown
+	end     time.Time // time of rotation
 }
 
-func newFileWriter(cfg *Config) (w *fileWriter, err error) {
+func newFileWriter(cfg *Config, m *Metrics) (w *fileWriter, err error) {
 	var di os.FileInfo
 	var path string
 	if di, err = os.Stat(cfg.Dir); err != nil {
@@ -165,12 +433,29 @@ func newFileWriter(cfg *Config) (w *fileWriter, err error) {
 
 	w = &fileWriter{
 		cfg,
+		m,
 		path,
 		nil,
 		nil,
 		nil,
 		nil,
 		time.Time{},
+		0,
+		time.Time{},
+		false,
+		nil,
+		nil,
+	}
+
+	if w.Verify || w.Checksum {
+		w.rotations = make(chan rotatedFile, rotatedQueueLen)
+		w.done = make(chan struct{})
+		go w.processRotated()
+		defer func() {
+			if err != nil {
+				close(w.rotations)
+			}
+		}()
 	}
 
 	if err = w.open(false); err != nil {
@@ -186,6 +471,12 @@ func (w *fileWriter) Write(p []byte) (n int, err error) {
 	if n, err = w.writer.Write(p); err != nil {
 		return
 	}
+	if w.records >= 0 {
+		w.records++
+	}
+	if w.start.IsZero() && !w.appended {
+		w.start = time.Now()
+	}
 
 	if w.lastRotate.IsZero() { // set last rotate time on first write
 		w.lastRotate = time.Now()
@@ -208,6 +499,14 @@ func (w *fileWriter) Flush() (err error) {
 }
 
 func (w *fileWriter) Close() (err error) {
+	if w.rotations != nil {
+		defer func() {
+			close(w.rotations)
+			<-w.done
+			w.rotations = nil
+		}()
+	}
+
 	if c, ok := w.writer.(io.Closer); ok {
 		if err = c.Close(); err != nil {
 			log.Printf("file writer error on close: %s", err)
@@ -237,6 +536,18 @@ func (w *fileWriter) open(quiet bool) (err error) {
 	} else if !os.IsNotExist(err) {
 		return
 	}
+	w.records = 0
+	w.start = time.Time{}
+	w.appended = sz > 0
+	if (w.Verify || w.Checksum) && sz > 0 { // appending, so count existing records
+		if n, e := CountRecordsFile(w.path); e == nil {
+			w.records = int64(n)
+		} else {
+			log.Printf("writer unable to count records in existing %s (%s)",
+				w.path, e)
+			w.records = -1
+		}
+	}
 
 	if w.file, err = os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
 		return
@@ -297,10 +608,18 @@ func (w *fileWriter) rotate() (err error) {
 		return
 	}
 
+	t := w.start
+	if t.IsZero() { // appended to, so partition by rotation time
+		t = time.Now()
+	}
+	var dir string
+	if dir, err = w.partitionDir(t); err != nil {
+		return
+	}
 	var np string
 	for i := 1; ; i++ {
 		var gz bool
-		np, gz = w.rotatedFilename(i)
+		np, gz = w.rotatedFilename(dir, i)
 		var np2 string
 		if gz {
 			np2 = strings.TrimSuffix(np, ".gz")
@@ -318,10 +637,14 @@ func (w *fileWriter) rotate() (err error) {
 		log.Printf("renaming %s to %s", w.path, np)
 	}
 
-	if err = os.Rename(w.path, np); err != nil {
+	if err = move(w.path, np); err != nil {
 		return
 	}
 
+	if w.rotations != nil {
+		w.rotations <- rotatedFile{np, w.records, w.start, time.Now()}
+	}
+
 	err = w.open(true)
 
 	if w.RotateInterval > 0 {
@@ -331,11 +654,46 @@ func (w *fileWriter) rotate() (err error) {
 	return
 }
 
-func (w *fileWriter) rotatedFilename(n int) (rp string, gz bool) {
+// processRotated verifies and checksums rotated files, as configured, in the
+// background. Files are processed one at a time, so manifest entries are
+// appended in rotation order.
+func (w *fileWriter) processRotated() {
+	defer close(w.done)
+	for r := range w.rotations {
+		if w.Verify {
+			w.verify(r.path, r.records)
+		}
+		if w.Checksum {
+			if err := w.checksum(r.path, r.records, r.start,
+				r.end); err != nil {
+				log.Printf("writer unable to checksum %s (%s)", r.path, err)
+			}
+		}
+	}
+}
+
+// verify reads back a rotated file, checking that it decompresses and decodes,
+// and that it contains the given number of records, if known (>= 0).
+func (w *fileWriter) verify(path string, records int64) {
+	n, err := CountRecordsFile(path)
+	if err == nil && records >= 0 && n != uint64(records) {
+		err = fmt.Errorf("read %d records, wrote %d", n, records)
+	}
+	w.metrics.recordVerify(err)
+	if err != nil {
+		log.Printf("writer verification of %s failed (%s)", path, err)
+		return
+	}
+	if w.Log {
+		log.Printf("writer verified %s (%d records)", path, n)
+	}
+}
+
+func (w *fileWriter) rotatedFilename(dir string, n int) (rp string, gz bool) {
 	var ext string
 	var ext2 string
 
-	rp = w.path
+	rp = filepath.Join(dir, filepath.Base(w.path))
 	ext = filepath.Ext(rp)
 	rp = strings.TrimSuffix(rp, ext)
 	if ext == ".gz" {